@@ -6,6 +6,7 @@ import (
 	"bufio"
 	"fmt"
 	"net"
+	"strings"
 )
 
 type KVClient struct {
@@ -38,6 +39,12 @@ func (c *KVClient) Begin() (string, error) {
 	return c.sendCommand("BEGIN")
 }
 
+// BeginIsolation starts a transaction with the isolation level, SNAPSHOT or
+// READ COMMITTED
+func (c *KVClient) BeginIsolation(level string) (string, error) {
+	return c.sendCommand(fmt.Sprintf("BEGIN ISOLATION %s", level))
+}
+
 func (c *KVClient) Commit() (string, error) {
 	return c.sendCommand("COMMIT")
 }
@@ -46,6 +53,110 @@ func (c *KVClient) Rollback() (string, error) {
 	return c.sendCommand("ROLLBACK")
 }
 
+func (c *KVClient) Savepoint(name string) (string, error) {
+	return c.sendCommand(fmt.Sprintf("SAVEPOINT %s", name))
+}
+
+func (c *KVClient) RollbackTo(name string) (string, error) {
+	return c.sendCommand(fmt.Sprintf("ROLLBACK TO %s", name))
+}
+
+func (c *KVClient) Release(name string) (string, error) {
+	return c.sendCommand(fmt.Sprintf("RELEASE %s", name))
+}
+
+// Txn runs the then commands if all the comparisons hold and the otherwise
+// commands if not, commands are separated by ";" and comparisons by "AND"
+func (c *KVClient) Txn(comparisons, then, otherwise string) (string, error) {
+	command := fmt.Sprintf("TXN IF %s THEN %s", comparisons, then)
+	if otherwise != "" {
+		command += " ELSE " + otherwise
+	}
+	return c.sendCommand(command)
+}
+
+// LockAcquire takes the named lock for the ttl and returns its fencing
+// token, with a wait it queues behind the other waiters for up to wait
+func (c *KVClient) LockAcquire(name, owner, ttl, wait string) (string, error) {
+	command := fmt.Sprintf("LOCK ACQUIRE %s %s %s", name, owner, ttl)
+	if wait != "" {
+		command += " WAIT " + wait
+	}
+	return c.sendCommand(command)
+}
+
+func (c *KVClient) LockRenew(name, owner, ttl string) (string, error) {
+	return c.sendCommand(fmt.Sprintf("LOCK RENEW %s %s %s", name, owner, ttl))
+}
+
+func (c *KVClient) LockRelease(name, owner string) (string, error) {
+	return c.sendCommand(fmt.Sprintf("LOCK RELEASE %s %s", name, owner))
+}
+
+func (c *KVClient) LockInfo(name string) (string, error) {
+	return c.sendCommand(fmt.Sprintf("LOCK INFO %s", name))
+}
+
+func (c *KVClient) LeaseGrant(ttl string) (string, error) {
+	return c.sendCommand(fmt.Sprintf("LEASE GRANT %s", ttl))
+}
+
+func (c *KVClient) LeaseKeepAlive(id string) (string, error) {
+	return c.sendCommand(fmt.Sprintf("LEASE KEEPALIVE %s", id))
+}
+
+func (c *KVClient) LeaseRevoke(id string) (string, error) {
+	return c.sendCommand(fmt.Sprintf("LEASE REVOKE %s", id))
+}
+
+func (c *KVClient) LeaseTimeToLive(id string, keys bool) (string, error) {
+	command := fmt.Sprintf("LEASE TIMETOLIVE %s", id)
+	if keys {
+		command += " KEYS"
+	}
+	return c.sendCommand(command)
+}
+
+func (c *KVClient) SetWithLease(collection, key, value, id string) (string, error) {
+	return c.sendCommand(fmt.Sprintf("SET %s %s %s LEASE %s", collection, key, value, id))
+}
+
+func (c *KVClient) Save() (string, error) {
+	return c.sendCommand("SAVE")
+}
+
+func (c *KVClient) BgSave() (string, error) {
+	return c.sendCommand("BGSAVE")
+}
+
+func (c *KVClient) LastSave() (string, error) {
+	return c.sendCommand("LASTSAVE")
+}
+
+func (c *KVClient) RewriteLog() (string, error) {
+	return c.sendCommand("REWRITELOG")
+}
+
+func (c *KVClient) Multi() (string, error) {
+	return c.sendCommand("MULTI")
+}
+
+func (c *KVClient) Exec() (string, error) {
+	return c.sendCommand("EXEC")
+}
+
+func (c *KVClient) Discard() (string, error) {
+	return c.sendCommand("DISCARD")
+}
+
+func (c *KVClient) Watch(collectionName string, keys ...string) (string, error) {
+	return c.sendCommand(fmt.Sprintf("WATCH %s %s", collectionName, strings.Join(keys, " ")))
+}
+
+func (c *KVClient) Unwatch() (string, error) {
+	return c.sendCommand("UNWATCH")
+}
+
 func (c *KVClient) TSet(collectionName, key, value string) (string, error) {
 	return c.sendCommand(fmt.Sprintf("TSET %s %s %s", collectionName, key, value))
 }
@@ -62,6 +173,14 @@ func (c *KVClient) Set(collectionName, key, value string) (string, error) {
 	return c.sendCommand(fmt.Sprintf("SET %s %s %s", collectionName, key, value))
 }
 
+func (c *KVClient) Incr(collectionName, key string) (string, error) {
+	return c.sendCommand(fmt.Sprintf("INCR %s %s", collectionName, key))
+}
+
+func (c *KVClient) IncrBy(collectionName, key string, delta int64) (string, error) {
+	return c.sendCommand(fmt.Sprintf("INCRBY %s %s %d", collectionName, key, delta))
+}
+
 func (c *KVClient) Get(collectionName, key string) (string, error) {
 	return c.sendCommand(fmt.Sprintf("GET %s %s", collectionName, key))
 }
@@ -13,15 +13,28 @@ type ClientConfig struct {
 	ConnectTime time.Time
 	ClientState *ClientState
 	Connection  *net.Conn
+	Transaction *TransactionalKeyValueStore // writes buffered between BEGIN and COMMIT
 }
 
 // state can be 1 of the following:
 // - transactional
 // - active
+// - queueing, between MULTI and EXEC
 
 type ClientState struct {
 	State           int
 	IsAuthenticated bool
+	Queue           []QueuedCommand // commands queued between MULTI and EXEC
+	QueueFailed     bool            // a queued command was invalid, EXEC aborts
+	Watches         []WatchedKey    // keys which must not change until EXEC or COMMIT
+}
+
+// QueuedCommand is a command queued by MULTI to run on EXEC
+type QueuedCommand struct {
+	Name           string
+	CollectionName string
+	Args           []string
+	Encoding       string
 }
 
 // NewClientState creates a new instance of ClientState
@@ -2,6 +2,7 @@ package models
 
 import (
 	"log"
+	"sort"
 	"sync"
 	"time"
 )
@@ -11,14 +12,148 @@ type CollectionStore struct {
 	KeyValueStore *KeyValueStore
 	collections   map[string]*KeyValueStore // Map to store collections
 	mu            sync.RWMutex              // Mutex for thread-safe access to collections map
+	notifier      *KeyspaceNotifier         // Publishes keyspace events, nil when disabled
+	limit         MemoryLimit               // maxmemory settings, zero value means no limit
+	onEvict       func(collection, key string) error
+	evicted       []collectionKey                 // evictions not handed to onEvict yet
+	compression   map[string]CompressionSetting   // compression per collection, "*" for the rest
+	storage       StorageConfig                   // storage engine per collection
+	tiering       map[string]TieringSetting       // tiering per collection, "*" for the rest
+	execMu        sync.RWMutex                    // held shared by every command, exclusively by dumps
+	lockMu        sync.Mutex                      // guards collLocks
+	collLocks     map[string]*collectionLock      // execution locks of the collections in use
+	clock         *versionClock                   // versions of the keys of every collection
+	snapshots     *snapshotRegistry               // open snapshot transactions of every collection
+	prepared      map[string]*PreparedTransaction // distributed transactions waiting for a decision
+	preparedKeys  map[collectionKey]string        // keys locked by the prepared transactions
+	locks         *LockManager                    // named locks taken with LOCK ACQUIRE
+	leases        map[int64]*Lease                // leases granted with LEASE GRANT
+	keyLeases     map[collectionKey]int64         // lease each attached key belongs to
+	lastLeaseID   int64
+}
+
+// collectionKey identifies a key of a collection
+type collectionKey struct {
+	collection string
+	key        string
 }
 
 // NewCollectionStore creates a new CollectionStore instance
 func NewCollectionStore() *CollectionStore {
-	return &CollectionStore{
+	cs := &CollectionStore{
 		KeyValueStore: NewKeyValueStore(),
 		collections:   make(map[string]*KeyValueStore),
+		clock:         &versionClock{},
+		snapshots:     newSnapshotRegistry(),
+		prepared:      make(map[string]*PreparedTransaction),
+		preparedKeys:  make(map[collectionKey]string),
+		locks:         NewLockManager(),
+		leases:        make(map[int64]*Lease),
+		keyLeases:     make(map[collectionKey]int64),
+		collLocks:     make(map[string]*collectionLock),
 	}
+	cs.locks.exec = cs.execMu.RLocker()
+	return cs
+}
+
+// Locks returns the named locks of the node
+func (cs *CollectionStore) Locks() *LockManager {
+	return cs.locks
+}
+
+// LockShared is held while a single command executes
+func (cs *CollectionStore) LockShared() {
+	cs.execMu.RLock()
+}
+
+func (cs *CollectionStore) UnlockShared() {
+	cs.execMu.RUnlock()
+}
+
+// LockExclusive keeps every other command from executing until
+// UnlockExclusive, so a dump sees no command half applied
+func (cs *CollectionStore) LockExclusive() {
+	cs.execMu.Lock()
+}
+
+func (cs *CollectionStore) UnlockExclusive() {
+	cs.execMu.Unlock()
+}
+
+// collectionLock is the execution lock of a collection, it is dropped once
+// nobody holds or waits for it
+type collectionLock struct {
+	sync.RWMutex
+	refs int
+}
+
+// LockCollections takes the execution locks of the collections, shared by a
+// single command and exclusively by a queue of commands which must run
+// atomically. They are taken in sorted order, so two queues never wait on
+// each other. The caller holds the shared execution lock, the returned
+// function releases the locks
+func (cs *CollectionStore) LockCollections(names []string, exclusive bool) func() {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	names = nil
+	for _, name := range sorted {
+		if len(names) == 0 || name != names[len(names)-1] {
+			names = append(names, name)
+		}
+	}
+
+	locks := make([]*collectionLock, len(names))
+	for i, name := range names {
+		cs.lockMu.Lock()
+		lock, ok := cs.collLocks[name]
+		if !ok {
+			lock = &collectionLock{}
+			cs.collLocks[name] = lock
+		}
+		lock.refs++
+		cs.lockMu.Unlock()
+
+		if exclusive {
+			lock.Lock()
+		} else {
+			lock.RLock()
+		}
+		locks[i] = lock
+	}
+
+	return func() {
+		cs.lockMu.Lock()
+		defer cs.lockMu.Unlock()
+		for i, lock := range locks {
+			if exclusive {
+				lock.Unlock()
+			} else {
+				lock.RUnlock()
+			}
+			if lock.refs--; lock.refs == 0 {
+				delete(cs.collLocks, names[i])
+			}
+		}
+	}
+}
+
+// CollectionNames returns the names of the collections
+func (cs *CollectionStore) CollectionNames() []string {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	names := make([]string, 0, len(cs.collections))
+	for name := range cs.collections {
+		names = append(names, name)
+	}
+	return names
+}
+
+// SetNotifier sets the notifier used to publish keyspace events
+func (cs *CollectionStore) SetNotifier(notifier *KeyspaceNotifier) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.notifier = notifier
 }
 
 func (cs *CollectionStore) GetCollection() map[string]*KeyValueStore {
@@ -27,19 +162,28 @@ func (cs *CollectionStore) GetCollection() map[string]*KeyValueStore {
 	return cs.collections
 }
 
-func (cs *CollectionStore) UpdateKeyInCollectionWithTTL(collectionName, key string, ttl time.Duration) {
+func (cs *CollectionStore) UpdateKeyInCollectionWithTTL(collectionName, key string, ttl time.Duration) bool {
+	return cs.UpdateKeyInCollectionWithExpiration(collectionName, key, time.Now().Add(ttl))
+}
+
+// UpdateKeyInCollectionWithExpiration sets an absolute expiration on a key,
+// returns false if the collection or the key doesn't exist
+func (cs *CollectionStore) UpdateKeyInCollectionWithExpiration(collectionName, key string, at time.Time) bool {
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 
 	// Check if the collection exists
 	coll, ok := cs.collections[collectionName]
 	if !ok {
-		// Create a new collection if it doesn't exist
-		log.Printf("collection with %v doesn't exist, creating...", collectionName)
+		log.Printf("collection with %v doesn't exist", collectionName)
+		return false
 	}
 
-	// Set the key-value pair in the collection
-	coll.UpdateKeyWithTTL(key, ttl)
+	if !coll.UpdateKeyWithExpiration(key, at) {
+		return false
+	}
+	cs.notifier.Notify(NotifyGeneric, "expire", collectionName, key)
+	return true
 }
 
 // SetKeyInCollection sets a key-value pair in the specified collection
@@ -47,17 +191,72 @@ func (cs *CollectionStore) SetKeyInCollection(collectionName, key, value string)
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
 
-	// Check if the collection exists
+	// Set the key-value pair in the collection
+	cs.getOrCreateCollectionLocked(collectionName).Set(key, value)
+	cs.attachLeaseLocked(collectionName, key, 0)
+	cs.notifier.Notify(NotifyString, "set", collectionName, key)
+}
+
+// SetEncodedKeyInCollection sets a value which is already compressed, as
+// found in the snapshot and in replication
+func (cs *CollectionStore) SetEncodedKeyInCollection(collectionName, key, encoding, payload string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.getOrCreateCollectionLocked(collectionName).SetEncoded(key, encoding, payload)
+	cs.attachLeaseLocked(collectionName, key, 0)
+	cs.notifier.Notify(NotifyString, "set", collectionName, key)
+}
+
+// getOrCreateCollectionLocked returns the collection, creating it with its
+// compression setting and storage engine if it doesn't exist. The caller
+// must hold the lock
+func (cs *CollectionStore) getOrCreateCollectionLocked(collectionName string) *KeyValueStore {
 	coll, ok := cs.collections[collectionName]
 	if !ok {
 		// Create a new collection if it doesn't exist
 		// log.Printf("collection with %v doesn't exist, creating...", collectionName)
-		coll = NewKeyValueStore()
+		coll = newKeyValueStore(cs.openEngineLocked(collectionName), cs.clock)
+		coll.compression = cs.compressionSettingLocked(collectionName)
+		coll.tier.setting = cs.tieringSettingLocked(collectionName)
+		coll.tier.path = cs.valueFilePathLocked(collectionName)
+		coll.snapshots = cs.snapshots
 		cs.collections[collectionName] = coll
 	}
+	return coll
+}
 
-	// Set the key-value pair in the collection
-	coll.Set(key, value)
+func (cs *CollectionStore) compressionSettingLocked(collectionName string) *CompressionSetting {
+	if setting, ok := cs.compression[collectionName]; ok {
+		return &setting
+	}
+	if setting, ok := cs.compression[DEFAULT_COLLECTION_SETTING]; ok {
+		return &setting
+	}
+	return nil
+}
+
+// SetCompression sets the compression per collection, "*" applies to every
+// collection without its own setting. Existing values are left as they are
+func (cs *CollectionStore) SetCompression(settings map[string]CompressionSetting) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.compression = settings
+	for collName, coll := range cs.collections {
+		coll.mu.Lock()
+		coll.compression = cs.compressionSettingLocked(collName)
+		coll.mu.Unlock()
+	}
+}
+
+// EncodeValue compresses the value with the setting of the collection, the
+// encoding is empty if the value is stored raw
+func (cs *CollectionStore) EncodeValue(collectionName, value string) (string, string) {
+	cs.mu.RLock()
+	setting := cs.compressionSettingLocked(collectionName)
+	cs.mu.RUnlock()
+	return EncodeValue(setting, value)
 }
 
 // GetKeyInCollection retrieves the value for a key in the specified collection
@@ -88,7 +287,23 @@ func (cs *CollectionStore) DeleteKeyInCollection(collectionName, key string) {
 	}
 
 	// Delete the key from the collection
-	coll.Delete(key)
+	if coll.Delete(key) {
+		cs.notifier.Notify(NotifyGeneric, "del", collectionName, key)
+	}
+}
+
+// ExpireKeyInCollection deletes a key which the master decided has expired
+func (cs *CollectionStore) ExpireKeyInCollection(collectionName, key string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	coll, ok := cs.collections[collectionName]
+	if !ok {
+		return
+	}
+	if coll.Delete(key) {
+		cs.notifier.Notify(NotifyExpired, "expired", collectionName, key)
+	}
 }
 
 // CollectionExists checks if a collection exists
@@ -100,19 +315,44 @@ func (cs *CollectionStore) CollectionExists(collectionName string) bool {
 	return ok
 }
 
+// KeyCount returns the number of keys of every collection, including the
+// expired ones which aren't cleaned up yet
+func (cs *CollectionStore) KeyCount() int {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	count := 0
+	for _, coll := range cs.collections {
+		coll.mu.RLock()
+		count += coll.engine.Len()
+		coll.mu.RUnlock()
+	}
+	return count
+}
+
 // GetAllKeyValues returns all the key-value pairs in all collections
 func (cs *CollectionStore) GetAllKeyValues() map[string]map[string]string {
 	cs.mu.RLock()
 	defer cs.mu.RUnlock()
 
 	result := make(map[string]map[string]string)
+	now := time.Now()
 
 	for collName, coll := range cs.collections {
 		keyValuePairs := make(map[string]string)
 		coll.mu.RLock()
-		for key, value := range coll.store {
-			keyValuePairs[key] = value.Value
-		}
+		coll.engine.Iterate(func(key string, value *Value) bool {
+			if value.IsExpired(now) {
+				return true
+			}
+			decoded, err := value.Decode()
+			if err != nil {
+				log.Printf("error decoding value for key: %v: %v", key, err)
+				return true
+			}
+			keyValuePairs[key] = decoded
+			return true
+		})
 		coll.mu.RUnlock()
 		result[collName] = keyValuePairs
 	}
@@ -138,11 +378,137 @@ func (cs *CollectionStore) GetAllKeyValuesInCollection(collectionName string) ma
 	defer coll.mu.RUnlock()
 
 	// Copy the key-value pairs from the collection's KeyValueStore
-	for key, value := range coll.store {
-		result[key] = value.Value
-	}
+	now := time.Now()
+	coll.engine.Iterate(func(key string, value *Value) bool {
+		if value.IsExpired(now) {
+			return true
+		}
+		decoded, err := value.Decode()
+		if err != nil {
+			log.Printf("error decoding value for key: %v: %v", key, err)
+			return true
+		}
+		result[key] = decoded
+		return true
+	})
 
 	log.Printf("all keys in collection: %v ----------- %v", collectionName, result)
 
 	return result
 }
+
+// GetExpiredKeys returns the expired keys of every collection, keyed by
+// collection name
+func (cs *CollectionStore) GetExpiredKeys(now time.Time) map[string][]string {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	result := make(map[string][]string)
+	for collName, coll := range cs.collections {
+		if keys := coll.ExpiredKeys(now); len(keys) > 0 {
+			result[collName] = keys
+		}
+	}
+	return result
+}
+
+// DeleteExpiredKeyInCollection deletes a key only if it is still expired,
+// returns true if the key was removed
+func (cs *CollectionStore) DeleteExpiredKeyInCollection(collectionName, key string, now time.Time) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	coll, ok := cs.collections[collectionName]
+	if !ok {
+		return false
+	}
+	if !coll.DeleteIfExpired(key, now) {
+		return false
+	}
+	cs.notifier.Notify(NotifyExpired, "expired", collectionName, key)
+	return true
+}
+
+// DeleteExpiredKeys removes every expired key from all collections and
+// returns the removed keys keyed by collection name
+func (cs *CollectionStore) DeleteExpiredKeys(now time.Time) map[string][]string {
+	removed := make(map[string][]string)
+	for collName, keys := range cs.GetExpiredKeys(now) {
+		for _, key := range keys {
+			if cs.DeleteExpiredKeyInCollection(collName, key, now) {
+				removed[collName] = append(removed[collName], key)
+			}
+		}
+	}
+	return removed
+}
+
+// BatchOptions are the checks ApplyBatch makes before applying a batch
+type BatchOptions struct {
+	Reserve  bool         // reserve the memory for the whole batch
+	Watches  []WatchedKey // keys which must not have changed
+	Snapshot uint64       // keys written must not have changed since, 0 skips the check
+}
+
+// ApplyBatch applies the mutations of a transaction atomically, no other
+// reader or writer of the store sees a part of the batch. When reserving
+// the memory for the whole batch is reserved up front, so the batch is
+// either applied completely or rejected with ErrOOM. The batch is rejected
+// with ErrWatchedKeyModified if any of the watched keys changed and with
+// ErrConflict if a key it writes was written after its snapshot.
+// ErrEvictionNotLogged is returned once the batch is applied
+func (cs *CollectionStore) ApplyBatch(mutations []Mutation, opts BatchOptions) (err error) {
+	cs.mu.Lock()
+	defer cs.reportEvictions(&err)
+	defer cs.mu.Unlock()
+
+	if cs.watchedKeysChangedLocked(opts.Watches) {
+		return ErrWatchedKeyModified
+	}
+	if opts.Snapshot != 0 && cs.conflictsLocked(mutations, opts.Snapshot) {
+		return ErrConflict
+	}
+	if _, ok := cs.lockedKeysLocked(mutations); ok {
+		return ErrKeyLocked
+	}
+
+	if opts.Reserve {
+		var needed int64
+		for _, m := range mutations {
+			if m.Op == MUTATION_SET {
+				needed += cs.neededMemoryLocked(m.Collection, m.Key, m.Value)
+			}
+		}
+		if err := cs.reserveMemoryLocked(needed); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range mutations {
+		cs.applyLocked(m)
+	}
+	return nil
+}
+
+// applyLocked applies a single mutation, the caller must hold the lock
+func (cs *CollectionStore) applyLocked(m Mutation) {
+	switch m.Op {
+	case MUTATION_SET:
+		coll := cs.getOrCreateCollectionLocked(m.Collection)
+		if m.Encoding != "" {
+			coll.SetEncoded(m.Key, m.Encoding, m.Value)
+		} else {
+			coll.Set(m.Key, m.Value)
+		}
+		cs.attachLeaseLocked(m.Collection, m.Key, 0)
+		cs.notifier.Notify(NotifyString, "set", m.Collection, m.Key)
+	case MUTATION_DELETE:
+		if coll, ok := cs.collections[m.Collection]; ok && coll.Delete(m.Key) {
+			cs.notifier.Notify(NotifyGeneric, "del", m.Collection, m.Key)
+		}
+	case MUTATION_EXPIRE_AT:
+		if coll, ok := cs.collections[m.Collection]; ok && coll.UpdateKeyWithExpiration(m.Key, m.ExpireAt) {
+			cs.notifier.Notify(NotifyGeneric, "expire", m.Collection, m.Key)
+		}
+	}
+}
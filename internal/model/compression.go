@@ -0,0 +1,172 @@
+package models
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+const (
+	GZIP  = "gzip"
+	FLATE = "flate"
+	// collection name used for the compression setting of every collection
+	// which doesn't have its own
+	DEFAULT_COLLECTION_SETTING = "*"
+)
+
+// Compressor compresses values, new algorithms can be added with
+// RegisterCompressor
+type Compressor interface {
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var (
+	compressors   = make(map[string]Compressor)
+	compressorsMu sync.RWMutex
+)
+
+func init() {
+	RegisterCompressor(GZIP, &gzipCompressor{})
+	RegisterCompressor(FLATE, &flateCompressor{})
+}
+
+// RegisterCompressor makes a compression algorithm available by name
+func RegisterCompressor(name string, compressor Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[name] = compressor
+}
+
+// GetCompressor returns the compressor registered with the name
+func GetCompressor(name string) (Compressor, bool) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	compressor, ok := compressors[name]
+	return compressor, ok
+}
+
+// CompressionSetting is the compression of a collection, values of at least
+// Threshold bytes are compressed with Algorithm
+type CompressionSetting struct {
+	Algorithm string
+	Threshold int
+}
+
+// ParseCompressionSetting parses the algorithm and threshold of the
+// compression config option
+func ParseCompressionSetting(algorithm, threshold string) (CompressionSetting, error) {
+	if _, ok := GetCompressor(algorithm); !ok {
+		return CompressionSetting{}, fmt.Errorf("unknown compression algorithm: %v", algorithm)
+	}
+	size, err := strconv.Atoi(threshold)
+	if err != nil || size < 0 {
+		return CompressionSetting{}, fmt.Errorf("invalid compression threshold: %v", threshold)
+	}
+	return CompressionSetting{Algorithm: algorithm, Threshold: size}, nil
+}
+
+// EncodeValue compresses the value with the setting, it returns an empty
+// encoding when the value is below the threshold or doesn't compress. The
+// payload is prefixed with the uncompressed length so stats don't need to
+// decompress it
+func EncodeValue(setting *CompressionSetting, value string) (string, string) {
+	if setting == nil || len(value) < setting.Threshold {
+		return "", value
+	}
+	compressor, ok := GetCompressor(setting.Algorithm)
+	if !ok {
+		return "", value
+	}
+	compressed, err := compressor.Compress([]byte(value))
+	if err != nil {
+		return "", value
+	}
+	payload := binary.AppendUvarint(make([]byte, 0, len(compressed)+binary.MaxVarintLen64), uint64(len(value)))
+	payload = append(payload, compressed...)
+	if len(payload) >= len(value) {
+		return "", value
+	}
+	return setting.Algorithm, string(payload)
+}
+
+// DecodeValue decompresses a payload produced by EncodeValue
+func DecodeValue(encoding, payload string) (string, error) {
+	if encoding == "" {
+		return payload, nil
+	}
+	compressor, ok := GetCompressor(encoding)
+	if !ok {
+		return "", fmt.Errorf("unknown compression algorithm: %v", encoding)
+	}
+	_, n := binary.Uvarint([]byte(payload))
+	if n <= 0 {
+		return "", errors.New("corrupt compressed value")
+	}
+	data, err := compressor.Decompress([]byte(payload[n:]))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// encodedRawSize returns the uncompressed length stored in the payload
+func encodedRawSize(payload string) int64 {
+	size, n := binary.Uvarint([]byte(payload))
+	if n <= 0 {
+		return int64(len(payload))
+	}
+	return int64(size)
+}
+
+type gzipCompressor struct{}
+
+func (c *gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+type flateCompressor struct{}
+
+func (c *flateCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *flateCompressor) Decompress(data []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
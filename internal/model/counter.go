@@ -0,0 +1,55 @@
+package models
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+var (
+	ErrNotInteger = errors.New("value is not an integer or out of range")
+	ErrOverflow   = errors.New("increment or decrement would overflow")
+)
+
+// ParseCounter parses the value of a counter, a missing key counts as 0
+func ParseCounter(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+	return n, nil
+}
+
+// AddToCounter returns n + delta, or ErrOverflow
+func AddToCounter(n, delta int64) (int64, error) {
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, ErrOverflow
+	}
+	return n + delta, nil
+}
+
+// IncrementKeyInCollection adds delta to the integer stored at the key and
+// returns the result. The read and the write happen under the same lock and
+// the result is stored exactly like a SET of it, so the SET is what gets
+// logged and replicated
+func (cs *CollectionStore) IncrementKeyInCollection(collectionName, key string, delta int64) (int64, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	coll := cs.getOrCreateCollectionLocked(collectionName)
+	current, err := ParseCounter(coll.Get(key))
+	if err != nil {
+		return 0, err
+	}
+	next, err := AddToCounter(current, delta)
+	if err != nil {
+		return 0, err
+	}
+	coll.Set(key, strconv.FormatInt(next, 10))
+	cs.attachLeaseLocked(collectionName, key, 0)
+	cs.notifier.Notify(NotifyString, "incrby", collectionName, key)
+	return next, nil
+}
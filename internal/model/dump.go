@@ -0,0 +1,458 @@
+package models
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+const (
+	// DUMP_MAGIC starts every dump file, followed by the format version
+	DUMP_MAGIC   = "KVDUMP"
+	DUMP_VERSION = 2
+
+	// types of the values in a dump
+	DUMP_TYPE_STRING  = 0 // stored as the client wrote it
+	DUMP_TYPE_ENCODED = 1 // compressed, followed by the name of the encoding
+
+	// MAX_DUMP_FIELD is the longest key, value or name a dump may contain
+	MAX_DUMP_FIELD = 512 << 20
+
+	// expiration of a value which never expires
+	dumpNoExpiration = -1
+)
+
+var (
+	ErrInvalidDump = errors.New("invalid dump")
+	crc32c         = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// DumpImage is a point in time copy of a CollectionStore, written as a
+// compact binary dump. LogSeq is the sequence number of the last record of
+// the snapshot log when the copy was taken, only the records after it have
+// to be replayed on top
+type DumpImage struct {
+	CreatedAt time.Time
+	LogSeq    uint64
+
+	collections map[string]EngineSnapshot
+	keyLeases   map[collectionKey]int64
+	leases      []Lease
+	lastLeaseID int64
+	locks       []DistributedLock
+	lastToken   uint64
+	prepared    []PreparedTransaction
+}
+
+// Keys returns the number of keys in the dump
+func (img *DumpImage) Keys() int {
+	keys := 0
+	for _, entries := range img.collections {
+		keys += entries.Len()
+	}
+	return keys
+}
+
+// Release lets go of the state the image holds on to in the storage
+// engines, the image can't be encoded afterwards
+func (img *DumpImage) Release() {
+	for _, entries := range img.collections {
+		entries.Release()
+	}
+}
+
+// Leases returns the leases of the dump and the last lease id given out
+func (img *DumpImage) Leases() ([]Lease, int64) {
+	return img.leases, img.lastLeaseID
+}
+
+// Locks returns the held locks of the dump and the last fencing token
+func (img *DumpImage) Locks() ([]DistributedLock, uint64) {
+	return img.locks, img.lastToken
+}
+
+// Prepared returns the prepared distributed transactions of the dump
+func (img *DumpImage) Prepared() []PreparedTransaction {
+	return img.prepared
+}
+
+// Scan calls fn for every key of the dump with its stored payload, read
+// back from the value file when it was spilled, and the lease it is
+// attached to, 0 when none
+func (img *DumpImage) Scan(fn func(collection, key string, value *Value, payload string, lease int64)) error {
+	for collName, entries := range img.collections {
+		var err error
+		entries.Iterate(func(key string, value *Value) bool {
+			payload, readErr := value.payload()
+			if readErr != nil {
+				err = fmt.Errorf("reading key %v of collection %v: %w", key, collName, readErr)
+				return false
+			}
+			fn(collName, key, value, payload, img.keyLeases[collectionKey{collName, key}])
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// KeepCollections drops every collection of the image which isn't listed,
+// together with the leases attached to its keys
+func (img *DumpImage) KeepCollections(names []string) {
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		keep[name] = true
+	}
+	for collName, entries := range img.collections {
+		if !keep[collName] {
+			entries.Release()
+			delete(img.collections, collName)
+		}
+	}
+	for attached := range img.keyLeases {
+		if !keep[attached.collection] {
+			delete(img.keyLeases, attached)
+		}
+	}
+}
+
+// CaptureDump takes a snapshot of the storage engine of every collection
+// for a dump. The caller must hold the exclusive execution lock, which is
+// only needed while the snapshots are taken: values are never modified in
+// place, a write replaces the *Value, so the snapshots keep the state of
+// the capture while writers go on. The image must be released once it is
+// written
+func (cs *CollectionStore) CaptureDump(logSeq uint64) *DumpImage {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	img := &DumpImage{
+		CreatedAt:   time.Now(),
+		LogSeq:      logSeq,
+		collections: make(map[string]EngineSnapshot, len(cs.collections)),
+		keyLeases:   make(map[collectionKey]int64, len(cs.keyLeases)),
+		lastLeaseID: cs.lastLeaseID,
+	}
+	for collName, coll := range cs.collections {
+		coll.mu.RLock()
+		img.collections[collName] = coll.snapshotLocked()
+		coll.mu.RUnlock()
+	}
+	for attached, id := range cs.keyLeases {
+		img.keyLeases[attached] = id
+	}
+	for _, lease := range cs.leases {
+		img.leases = append(img.leases, Lease{ID: lease.ID, TTL: lease.TTL, ExpiresAt: lease.ExpiresAt})
+	}
+	for _, tx := range cs.prepared {
+		img.prepared = append(img.prepared, *tx)
+	}
+	img.locks, img.lastToken = cs.locks.Held()
+	return img
+}
+
+// RestoreDump loads the dump into the store, on top of what it holds
+func (cs *CollectionStore) RestoreDump(img *DumpImage) {
+	cs.locks.Restore(img.locks, img.lastToken)
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if img.lastLeaseID > cs.lastLeaseID {
+		cs.lastLeaseID = img.lastLeaseID
+	}
+	for _, lease := range img.leases {
+		cs.leases[lease.ID] = &Lease{ID: lease.ID, TTL: lease.TTL, ExpiresAt: lease.ExpiresAt, keys: make(map[collectionKey]struct{})}
+	}
+	for i := range img.prepared {
+		tx := img.prepared[i]
+		cs.prepared[tx.TxID] = &tx
+		for _, m := range tx.Mutations {
+			cs.preparedKeys[collectionKey{m.Collection, m.Key}] = tx.TxID
+		}
+	}
+	for collName, entries := range img.collections {
+		coll := cs.getOrCreateCollectionLocked(collName)
+		coll.mu.Lock()
+		var keys []string
+		entries.Iterate(func(key string, value *Value) bool {
+			coll.put(key, value)
+			keys = append(keys, key)
+			return true
+		})
+		coll.mu.Unlock()
+		for _, key := range keys {
+			cs.attachLeaseLocked(collName, key, img.keyLeases[collectionKey{collName, key}])
+		}
+	}
+}
+
+// dumpWriter writes the fields of a dump and keeps the checksum of
+// everything written
+type dumpWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (d *dumpWriter) write(p []byte) {
+	if d.err != nil {
+		return
+	}
+	if _, d.err = d.w.Write(p); d.err == nil {
+		d.crc.Write(p)
+	}
+}
+
+func (d *dumpWriter) uvarint(v uint64) {
+	d.write(d.buf[:binary.PutUvarint(d.buf[:], v)])
+}
+
+func (d *dumpWriter) varint(v int64) {
+	d.write(d.buf[:binary.PutVarint(d.buf[:], v)])
+}
+
+func (d *dumpWriter) string(s string) {
+	d.uvarint(uint64(len(s)))
+	d.write([]byte(s))
+}
+
+func (d *dumpWriter) time(t time.Time) {
+	d.varint(t.UnixMilli())
+}
+
+// Encode writes the dump: a header with the time of the capture and the log
+// offset, the leases, the locks, the prepared transactions, every collection with its typed values and
+// absolute expirations, and a trailing CRC32C of everything before it
+func (img *DumpImage) Encode(w io.Writer) error {
+	d := &dumpWriter{w: bufio.NewWriter(w), crc: crc32.New(crc32c)}
+	d.write([]byte(DUMP_MAGIC))
+	d.uvarint(DUMP_VERSION)
+	d.time(img.CreatedAt)
+	d.uvarint(img.LogSeq)
+
+	d.varint(img.lastLeaseID)
+	d.uvarint(uint64(len(img.leases)))
+	for _, lease := range img.leases {
+		d.varint(lease.ID)
+		d.varint(lease.TTL.Milliseconds())
+		d.time(lease.ExpiresAt)
+	}
+
+	d.uvarint(img.lastToken)
+	d.uvarint(uint64(len(img.locks)))
+	for _, lock := range img.locks {
+		d.string(lock.Name)
+		d.string(lock.Owner)
+		d.uvarint(lock.Token)
+		d.time(lock.ExpiresAt)
+	}
+
+	d.uvarint(uint64(len(img.prepared)))
+	for _, tx := range img.prepared {
+		d.string(tx.TxID)
+		d.uvarint(uint64(len(tx.Mutations)))
+		for _, m := range tx.Mutations {
+			d.string(m.Op)
+			d.string(m.Collection)
+			d.string(m.Key)
+			d.string(m.Encoding)
+			d.string(m.Value)
+			d.time(m.ExpireAt)
+		}
+	}
+
+	d.uvarint(uint64(len(img.collections)))
+	for collName, entries := range img.collections {
+		d.string(collName)
+		d.uvarint(uint64(entries.Len()))
+		written := 0
+		entries.Iterate(func(key string, value *Value) bool {
+			written++
+			d.string(key)
+			if value.Encoding() == "" {
+				d.write([]byte{DUMP_TYPE_STRING})
+			} else {
+				d.write([]byte{DUMP_TYPE_ENCODED})
+				d.string(value.Encoding())
+			}
+			payload, err := value.payload()
+			if err != nil && d.err == nil {
+				d.err = fmt.Errorf("reading key %v of collection %v: %w", key, collName, err)
+			}
+			d.string(payload)
+			if value.HasExpiration() {
+				d.time(value.GetExpiration())
+			} else {
+				d.varint(dumpNoExpiration)
+			}
+			d.varint(img.keyLeases[collectionKey{collName, key}])
+			return true
+		})
+		if written != entries.Len() && d.err == nil {
+			d.err = fmt.Errorf("collection %v has %v keys, its engine counted %v", collName, written, entries.Len())
+		}
+	}
+
+	if d.err != nil {
+		return d.err
+	}
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], d.crc.Sum32())
+	if _, err := d.w.Write(sum[:]); err != nil {
+		return err
+	}
+	return d.w.Flush()
+}
+
+// dumpReader reads the fields written by dumpWriter, the first error sticks
+type dumpReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+	err error
+}
+
+func (d *dumpReader) ReadByte() (byte, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	var b byte
+	if b, d.err = d.r.ReadByte(); d.err != nil {
+		return 0, d.err
+	}
+	d.crc.Write([]byte{b})
+	return b, nil
+}
+
+func (d *dumpReader) read(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > MAX_DUMP_FIELD {
+		d.err = fmt.Errorf("%w: field of %v bytes", ErrInvalidDump, n)
+		return nil
+	}
+	p := make([]byte, n)
+	if _, d.err = io.ReadFull(d.r, p); d.err != nil {
+		return nil
+	}
+	d.crc.Write(p)
+	return p
+}
+
+func (d *dumpReader) uvarint() uint64 {
+	v, err := binary.ReadUvarint(d)
+	if d.err == nil {
+		d.err = err
+	}
+	return v
+}
+
+func (d *dumpReader) varint() int64 {
+	v, err := binary.ReadVarint(d)
+	if d.err == nil {
+		d.err = err
+	}
+	return v
+}
+
+func (d *dumpReader) string() string {
+	return string(d.read(d.uvarint()))
+}
+
+func (d *dumpReader) time() time.Time {
+	return time.UnixMilli(d.varint())
+}
+
+// DecodeDump reads a dump written by Encode and checks its checksum
+func DecodeDump(r io.Reader) (*DumpImage, error) {
+	d := &dumpReader{r: bufio.NewReader(r), crc: crc32.New(crc32c)}
+	if magic := d.read(uint64(len(DUMP_MAGIC))); d.err == nil && string(magic) != DUMP_MAGIC {
+		return nil, fmt.Errorf("%w: bad magic", ErrInvalidDump)
+	}
+	if version := d.uvarint(); d.err == nil && version != DUMP_VERSION {
+		return nil, fmt.Errorf("%w: unsupported version %v", ErrInvalidDump, version)
+	}
+
+	img := &DumpImage{
+		collections: make(map[string]EngineSnapshot),
+		keyLeases:   make(map[collectionKey]int64),
+	}
+	img.CreatedAt = d.time()
+	img.LogSeq = d.uvarint()
+
+	img.lastLeaseID = d.varint()
+	for n := d.uvarint(); n > 0 && d.err == nil; n-- {
+		lease := Lease{ID: d.varint()}
+		lease.TTL = time.Duration(d.varint()) * time.Millisecond
+		lease.ExpiresAt = d.time()
+		img.leases = append(img.leases, lease)
+	}
+
+	img.lastToken = d.uvarint()
+	for n := d.uvarint(); n > 0 && d.err == nil; n-- {
+		lock := DistributedLock{Name: d.string(), Owner: d.string()}
+		lock.Token = d.uvarint()
+		lock.ExpiresAt = d.time()
+		img.locks = append(img.locks, lock)
+	}
+
+	for n := d.uvarint(); n > 0 && d.err == nil; n-- {
+		tx := PreparedTransaction{TxID: d.string()}
+		for m := d.uvarint(); m > 0 && d.err == nil; m-- {
+			mutation := Mutation{Op: d.string(), Collection: d.string(), Key: d.string(), Encoding: d.string(), Value: d.string()}
+			mutation.ExpireAt = d.time()
+			tx.Mutations = append(tx.Mutations, mutation)
+		}
+		img.prepared = append(img.prepared, tx)
+	}
+
+	for n := d.uvarint(); n > 0 && d.err == nil; n-- {
+		collName := d.string()
+		entries := newMemoryEngine()
+		for m := d.uvarint(); m > 0 && d.err == nil; m-- {
+			key := d.string()
+			var value *Value
+			switch valueType, _ := d.ReadByte(); valueType {
+			case DUMP_TYPE_STRING:
+				value = NewKeyValue(d.string())
+			case DUMP_TYPE_ENCODED:
+				encoding := d.string()
+				value = NewEncodedKeyValue(d.string(), encoding)
+			default:
+				if d.err == nil {
+					d.err = fmt.Errorf("%w: unknown value type %v", ErrInvalidDump, valueType)
+				}
+				continue
+			}
+			if expiresAt := d.varint(); expiresAt != dumpNoExpiration {
+				value.SetExpirationAt(time.UnixMilli(expiresAt))
+			}
+			if id := d.varint(); id != 0 {
+				img.keyLeases[collectionKey{collName, key}] = id
+			}
+			entries.Put(key, value)
+		}
+		img.collections[collName] = entries
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidDump, d.err)
+	}
+
+	var sum [4]byte
+	if _, err := io.ReadFull(d.r, sum[:]); err != nil {
+		return nil, fmt.Errorf("%w: missing checksum", ErrInvalidDump)
+	}
+	if binary.LittleEndian.Uint32(sum[:]) != d.crc.Sum32() {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrInvalidDump)
+	}
+	return img, nil
+}
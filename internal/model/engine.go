@@ -0,0 +1,230 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	// MEMORY_ENGINE keeps the keys of a collection in a map, the default
+	MEMORY_ENGINE = "memory"
+	// LSM_ENGINE keeps the keys of a collection on disk, see OpenLSMEngine
+	LSM_ENGINE = "lsm"
+)
+
+// StorageEngine holds the keys of a collection. KeyValueStore serializes
+// the calls with its own lock, an engine only has to guard what it does in
+// the background. Values are never modified in place, a write replaces the
+// *Value
+type StorageEngine interface {
+	Get(key string) (*Value, bool)
+	Put(key string, value *Value) error
+	Delete(key string) error
+	// Iterate calls fn for every key until it returns false, in an order
+	// of the engine's choosing
+	Iterate(fn func(key string, value *Value) bool)
+	Len() int
+	// Snapshot returns a read only view of the keys as they are now, the
+	// writes after it don't show up in it
+	Snapshot() EngineSnapshot
+	// InMemory reports whether the values are held in memory, only those
+	// count towards maxmemory and are evicted
+	InMemory() bool
+	Close() error
+}
+
+// EngineSnapshot is a point in time view of a StorageEngine, it holds on to
+// the state it needs until it is released
+type EngineSnapshot interface {
+	Get(key string) (*Value, bool)
+	Iterate(fn func(key string, value *Value) bool)
+	Len() int
+	Release()
+}
+
+// EngineFactory opens the engine of a collection, dir is where the
+// collection keeps its files
+type EngineFactory func(dir string) (StorageEngine, error)
+
+var (
+	engineFactories   = make(map[string]EngineFactory)
+	engineFactoriesMu sync.RWMutex
+)
+
+func init() {
+	RegisterStorageEngine(MEMORY_ENGINE, func(string) (StorageEngine, error) {
+		return newMemoryEngine(), nil
+	})
+	RegisterStorageEngine(LSM_ENGINE, func(dir string) (StorageEngine, error) {
+		return OpenLSMEngine(dir, LSMOptions{})
+	})
+}
+
+// RegisterStorageEngine makes a storage engine available by name
+func RegisterStorageEngine(name string, factory EngineFactory) {
+	engineFactoriesMu.Lock()
+	defer engineFactoriesMu.Unlock()
+	engineFactories[name] = factory
+}
+
+// GetStorageEngine returns the factory of the engine registered with the name
+func GetStorageEngine(name string) (EngineFactory, bool) {
+	engineFactoriesMu.RLock()
+	defer engineFactoriesMu.RUnlock()
+	factory, ok := engineFactories[name]
+	return factory, ok
+}
+
+// StorageConfig is the storage engine of every collection, "*" applies to
+// the collections without their own. A collection whose engine keeps files
+// keeps them in its own directory under Dir
+type StorageConfig struct {
+	Dir     string
+	Engines map[string]string
+}
+
+// engineLocked returns the engine name of the collection, the caller must
+// hold the lock
+func (cs *CollectionStore) engineLocked(collectionName string) string {
+	if engine, ok := cs.storage.Engines[collectionName]; ok {
+		return engine
+	}
+	if engine, ok := cs.storage.Engines[DEFAULT_COLLECTION_SETTING]; ok {
+		return engine
+	}
+	return MEMORY_ENGINE
+}
+
+// collectionDir returns the directory of the collection under the dir, the
+// name is escaped so any collection name makes a single directory
+func collectionDir(dir, collectionName string) string {
+	return filepath.Join(dir, url.PathEscape(collectionName))
+}
+
+// SetStorage sets the storage engine per collection for the collections
+// created from now on, and opens the collections found under the storage
+// directory, which hold their keys on disk from an earlier run
+func (cs *CollectionStore) SetStorage(config StorageConfig) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for collName, engine := range config.Engines {
+		if _, ok := GetStorageEngine(engine); !ok {
+			return fmt.Errorf("unknown storage engine %v for collection %v", engine, collName)
+		}
+	}
+	cs.storage = config
+	if config.Dir == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(config.Dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		collName, err := url.PathUnescape(entry.Name())
+		if err != nil || !entry.IsDir() || cs.engineLocked(collName) == MEMORY_ENGINE {
+			continue
+		}
+		if _, ok := cs.collections[collName]; !ok {
+			cs.getOrCreateCollectionLocked(collName)
+		}
+	}
+	return nil
+}
+
+// openEngineLocked opens the storage engine of a new collection, a
+// collection whose engine fails to open is kept in memory
+func (cs *CollectionStore) openEngineLocked(collectionName string) StorageEngine {
+	name := cs.engineLocked(collectionName)
+	factory, ok := GetStorageEngine(name)
+	if !ok || name == MEMORY_ENGINE {
+		return newMemoryEngine()
+	}
+	engine, err := factory(collectionDir(cs.storage.Dir, collectionName))
+	if err != nil {
+		log.Printf("error opening the %v engine of collection %v, keeping it in memory: %v", name, collectionName, err)
+		return newMemoryEngine()
+	}
+	return engine
+}
+
+// Close closes the storage engines of every collection and removes their
+// value files
+func (cs *CollectionStore) Close() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	var firstErr error
+	for collName, coll := range cs.collections {
+		coll.mu.Lock()
+		coll.tier.close()
+		coll.mu.Unlock()
+		if err := coll.engine.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("closing collection %v: %w", collName, err)
+		}
+	}
+	return firstErr
+}
+
+// memoryEngine is the default StorageEngine, a map of the keys
+type memoryEngine struct {
+	entries map[string]*Value
+}
+
+func newMemoryEngine() *memoryEngine {
+	return &memoryEngine{entries: make(map[string]*Value)}
+}
+
+func (m *memoryEngine) Get(key string) (*Value, bool) {
+	value, ok := m.entries[key]
+	return value, ok
+}
+
+func (m *memoryEngine) Put(key string, value *Value) error {
+	m.entries[key] = value
+	return nil
+}
+
+func (m *memoryEngine) Delete(key string) error {
+	delete(m.entries, key)
+	return nil
+}
+
+// Iterate follows the randomized map iteration, which eviction relies on
+// for its samples
+func (m *memoryEngine) Iterate(fn func(key string, value *Value) bool) {
+	for key, value := range m.entries {
+		if !fn(key, value) {
+			return
+		}
+	}
+}
+
+func (m *memoryEngine) Len() int {
+	return len(m.entries)
+}
+
+// Snapshot copies the map, the values are shared since they are never
+// modified in place
+func (m *memoryEngine) Snapshot() EngineSnapshot {
+	entries := make(map[string]*Value, len(m.entries))
+	for key, value := range m.entries {
+		entries[key] = value
+	}
+	return &memoryEngine{entries: entries}
+}
+
+func (m *memoryEngine) InMemory() bool {
+	return true
+}
+
+func (m *memoryEngine) Close() error {
+	return nil
+}
+
+func (m *memoryEngine) Release() {}
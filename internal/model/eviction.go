@@ -0,0 +1,208 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Eviction policies applied once the used memory reaches maxmemory
+const (
+	NO_EVICTION    = "noeviction"
+	ALLKEYS_LRU    = "allkeys-lru"
+	ALLKEYS_LFU    = "allkeys-lfu"
+	VOLATILE_LRU   = "volatile-lru"
+	VOLATILE_TTL   = "volatile-ttl"
+	ALLKEYS_RANDOM = "allkeys-random"
+
+	DEFAULT_MAXMEMORY_SAMPLES = 5
+	// approximate bytes taken by an empty collection
+	COLLECTION_OVERHEAD = 256
+)
+
+var ErrOOM = errors.New("OOM command not allowed when used memory > 'maxmemory'")
+
+// ErrEvictionNotLogged is returned once a key was evicted which the
+// eviction handler failed to record
+var ErrEvictionNotLogged = errors.New("eviction not logged")
+
+// ParseEvictionPolicy validates the maxmemory-policy option
+func ParseEvictionPolicy(policy string) (string, error) {
+	switch policy {
+	case NO_EVICTION, ALLKEYS_LRU, ALLKEYS_LFU, VOLATILE_LRU, VOLATILE_TTL, ALLKEYS_RANDOM:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid maxmemory-policy: %v", policy)
+	}
+}
+
+// MemoryLimit holds the maxmemory settings of a CollectionStore
+type MemoryLimit struct {
+	MaxMemory int64  // bytes, 0 means no limit
+	Policy    string // one of the eviction policies
+	Samples   int    // keys sampled per collection to pick a victim
+}
+
+// evictionCandidate is the best key to evict found while sampling
+type evictionCandidate struct {
+	collection string
+	key        string
+	score      float64 // higher is a better candidate
+}
+
+// score ranks a sampled value for the policy, higher means evict first
+func evictionScore(policy string, value *Value, now time.Time) float64 {
+	switch policy {
+	case ALLKEYS_LRU, VOLATILE_LRU:
+		return float64(value.IdleTime(now))
+	case ALLKEYS_LFU:
+		return 255 - float64(value.Frequency(now))
+	case VOLATILE_TTL:
+		return -float64(value.GetExpiration().Sub(now))
+	default:
+		return rand.Float64()
+	}
+}
+
+// findEvictionCandidate samples every collection and returns the best key to
+// evict for the policy, the caller must hold the collections lock
+func (cs *CollectionStore) findEvictionCandidate(now time.Time) (*evictionCandidate, bool) {
+	volatile := cs.limit.Policy == VOLATILE_LRU || cs.limit.Policy == VOLATILE_TTL
+	samples := cs.limit.Samples
+	if samples <= 0 {
+		samples = DEFAULT_MAXMEMORY_SAMPLES
+	}
+
+	var best *evictionCandidate
+	for collName, coll := range cs.collections {
+		for key, value := range coll.sample(samples, volatile) {
+			score := evictionScore(cs.limit.Policy, value, now)
+			if best == nil || score > best.score {
+				best = &evictionCandidate{collection: collName, key: key, score: score}
+			}
+		}
+	}
+	return best, best != nil
+}
+
+// usedMemoryLocked sums the memory of every collection, the caller must hold
+// the collections lock
+func (cs *CollectionStore) usedMemoryLocked() int64 {
+	var used int64
+	for _, coll := range cs.collections {
+		used += COLLECTION_OVERHEAD + coll.MemoryUsage()
+	}
+	return used
+}
+
+// UsedMemory returns the approximate memory taken by all the collections
+func (cs *CollectionStore) UsedMemory() int64 {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.usedMemoryLocked()
+}
+
+// SetMemoryLimit sets the maxmemory settings
+func (cs *CollectionStore) SetMemoryLimit(limit MemoryLimit) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.limit = limit
+}
+
+// SetEvictionHandler sets a callback invoked for every evicted key, the
+// master uses it to replicate the eviction. It is called once the
+// collections lock is released, so logging the eviction doesn't hold up
+// every other reader and writer. An error of the handler is returned by
+// the write which evicted the key
+func (cs *CollectionStore) SetEvictionHandler(handler func(collection, key string) error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.onEvict = handler
+}
+
+// ReserveMemory makes room for writing value to key, evicting keys according
+// to the policy until the write fits under maxmemory. It returns ErrOOM if
+// the policy is noeviction or there is nothing left to evict, and
+// ErrEvictionNotLogged if the handler failed to record an eviction
+func (cs *CollectionStore) ReserveMemory(collectionName, key, value string) (err error) {
+	cs.mu.Lock()
+	defer cs.reportEvictions(&err)
+	defer cs.mu.Unlock()
+	return cs.reserveMemoryLocked(cs.neededMemoryLocked(collectionName, key, value))
+}
+
+// neededMemoryLocked returns the memory a write of value to key adds, the
+// caller must hold the collections lock
+func (cs *CollectionStore) neededMemoryLocked(collectionName, key, value string) int64 {
+	needed := int64(len(key)) + ENTRY_OVERHEAD + int64(len(value)) + VALUE_OVERHEAD
+	if coll, ok := cs.collections[collectionName]; ok {
+		if !coll.inMemory() {
+			return 0
+		}
+		if size, ok := coll.KeyMemoryUsage(key); ok {
+			needed -= size
+		}
+	} else {
+		needed += COLLECTION_OVERHEAD
+	}
+	return needed
+}
+
+// reserveMemoryLocked evicts keys until needed more bytes fit under
+// maxmemory, the caller must hold the collections lock and call
+// reportEvictions once it released it
+func (cs *CollectionStore) reserveMemoryLocked(needed int64) error {
+	if cs.limit.MaxMemory <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	for cs.usedMemoryLocked()+needed > cs.limit.MaxMemory {
+		if cs.limit.Policy == NO_EVICTION || cs.limit.Policy == "" {
+			return ErrOOM
+		}
+		candidate, ok := cs.findEvictionCandidate(now)
+		if !ok {
+			return ErrOOM
+		}
+		if cs.evictLocked(candidate.collection, candidate.key) && cs.onEvict != nil {
+			cs.evicted = append(cs.evicted, collectionKey{candidate.collection, candidate.key})
+		}
+	}
+	return nil
+}
+
+// reportEvictions hands the keys evicted so far to the eviction handler,
+// without holding the collections lock. The first failure of the handler
+// is stored in err unless it already holds an error
+func (cs *CollectionStore) reportEvictions(err *error) {
+	cs.mu.Lock()
+	evicted, handler := cs.evicted, cs.onEvict
+	cs.evicted = nil
+	cs.mu.Unlock()
+	for _, k := range evicted {
+		if handlerErr := handler(k.collection, k.key); handlerErr != nil && *err == nil {
+			*err = fmt.Errorf("%w: %v:%v: %v", ErrEvictionNotLogged, k.collection, k.key, handlerErr)
+		}
+	}
+}
+
+// evictLocked removes the key and publishes the eviction, the caller must
+// hold the collections lock
+func (cs *CollectionStore) evictLocked(collectionName, key string) bool {
+	coll, ok := cs.collections[collectionName]
+	if !ok || !coll.Delete(key) {
+		return false
+	}
+	cs.notifier.Notify(NotifyEvicted, "evicted", collectionName, key)
+	return true
+}
+
+// EvictKeyInCollection deletes a key which the master evicted, the eviction
+// handler isn't invoked since the eviction is already replicated
+func (cs *CollectionStore) EvictKeyInCollection(collectionName, key string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.evictLocked(collectionName, key)
+}
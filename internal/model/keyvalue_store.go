@@ -6,25 +6,148 @@ import (
 	"time"
 )
 
-// KeyValueStore represents the in-memory key-value store
+// KeyValueStore represents a collection, the keys are held by its storage
+// engine and everything else about them in memory
 type KeyValueStore struct {
-	mu    sync.RWMutex
-	store map[string]*Value
+	mu       sync.RWMutex
+	engine   StorageEngine
+	used     int64               // approximate memory taken by the keys and values held in memory
+	expiring map[string]struct{} // keys with an expiration, so expired keys are found without a scan
+	tier     *valueTier          // spills the cold values, see SetTiering
+
+	compression    *CompressionSetting // nil when values are stored raw
+	compressedKeys int                 // number of values stored compressed
+	rawBytes       int64               // uncompressed length of the compressed values
+	storedBytes    int64               // compressed length of the compressed values
+
+	clock      *versionClock              // shared by every collection of a CollectionStore
+	watched    map[string]int             // number of WATCHes per key
+	tombstones map[string]uint64          // versions of deleted keys which are watched or in a snapshot
+	snapshots  *snapshotRegistry          // open snapshot transactions, nil keeps no history
+	history    map[string][]snapshotValue // earlier values of the keys, oldest first
 }
 
 // NewKeyValueStore creates a new instance of KeyValueStore
 func NewKeyValueStore() *KeyValueStore {
-	return &KeyValueStore{
-		store: make(map[string]*Value),
+	return newKeyValueStore(newMemoryEngine(), &versionClock{})
+}
+
+// newKeyValueStore creates a collection on the engine, which may already
+// hold keys. The clock is moved past their versions, so a write after a
+// restart still looks like a change to the watchers of the key
+func newKeyValueStore(engine StorageEngine, clock *versionClock) *KeyValueStore {
+	kv := &KeyValueStore{
+		engine:     engine,
+		expiring:   make(map[string]struct{}),
+		tier:       &valueTier{},
+		clock:      clock,
+		watched:    make(map[string]int),
+		tombstones: make(map[string]uint64),
+		history:    make(map[string][]snapshotValue),
+	}
+	if engine.Len() > 0 {
+		engine.Iterate(func(key string, value *Value) bool {
+			clock.advance(value.version)
+			kv.account(key, value, 1)
+			return true
+		})
+	}
+	return kv
+}
+
+func entrySize(key string, value *Value) int64 {
+	return int64(len(key)) + ENTRY_OVERHEAD + value.Size()
+}
+
+// put replaces the value of the key and keeps the memory accounting in
+// sync, the caller must hold the write lock
+func (kv *KeyValueStore) put(key string, value *Value) {
+	prev, existed := kv.engine.Get(key)
+	value.version = kv.stampLocked(key)
+	value = kv.spillOversizedLocked(value)
+	if err := kv.engine.Put(key, value); err != nil {
+		log.Printf("error writing key: %v: %v", key, err)
+		return
+	}
+	if existed {
+		kv.account(key, prev, -1)
 	}
+	delete(kv.tombstones, key)
+	kv.account(key, value, 1)
+}
+
+// account adds or removes the value from the memory accounting, the
+// compression and tiering stats and the expiring keys
+func (kv *KeyValueStore) account(key string, value *Value, sign int) {
+	if kv.engine.InMemory() {
+		kv.used += int64(sign) * entrySize(key, value)
+	}
+	if value.cold != nil {
+		kv.tier.coldKeys += sign
+		kv.tier.coldBytes += int64(sign) * value.cold.length
+	}
+	kv.trackCompression(value, sign)
+	if sign > 0 && value.HasExpiration() {
+		kv.expiring[key] = struct{}{}
+	} else if sign < 0 {
+		delete(kv.expiring, key)
+	}
+}
+
+// trackCompression adds or removes the value from the compression stats
+func (kv *KeyValueStore) trackCompression(value *Value, sign int) {
+	if value.Encoding() == "" {
+		return
+	}
+	kv.compressedKeys += sign
+	kv.rawBytes += int64(sign) * value.RawSize()
+	kv.storedBytes += int64(sign) * value.storedSize()
+}
+
+// remove deletes the key and keeps the memory accounting in sync, the
+// caller must hold the write lock
+func (kv *KeyValueStore) remove(key string) bool {
+	prev, ok := kv.engine.Get(key)
+	if !ok {
+		return false
+	}
+	version := kv.stampLocked(key)
+	if err := kv.engine.Delete(key); err != nil {
+		log.Printf("error deleting key: %v: %v", key, err)
+		return false
+	}
+	kv.account(key, prev, -1)
+	if kv.watched[key] > 0 {
+		// a recreated key must not look unchanged to its watchers
+		kv.tombstones[key] = version
+	}
+	return true
 }
 
 func (kv *KeyValueStore) UpdateKeyWithTTL(key string, ttl time.Duration) {
-	kv.mu.RLock()
-	defer kv.mu.RUnlock()
-	keyValue := kv.store[key]
-	keyValue.SetExpiration(ttl)
-	kv.store[key] = keyValue
+	kv.UpdateKeyWithExpiration(key, time.Now().Add(ttl))
+}
+
+// UpdateKeyWithExpiration sets an absolute expiration on an existing key,
+// returns false if the key doesn't exist
+func (kv *KeyValueStore) UpdateKeyWithExpiration(key string, at time.Time) bool {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	keyValue, ok := kv.engine.Get(key)
+	if !ok {
+		return false
+	}
+	// the value is copied, a snapshot may still read the old expiration
+	updated := *keyValue
+	updated.SetExpirationAt(at)
+	updated.version = kv.stampLocked(key)
+	if err := kv.engine.Put(key, &updated); err != nil {
+		log.Printf("error writing key: %v: %v", key, err)
+		return false
+	}
+	kv.account(key, keyValue, -1)
+	kv.account(key, &updated, 1)
+	return true
 }
 
 // set sets a key-value pair with TTL
@@ -33,46 +156,126 @@ func (kv *KeyValueStore) SetKeyWithTTL(key, value string, ttl time.Duration) {
 	defer kv.mu.Unlock()
 	keyValue := NewKeyValue(value)
 	keyValue.SetExpiration(ttl)
-	kv.store[key] = keyValue
+	kv.put(key, keyValue)
 }
 
-// Set sets a key-value pair in the store
+// Set sets a key-value pair in the store, compressing the value if the
+// store has a compression setting and the value is over the threshold
 func (kv *KeyValueStore) Set(key, value string) {
+	encoding, payload := EncodeValue(kv.compression, value)
+	kv.SetEncoded(key, encoding, payload)
+}
+
+// SetEncoded sets a value which is already compressed with the encoding
+func (kv *KeyValueStore) SetEncoded(key, encoding, payload string) {
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
-	keyValue := NewKeyValue(value)
-	kv.store[key] = keyValue
+	keyValue := NewEncodedKeyValue(payload, encoding)
+	kv.put(key, keyValue)
 }
 
-// Get retrieves the value for a given key from the store
+// Get retrieves the value for a given key from the store, expired keys are
+// treated as missing even if they haven't been cleaned up yet. A spilled
+// value is brought back into memory once read
 func (kv *KeyValueStore) Get(key string) string {
 	kv.mu.RLock()
-	defer kv.mu.RUnlock()
-	log.Printf("value for key: %v = %v", key, kv.store[key])
-	return kv.store[key].Value
+	keyValue, ok := kv.engine.Get(key)
+	if !ok || keyValue.IsExpired(time.Now()) {
+		kv.mu.RUnlock()
+		return ""
+	}
+	keyValue.Touch()
+	payload, err := keyValue.payload()
+	kv.mu.RUnlock()
+	if err == nil && keyValue.IsCold() {
+		kv.faultIn(key, keyValue, payload)
+	}
+	var value string
+	if err == nil {
+		value, err = DecodeValue(keyValue.Encoding(), payload)
+	}
+	if err != nil {
+		log.Printf("error decoding value for key: %v: %v", key, err)
+		return ""
+	}
+	return value
 }
 
-// Delete deletes a key from the store
-func (kv *KeyValueStore) Delete(key string) {
+// Delete deletes a key from the store, returns false if the key didn't exist
+func (kv *KeyValueStore) Delete(key string) bool {
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
-	delete(kv.store, key)
-}
-
-func (kv *KeyValueStore) StartExpiryCleanup(interval time.Duration) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			kv.mu.Lock()
-			for key, entry := range kv.store {
-				if time.Now().After(entry.GetExpiration()) {
-					delete(kv.store, key)
-				}
-			}
-			kv.mu.Unlock()
+	return kv.remove(key)
+}
+
+// ExpiredKeys returns all the keys which are expired at the given time
+func (kv *KeyValueStore) ExpiredKeys(now time.Time) []string {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	var keys []string
+	for key := range kv.expiring {
+		if entry, ok := kv.engine.Get(key); ok && entry.IsExpired(now) {
+			keys = append(keys, key)
 		}
 	}
+	return keys
+}
+
+// DeleteIfExpired deletes the key only if it is still expired at the given
+// time, so a key which got overwritten in the meantime is left untouched
+func (kv *KeyValueStore) DeleteIfExpired(key string, now time.Time) bool {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	entry, ok := kv.engine.Get(key)
+	if !ok || !entry.IsExpired(now) {
+		return false
+	}
+	return kv.remove(key)
+}
+
+// MemoryUsage returns the approximate memory taken by the store
+func (kv *KeyValueStore) MemoryUsage() int64 {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	return kv.used
+}
+
+// KeyMemoryUsage returns the approximate memory taken by a single key
+func (kv *KeyValueStore) KeyMemoryUsage(key string) (int64, bool) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	entry, ok := kv.engine.Get(key)
+	if !ok {
+		return 0, false
+	}
+	return entrySize(key, entry), true
+}
+
+// inMemory reports whether the keys count towards maxmemory
+func (kv *KeyValueStore) inMemory() bool {
+	return kv.engine.InMemory()
+}
+
+// sample returns up to n keys picked by the randomized map iteration, when
+// volatile is set only keys with an expiration are considered. Keys which
+// aren't held in memory are never evicted
+func (kv *KeyValueStore) sample(n int, volatile bool) map[string]*Value {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	result := make(map[string]*Value, n)
+	if !kv.engine.InMemory() {
+		return result
+	}
+	kv.engine.Iterate(func(key string, entry *Value) bool {
+		if len(result) >= n {
+			return false
+		}
+		if !volatile || entry.HasExpiration() {
+			result[key] = entry
+		}
+		return true
+	})
+	return result
 }
@@ -46,6 +46,7 @@ func (s *KVServer) HandleClientConnect(clientID, ipAddress string, conn net.Conn
 		ConnectTime: time.Now(),
 		ClientState: NewClientState(),
 		Connection:  &conn,
+		Transaction: NewTransactionalKeyValueStore(),
 	}
 
 	s.clients[clientID] = config
@@ -0,0 +1,162 @@
+package models
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var ErrLeaseNotFound = errors.New("lease not found")
+
+// Lease is an expiring handle the keys set with it are attached to, they are
+// all deleted together when the lease expires or is revoked
+type Lease struct {
+	ID        int64
+	TTL       time.Duration
+	ExpiresAt time.Time
+	keys      map[collectionKey]struct{}
+}
+
+// LeaseInfo is the reply to LEASE TIMETOLIVE
+type LeaseInfo struct {
+	ID         int64    `json:"id"`
+	TTL        int64    `json:"ttl_ms"`         // remaining time to live
+	GrantedTTL int64    `json:"granted_ttl_ms"` // time to live set by GRANT
+	Keys       []string `json:"keys,omitempty"` // collection:key of the attached keys
+}
+
+// GrantLease creates a lease which expires after the ttl unless it is kept alive
+func (cs *CollectionStore) GrantLease(ttl time.Duration) Lease {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.lastLeaseID++
+	lease := &Lease{ID: cs.lastLeaseID, TTL: ttl, ExpiresAt: time.Now().Add(ttl), keys: make(map[collectionKey]struct{})}
+	cs.leases[lease.ID] = lease
+	return *lease
+}
+
+// ApplyLeaseGrant records a grant or a keepalive replicated from the master,
+// new ids continue after the highest id seen
+func (cs *CollectionStore) ApplyLeaseGrant(id int64, ttl time.Duration, expiresAt time.Time) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if id > cs.lastLeaseID {
+		cs.lastLeaseID = id
+	}
+	lease, ok := cs.leases[id]
+	if !ok {
+		lease = &Lease{ID: id, keys: make(map[collectionKey]struct{})}
+		cs.leases[id] = lease
+	}
+	lease.TTL, lease.ExpiresAt = ttl, expiresAt
+}
+
+// KeepAliveLease restarts the time to live of the lease
+func (cs *CollectionStore) KeepAliveLease(id int64) (Lease, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	lease, ok := cs.leases[id]
+	if !ok || !time.Now().Before(lease.ExpiresAt) {
+		return Lease{}, ErrLeaseNotFound
+	}
+	lease.ExpiresAt = time.Now().Add(lease.TTL)
+	return *lease, nil
+}
+
+// RevokeLease deletes the lease and every key attached to it at once,
+// readers see either all of the keys or none of them
+func (cs *CollectionStore) RevokeLease(id int64) (int, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	lease, ok := cs.leases[id]
+	if !ok {
+		return 0, ErrLeaseNotFound
+	}
+	deleted := 0
+	for attached := range lease.keys {
+		delete(cs.keyLeases, attached)
+		if coll, ok := cs.collections[attached.collection]; ok && coll.Delete(attached.key) {
+			cs.notifier.Notify(NotifyGeneric, "del", attached.collection, attached.key)
+			deleted++
+		}
+	}
+	delete(cs.leases, id)
+	return deleted, nil
+}
+
+// LeaseTimeToLive returns the remaining time to live of the lease and, when
+// withKeys is set, its keys
+func (cs *CollectionStore) LeaseTimeToLive(id int64, withKeys bool) (LeaseInfo, error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	lease, ok := cs.leases[id]
+	if !ok || !time.Now().Before(lease.ExpiresAt) {
+		return LeaseInfo{}, ErrLeaseNotFound
+	}
+	info := LeaseInfo{ID: id, TTL: time.Until(lease.ExpiresAt).Milliseconds(), GrantedTTL: lease.TTL.Milliseconds()}
+	if withKeys {
+		info.Keys = make([]string, 0, len(lease.keys))
+		for attached := range lease.keys {
+			info.Keys = append(info.Keys, attached.collection+":"+attached.key)
+		}
+		sort.Strings(info.Keys)
+	}
+	return info, nil
+}
+
+// ExpiredLeases returns the ids of the leases which are expired at the given time
+func (cs *CollectionStore) ExpiredLeases(now time.Time) []int64 {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	var ids []int64
+	for id, lease := range cs.leases {
+		if !now.Before(lease.ExpiresAt) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// attachLeaseLocked moves the key to the lease, a lease id of 0 detaches the
+// key from its lease. The caller must hold the lock
+func (cs *CollectionStore) attachLeaseLocked(collectionName, key string, id int64) {
+	attached := collectionKey{collectionName, key}
+	if previous, ok := cs.keyLeases[attached]; ok {
+		if lease, ok := cs.leases[previous]; ok {
+			delete(lease.keys, attached)
+		}
+		delete(cs.keyLeases, attached)
+	}
+	if lease, ok := cs.leases[id]; ok {
+		lease.keys[attached] = struct{}{}
+		cs.keyLeases[attached] = id
+	}
+}
+
+// SetKeyInCollectionWithLease sets the key and attaches it to the lease, the
+// value is compressed with the encoding when it is set. A lease which ran out
+// but isn't revoked yet still takes keys, so replaying the log gives the same
+// result as on the master
+func (cs *CollectionStore) SetKeyInCollectionWithLease(collectionName, key, encoding, value string, id int64) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if _, ok := cs.leases[id]; !ok {
+		return ErrLeaseNotFound
+	}
+	coll := cs.getOrCreateCollectionLocked(collectionName)
+	if encoding != "" {
+		coll.SetEncoded(key, encoding, value)
+	} else {
+		coll.Set(key, value)
+	}
+	cs.attachLeaseLocked(collectionName, key, id)
+	cs.notifier.Notify(NotifyString, "set", collectionName, key)
+	return nil
+}
@@ -0,0 +1,314 @@
+package models
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrLockNotHeld = errors.New("lock is not held by the owner")
+
+// DistributedLock is a lease on a named lock, the token grows with every
+// grant so a resource can reject writes from a holder whose lease expired
+type DistributedLock struct {
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner"`
+	Token     uint64    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// lockWaiter is a blocked LOCK ACQUIRE, granted is sent the lock once it
+// reaches the head of the queue and the lock is free
+type lockWaiter struct {
+	owner   string
+	ttl     time.Duration
+	granted chan DistributedLock
+}
+
+type lockEntry struct {
+	lock    *DistributedLock // nil when the lock is free
+	timer   *time.Timer      // releases the lock when the lease expires
+	waiters []*lockWaiter    // blocked acquires, first come first served
+}
+
+// LockManager keeps the named locks of a node. Every grant and release is
+// reported to the handler with absolute expirations, so replicas can apply
+// them and a promoted replica keeps the holders and the token sequence.
+// Grants and releases hold the shared execution lock of the store while
+// they change the lock and report it, so the handler logs them on the same
+// side of a dump as the change
+type LockManager struct {
+	exec      sync.Locker // shared execution lock of the store, may be nil
+	mu        sync.Mutex
+	locks     map[string]*lockEntry
+	lastToken uint64
+	onChange  func(lock DistributedLock, held bool)
+}
+
+func NewLockManager() *LockManager {
+	return &LockManager{locks: make(map[string]*lockEntry)}
+}
+
+// SetHandler sets the function called on every grant and release
+func (m *LockManager) SetHandler(handler func(lock DistributedLock, held bool)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onChange = handler
+}
+
+// lock takes the shared execution lock, then the lock of the manager
+func (m *LockManager) lock() {
+	if m.exec != nil {
+		m.exec.Lock()
+	}
+	m.mu.Lock()
+}
+
+func (m *LockManager) unlock() {
+	m.mu.Unlock()
+	if m.exec != nil {
+		m.exec.Unlock()
+	}
+}
+
+func (m *LockManager) entryLocked(name string) *lockEntry {
+	entry, ok := m.locks[name]
+	if !ok {
+		entry = &lockEntry{}
+		m.locks[name] = entry
+	}
+	return entry
+}
+
+func (m *LockManager) notifyLocked(lock DistributedLock, held bool) {
+	if m.onChange != nil {
+		m.onChange(lock, held)
+	}
+}
+
+// grantLocked gives the lock to the owner with a new token, the caller must
+// hold the lock
+func (m *LockManager) grantLocked(name, owner string, ttl time.Duration) DistributedLock {
+	m.lastToken++
+	lock := DistributedLock{Name: name, Owner: owner, Token: m.lastToken, ExpiresAt: time.Now().Add(ttl)}
+	m.setLocked(lock)
+	m.notifyLocked(lock, true)
+	return lock
+}
+
+// setLocked records the holder of the lock and arms the lease timer, the
+// caller must hold the lock
+func (m *LockManager) setLocked(lock DistributedLock) {
+	entry := m.entryLocked(lock.Name)
+	if entry.timer != nil {
+		entry.timer.Stop()
+	}
+	held := lock
+	entry.lock = &held
+	token := lock.Token
+	entry.timer = time.AfterFunc(time.Until(lock.ExpiresAt), func() {
+		m.expire(lock.Name, token)
+	})
+}
+
+// freeLocked releases the lock and hands it to the first waiter, the caller
+// must hold the lock
+func (m *LockManager) freeLocked(name string) {
+	entry, ok := m.locks[name]
+	if !ok || entry.lock == nil {
+		return
+	}
+	if entry.timer != nil {
+		entry.timer.Stop()
+		entry.timer = nil
+	}
+	released := *entry.lock
+	entry.lock = nil
+	m.notifyLocked(released, false)
+
+	if len(entry.waiters) > 0 {
+		waiter := entry.waiters[0]
+		entry.waiters = entry.waiters[1:]
+		waiter.granted <- m.grantLocked(name, waiter.owner, waiter.ttl)
+		return
+	}
+	delete(m.locks, name)
+}
+
+// expire releases the lock if the lease with the token is still the holder
+func (m *LockManager) expire(name string, token uint64) {
+	m.lock()
+	defer m.unlock()
+	if entry, ok := m.locks[name]; ok && entry.lock != nil && entry.lock.Token == token {
+		m.freeLocked(name)
+	}
+}
+
+// Acquire takes the lock for the owner for the ttl. A lock held by the same
+// owner is extended and keeps its token. When the lock is held by someone
+// else the call waits up to wait behind the earlier waiters, ok is false if
+// the lock wasn't granted in time
+func (m *LockManager) Acquire(name, owner string, ttl, wait time.Duration) (DistributedLock, bool) {
+	m.lock()
+	entry := m.entryLocked(name)
+	if entry.lock != nil && !time.Now().Before(entry.lock.ExpiresAt) {
+		// the lease ran out before its timer fired
+		m.freeLocked(name)
+		entry = m.entryLocked(name)
+	}
+	if entry.lock == nil {
+		lock := m.grantLocked(name, owner, ttl)
+		m.unlock()
+		return lock, true
+	}
+	if entry.lock.Owner == owner {
+		lock := *entry.lock
+		lock.ExpiresAt = time.Now().Add(ttl)
+		m.setLocked(lock)
+		m.notifyLocked(lock, true)
+		m.unlock()
+		return lock, true
+	}
+	if wait <= 0 {
+		m.unlock()
+		return DistributedLock{}, false
+	}
+
+	// the waiter is granted the lock by the release which frees it, the
+	// execution lock isn't held while waiting
+	waiter := &lockWaiter{owner: owner, ttl: ttl, granted: make(chan DistributedLock, 1)}
+	entry.waiters = append(entry.waiters, waiter)
+	m.unlock()
+
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	select {
+	case lock := <-waiter.granted:
+		return lock, true
+	case <-timeout.C:
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, w := range entry.waiters {
+		if w == waiter {
+			entry.waiters = append(entry.waiters[:i], entry.waiters[i+1:]...)
+			return DistributedLock{}, false
+		}
+	}
+	// granted while the timeout fired
+	return <-waiter.granted, true
+}
+
+// Renew extends the lease of the owner, the token stays the same
+func (m *LockManager) Renew(name, owner string, ttl time.Duration) (DistributedLock, error) {
+	m.lock()
+	defer m.unlock()
+	entry, ok := m.locks[name]
+	if !ok || entry.lock == nil || entry.lock.Owner != owner || !time.Now().Before(entry.lock.ExpiresAt) {
+		return DistributedLock{}, ErrLockNotHeld
+	}
+	lock := *entry.lock
+	lock.ExpiresAt = time.Now().Add(ttl)
+	m.setLocked(lock)
+	m.notifyLocked(lock, true)
+	return lock, nil
+}
+
+// Release frees the lock held by the owner
+func (m *LockManager) Release(name, owner string) error {
+	m.lock()
+	defer m.unlock()
+	entry, ok := m.locks[name]
+	if !ok || entry.lock == nil || entry.lock.Owner != owner {
+		return ErrLockNotHeld
+	}
+	m.freeLocked(name)
+	return nil
+}
+
+// Info returns the holder of the lock and the number of waiters, ok is false
+// when the lock is free
+func (m *LockManager) Info(name string) (DistributedLock, int, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.locks[name]
+	if !ok || entry.lock == nil || !time.Now().Before(entry.lock.ExpiresAt) {
+		return DistributedLock{}, 0, false
+	}
+	return *entry.lock, len(entry.waiters), true
+}
+
+// ApplyGrant records a grant replicated from the master, the token sequence
+// continues after the highest token seen. A grant whose lease already ran
+// out, as when an old log is replayed, only ends the earlier holder, so no
+// expiry is reported for it
+func (m *LockManager) ApplyGrant(lock DistributedLock) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if lock.Token > m.lastToken {
+		m.lastToken = lock.Token
+	}
+	if !time.Now().Before(lock.ExpiresAt) {
+		if entry, ok := m.locks[lock.Name]; ok && entry.lock != nil && entry.lock.Token <= lock.Token {
+			m.dropLocked(lock.Name)
+		}
+		return
+	}
+	m.setLocked(lock)
+}
+
+// ApplyRelease records a release replicated from the master, a lock granted
+// again in the meantime is left alone
+func (m *LockManager) ApplyRelease(name string, token uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if token > m.lastToken {
+		m.lastToken = token
+	}
+	if entry, ok := m.locks[name]; ok && entry.lock != nil && entry.lock.Token == token {
+		m.dropLocked(name)
+	}
+}
+
+// dropLocked forgets the holder of the lock without reporting it, the
+// caller must hold the lock
+func (m *LockManager) dropLocked(name string) {
+	entry := m.locks[name]
+	if entry.timer != nil {
+		entry.timer.Stop()
+	}
+	entry.lock, entry.timer = nil, nil
+	if len(entry.waiters) == 0 {
+		delete(m.locks, name)
+	}
+}
+
+// Held returns the held locks and the last token given out, for a dump
+func (m *LockManager) Held() ([]DistributedLock, uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var held []DistributedLock
+	for _, entry := range m.locks {
+		if entry.lock != nil {
+			held = append(held, *entry.lock)
+		}
+	}
+	return held, m.lastToken
+}
+
+// Restore records the locks of a dump which are still held, the token
+// sequence continues after the last token of the dump
+func (m *LockManager) Restore(held []DistributedLock, lastToken uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if lastToken > m.lastToken {
+		m.lastToken = lastToken
+	}
+	now := time.Now()
+	for _, lock := range held {
+		if now.Before(lock.ExpiresAt) {
+			m.setLocked(lock)
+		}
+	}
+}
@@ -0,0 +1,586 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	DEFAULT_LSM_MEMTABLE_SIZE      = 4 << 20
+	DEFAULT_LSM_COMPACTION_TRIGGER = 4
+
+	// files of an LSM engine in its directory, next to the tables
+	LSM_WAL_FILE    = "wal.log"
+	LSM_TABLES_FILE = "TABLES"
+	lsmWALHeader    = 8
+)
+
+// LSMOptions tunes an LSM engine, zero values take the defaults
+type LSMOptions struct {
+	// bytes of entries the memtable holds before it is flushed to a table
+	MemtableSize int64
+	// number of tables which starts a compaction merging them into one
+	CompactionTrigger int
+}
+
+// lsmEngine is a StorageEngine which keeps the keys of a collection on
+// disk, so a collection can outgrow the memory of the node.
+//
+// Writes go to the WAL and to the memtable, a map of the latest writes.
+// Once the memtable is full it is written out as a new sstable, a file
+// sorted by key with a sparse index and a bloom filter, and the WAL starts
+// over. A read checks the memtable and then the tables from the newest to
+// the oldest, the filters skip most of the tables which don't hold the key.
+// Once enough tables piled up a background compaction merges them into one,
+// keeping the newest value of every key and dropping the deleted ones. The
+// TABLES file lists the live tables oldest first.
+//
+// The WAL isn't synced, the snapshot log is what makes a write durable,
+// the WAL only keeps the memtable across a restart of the process
+type lsmEngine struct {
+	dir     string
+	options LSMOptions
+
+	mu         sync.RWMutex
+	memtable   map[string]*Value // nil for a deleted key
+	memSize    int64
+	wal        *os.File
+	tables     []*sstable // oldest first
+	nextID     int
+	count      int // live keys
+	compacting bool
+	closed     bool
+
+	compactions sync.WaitGroup
+}
+
+// memEntry is an entry of a sorted copy of the memtable
+type memEntry struct {
+	key   string
+	value *Value
+}
+
+// OpenLSMEngine opens the LSM engine kept in the directory, creating it if
+// needed. It replays the WAL, cutting off a record torn by a crash, and
+// removes the files a crash during a flush or a compaction left behind
+func OpenLSMEngine(dir string, options LSMOptions) (StorageEngine, error) {
+	if options.MemtableSize <= 0 {
+		options.MemtableSize = DEFAULT_LSM_MEMTABLE_SIZE
+	}
+	if options.CompactionTrigger < 2 {
+		options.CompactionTrigger = DEFAULT_LSM_COMPACTION_TRIGGER
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	e := &lsmEngine{dir: dir, options: options, memtable: make(map[string]*Value), nextID: 1}
+	if err := e.openTables(); err != nil {
+		e.closeTables()
+		return nil, err
+	}
+	if err := e.replayWAL(); err != nil {
+		e.closeTables()
+		return nil, err
+	}
+	wal, err := os.OpenFile(filepath.Join(dir, LSM_WAL_FILE), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		e.closeTables()
+		return nil, err
+	}
+	e.wal = wal
+	e.iterateLocked(func(string, *Value) bool {
+		e.count++
+		return true
+	})
+	return e, nil
+}
+
+// openTables opens the tables listed in TABLES and removes the others
+func (e *lsmEngine) openTables() error {
+	var ids []int
+	data, err := os.ReadFile(filepath.Join(e.dir, LSM_TABLES_FILE))
+	if err == nil {
+		if err := json.Unmarshal(data, &ids); err != nil {
+			return fmt.Errorf("invalid %v in %v: %w", LSM_TABLES_FILE, e.dir, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	listed := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		table, err := openTable(e.dir, id)
+		if err != nil {
+			return err
+		}
+		e.tables = append(e.tables, table)
+		listed[id] = true
+		if id >= e.nextID {
+			e.nextID = id + 1
+		}
+	}
+
+	entries, err := os.ReadDir(e.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.Contains(name, ".tmp-") {
+			os.Remove(filepath.Join(e.dir, name))
+			continue
+		}
+		id, err := strconv.Atoi(strings.TrimSuffix(name, ".sst"))
+		if err != nil || !strings.HasSuffix(name, ".sst") {
+			continue
+		}
+		if id >= e.nextID {
+			e.nextID = id + 1
+		}
+		if !listed[id] {
+			log.Printf("removing %v, a table of %v which isn't live", name, e.dir)
+			os.Remove(filepath.Join(e.dir, name))
+		}
+	}
+	return nil
+}
+
+// replayWAL loads the WAL into the memtable. Every record is
+//
+//	<length> <crc32c> <entry>
+//
+// with the length and the checksum of the entry as little endian uint32
+func (e *lsmEngine) replayWAL() error {
+	path := filepath.Join(e.dir, LSM_WAL_FILE)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, 64*1024)
+	header := make([]byte, lsmWALHeader)
+	var offset int64
+	for {
+		if _, err := io.ReadFull(reader, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			break
+		}
+		length := binary.LittleEndian.Uint32(header)
+		if length > 2*entryMaxStringBytes {
+			break
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			break
+		}
+		if crc32.Checksum(payload, lsmCRC) != binary.LittleEndian.Uint32(header[4:]) {
+			break
+		}
+		key, value, err := readEntry(bufio.NewReader(bytes.NewReader(payload)))
+		if err != nil {
+			break
+		}
+		e.setLocked(key, value)
+		offset += lsmWALHeader + int64(length)
+	}
+	log.Printf("cutting off the torn tail of %v at offset %v", path, offset)
+	return os.Truncate(path, offset)
+}
+
+func (e *lsmEngine) Get(key string) (*Value, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.getLocked(key)
+}
+
+// getLocked looks the key up in the memtable and then in the tables from
+// the newest, the first one which knows the key has its latest state
+func (e *lsmEngine) getLocked(key string) (*Value, bool) {
+	if value, ok := e.memtable[key]; ok {
+		return value, value != nil
+	}
+	return getFromTables(e.tables, key)
+}
+
+func getFromTables(tables []*sstable, key string) (*Value, bool) {
+	for i := len(tables) - 1; i >= 0; i-- {
+		value, found, err := tables[i].get(key)
+		if err != nil {
+			logTableError(tables[i], err)
+			continue
+		}
+		if found {
+			return value, value != nil
+		}
+	}
+	return nil, false
+}
+
+func (e *lsmEngine) Put(key string, value *Value) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, existed := e.getLocked(key)
+	if err := e.writeLocked(key, value); err != nil {
+		return err
+	}
+	if !existed {
+		e.count++
+	}
+	return e.maybeFlushLocked()
+}
+
+// Delete writes a tombstone, which hides the key in the older tables until
+// a compaction drops both
+func (e *lsmEngine) Delete(key string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, existed := e.getLocked(key); !existed {
+		return nil
+	}
+	if err := e.writeLocked(key, nil); err != nil {
+		return err
+	}
+	e.count--
+	return e.maybeFlushLocked()
+}
+
+// writeLocked appends the entry to the WAL and applies it to the memtable
+func (e *lsmEngine) writeLocked(key string, value *Value) error {
+	if e.closed {
+		return fmt.Errorf("lsm engine %v is closed", e.dir)
+	}
+	entry := appendEntry(nil, key, value)
+	record := make([]byte, lsmWALHeader, lsmWALHeader+len(entry))
+	binary.LittleEndian.PutUint32(record, uint32(len(entry)))
+	binary.LittleEndian.PutUint32(record[4:], crc32.Checksum(entry, lsmCRC))
+	if _, err := e.wal.Write(append(record, entry...)); err != nil {
+		return err
+	}
+	e.setLocked(key, value)
+	return nil
+}
+
+func memEntrySize(key string, value *Value) int64 {
+	if value == nil {
+		return int64(len(key)) + ENTRY_OVERHEAD
+	}
+	return entrySize(key, value)
+}
+
+func (e *lsmEngine) setLocked(key string, value *Value) {
+	if prev, ok := e.memtable[key]; ok {
+		e.memSize -= memEntrySize(key, prev)
+	}
+	e.memtable[key] = value
+	e.memSize += memEntrySize(key, value)
+}
+
+func (e *lsmEngine) sortedMemtableLocked() []memEntry {
+	entries := make([]memEntry, 0, len(e.memtable))
+	for key, value := range e.memtable {
+		entries = append(entries, memEntry{key: key, value: value})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	return entries
+}
+
+func (e *lsmEngine) maybeFlushLocked() error {
+	if e.memSize < e.options.MemtableSize {
+		return nil
+	}
+	return e.flushLocked()
+}
+
+// flushLocked writes the memtable to a new table and starts a new WAL. A
+// crash before the WAL is reset replays entries which are already in the
+// table, which changes nothing
+func (e *lsmEngine) flushLocked() error {
+	if len(e.memtable) == 0 {
+		return nil
+	}
+	entries := e.sortedMemtableLocked()
+	i := 0
+	table, err := writeTable(e.dir, e.nextID, len(entries), func() (string, *Value, bool) {
+		for i < len(entries) {
+			entry := entries[i]
+			i++
+			// with no older table a tombstone has nothing left to hide
+			if entry.value == nil && len(e.tables) == 0 {
+				continue
+			}
+			return entry.key, entry.value, true
+		}
+		return "", nil, false
+	})
+	if err != nil {
+		return err
+	}
+	e.nextID++
+	if table != nil {
+		e.tables = append(e.tables, table)
+		if err := e.writeTablesLocked(); err != nil {
+			return err
+		}
+	}
+
+	if err := e.wal.Close(); err != nil {
+		return err
+	}
+	wal, err := os.Create(filepath.Join(e.dir, LSM_WAL_FILE))
+	if err != nil {
+		return err
+	}
+	e.wal = wal
+	e.memtable = make(map[string]*Value)
+	e.memSize = 0
+
+	if len(e.tables) >= e.options.CompactionTrigger && !e.compacting && !e.closed {
+		e.compacting = true
+		e.compactions.Add(1)
+		go e.compact()
+	}
+	return nil
+}
+
+// writeTablesLocked replaces TABLES with the ids of the live tables
+func (e *lsmEngine) writeTablesLocked() error {
+	ids := make([]int, 0, len(e.tables))
+	for _, table := range e.tables {
+		ids = append(ids, table.id)
+	}
+	data, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(e.dir, LSM_TABLES_FILE)
+	tmp, err := os.CreateTemp(e.dir, LSM_TABLES_FILE+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	dir, err := os.Open(e.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// compact merges every table into one. Writes go on meanwhile, the tables
+// they flush are newer than the merged ones and stay after the result. The
+// merge covers the oldest table, so the tombstones have nothing left to
+// hide and are dropped
+func (e *lsmEngine) compact() {
+	defer e.compactions.Done()
+
+	e.mu.Lock()
+	inputs := append([]*sstable(nil), e.tables...)
+	keys := 0
+	sources := make([]entryIterator, 0, len(inputs))
+	for _, table := range inputs {
+		table.refs++
+		keys += table.count
+		sources = append(sources, table.iterator())
+	}
+	id := e.nextID
+	e.nextID++
+	e.mu.Unlock()
+
+	merged := newMergeIterator(sources)
+	table, err := writeTable(e.dir, id, keys, func() (string, *Value, bool) {
+		for {
+			key, value, ok := merged.next()
+			if !ok || value != nil {
+				return key, value, ok
+			}
+		}
+	})
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.compacting = false
+	if err == nil {
+		rest := e.tables[len(inputs):]
+		var tables []*sstable
+		if table != nil {
+			tables = append(tables, table)
+		}
+		e.tables = append(tables, rest...)
+		if err = e.writeTablesLocked(); err != nil {
+			e.tables = append(append([]*sstable(nil), inputs...), rest...)
+			if table != nil {
+				table.obsolete = true
+				e.unrefLocked(table)
+			}
+		}
+	}
+	for _, input := range inputs {
+		e.unrefLocked(input)
+	}
+	if err != nil {
+		log.Printf("error compacting %v: %v", e.dir, err)
+		return
+	}
+	for _, input := range inputs {
+		input.obsolete = true
+		e.unrefLocked(input)
+	}
+	log.Printf("compacted %v tables of %v", len(inputs), e.dir)
+}
+
+// unrefLocked drops a reference to the table, the last one closes it and
+// removes an obsolete table
+func (e *lsmEngine) unrefLocked(table *sstable) {
+	table.refs--
+	if table.refs > 0 {
+		return
+	}
+	table.file.Close()
+	if table.obsolete {
+		os.Remove(table.path)
+	}
+}
+
+func (e *lsmEngine) Iterate(fn func(key string, value *Value) bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	e.iterateLocked(fn)
+}
+
+// iterateLocked visits the keys in order, merging the tables and the
+// memtable
+func (e *lsmEngine) iterateLocked(fn func(key string, value *Value) bool) {
+	iterateLive(sourcesOf(e.tables, e.sortedMemtableLocked()), fn)
+}
+
+func sourcesOf(tables []*sstable, memtable []memEntry) []entryIterator {
+	sources := make([]entryIterator, 0, len(tables)+1)
+	for _, table := range tables {
+		sources = append(sources, table.iterator())
+	}
+	return append(sources, &sliceIterator{entries: memtable})
+}
+
+func (e *lsmEngine) Len() int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.count
+}
+
+// Snapshot copies the memtable and keeps the current tables open, and on
+// disk, until the snapshot is released
+func (e *lsmEngine) Snapshot() EngineSnapshot {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	snapshot := &lsmSnapshot{
+		engine:   e,
+		memtable: e.sortedMemtableLocked(),
+		tables:   append([]*sstable(nil), e.tables...),
+		count:    e.count,
+	}
+	for _, table := range snapshot.tables {
+		table.refs++
+	}
+	return snapshot
+}
+
+func (e *lsmEngine) InMemory() bool {
+	return false
+}
+
+// Close waits for a running compaction and closes the files, the memtable
+// stays in the WAL
+func (e *lsmEngine) Close() error {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return nil
+	}
+	e.closed = true
+	e.mu.Unlock()
+	e.compactions.Wait()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closeTables()
+	return e.wal.Close()
+}
+
+func (e *lsmEngine) closeTables() {
+	for _, table := range e.tables {
+		e.unrefLocked(table)
+	}
+	e.tables = nil
+}
+
+// lsmSnapshot is a point in time view of an lsmEngine
+type lsmSnapshot struct {
+	engine   *lsmEngine
+	memtable []memEntry
+	tables   []*sstable
+	count    int
+	released bool
+}
+
+func (s *lsmSnapshot) Get(key string) (*Value, bool) {
+	i := sort.Search(len(s.memtable), func(i int) bool { return s.memtable[i].key >= key })
+	if i < len(s.memtable) && s.memtable[i].key == key {
+		return s.memtable[i].value, s.memtable[i].value != nil
+	}
+	return getFromTables(s.tables, key)
+}
+
+func (s *lsmSnapshot) Iterate(fn func(key string, value *Value) bool) {
+	iterateLive(sourcesOf(s.tables, s.memtable), fn)
+}
+
+func (s *lsmSnapshot) Len() int {
+	return s.count
+}
+
+func (s *lsmSnapshot) Release() {
+	s.engine.mu.Lock()
+	defer s.engine.mu.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+	for _, table := range s.tables {
+		s.engine.unrefLocked(table)
+	}
+}
+
+func logTableError(table *sstable, err error) {
+	log.Printf("error reading %v: %v", table.path, err)
+}
@@ -0,0 +1,209 @@
+package models
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CollectionMemoryStats is the memory breakdown of a single collection
+type CollectionMemoryStats struct {
+	Keys      int   `json:"keys"`
+	UsedBytes int64 `json:"used_bytes"`
+	Dataset   int64 `json:"dataset_bytes"`
+	CompressionStats
+	TieringStats
+}
+
+// CompressionStats reports how well the compressed values compress, the
+// ratio is the uncompressed over the compressed size
+type CompressionStats struct {
+	CompressedKeys   int     `json:"compressed_keys"`
+	RawBytes         int64   `json:"compressed_raw_bytes"`
+	StoredBytes      int64   `json:"compressed_stored_bytes"`
+	CompressionRatio float64 `json:"compression_ratio"`
+}
+
+func (c *CompressionStats) add(other CompressionStats) {
+	c.CompressedKeys += other.CompressedKeys
+	c.RawBytes += other.RawBytes
+	c.StoredBytes += other.StoredBytes
+	c.computeRatio()
+}
+
+func (c *CompressionStats) computeRatio() {
+	c.CompressionRatio = 0
+	if c.StoredBytes > 0 {
+		c.CompressionRatio = float64(c.RawBytes) / float64(c.StoredBytes)
+	}
+}
+
+// MemoryStats is the memory report of a CollectionStore
+type MemoryStats struct {
+	UsedMemory          int64                             `json:"used_memory"`
+	Dataset             int64                             `json:"dataset_bytes"`
+	Overhead            int64                             `json:"overhead_bytes"`
+	Keys                int                               `json:"keys"`
+	MaxMemory           int64                             `json:"maxmemory"`
+	MaxMemoryPolicy     string                            `json:"maxmemory_policy"`
+	HeapAlloc           uint64                            `json:"heap_alloc"`
+	HeapInuse           uint64                            `json:"heap_inuse"`
+	HeapIdle            uint64                            `json:"heap_idle"`
+	HeapReleased        uint64                            `json:"heap_released"`
+	Sys                 uint64                            `json:"sys"`
+	FragmentationRatio  float64                           `json:"fragmentation_ratio"`
+	CollectionBreakdown map[string]*CollectionMemoryStats `json:"collections"`
+	CompressionStats
+	TieringStats
+}
+
+// KeyMemory is the memory taken by a single key
+type KeyMemory struct {
+	Collection string
+	Key        string
+	Size       int64 // approximate bytes including the overheads
+	ValueSize  int64 // bytes of the payload
+}
+
+// memoryStats returns the breakdown of the collection, the dataset only
+// counts the keys held in memory
+func (kv *KeyValueStore) memoryStats() *CollectionMemoryStats {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	stats := &CollectionMemoryStats{Keys: kv.engine.Len(), UsedBytes: kv.used}
+	if kv.engine.InMemory() {
+		kv.engine.Iterate(func(key string, value *Value) bool {
+			stats.Dataset += int64(len(key) + len(value.Value))
+			return true
+		})
+	}
+	stats.CompressedKeys = kv.compressedKeys
+	stats.RawBytes = kv.rawBytes
+	stats.StoredBytes = kv.storedBytes
+	stats.computeRatio()
+	stats.TieringStats = kv.tieringStatsLocked()
+	return stats
+}
+
+// MemoryUsageOfKey returns the approximate memory taken by a key
+func (cs *CollectionStore) MemoryUsageOfKey(collectionName, key string) (int64, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	coll, ok := cs.collections[collectionName]
+	if !ok {
+		return 0, false
+	}
+	return coll.KeyMemoryUsage(key)
+}
+
+// MemoryStats returns the memory report, the fragmentation is estimated from
+// the go runtime as the heap in use over the live heap
+func (cs *CollectionStore) MemoryStats() *MemoryStats {
+	cs.mu.RLock()
+	stats := &MemoryStats{
+		MaxMemory:           cs.limit.MaxMemory,
+		MaxMemoryPolicy:     cs.limit.Policy,
+		CollectionBreakdown: make(map[string]*CollectionMemoryStats),
+	}
+	for collName, coll := range cs.collections {
+		collStats := coll.memoryStats()
+		stats.CollectionBreakdown[collName] = collStats
+		stats.UsedMemory += COLLECTION_OVERHEAD + collStats.UsedBytes
+		stats.Dataset += collStats.Dataset
+		stats.Keys += collStats.Keys
+		stats.CompressionStats.add(collStats.CompressionStats)
+		stats.TieringStats.add(collStats.TieringStats)
+	}
+	cs.mu.RUnlock()
+	stats.Overhead = stats.UsedMemory - stats.Dataset
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	stats.HeapAlloc = ms.HeapAlloc
+	stats.HeapInuse = ms.HeapInuse
+	stats.HeapIdle = ms.HeapIdle
+	stats.HeapReleased = ms.HeapReleased
+	stats.Sys = ms.Sys
+	if ms.HeapAlloc > 0 {
+		stats.FragmentationRatio = float64(ms.HeapInuse) / float64(ms.HeapAlloc)
+	}
+	return stats
+}
+
+// ScanKeyMemory calls fn with the memory taken by every live key
+func (cs *CollectionStore) ScanKeyMemory(fn func(km KeyMemory)) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	now := time.Now()
+	for collName, coll := range cs.collections {
+		coll.mu.RLock()
+		coll.engine.Iterate(func(key string, value *Value) bool {
+			if !value.IsExpired(now) {
+				fn(KeyMemory{
+					Collection: collName,
+					Key:        key,
+					Size:       entrySize(key, value),
+					ValueSize:  value.storedSize(),
+				})
+			}
+			return true
+		})
+		coll.mu.RUnlock()
+	}
+}
+
+const (
+	// keys bigger than this are reported by the doctor
+	BIG_KEY_THRESHOLD = 1 << 20
+	// fragmentation above this ratio is reported by the doctor
+	HIGH_FRAGMENTATION_RATIO = 1.5
+	// used memory above this fraction of maxmemory is reported by the doctor
+	MAXMEMORY_WARNING_RATIO = 0.9
+)
+
+// MemoryDoctor returns a single line report of the memory problems found
+func (cs *CollectionStore) MemoryDoctor() string {
+	stats := cs.MemoryStats()
+	var issues []string
+
+	if stats.Keys == 0 {
+		return "the store is empty, nothing to report"
+	}
+	if stats.MaxMemory > 0 && float64(stats.UsedMemory) > MAXMEMORY_WARNING_RATIO*float64(stats.MaxMemory) {
+		issues = append(issues, fmt.Sprintf("used memory %v is over %v%% of maxmemory %v with policy %v",
+			stats.UsedMemory, int(MAXMEMORY_WARNING_RATIO*100), stats.MaxMemory, stats.MaxMemoryPolicy))
+	}
+	if stats.FragmentationRatio > HIGH_FRAGMENTATION_RATIO {
+		issues = append(issues, fmt.Sprintf("high fragmentation ratio %.2f, the heap holds memory that is no longer live", stats.FragmentationRatio))
+	}
+	if stats.Dataset > 0 && stats.Overhead > stats.Dataset {
+		issues = append(issues, fmt.Sprintf("overhead %v is bigger than the dataset %v, values are very small", stats.Overhead, stats.Dataset))
+	}
+
+	var bigKeys []string
+	cs.ScanKeyMemory(func(km KeyMemory) {
+		if km.Size > BIG_KEY_THRESHOLD {
+			bigKeys = append(bigKeys, km.Collection+":"+km.Key)
+		}
+	})
+	if len(bigKeys) > 0 {
+		sort.Strings(bigKeys)
+		issues = append(issues, fmt.Sprintf("%v big keys over %v bytes: %v", len(bigKeys), BIG_KEY_THRESHOLD, strings.Join(bigKeys, ",")))
+	}
+
+	for collName, collStats := range stats.CollectionBreakdown {
+		if len(stats.CollectionBreakdown) > 1 && collStats.UsedBytes*2 > stats.UsedMemory {
+			issues = append(issues, fmt.Sprintf("collection %v holds more than half of the used memory", collName))
+		}
+	}
+
+	if len(issues) == 0 {
+		return "no memory problems detected"
+	}
+	return strings.Join(issues, "; ")
+}
@@ -0,0 +1,94 @@
+package models
+
+import (
+	"fmt"
+)
+
+// Event classes for keyspace notifications, configured with the
+// notify-keyspace-events option using the same letters as redis:
+//
+//	K  keyspace events, published on __keyspace__:<collection>:<key>
+//	E  keyevent events, published on __keyevent__:<event>
+//	g  generic commands like del and expire
+//	$  string commands like set
+//	x  expired events, every time a key is expired
+//	e  evicted events, every time a key is evicted for maxmemory
+//	A  alias for g$xe
+const (
+	NotifyKeyspace = 1 << iota
+	NotifyKeyevent
+	NotifyGeneric
+	NotifyString
+	NotifyExpired
+	NotifyEvicted
+	NotifyAll = NotifyGeneric | NotifyString | NotifyExpired | NotifyEvicted
+)
+
+const (
+	KEYSPACE_CHANNEL_PREFIX = "__keyspace__:"
+	KEYEVENT_CHANNEL_PREFIX = "__keyevent__:"
+)
+
+// ParseKeyspaceEvents converts the notify-keyspace-events flags into a
+// bitmask of event classes
+func ParseKeyspaceEvents(flags string) (int, error) {
+	mask := 0
+	for _, flag := range flags {
+		switch flag {
+		case 'K':
+			mask |= NotifyKeyspace
+		case 'E':
+			mask |= NotifyKeyevent
+		case 'g':
+			mask |= NotifyGeneric
+		case '$':
+			mask |= NotifyString
+		case 'x':
+			mask |= NotifyExpired
+		case 'e':
+			mask |= NotifyEvicted
+		case 'A':
+			mask |= NotifyAll
+		default:
+			return 0, fmt.Errorf("invalid keyspace event class: %c", flag)
+		}
+	}
+	return mask, nil
+}
+
+// KeyspaceNotifier publishes key changes through the PubSub
+type KeyspaceNotifier struct {
+	ps    *PubSub
+	flags int
+}
+
+// NewKeyspaceNotifier creates a notifier for the enabled event classes, a
+// notifier without keyspace or keyevent channels enabled never publishes
+func NewKeyspaceNotifier(ps *PubSub, flags int) *KeyspaceNotifier {
+	if flags&(NotifyKeyspace|NotifyKeyevent) == 0 || flags&NotifyAll == 0 {
+		flags = 0
+	}
+	return &KeyspaceNotifier{
+		ps:    ps,
+		flags: flags,
+	}
+}
+
+// Enabled reports whether events of the given class are published, it is
+// the only thing paid on the hot path when the class is disabled
+func (n *KeyspaceNotifier) Enabled(class int) bool {
+	return n != nil && n.ps != nil && n.flags&class != 0
+}
+
+// Notify publishes the event for the key on the enabled channels
+func (n *KeyspaceNotifier) Notify(class int, event, collection, key string) {
+	if !n.Enabled(class) {
+		return
+	}
+	if n.flags&NotifyKeyspace != 0 {
+		n.ps.Publish(KEYSPACE_CHANNEL_PREFIX+collection+":"+key, event)
+	}
+	if n.flags&NotifyKeyevent != 0 {
+		n.ps.Publish(KEYEVENT_CHANNEL_PREFIX+event, collection+":"+key)
+	}
+}
@@ -0,0 +1,127 @@
+package models
+
+import (
+	"errors"
+	"sort"
+)
+
+var (
+	ErrKeyLocked          = errors.New("key is locked by a prepared transaction")
+	ErrUnknownTransaction = errors.New("unknown prepared transaction")
+)
+
+// PreparedTransaction is the part of a distributed transaction a shard voted
+// to commit, its keys stay locked until the coordinator commits or aborts it
+type PreparedTransaction struct {
+	TxID      string
+	Mutations []Mutation
+}
+
+// lockedKeysLocked returns the prepared transaction holding a key written
+// by the mutations, the caller must hold the lock
+func (cs *CollectionStore) lockedKeysLocked(mutations []Mutation) (string, bool) {
+	for _, m := range mutations {
+		if txID, ok := cs.preparedKeys[collectionKey{m.Collection, m.Key}]; ok {
+			return txID, true
+		}
+	}
+	return "", false
+}
+
+// KeyLocked reports whether the key is locked by a prepared transaction
+func (cs *CollectionStore) KeyLocked(collectionName, key string) bool {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	_, ok := cs.preparedKeys[collectionKey{collectionName, key}]
+	return ok
+}
+
+// Prepare locks the keys written by the mutations for the transaction, once
+// it returns nil the transaction is guaranteed to commit. When reserving the
+// memory for the whole transaction is reserved up front. Preparing a
+// transaction again is a no-op. ErrEvictionNotLogged is returned once the
+// transaction is prepared
+func (cs *CollectionStore) Prepare(txID string, mutations []Mutation, reserve bool) (err error) {
+	cs.mu.Lock()
+	defer cs.reportEvictions(&err)
+	defer cs.mu.Unlock()
+
+	if _, ok := cs.prepared[txID]; ok {
+		return nil
+	}
+	if holder, ok := cs.lockedKeysLocked(mutations); ok && holder != txID {
+		return ErrKeyLocked
+	}
+	if reserve {
+		var needed int64
+		for _, m := range mutations {
+			if m.Op == MUTATION_SET {
+				needed += cs.neededMemoryLocked(m.Collection, m.Key, m.Value)
+			}
+		}
+		if err := cs.reserveMemoryLocked(needed); err != nil {
+			return err
+		}
+	}
+
+	cs.prepared[txID] = &PreparedTransaction{TxID: txID, Mutations: mutations}
+	for _, m := range mutations {
+		cs.preparedKeys[collectionKey{m.Collection, m.Key}] = txID
+	}
+	return nil
+}
+
+// releasePreparedLocked forgets the prepared transaction and unlocks its
+// keys, the caller must hold the lock
+func (cs *CollectionStore) releasePreparedLocked(txID string) (*PreparedTransaction, bool) {
+	tx, ok := cs.prepared[txID]
+	if !ok {
+		return nil, false
+	}
+	delete(cs.prepared, txID)
+	for _, m := range tx.Mutations {
+		delete(cs.preparedKeys, collectionKey{m.Collection, m.Key})
+	}
+	return tx, true
+}
+
+// CommitPrepared applies the mutations of the prepared transaction and
+// unlocks its keys
+func (cs *CollectionStore) CommitPrepared(txID string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	tx, ok := cs.releasePreparedLocked(txID)
+	if !ok {
+		return ErrUnknownTransaction
+	}
+	for _, m := range tx.Mutations {
+		cs.applyLocked(m)
+	}
+	return nil
+}
+
+// AbortPrepared discards the prepared transaction and unlocks its keys
+func (cs *CollectionStore) AbortPrepared(txID string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if _, ok := cs.releasePreparedLocked(txID); !ok {
+		return ErrUnknownTransaction
+	}
+	return nil
+}
+
+// PreparedTransactions returns the ids of the transactions which are
+// prepared and waiting for the decision of the coordinator
+func (cs *CollectionStore) PreparedTransactions() []string {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	ids := make([]string, 0, len(cs.prepared))
+	for txID := range cs.prepared {
+		ids = append(ids, txID)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -4,67 +4,106 @@ import (
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 )
 
+// SUBSCRIBER_QUEUE_SIZE is how many messages a subscriber can fall behind,
+// further messages to it are dropped until it catches up
+const SUBSCRIBER_QUEUE_SIZE = 1024
+
+// subscriber is a subscription of a client to a topic, its messages are
+// queued and written to the connection in order
+type subscriber struct {
+	queue chan string
+}
+
 type PubSub struct {
-	clients map[string]*ClientConfig
-	topics  map[string][]chan string
+	clients map[string]map[string]*subscriber // subscriptions of every client by topic
+	topics  map[string][]*subscriber
+	dropped uint64 // messages dropped because a subscriber's queue was full
 	Mutex   sync.Mutex
 }
 
 func NewPubSub() *PubSub {
 	return &PubSub{
-		topics:  make(map[string][]chan string),
-		clients: make(map[string]*ClientConfig),
+		topics:  make(map[string][]*subscriber),
+		clients: make(map[string]map[string]*subscriber),
 	}
 }
 
+// Subscribe subscribes the client to the topic, a client can subscribe to
+// several topics on the same connection. Messages published once it
+// returns are delivered in order
 func (ps *PubSub) Subscribe(topic string, conn net.Conn, cc *ClientConfig) {
 	ps.Mutex.Lock()
 	defer ps.Mutex.Unlock()
 
-	if _, ok := ps.clients[cc.ClientID]; ok {
+	if _, ok := ps.clients[cc.ClientID][topic]; ok {
 		log.Printf("Client already subscribed to topic: %s", topic)
 		return
 	}
-
-	if _, ok := ps.topics[topic]; !ok {
-		ps.topics[topic] = make([]chan string, 0)
+	if _, ok := ps.clients[cc.ClientID]; !ok {
+		ps.clients[cc.ClientID] = make(map[string]*subscriber)
 	}
 
-	// Create a channel for this subscription
-	ch := make(chan string)
-	ps.topics[topic] = append(ps.topics[topic], ch)
-	ps.clients[cc.ClientID] = cc
+	sub := &subscriber{queue: make(chan string, SUBSCRIBER_QUEUE_SIZE)}
+	ps.topics[topic] = append(ps.topics[topic], sub)
+	ps.clients[cc.ClientID][topic] = sub
 
-	// Start a goroutine to listen for messages on this channel and forward them to the client
+	// forward the queued messages to the client until it disconnects
 	go func() {
-		for message := range ch {
-			_, err := conn.Write([]byte(message + "\n"))
-			if err != nil {
-				// Handle error (e.g., client disconnected)
+		for message := range sub.queue {
+			if _, err := conn.Write([]byte(message + "\n")); err != nil {
 				log.Printf("Error writing to connection: %v", err)
-				break
+				ps.unsubscribe(topic, cc.ClientID)
+				return
 			}
 		}
 	}()
 }
 
+// unsubscribe removes the subscription of the client to the topic
+func (ps *PubSub) unsubscribe(topic, clientID string) {
+	ps.Mutex.Lock()
+	defer ps.Mutex.Unlock()
+
+	sub, ok := ps.clients[clientID][topic]
+	if !ok {
+		return
+	}
+	delete(ps.clients[clientID], topic)
+	if len(ps.clients[clientID]) == 0 {
+		delete(ps.clients, clientID)
+	}
+	subscribers := ps.topics[topic]
+	for i, s := range subscribers {
+		if s == sub {
+			ps.topics[topic] = append(subscribers[:i:i], subscribers[i+1:]...)
+			break
+		}
+	}
+	if len(ps.topics[topic]) == 0 {
+		delete(ps.topics, topic)
+	}
+}
+
+// Publish queues the message for every subscriber of the topic without
+// waiting for any of them, a subscriber whose queue is full misses it
 func (ps *PubSub) Publish(topic, message string) {
 	ps.Mutex.Lock()
 	defer ps.Mutex.Unlock()
 
-	if subscribers, ok := ps.topics[topic]; ok {
-		for _, ch := range subscribers {
-			// Non-blocking send in case of slow consumers
-			go func(ch chan string) {
-				select {
-				case ch <- message:
-				default:
-					// Log or handle the fact that a message was not sent.
-					log.Printf("Message not sent to client")
-				}
-			}(ch)
+	for _, sub := range ps.topics[topic] {
+		select {
+		case sub.queue <- message:
+		default:
+			atomic.AddUint64(&ps.dropped, 1)
 		}
 	}
 }
+
+// Dropped returns how many messages were dropped because a subscriber
+// fell too far behind
+func (ps *PubSub) Dropped() uint64 {
+	return atomic.LoadUint64(&ps.dropped)
+}
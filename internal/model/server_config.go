@@ -2,10 +2,14 @@ package models
 
 import (
 	"bufio"
+	"fmt"
 	"log"
 	"os"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/sk25469/kv/utils"
 )
 
 type Config struct {
@@ -16,6 +20,62 @@ type Config struct {
 	password       string
 	ProtectedMode  bool
 	IsMaster       bool
+	// bitmask of the keyspace event classes to publish, see ParseKeyspaceEvents
+	NotifyKeyspaceEvents int
+	MemoryLimit          MemoryLimit
+	// compression per collection, "*" applies to the rest of the collections
+	Compression map[string]CompressionSetting
+	// storage engine per collection and where their files are kept, an
+	// empty Dir keeps them under the snapshot directory per port
+	Storage StorageConfig
+	// tiering per collection, "*" applies to the rest of the collections
+	Tiering     map[string]TieringSetting
+	LogRewrite  LogRewriteConfig
+	LogSegments LogSegmentConfig
+	// when the snapshot log is synced to disk, see ParseFsyncPolicy
+	AppendFsync string
+	// whether a torn tail of the snapshot log is cut off on load
+	LogLoadTruncated bool
+}
+
+// Fsync policies of the snapshot log
+const (
+	FSYNC_ALWAYS   = "always"   // every append is synced before it is acknowledged
+	FSYNC_EVERYSEC = "everysec" // the log is synced once a second
+	FSYNC_NO       = "no"       // the operating system decides when to write it out
+)
+
+// ParseFsyncPolicy validates the appendfsync option
+func ParseFsyncPolicy(policy string) (string, error) {
+	switch policy {
+	case FSYNC_ALWAYS, FSYNC_EVERYSEC, FSYNC_NO:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid appendfsync: %v", policy)
+	}
+}
+
+const (
+	DEFAULT_REWRITE_MIN_SIZE   = 64 << 20
+	DEFAULT_REWRITE_PERCENTAGE = 100
+	DEFAULT_SEGMENT_MAX_SIZE   = 16 << 20
+	DEFAULT_SEGMENT_MAX_AGE    = time.Hour
+)
+
+// LogRewriteConfig triggers a rewrite of the snapshot log into a dump once
+// the log written since the last dump is at least MinSize bytes and
+// Percentage percent of the size of that dump, a Percentage of 0 disables
+// automatic rewrites
+type LogRewriteConfig struct {
+	MinSize    int64
+	Percentage int
+}
+
+// LogSegmentConfig seals the active segment of the snapshot log once it
+// holds MaxSize bytes or once it is MaxAge old, 0 disables either limit
+type LogSegmentConfig struct {
+	MaxSize int64
+	MaxAge  time.Duration
 }
 
 func NewConfig(ip, port, username, password string) *Config {
@@ -27,6 +87,23 @@ func NewConfig(ip, port, username, password string) *Config {
 		password:       password,
 		IsMaster:       false,
 		ProtectedMode:  false,
+		MemoryLimit: MemoryLimit{
+			Policy:  NO_EVICTION,
+			Samples: DEFAULT_MAXMEMORY_SAMPLES,
+		},
+		Compression: make(map[string]CompressionSetting),
+		Storage:     StorageConfig{Engines: make(map[string]string)},
+		Tiering:     make(map[string]TieringSetting),
+		LogRewrite: LogRewriteConfig{
+			MinSize:    DEFAULT_REWRITE_MIN_SIZE,
+			Percentage: DEFAULT_REWRITE_PERCENTAGE,
+		},
+		LogSegments: LogSegmentConfig{
+			MaxSize: DEFAULT_SEGMENT_MAX_SIZE,
+			MaxAge:  DEFAULT_SEGMENT_MAX_AGE,
+		},
+		AppendFsync:      FSYNC_EVERYSEC,
+		LogLoadTruncated: true,
 	}
 }
 
@@ -48,13 +125,16 @@ func LoadConfig(filename string) (*Config, error) {
 	config := NewConfig("", "", "", "")
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, " ")
-		if len(parts) != 2 {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) < 2 {
 			continue
 		}
-		key := strings.TrimSpace(parts[0])
-		value := strings.TrimSpace(parts[1])
+		key := parts[0]
+		value := strings.Join(parts[1:], " ")
 		switch key {
 		case "ip":
 			config.IP = value
@@ -73,6 +153,119 @@ func LoadConfig(filename string) (*Config, error) {
 				return &Config{}, err
 			}
 			config.SetPassword(hashedPassword)
+		case "notify-keyspace-events":
+			flags, err := ParseKeyspaceEvents(value)
+			if err != nil {
+				log.Printf("error parsing notify-keyspace-events: %v", err)
+				return &Config{}, err
+			}
+			config.NotifyKeyspaceEvents = flags
+		case "compression":
+			// compression <collection|*> <algorithm> <threshold>
+			if len(parts) != 4 {
+				log.Printf("usage: compression <collection|*> <algorithm> <threshold>")
+				continue
+			}
+			setting, err := ParseCompressionSetting(parts[2], parts[3])
+			if err != nil {
+				log.Printf("error parsing compression: %v", err)
+				return &Config{}, err
+			}
+			config.Compression[parts[1]] = setting
+		case "storage-engine":
+			// storage-engine <collection|*> <engine>
+			if len(parts) != 3 {
+				log.Printf("usage: storage-engine <collection|*> <engine>")
+				continue
+			}
+			if _, ok := GetStorageEngine(parts[2]); !ok {
+				log.Printf("unknown storage engine: %v", parts[2])
+				return &Config{}, fmt.Errorf("unknown storage engine: %v", parts[2])
+			}
+			config.Storage.Engines[parts[1]] = parts[2]
+		case "tiering":
+			// tiering <collection|*> <cold-after> <min-size>
+			if len(parts) != 4 {
+				log.Printf("usage: tiering <collection|*> <cold-after> <min-size>")
+				continue
+			}
+			setting, err := ParseTieringSetting(parts[2], parts[3])
+			if err != nil {
+				log.Printf("error parsing tiering: %v", err)
+				return &Config{}, err
+			}
+			config.Tiering[parts[1]] = setting
+		case "storage-dir":
+			config.Storage.Dir = value
+		case "maxmemory":
+			maxMemory, err := parseMemory(value)
+			if err != nil {
+				log.Printf("error parsing maxmemory: %v", err)
+				return &Config{}, err
+			}
+			config.MemoryLimit.MaxMemory = maxMemory
+		case "maxmemory-policy":
+			policy, err := ParseEvictionPolicy(value)
+			if err != nil {
+				log.Printf("error parsing maxmemory-policy: %v", err)
+				return &Config{}, err
+			}
+			config.MemoryLimit.Policy = policy
+		case "maxmemory-samples":
+			samples, err := strconv.Atoi(value)
+			if err != nil || samples <= 0 {
+				log.Printf("unable to parse maxmemory-samples: %v", value)
+				continue
+			}
+			config.MemoryLimit.Samples = samples
+		case "auto-rewrite-min-size":
+			minSize, err := parseMemory(value)
+			if err != nil {
+				log.Printf("error parsing auto-rewrite-min-size: %v", err)
+				return &Config{}, err
+			}
+			config.LogRewrite.MinSize = minSize
+		case "auto-rewrite-percentage":
+			percentage, err := strconv.Atoi(value)
+			if err != nil || percentage < 0 {
+				log.Printf("unable to parse auto-rewrite-percentage: %v", value)
+				continue
+			}
+			config.LogRewrite.Percentage = percentage
+		case "segment-max-size":
+			maxSize, err := parseMemory(value)
+			if err != nil {
+				log.Printf("error parsing segment-max-size: %v", err)
+				return &Config{}, err
+			}
+			config.LogSegments.MaxSize = maxSize
+		case "segment-max-age":
+			if value == "0" {
+				config.LogSegments.MaxAge = 0
+				continue
+			}
+			maxAge, err := utils.ParseDuration(value)
+			if err != nil {
+				log.Printf("error parsing segment-max-age: %v", err)
+				return &Config{}, err
+			}
+			config.LogSegments.MaxAge = maxAge
+		case "appendfsync":
+			policy, err := ParseFsyncPolicy(value)
+			if err != nil {
+				log.Printf("error parsing appendfsync: %v", err)
+				return &Config{}, err
+			}
+			config.AppendFsync = policy
+		case "log-load-truncated":
+			switch value {
+			case "yes":
+				config.LogLoadTruncated = true
+			case "no":
+				config.LogLoadTruncated = false
+			default:
+				log.Printf("unable to parse log-load-truncated: %v", value)
+			}
 		}
 	}
 
@@ -92,3 +285,24 @@ func parseMaxConnections(maxConnStr string) int {
 	}
 	return maxConn
 }
+
+// parseMemory parses a size like 1048576, 512kb, 100mb or 1gb into bytes
+func parseMemory(input string) (int64, error) {
+	input = strings.ToLower(input)
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"b", 1}} {
+		if strings.HasSuffix(input, unit.suffix) {
+			input = strings.TrimSuffix(input, unit.suffix)
+			multiplier = unit.size
+			break
+		}
+	}
+	size, err := strconv.ParseInt(input, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid memory size: %v", input)
+	}
+	return size * multiplier, nil
+}
@@ -0,0 +1,238 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Isolation levels of a transaction started with BEGIN
+const (
+	ISOLATION_READ_COMMITTED = "read-committed"
+	ISOLATION_SNAPSHOT       = "snapshot"
+)
+
+var ErrConflict = errors.New("write conflict with a concurrent transaction, retry the transaction")
+
+// ParseIsolationLevel parses the level given to BEGIN ISOLATION, as
+// SNAPSHOT, READ COMMITTED or READ-COMMITTED
+func ParseIsolationLevel(args []string) (string, error) {
+	switch strings.ToLower(strings.Join(args, "-")) {
+	case ISOLATION_SNAPSHOT:
+		return ISOLATION_SNAPSHOT, nil
+	case ISOLATION_READ_COMMITTED:
+		return ISOLATION_READ_COMMITTED, nil
+	default:
+		return "", fmt.Errorf("unknown isolation level: %v", strings.Join(args, " "))
+	}
+}
+
+// snapshotRegistry keeps the versions at which the open snapshot
+// transactions started, old values are kept only while one of them is open
+type snapshotRegistry struct {
+	mu     sync.RWMutex
+	active map[uint64]int
+}
+
+func newSnapshotRegistry() *snapshotRegistry {
+	return &snapshotRegistry{active: make(map[uint64]int)}
+}
+
+// stamp hands out the version of a write and reports whether the previous
+// value has to be kept for an open snapshot. A snapshot can't start between
+// the check and the version, so every write after its start is kept
+func (r *snapshotRegistry) stamp(clock *versionClock) (uint64, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return clock.next(), len(r.active) > 0
+}
+
+func (r *snapshotRegistry) begin(clock *versionClock) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// the version is never 0, which means no snapshot
+	version := clock.next()
+	r.active[version]++
+	return version
+}
+
+func (r *snapshotRegistry) end(version uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.active[version]--
+	if r.active[version] <= 0 {
+		delete(r.active, version)
+	}
+}
+
+// oldest returns the oldest open snapshot, ok is false when there is none
+func (r *snapshotRegistry) oldest() (uint64, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var oldest uint64
+	for v := range r.active {
+		if oldest == 0 || v < oldest {
+			oldest = v
+		}
+	}
+	return oldest, oldest != 0
+}
+
+// snapshotValue is an earlier state of a key, value is nil when the key
+// didn't exist
+type snapshotValue struct {
+	version uint64
+	value   *Value
+}
+
+// stampLocked returns the version of a write and keeps the current state of
+// the key for the open snapshots, the caller must hold the write lock
+func (kv *KeyValueStore) stampLocked(key string) uint64 {
+	if kv.snapshots == nil {
+		return kv.clock.next()
+	}
+	version, keep := kv.snapshots.stamp(kv.clock)
+	if keep {
+		var previous snapshotValue
+		if value, ok := kv.engine.Get(key); ok {
+			previous = snapshotValue{version: value.version, value: value}
+		} else {
+			previous = snapshotValue{version: kv.tombstones[key]}
+		}
+		kv.history[key] = append(kv.history[key], previous)
+		// the delete of the key needs a version the snapshots can compare
+		kv.tombstones[key] = version
+	}
+	return version
+}
+
+// valueAtLocked returns the value of the key as of the snapshot, nil when
+// the key didn't exist then, the caller must hold the lock
+func (kv *KeyValueStore) valueAtLocked(key string, snapshot uint64) *Value {
+	if value, ok := kv.engine.Get(key); ok && value.version <= snapshot {
+		return value
+	} else if !ok && kv.tombstones[key] <= snapshot {
+		return nil
+	}
+	history := kv.history[key]
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].version <= snapshot {
+			return history[i].value
+		}
+	}
+	return nil
+}
+
+// GetAt retrieves the value of the key as of the snapshot
+func (kv *KeyValueStore) GetAt(key string, snapshot uint64) string {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	keyValue := kv.valueAtLocked(key, snapshot)
+	if keyValue == nil || keyValue.IsExpired(time.Now()) {
+		return ""
+	}
+	keyValue.Touch()
+	value, err := keyValue.Decode()
+	if err != nil {
+		return ""
+	}
+	return value
+}
+
+// pruneHistory drops the earlier values no open snapshot can read, all of
+// them when there is no open snapshot. The open snapshots are checked under
+// the lock, a snapshot starting later sees only the current values
+func (kv *KeyValueStore) pruneHistory() {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	oldest, open := kv.snapshots.oldest()
+	if !open {
+		kv.history = make(map[string][]snapshotValue)
+		for key := range kv.tombstones {
+			if kv.watched[key] == 0 {
+				delete(kv.tombstones, key)
+			}
+		}
+		return
+	}
+	for key, history := range kv.history {
+		// the newest state at or before the oldest snapshot is still needed
+		keep := 0
+		for i, previous := range history {
+			if previous.version <= oldest {
+				keep = i
+			}
+		}
+		if value, ok := kv.engine.Get(key); ok && value.version <= oldest {
+			keep = len(history)
+		} else if !ok && kv.tombstones[key] <= oldest {
+			keep = len(history)
+		}
+		if keep == len(history) {
+			delete(kv.history, key)
+		} else if keep > 0 {
+			kv.history[key] = append([]snapshotValue(nil), history[keep:]...)
+		}
+	}
+}
+
+// conflictsLocked reports whether the key was written after the snapshot,
+// the caller must hold the lock
+func (kv *KeyValueStore) conflictsLocked(key string, snapshot uint64) bool {
+	version, _ := kv.keyVersionLocked(key, time.Now())
+	return version > snapshot
+}
+
+// BeginSnapshot starts a snapshot of every collection and returns its
+// version, reads at the version see the keys as they were at this point
+func (cs *CollectionStore) BeginSnapshot() uint64 {
+	return cs.snapshots.begin(cs.clock)
+}
+
+// EndSnapshot closes the snapshot and drops the earlier values which are no
+// longer needed, a version of 0 is ignored
+func (cs *CollectionStore) EndSnapshot(version uint64) {
+	if version == 0 {
+		return
+	}
+	cs.snapshots.end(version)
+
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	for _, coll := range cs.collections {
+		coll.pruneHistory()
+	}
+}
+
+// GetKeyInCollectionAt retrieves the value of the key as of the snapshot
+func (cs *CollectionStore) GetKeyInCollectionAt(collectionName, key string, snapshot uint64) string {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	coll, ok := cs.collections[collectionName]
+	if !ok {
+		return ""
+	}
+	return coll.GetAt(key, snapshot)
+}
+
+// conflictsLocked reports whether any key written by the mutations was
+// written by someone else after the snapshot, the caller must hold the lock
+func (cs *CollectionStore) conflictsLocked(mutations []Mutation, snapshot uint64) bool {
+	for _, m := range mutations {
+		coll, ok := cs.collections[m.Collection]
+		if !ok {
+			continue
+		}
+		coll.mu.RLock()
+		conflict := coll.conflictsLocked(m.Key, snapshot)
+		coll.mu.RUnlock()
+		if conflict {
+			return true
+		}
+	}
+	return false
+}
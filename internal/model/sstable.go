@@ -0,0 +1,467 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// every LSM_INDEX_INTERVAL-th key of a table is kept in its index
+	LSM_INDEX_INTERVAL = 16
+	// bits of the bloom filter of a table per key, about 1% false positives
+	LSM_BLOOM_BITS_PER_KEY = 10
+	LSM_BLOOM_HASHES       = 7
+
+	// SSTABLE_MAGIC ends every table file
+	SSTABLE_MAGIC       = 0x4b565354 // KVST
+	sstableFooterSize   = 8 + 8 + 8 + 4 + 4
+	entryTombstone      = 0
+	entryValue          = 1
+	entryNoExpiration   = -1
+	entryMaxStringBytes = 1 << 30
+)
+
+var (
+	ErrInvalidTable = errors.New("invalid sstable")
+	lsmCRC          = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// An entry of the WAL or of a table is
+//
+//	<key> <kind> [<encoding> <value> <expiration> <version>]
+//
+// strings are prefixed with their uvarint length, the expiration is in unix
+// millis or -1 and a tombstone, the delete of a key, has no value
+func appendEntry(buf []byte, key string, value *Value) []byte {
+	buf = appendString(buf, key)
+	if value == nil {
+		return append(buf, entryTombstone)
+	}
+	buf = append(buf, entryValue)
+	buf = appendString(buf, value.encoding)
+	buf = appendString(buf, value.Value)
+	expiration := int64(entryNoExpiration)
+	if value.HasExpiration() {
+		expiration = value.expiration.UnixMilli()
+	}
+	buf = binary.AppendVarint(buf, expiration)
+	return binary.AppendUvarint(buf, value.version)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// readEntry reads an entry written by appendEntry, the value is nil for a
+// tombstone
+func readEntry(r *bufio.Reader) (string, *Value, error) {
+	key, err := readString(r)
+	if err != nil {
+		return "", nil, err
+	}
+	kind, err := r.ReadByte()
+	if err != nil {
+		return "", nil, io.ErrUnexpectedEOF
+	}
+	if kind == entryTombstone {
+		return key, nil, nil
+	}
+	if kind != entryValue {
+		return "", nil, fmt.Errorf("unknown entry kind %v", kind)
+	}
+	encoding, err := readString(r)
+	if err != nil {
+		return "", nil, noEOF(err)
+	}
+	payload, err := readString(r)
+	if err != nil {
+		return "", nil, noEOF(err)
+	}
+	expiration, err := binary.ReadVarint(r)
+	if err != nil {
+		return "", nil, noEOF(err)
+	}
+	version, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", nil, noEOF(err)
+	}
+	value := NewEncodedKeyValue(payload, encoding)
+	if expiration != entryNoExpiration {
+		value.SetExpirationAt(time.UnixMilli(expiration))
+	}
+	value.version = version
+	return key, value, nil
+}
+
+func readString(r *bufio.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if n > entryMaxStringBytes {
+		return "", fmt.Errorf("string of %v bytes", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", noEOF(err)
+	}
+	return string(buf), nil
+}
+
+// noEOF turns an EOF in the middle of an entry into ErrUnexpectedEOF, an
+// EOF is only expected before the first byte of an entry
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// bloomFilter answers whether a table may hold a key
+type bloomFilter []byte
+
+func newBloomFilter(keys int) bloomFilter {
+	bits := keys * LSM_BLOOM_BITS_PER_KEY
+	if bits < 64 {
+		bits = 64
+	}
+	return make(bloomFilter, (bits+7)/8)
+}
+
+// bloomHashes derives the probes from two halves of a 64 bit hash
+func bloomHashes(key string) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+func (b bloomFilter) add(key string) {
+	h1, h2 := bloomHashes(key)
+	bits := uint32(len(b) * 8)
+	for i := uint32(0); i < LSM_BLOOM_HASHES; i++ {
+		bit := (h1 + i*h2) % bits
+		b[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+func (b bloomFilter) mayContain(key string) bool {
+	if len(b) == 0 {
+		return true
+	}
+	h1, h2 := bloomHashes(key)
+	bits := uint32(len(b) * 8)
+	for i := uint32(0); i < LSM_BLOOM_HASHES; i++ {
+		bit := (h1 + i*h2) % bits
+		if b[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// An sstable is a file of entries sorted by key followed by
+//
+//	<index> <bloom filter> <footer>
+//
+// The index holds every LSM_INDEX_INTERVAL-th key with its offset, the
+// footer the offsets of the index and the filter, the number of entries, the
+// CRC32C of the index and the filter and SSTABLE_MAGIC. A lookup checks the
+// filter, finds the last indexed key before the key and reads at most
+// LSM_INDEX_INTERVAL entries from there
+type sstable struct {
+	id       int
+	path     string
+	file     *os.File
+	dataEnd  int64
+	index    []indexEntry
+	bloom    bloomFilter
+	count    int
+	refs     int  // the engine and the open snapshots, guarded by the engine
+	obsolete bool // replaced by a compaction, removed once unreferenced
+}
+
+type indexEntry struct {
+	key    string
+	offset int64
+}
+
+// tablePath returns the path of the table with the id
+func tablePath(dir string, id int) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d.sst", id))
+}
+
+// writeTable writes the entries, which next returns in key order, to a new
+// table and opens it. It returns nil when there was no entry
+func writeTable(dir string, id int, keys int, next func() (string, *Value, bool)) (*sstable, error) {
+	path := tablePath(dir, id)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := bufio.NewWriterSize(tmp, 64*1024)
+	bloom := newBloomFilter(keys)
+	var index []indexEntry
+	var offset int64
+	var buf []byte
+	count := 0
+	for {
+		key, value, ok := next()
+		if !ok {
+			break
+		}
+		if count%LSM_INDEX_INTERVAL == 0 {
+			index = append(index, indexEntry{key: key, offset: offset})
+		}
+		bloom.add(key)
+		buf = appendEntry(buf[:0], key, value)
+		if _, err := w.Write(buf); err != nil {
+			return nil, err
+		}
+		offset += int64(len(buf))
+		count++
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	var meta []byte
+	meta = binary.AppendUvarint(meta, uint64(len(index)))
+	for _, entry := range index {
+		meta = appendString(meta, entry.key)
+		meta = binary.AppendUvarint(meta, uint64(entry.offset))
+	}
+	bloomOffset := offset + int64(len(meta))
+	meta = append(meta, bloom...)
+	footer := make([]byte, 0, sstableFooterSize)
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(offset))
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(bloomOffset))
+	footer = binary.LittleEndian.AppendUint64(footer, uint64(count))
+	footer = binary.LittleEndian.AppendUint32(footer, crc32.Checksum(meta, lsmCRC))
+	footer = binary.LittleEndian.AppendUint32(footer, SSTABLE_MAGIC)
+	if _, err := w.Write(append(meta, footer...)); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return nil, err
+	}
+	return openTable(dir, id)
+}
+
+// openTable opens the table and reads its index and filter into memory
+func openTable(dir string, id int) (*sstable, error) {
+	path := tablePath(dir, id)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	table, err := readTableMeta(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%w %v: %v", ErrInvalidTable, path, err)
+	}
+	table.id, table.path, table.file, table.refs = id, path, file, 1
+	return table, nil
+}
+
+func readTableMeta(file *os.File) (*sstable, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < sstableFooterSize {
+		return nil, errors.New("no footer")
+	}
+	footer := make([]byte, sstableFooterSize)
+	if _, err := file.ReadAt(footer, info.Size()-sstableFooterSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[28:]) != SSTABLE_MAGIC {
+		return nil, errors.New("bad magic")
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(footer[0:]))
+	bloomOffset := int64(binary.LittleEndian.Uint64(footer[8:]))
+	metaEnd := info.Size() - sstableFooterSize
+	if indexOffset < 0 || indexOffset > bloomOffset || bloomOffset > metaEnd {
+		return nil, errors.New("bad offsets")
+	}
+	meta := make([]byte, metaEnd-indexOffset)
+	if _, err := file.ReadAt(meta, indexOffset); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(meta, lsmCRC) != binary.LittleEndian.Uint32(footer[24:]) {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	table := &sstable{
+		dataEnd: indexOffset,
+		count:   int(binary.LittleEndian.Uint64(footer[16:])),
+		bloom:   bloomFilter(meta[bloomOffset-indexOffset:]),
+	}
+	r := bufio.NewReader(bytes.NewReader(meta[:bloomOffset-indexOffset]))
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	for ; n > 0; n-- {
+		key, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		offset, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		table.index = append(table.index, indexEntry{key: key, offset: int64(offset)})
+	}
+	return table, nil
+}
+
+// get looks the key up, found with a nil value is a tombstone
+func (t *sstable) get(key string) (*Value, bool, error) {
+	if !t.bloom.mayContain(key) {
+		return nil, false, nil
+	}
+	// the last indexed key at or before the key
+	i := sort.Search(len(t.index), func(i int) bool { return t.index[i].key > key }) - 1
+	if i < 0 {
+		return nil, false, nil
+	}
+	r := bufio.NewReader(io.NewSectionReader(t.file, t.index[i].offset, t.dataEnd-t.index[i].offset))
+	for n := 0; n < LSM_INDEX_INTERVAL; n++ {
+		entryKey, value, err := readEntry(r)
+		if err == io.EOF {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("%v: %w", t.path, err)
+		}
+		if entryKey == key {
+			return value, true, nil
+		}
+		if entryKey > key {
+			break
+		}
+	}
+	return nil, false, nil
+}
+
+// entryIterator returns the entries of a source in key order
+type entryIterator interface {
+	next() (string, *Value, bool)
+}
+
+// tableIterator reads the entries of a table in order
+type tableIterator struct {
+	table  *sstable
+	reader *bufio.Reader
+}
+
+func (t *sstable) iterator() *tableIterator {
+	return &tableIterator{table: t, reader: bufio.NewReaderSize(io.NewSectionReader(t.file, 0, t.dataEnd), 64*1024)}
+}
+
+func (it *tableIterator) next() (string, *Value, bool) {
+	key, value, err := readEntry(it.reader)
+	if err != nil {
+		if err != io.EOF {
+			logTableError(it.table, err)
+		}
+		return "", nil, false
+	}
+	return key, value, true
+}
+
+// sliceIterator returns the entries of a sorted memtable copy
+type sliceIterator struct {
+	entries []memEntry
+	i       int
+}
+
+func (it *sliceIterator) next() (string, *Value, bool) {
+	if it.i >= len(it.entries) {
+		return "", nil, false
+	}
+	entry := it.entries[it.i]
+	it.i++
+	return entry.key, entry.value, true
+}
+
+// mergeIterator merges sources, oldest first, into a single run in key
+// order. For a key in several sources the newest wins, tombstones are
+// passed on so a merge which doesn't cover every table keeps them
+type mergeIterator struct {
+	sources []entryIterator
+	heads   []mergeHead
+}
+
+type mergeHead struct {
+	key   string
+	value *Value
+	ok    bool
+}
+
+func newMergeIterator(sources []entryIterator) *mergeIterator {
+	m := &mergeIterator{sources: sources, heads: make([]mergeHead, len(sources))}
+	for i, source := range sources {
+		m.heads[i].key, m.heads[i].value, m.heads[i].ok = source.next()
+	}
+	return m
+}
+
+func (m *mergeIterator) next() (string, *Value, bool) {
+	newest := -1
+	for i := range m.heads {
+		if !m.heads[i].ok {
+			continue
+		}
+		// a later source is newer, so it wins a tie
+		if newest < 0 || m.heads[i].key <= m.heads[newest].key {
+			newest = i
+		}
+	}
+	if newest < 0 {
+		return "", nil, false
+	}
+	key, value := m.heads[newest].key, m.heads[newest].value
+	for i := range m.heads {
+		if m.heads[i].ok && m.heads[i].key == key {
+			m.heads[i].key, m.heads[i].value, m.heads[i].ok = m.sources[i].next()
+		}
+	}
+	return key, value, true
+}
+
+// iterateLive calls fn for every live key of the merged sources
+func iterateLive(sources []entryIterator, fn func(key string, value *Value) bool) {
+	merged := newMergeIterator(sources)
+	for {
+		key, value, ok := merged.next()
+		if !ok || (value != nil && !fn(key, value)) {
+			return
+		}
+	}
+}
@@ -0,0 +1,488 @@
+package models
+
+import (
+	"fmt"
+	"hash/crc32"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sk25469/kv/utils"
+)
+
+const (
+	// keys looked at per collection on every tiering pass for idle values
+	TIERING_SCAN_KEYS = 1000
+	// the value file is compacted once it holds at least this many dead
+	// bytes and more dead than live ones
+	VALUE_FILE_COMPACT_MIN_SIZE = 1 << 20
+	VALUE_FILE_SUFFIX           = ".values"
+)
+
+// TieringSetting spills the value of a key to the value file of its
+// collection once it hasn't been read for ColdAfter, or as soon as it is
+// written when it is at least MinSize bytes. 0 disables either
+type TieringSetting struct {
+	ColdAfter time.Duration
+	MinSize   int64
+}
+
+// ParseTieringSetting parses the idle window and the size threshold of the
+// tiering config option
+func ParseTieringSetting(coldAfter, minSize string) (TieringSetting, error) {
+	var setting TieringSetting
+	if coldAfter != "0" {
+		window, err := utils.ParseDuration(coldAfter)
+		if err != nil {
+			return TieringSetting{}, fmt.Errorf("invalid tiering window: %v", coldAfter)
+		}
+		setting.ColdAfter = window
+	}
+	size, err := parseMemory(minSize)
+	if err != nil {
+		return TieringSetting{}, fmt.Errorf("invalid tiering size threshold: %v", minSize)
+	}
+	setting.MinSize = size
+	return setting, nil
+}
+
+// TieringStats reports how the keys are split between the values held in
+// memory and the values spilled to the value files
+type TieringStats struct {
+	HotKeys        int   `json:"hot_keys"`
+	ColdKeys       int   `json:"cold_keys"`
+	ColdBytes      int64 `json:"cold_bytes"`
+	ValueFileBytes int64 `json:"value_file_bytes"`
+	Spills         int64 `json:"spills"`
+	Faults         int64 `json:"faults"`
+	Compactions    int64 `json:"value_file_compactions"`
+}
+
+func (t *TieringStats) add(other TieringStats) {
+	t.HotKeys += other.HotKeys
+	t.ColdKeys += other.ColdKeys
+	t.ColdBytes += other.ColdBytes
+	t.ValueFileBytes += other.ValueFileBytes
+	t.Spills += other.Spills
+	t.Faults += other.Faults
+	t.Compactions += other.Compactions
+}
+
+// valueFile is an append-only file holding the spilled payloads of a
+// collection. It only lives as long as the process, the payloads are
+// restored from the dump and the log like every other value
+type valueFile struct {
+	file *os.File
+	path string
+	size int64
+}
+
+func createValueFile(path string) (*valueFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &valueFile{file: file, path: path}, nil
+}
+
+// append writes the payload at the end of the file, the caller makes sure
+// there is a single writer
+func (f *valueFile) append(payload string) (*coldRef, error) {
+	data := []byte(payload)
+	if _, err := f.file.WriteAt(data, f.size); err != nil {
+		return nil, err
+	}
+	ref := &coldRef{file: f, offset: f.size, length: int64(len(data)), sum: crc32.Checksum(data, lsmCRC)}
+	f.size += int64(len(data))
+	return ref, nil
+}
+
+func (f *valueFile) remove() {
+	f.file.Close()
+	os.Remove(f.path)
+}
+
+// coldRef points at a payload in the value file
+type coldRef struct {
+	file    *valueFile
+	offset  int64
+	length  int64
+	rawSize int64  // length of the value as the client wrote it
+	sum     uint32 // CRC32C of the payload
+}
+
+func (r *coldRef) read() (string, error) {
+	data := make([]byte, r.length)
+	if _, err := r.file.file.ReadAt(data, r.offset); err != nil {
+		return "", err
+	}
+	if crc32.Checksum(data, lsmCRC) != r.sum {
+		return "", fmt.Errorf("corrupt spilled value at offset %v of %v", r.offset, r.file.path)
+	}
+	return string(data), nil
+}
+
+// valueTier spills the cold values of a collection, it is guarded by the
+// lock of the collection apart from pins and compacting
+type valueTier struct {
+	setting     TieringSetting
+	path        string     // empty when the collection has nowhere to spill to
+	file        *valueFile // nil until the first spill
+	coldKeys    int
+	coldBytes   int64
+	spills      int64
+	faults      int64
+	compactions int64
+	pins        int32 // dumps reading the spilled payloads, the file isn't compacted meanwhile
+	compacting  int32
+}
+
+func (t *valueTier) enabled() bool {
+	return t.path != "" && (t.setting.ColdAfter > 0 || t.setting.MinSize > 0)
+}
+
+// oversized reports whether the value is spilled for its size alone, such a
+// value stays in the value file when it is read
+func (t *valueTier) oversized(value *Value) bool {
+	return t.setting.MinSize > 0 && value.storedSize() >= t.setting.MinSize
+}
+
+// spill writes the payload to the value file and returns a copy of the
+// value pointing at it, the caller must hold the write lock
+func (t *valueTier) spill(value *Value) (*Value, error) {
+	if t.file == nil {
+		file, err := createValueFile(t.path)
+		if err != nil {
+			return nil, err
+		}
+		t.file = file
+	}
+	ref, err := t.file.append(value.Value)
+	if err != nil {
+		return nil, err
+	}
+	ref.rawSize = value.RawSize()
+	cold := *value
+	cold.Value = ""
+	cold.cold = ref
+	t.spills++
+	return &cold, nil
+}
+
+// worthSpilling reports whether spilling the value saves memory
+func worthSpilling(value *Value) bool {
+	return value.cold == nil && int64(len(value.Value)) > COLD_REF_OVERHEAD
+}
+
+// spillLocked replaces the value of the key with a copy kept in the value
+// file, the caller must hold the write lock
+func (kv *KeyValueStore) spillLocked(key string, value *Value) error {
+	cold, err := kv.tier.spill(value)
+	if err != nil {
+		return err
+	}
+	if err := kv.engine.Put(key, cold); err != nil {
+		return err
+	}
+	kv.account(key, value, -1)
+	kv.account(key, cold, 1)
+	return nil
+}
+
+// spillOversizedLocked returns the value to store for a write, spilled
+// right away when it is over the size threshold. The caller must hold the
+// write lock
+func (kv *KeyValueStore) spillOversizedLocked(value *Value) *Value {
+	if !kv.tier.enabled() || !kv.engine.InMemory() || !kv.tier.oversized(value) || !worthSpilling(value) {
+		return value
+	}
+	cold, err := kv.tier.spill(value)
+	if err != nil {
+		log.Printf("error spilling value: %v", err)
+		return value
+	}
+	return cold
+}
+
+// spillIdle spills the values which weren't read for the idle window among
+// the keys looked at, the scan runs under the read lock and the spills
+// check the value again under the write lock
+func (kv *KeyValueStore) spillIdle(now time.Time) (int, error) {
+	kv.mu.RLock()
+	window := kv.tier.setting.ColdAfter
+	if !kv.tier.enabled() || window <= 0 || !kv.engine.InMemory() {
+		kv.mu.RUnlock()
+		return 0, nil
+	}
+	var idle []string
+	scanned := 0
+	kv.engine.Iterate(func(key string, value *Value) bool {
+		scanned++
+		if worthSpilling(value) && value.IdleTime(now) >= window && !value.IsExpired(now) {
+			idle = append(idle, key)
+		}
+		return scanned < TIERING_SCAN_KEYS
+	})
+	kv.mu.RUnlock()
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	spilled := 0
+	for _, key := range idle {
+		// the key may have been read or written since the scan
+		value, ok := kv.engine.Get(key)
+		if !ok || !worthSpilling(value) || value.IdleTime(now) < window {
+			continue
+		}
+		if err := kv.spillLocked(key, value); err != nil {
+			return spilled, err
+		}
+		spilled++
+	}
+	return spilled, nil
+}
+
+// faultIn brings a spilled value which was read back into memory, unless it
+// is spilled for its size or the key changed since it was read
+func (kv *KeyValueStore) faultIn(key string, cold *Value, payload string) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if current, ok := kv.engine.Get(key); !ok || current != cold || kv.tier.oversized(cold) {
+		return
+	}
+	hot := *cold
+	hot.Value = payload
+	hot.cold = nil
+	if err := kv.engine.Put(key, &hot); err != nil {
+		log.Printf("error faulting in key: %v: %v", key, err)
+		return
+	}
+	kv.account(key, cold, -1)
+	kv.account(key, &hot, 1)
+	kv.tier.faults++
+}
+
+// movedValue is a payload copied to the new value file by a compaction
+type movedValue struct {
+	from *Value
+	ref  *coldRef
+}
+
+// compactValueFile rewrites the value file with only the payloads still in
+// use, once it holds at least VALUE_FILE_COMPACT_MIN_SIZE dead bytes and
+// more dead than live ones. The payloads are copied without the lock and
+// the keys are pointed at the copies under the write lock, the ones spilled
+// in the meantime are copied then. A dump or a snapshot transaction may
+// read the spilled payloads of the current file, while one is open the
+// compaction is left for a later pass
+func (kv *KeyValueStore) compactValueFile() error {
+	if !atomic.CompareAndSwapInt32(&kv.tier.compacting, 0, 1) {
+		return nil
+	}
+	defer atomic.StoreInt32(&kv.tier.compacting, 0)
+
+	kv.mu.RLock()
+	current, path := kv.tier.file, kv.tier.path
+	if current == nil || !kv.compactableLocked() {
+		kv.mu.RUnlock()
+		return nil
+	}
+	var cold []string
+	values := make(map[string]*Value)
+	kv.engine.Iterate(func(key string, value *Value) bool {
+		if value.cold != nil {
+			cold = append(cold, key)
+			values[key] = value
+		}
+		return true
+	})
+	kv.mu.RUnlock()
+
+	next, err := createValueFile(path + ".compact")
+	if err != nil {
+		return err
+	}
+	moved := make(map[string]movedValue, len(cold))
+	for _, key := range cold {
+		ref, err := copyPayload(values[key], next)
+		if err != nil {
+			next.remove()
+			return err
+		}
+		moved[key] = movedValue{from: values[key], ref: ref}
+	}
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.tier.file != current || !kv.compactableLocked() {
+		next.remove()
+		return nil
+	}
+	var updates []string
+	kv.engine.Iterate(func(key string, value *Value) bool {
+		if value.cold != nil {
+			updates = append(updates, key)
+			values[key] = value
+		}
+		return true
+	})
+	for _, key := range updates {
+		value := values[key]
+		ref := moved[key].ref
+		if moved[key].from != value {
+			// spilled again after the copy
+			if ref, err = copyPayload(value, next); err != nil {
+				next.remove()
+				return err
+			}
+		}
+		updated := *value
+		updated.cold = ref
+		if err := kv.engine.Put(key, &updated); err != nil {
+			// the keys moved so far read from next, which is kept open
+			return err
+		}
+	}
+	kv.tier.file = next
+	current.file.Close()
+	kv.tier.compactions++
+	if err := os.Rename(next.path, path); err != nil {
+		return err
+	}
+	next.path = path
+	return nil
+}
+
+// compactableLocked reports whether the value file is worth compacting and
+// nothing else may read it, the caller must hold the lock
+func (kv *KeyValueStore) compactableLocked() bool {
+	dead := kv.tier.file.size - kv.tier.coldBytes
+	return dead >= VALUE_FILE_COMPACT_MIN_SIZE && dead > kv.tier.coldBytes &&
+		atomic.LoadInt32(&kv.tier.pins) == 0 && len(kv.history) == 0
+}
+
+// copyPayload appends the spilled payload of the value to the file
+func copyPayload(value *Value, file *valueFile) (*coldRef, error) {
+	payload, err := value.payload()
+	if err != nil {
+		return nil, err
+	}
+	ref, err := file.append(payload)
+	if err != nil {
+		return nil, err
+	}
+	ref.rawSize = value.cold.rawSize
+	return ref, nil
+}
+
+// pinnedSnapshot keeps the value file from being compacted while a dump
+// reads the spilled payloads
+type pinnedSnapshot struct {
+	EngineSnapshot
+	tier *valueTier
+	once sync.Once
+}
+
+func (s *pinnedSnapshot) Release() {
+	s.once.Do(func() {
+		s.EngineSnapshot.Release()
+		atomic.AddInt32(&s.tier.pins, -1)
+	})
+}
+
+// snapshotLocked returns a snapshot of the engine, pinning the value file
+// if there is one. The caller must hold the lock
+func (kv *KeyValueStore) snapshotLocked() EngineSnapshot {
+	snapshot := kv.engine.Snapshot()
+	if kv.tier.file == nil {
+		return snapshot
+	}
+	atomic.AddInt32(&kv.tier.pins, 1)
+	return &pinnedSnapshot{EngineSnapshot: snapshot, tier: kv.tier}
+}
+
+// tieringStats returns the split of the keys, the caller must hold the lock
+func (kv *KeyValueStore) tieringStatsLocked() TieringStats {
+	stats := TieringStats{
+		ColdKeys:    kv.tier.coldKeys,
+		ColdBytes:   kv.tier.coldBytes,
+		Spills:      kv.tier.spills,
+		Faults:      kv.tier.faults,
+		Compactions: kv.tier.compactions,
+	}
+	if kv.engine.InMemory() {
+		stats.HotKeys = kv.engine.Len() - kv.tier.coldKeys
+	}
+	if kv.tier.file != nil {
+		stats.ValueFileBytes = kv.tier.file.size
+	}
+	return stats
+}
+
+// close removes the value file, the spilled payloads are restored from the
+// dump and the log on the next start
+func (t *valueTier) close() {
+	if t.file != nil {
+		t.file.remove()
+	}
+}
+
+func (cs *CollectionStore) tieringSettingLocked(collectionName string) TieringSetting {
+	if setting, ok := cs.tiering[collectionName]; ok {
+		return setting
+	}
+	return cs.tiering[DEFAULT_COLLECTION_SETTING]
+}
+
+// valueFilePathLocked returns the value file of the collection, next to the
+// storage engine directories. It is empty without a storage directory
+func (cs *CollectionStore) valueFilePathLocked(collectionName string) string {
+	if cs.storage.Dir == "" {
+		return ""
+	}
+	return filepath.Join(cs.storage.Dir, url.PathEscape(collectionName)+VALUE_FILE_SUFFIX)
+}
+
+// SetTiering sets the tiering per collection, "*" applies to every
+// collection without its own setting. Values are spilled to a value file
+// under the storage directory, so only a store with one is tiered. Spilled
+// values stay where they are until they are read
+func (cs *CollectionStore) SetTiering(settings map[string]TieringSetting) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	cs.tiering = settings
+	for collName, coll := range cs.collections {
+		coll.mu.Lock()
+		coll.tier.setting = cs.tieringSettingLocked(collName)
+		coll.tier.path = cs.valueFilePathLocked(collName)
+		coll.mu.Unlock()
+	}
+}
+
+// TierValues spills the idle values of every collection and compacts the
+// value files, it is called periodically
+func (cs *CollectionStore) TierValues(now time.Time) {
+	cs.mu.RLock()
+	collections := make(map[string]*KeyValueStore, len(cs.collections))
+	for collName, coll := range cs.collections {
+		collections[collName] = coll
+	}
+	cs.mu.RUnlock()
+
+	for collName, coll := range collections {
+		if _, err := coll.spillIdle(now); err != nil {
+			log.Printf("error spilling idle values of collection %v: %v", collName, err)
+		}
+		if err := coll.compactValueFile(); err != nil {
+			log.Printf("error compacting the value file of collection %v: %v", collName, err)
+		}
+	}
+}
@@ -2,99 +2,274 @@ package models
 
 import (
 	"errors"
-	"fmt"
-	"log"
-	"strings"
 	"sync"
+	"time"
 )
 
+var ErrNoSavepoint = errors.New("no such savepoint")
+
+// Mutation operations applied by a transaction
+const (
+	MUTATION_SET       = "SET"
+	MUTATION_DELETE    = "DELETE"
+	MUTATION_EXPIRE_AT = "EXPIREAT"
+)
+
+// Mutation is a single write buffered by a transaction
+type Mutation struct {
+	Op         string
+	Collection string
+	Key        string
+	Value      string    // value of a SET, compressed when Encoding is set
+	Encoding   string    // compression of Value, empty when raw
+	ExpireAt   time.Time // absolute expiration of an EXPIREAT
+}
+
+// pendingWrite is the state of a key as seen by the transaction
+type pendingWrite struct {
+	value    string
+	deleted  bool
+	hasValue bool // false when only the expiration was changed
+	expireAt time.Time
+}
+
+// undoRecord restores the state of a key in the transaction, previous is nil
+// when the transaction hadn't written the key yet
+type undoRecord struct {
+	collection string
+	key        string
+	previous   *pendingWrite
+}
+
+// savepoint marks the position of the transaction a ROLLBACK TO returns to
+type savepoint struct {
+	name    string
+	logs    int // length of the transaction log
+	undoLen int // length of the undo log
+}
+
+// TransactionalKeyValueStore is the transaction context of a single client,
+// writes are buffered until COMMIT applies them to the CollectionStore and
+// reads see the client's own writes first
 type TransactionalKeyValueStore struct {
-	data   map[string]*KeyValueStore
-	mutex  sync.Mutex
-	logger *TransactionLogger
+	data     map[string]map[string]*pendingWrite
+	mutex    sync.Mutex
+	logger   *TransactionLogger
+	snapshot uint64 // version the committed values are read at, 0 reads the latest
+
+	undo       []undoRecord // previous states of the keys, kept while there are savepoints
+	savepoints []savepoint  // open savepoints, oldest first
 }
 
+// TransactionLogger keeps the buffered writes in the order they were made
 type TransactionLogger struct {
-	logs []string
+	logs []Mutation
 }
 
 func NewTransactionalKeyValueStore() *TransactionalKeyValueStore {
 	return &TransactionalKeyValueStore{
-		data:   make(map[string]*KeyValueStore),
+		data:   make(map[string]map[string]*pendingWrite),
 		logger: &TransactionLogger{},
 	}
 }
 
-func (kv *TransactionalKeyValueStore) BeginTransaction() {
+func (kv *TransactionalKeyValueStore) reset() {
+	kv.data = make(map[string]map[string]*pendingWrite)
 	kv.logger.logs = nil // Clear transaction log
+	kv.snapshot = 0
+	kv.undo = nil
+	kv.savepoints = nil
 }
 
-func (kv *TransactionalKeyValueStore) ExecTransaction() {
-	kv.logger.logs = nil // Clear transaction log
+// BeginTransaction starts a new transaction, discarding anything buffered
+func (kv *TransactionalKeyValueStore) BeginTransaction() {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	kv.reset()
+}
+
+// UseSnapshot makes the transaction read the committed values as of the
+// snapshot, the caller ends the snapshot once the transaction is done
+func (kv *TransactionalKeyValueStore) UseSnapshot(snapshot uint64) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	kv.snapshot = snapshot
 }
 
+// Snapshot returns the snapshot of the transaction, 0 under read committed
+func (kv *TransactionalKeyValueStore) Snapshot() uint64 {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	return kv.snapshot
+}
+
+// ExecTransaction returns the buffered writes in order and clears the
+// transaction, the caller applies them to the CollectionStore
+func (kv *TransactionalKeyValueStore) ExecTransaction() []Mutation {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	mutations := kv.logger.logs
+	kv.reset()
+	return mutations
+}
+
+// RollbackTransaction discards the buffered writes
 func (kv *TransactionalKeyValueStore) RollbackTransaction() {
-	for i := len(kv.logger.logs) - 1; i >= 0; i-- {
-		log := kv.logger.logs[i]
-		parts := kv.parseLog(log)
-		if parts == nil {
-			continue
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	kv.reset()
+}
+
+func (kv *TransactionalKeyValueStore) pending(collection, key string) *pendingWrite {
+	coll, ok := kv.data[collection]
+	if !ok {
+		coll = make(map[string]*pendingWrite)
+		kv.data[collection] = coll
+	}
+	write, ok := coll[key]
+	if len(kv.savepoints) > 0 {
+		record := undoRecord{collection: collection, key: key}
+		if ok {
+			previous := *write
+			record.previous = &previous
 		}
-		collection := parts[1]
-		key := parts[2]
-		prevValue := parts[4]
-		kvStore := kv.data[collection]
-		kvStore.store[key] = NewKeyValue(prevValue)
+		kv.undo = append(kv.undo, record)
 	}
-	kv.logger.logs = nil // Clear transaction log
+	if !ok {
+		write = &pendingWrite{}
+		coll[key] = write
+	}
+	return write
+}
+
+// Savepoint marks the current position of the transaction, a savepoint with
+// the same name as an earlier one hides it until it is released
+func (kv *TransactionalKeyValueStore) Savepoint(name string) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	kv.savepoints = append(kv.savepoints, savepoint{name: name, logs: len(kv.logger.logs), undoLen: len(kv.undo)})
 }
 
-func (kv *TransactionalKeyValueStore) parseLog(log string) []string {
-	return strings.Split(log, " ")
+func (kv *TransactionalKeyValueStore) findSavepoint(name string) int {
+	for i := len(kv.savepoints) - 1; i >= 0; i-- {
+		if kv.savepoints[i].name == name {
+			return i
+		}
+	}
+	return -1
 }
 
-func (kv *TransactionalKeyValueStore) Set(collection, key, value string) {
+// RollbackToSavepoint undoes every write made after the savepoint, the
+// savepoint stays open and the later ones are removed
+func (kv *TransactionalKeyValueStore) RollbackToSavepoint(name string) error {
 	kv.mutex.Lock()
 	defer kv.mutex.Unlock()
 
-	/// get the previous value
-	prevKvStore, ok := kv.data[collection]
-	prevValue := ""
-	if ok {
-		log.Printf("prevKvStore: %v", prevKvStore.store)
-		kvStoreMap, ok := prevKvStore.store[key]
-		if ok {
-			prevValue = kvStoreMap.Value
+	i := kv.findSavepoint(name)
+	if i < 0 {
+		return ErrNoSavepoint
+	}
+	sp := kv.savepoints[i]
+	for j := len(kv.undo) - 1; j >= sp.undoLen; j-- {
+		record := kv.undo[j]
+		if record.previous == nil {
+			delete(kv.data[record.collection], record.key)
+		} else {
+			kv.data[record.collection][record.key] = record.previous
 		}
 	}
+	kv.undo = kv.undo[:sp.undoLen]
+	kv.logger.logs = kv.logger.logs[:sp.logs]
+	kv.savepoints = kv.savepoints[:i+1]
+	return nil
+}
 
-	/// set the new value
-	kvStore, ok := kv.data[collection]
-	if !ok {
-		log.Printf("creating new kvStore for collection: %s", collection)
-		kvStore = NewKeyValueStore()
-		kvStore.store[key] = NewKeyValue(value)
-	} else {
-		kvStore.store[key] = NewKeyValue(value)
+// ReleaseSavepoint removes the savepoint and the later ones, their writes
+// become part of the enclosing savepoint or of the transaction
+func (kv *TransactionalKeyValueStore) ReleaseSavepoint(name string) error {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	i := kv.findSavepoint(name)
+	if i < 0 {
+		return ErrNoSavepoint
+	}
+	kv.savepoints = kv.savepoints[:i]
+	if len(kv.savepoints) == 0 {
+		kv.undo = nil
 	}
-	kv.data[collection] = kvStore
-	log.Printf("kvStore: %v", kvStore.store)
-	kv.logger.logs = append(kv.logger.logs, fmt.Sprintf("SET %s %s %s %s", collection, key, value, prevValue))
+	return nil
+}
+
+// Set buffers a write of the key
+func (kv *TransactionalKeyValueStore) Set(collection, key, value string) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	write := kv.pending(collection, key)
+	*write = pendingWrite{value: value, hasValue: true}
+	kv.logger.logs = append(kv.logger.logs, Mutation{Op: MUTATION_SET, Collection: collection, Key: key, Value: value})
 }
 
-func (kv *TransactionalKeyValueStore) Get(collection, key string) (string, error) {
+// Delete buffers a delete of the key
+func (kv *TransactionalKeyValueStore) Delete(collection, key string) {
 	kv.mutex.Lock()
 	defer kv.mutex.Unlock()
 
-	colKv, ok := kv.data[collection]
+	write := kv.pending(collection, key)
+	*write = pendingWrite{deleted: true, hasValue: true}
+	kv.logger.logs = append(kv.logger.logs, Mutation{Op: MUTATION_DELETE, Collection: collection, Key: key})
+}
+
+// ExpireAt buffers an absolute expiration of the key
+func (kv *TransactionalKeyValueStore) ExpireAt(collection, key string, at time.Time) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	write := kv.pending(collection, key)
+	write.expireAt = at
+	kv.logger.logs = append(kv.logger.logs, Mutation{Op: MUTATION_EXPIRE_AT, Collection: collection, Key: key, ExpireAt: at})
+}
+
+// Get returns the value of the key as written by the transaction, ok is
+// false when the transaction didn't write the value of the key and the
+// committed value has to be read instead. A deleted or expired key reads
+// as an empty value
+func (kv *TransactionalKeyValueStore) Get(collection, key string) (string, bool) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+
+	coll, ok := kv.data[collection]
 	if !ok {
-		return "", errors.New("key not found in collection")
+		return "", false
 	}
-	log.Printf("colKv: %v", colKv)
-
-	value, ok := colKv.store[key]
+	write, ok := coll[key]
 	if !ok {
-		return "", errors.New("key not found")
+		return "", false
+	}
+	if write.deleted || (!write.expireAt.IsZero() && time.Now().After(write.expireAt)) {
+		return "", true
+	}
+	if !write.hasValue {
+		return "", false
+	}
+	return write.value, true
+}
+
+// HasWrites reports whether the transaction buffered any writes
+func (kv *TransactionalKeyValueStore) HasWrites() bool {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	return len(kv.logger.logs) > 0
+}
+
+// Collections returns the collections the transaction wrote to
+func (kv *TransactionalKeyValueStore) Collections() []string {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	collections := make([]string, 0, len(kv.data))
+	for collection := range kv.data {
+		collections = append(collections, collection)
 	}
-	return value.Value, nil
+	return collections
 }
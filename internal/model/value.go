@@ -1,22 +1,104 @@
 package models
 
 import (
+	"math/rand"
+	"sync/atomic"
 	"time"
 
 	"github.com/sk25469/kv/utils"
 )
 
+const (
+	// approximate bytes taken by a Value apart from the payload
+	VALUE_OVERHEAD = 64
+	// approximate bytes taken by a map entry apart from the key and the value
+	ENTRY_OVERHEAD = 48
+	// approximate bytes taken by the pointer to a value spilled to disk
+	COLD_REF_OVERHEAD = 40
+	// initial LFU counter so new keys aren't evicted right away
+	LFU_INIT_VAL = 5
+	// higher factor makes the logarithmic LFU counter saturate slower
+	LFU_LOG_FACTOR = 10
+)
+
 // Value represents a key-value pair
 type Value struct {
 	Value      string `json:"value"`
 	expiration time.Time
+	lastAccess int64    // unix nanos of the last access, updated atomically
+	frequency  int32    // logarithmic LFU counter, updated atomically
+	encoding   string   // compression algorithm of Value, empty when stored raw
+	version    uint64   // bumped on every modification of the key
+	cold       *coldRef // where the payload was spilled to, Value is empty then
 }
 
 func NewKeyValue(val string) *Value {
 	return &Value{
 		Value:      val,
 		expiration: utils.INFINITY,
+		lastAccess: time.Now().UnixNano(),
+		frequency:  LFU_INIT_VAL,
+	}
+}
+
+// NewEncodedKeyValue creates a value holding a payload compressed with the
+// encoding, see EncodeValue
+func NewEncodedKeyValue(payload, encoding string) *Value {
+	value := NewKeyValue(payload)
+	value.encoding = encoding
+	return value
+}
+
+// Version returns the modification version of the key
+func (kv *Value) Version() uint64 {
+	return kv.version
+}
+
+// Encoding returns the compression algorithm of the stored payload
+func (kv *Value) Encoding() string {
+	return kv.encoding
+}
+
+// Decode returns the value as the client wrote it
+func (kv *Value) Decode() (string, error) {
+	payload, err := kv.payload()
+	if err != nil {
+		return "", err
 	}
+	return DecodeValue(kv.encoding, payload)
+}
+
+// IsCold reports whether the payload was spilled to the value file
+func (kv *Value) IsCold() bool {
+	return kv.cold != nil
+}
+
+// payload returns the stored payload, read from the value file when it was
+// spilled
+func (kv *Value) payload() (string, error) {
+	if kv.cold == nil {
+		return kv.Value, nil
+	}
+	return kv.cold.read()
+}
+
+// storedSize returns the length of the stored payload, wherever it is kept
+func (kv *Value) storedSize() int64 {
+	if kv.cold != nil {
+		return kv.cold.length
+	}
+	return int64(len(kv.Value))
+}
+
+// RawSize returns the length of the value as the client wrote it
+func (kv *Value) RawSize() int64 {
+	if kv.cold != nil {
+		return kv.cold.rawSize
+	}
+	if kv.encoding == "" {
+		return int64(len(kv.Value))
+	}
+	return encodedRawSize(kv.Value)
 }
 
 func (kv *Value) SetExpiration(ttl time.Duration) {
@@ -24,6 +106,63 @@ func (kv *Value) SetExpiration(ttl time.Duration) {
 	kv.expiration = expiration
 }
 
+// SetExpirationAt sets an absolute expiration time, so the same deadline
+// survives restarts and replication regardless of when it is applied
+func (kv *Value) SetExpirationAt(at time.Time) {
+	kv.expiration = at
+}
+
 func (kv *Value) GetExpiration() time.Time {
 	return kv.expiration
 }
+
+// HasExpiration reports whether the value has a TTL attached
+func (kv *Value) HasExpiration() bool {
+	return kv.expiration.Before(utils.INFINITY)
+}
+
+// IsExpired reports whether the value is logically dead at the given time
+func (kv *Value) IsExpired(now time.Time) bool {
+	return now.After(kv.expiration)
+}
+
+// Size returns the approximate memory taken by the value, a spilled value
+// only keeps its pointer in memory
+func (kv *Value) Size() int64 {
+	if kv.cold != nil {
+		return COLD_REF_OVERHEAD + VALUE_OVERHEAD
+	}
+	return int64(len(kv.Value)) + VALUE_OVERHEAD
+}
+
+// Touch records an access, it is safe to call with only a read lock held
+func (kv *Value) Touch() {
+	atomic.StoreInt64(&kv.lastAccess, time.Now().UnixNano())
+
+	// logarithmic counter, the more accesses the less likely the increment
+	counter := atomic.LoadInt32(&kv.frequency)
+	if counter >= 255 {
+		return
+	}
+	base := float64(counter - LFU_INIT_VAL)
+	if base < 0 {
+		base = 0
+	}
+	if rand.Float64() < 1.0/(base*LFU_LOG_FACTOR+1) {
+		atomic.CompareAndSwapInt32(&kv.frequency, counter, counter+1)
+	}
+}
+
+// IdleTime returns the time since the last access
+func (kv *Value) IdleTime(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, atomic.LoadInt64(&kv.lastAccess)))
+}
+
+// Frequency returns the LFU counter decayed by one for every idle minute
+func (kv *Value) Frequency(now time.Time) int32 {
+	counter := atomic.LoadInt32(&kv.frequency) - int32(kv.IdleTime(now)/time.Minute)
+	if counter < 0 {
+		return 0
+	}
+	return counter
+}
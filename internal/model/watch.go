@@ -0,0 +1,161 @@
+package models
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var ErrWatchedKeyModified = errors.New("watched key modified")
+
+// versionClock hands out the modification versions of the keys
+type versionClock struct {
+	current uint64
+}
+
+func (c *versionClock) next() uint64 {
+	return atomic.AddUint64(&c.current, 1)
+}
+
+// advance moves the clock to at least the version
+func (c *versionClock) advance(version uint64) {
+	for {
+		current := atomic.LoadUint64(&c.current)
+		if current >= version || atomic.CompareAndSwapUint64(&c.current, current, version) {
+			return
+		}
+	}
+}
+
+// WatchedKey is the version of a key at the time it was watched
+type WatchedKey struct {
+	Collection string
+	Key        string
+	Version    uint64
+	Live       bool // the key existed and wasn't expired
+}
+
+// keyVersionLocked returns the version of the key and whether it is live,
+// the caller must hold the lock
+func (kv *KeyValueStore) keyVersionLocked(key string, now time.Time) (uint64, bool) {
+	if value, ok := kv.engine.Get(key); ok {
+		return value.version, !value.IsExpired(now)
+	}
+	return kv.tombstones[key], false
+}
+
+// KeyVersion returns the modification version of the key and whether it is
+// live, deleted keys keep a version only while they are watched or a
+// snapshot is open
+func (kv *KeyValueStore) KeyVersion(key string) (uint64, bool) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	return kv.keyVersionLocked(key, time.Now())
+}
+
+func (kv *KeyValueStore) watch(key string) WatchedKey {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.watched[key]++
+	version, live := kv.keyVersionLocked(key, time.Now())
+	return WatchedKey{Key: key, Version: version, Live: live}
+}
+
+func (kv *KeyValueStore) unwatch(key string) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.watched[key]--
+	if kv.watched[key] <= 0 {
+		delete(kv.watched, key)
+		// an open snapshot still compares against the tombstone, pruning the
+		// history drops it once none is open
+		if _, open := kv.snapshots.oldest(); !open {
+			delete(kv.tombstones, key)
+		}
+	}
+}
+
+// Watch records the current version of the key, the collection is created
+// so that a delete of the key leaves a version behind
+func (cs *CollectionStore) Watch(collectionName, key string) WatchedKey {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	watched := cs.getOrCreateCollectionLocked(collectionName).watch(key)
+	watched.Collection = collectionName
+	return watched
+}
+
+// Unwatch releases the watches
+func (cs *CollectionStore) Unwatch(watches []WatchedKey) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	for _, watched := range watches {
+		if coll, ok := cs.collections[watched.Collection]; ok {
+			coll.unwatch(watched.Key)
+		}
+	}
+}
+
+// watchedKeysChangedLocked reports whether any watched key was modified,
+// deleted or expired since it was watched, the caller must hold the lock
+func (cs *CollectionStore) watchedKeysChangedLocked(watches []WatchedKey) bool {
+	now := time.Now()
+	for _, watched := range watches {
+		var version uint64
+		var live bool
+		if coll, ok := cs.collections[watched.Collection]; ok {
+			coll.mu.RLock()
+			version, live = coll.keyVersionLocked(watched.Key, now)
+			coll.mu.RUnlock()
+		}
+		if version != watched.Version || live != watched.Live {
+			return true
+		}
+	}
+	return false
+}
+
+// WatchedKeysChanged reports whether any watched key was modified, deleted
+// or expired since it was watched
+func (cs *CollectionStore) WatchedKeysChanged(watches []WatchedKey) bool {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	return cs.watchedKeysChangedLocked(watches)
+}
+
+// KeyState is the state of a key as compared by a conditional transaction,
+// a missing or expired key has version 0
+type KeyState struct {
+	Value    string
+	Version  uint64
+	Exists   bool
+	ExpireAt time.Time // zero when the key has no expiration
+}
+
+// GetKeyState returns the value, version and expiration of the key
+func (cs *CollectionStore) GetKeyState(collectionName, key string) KeyState {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	coll, ok := cs.collections[collectionName]
+	if !ok {
+		return KeyState{}
+	}
+	coll.mu.RLock()
+	defer coll.mu.RUnlock()
+	entry, ok := coll.engine.Get(key)
+	if !ok || entry.IsExpired(time.Now()) {
+		return KeyState{}
+	}
+	value, err := entry.Decode()
+	if err != nil {
+		return KeyState{}
+	}
+	state := KeyState{Value: value, Version: entry.version, Exists: true}
+	if entry.HasExpiration() {
+		state.ExpireAt = entry.GetExpiration()
+	}
+	return state
+}
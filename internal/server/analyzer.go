@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	models "github.com/sk25469/kv/internal/model"
+)
+
+// value size histogram buckets, the last bucket holds everything bigger
+var histogramBuckets = []int64{64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20}
+
+// AnalyzeSnapshot loads a snapshot file into a fresh store without starting
+// a server and reports the biggest keys, the biggest collections and the
+// value size histogram
+func AnalyzeSnapshot(snapshotPath string, top int, w io.Writer) error {
+	cs := models.NewCollectionStore()
+	records, err := loadSnapshot(snapshotPath, cs, false)
+	if err != nil {
+		return err
+	}
+
+	var keys []models.KeyMemory
+	histogram := make([]int, len(histogramBuckets)+1)
+	cs.ScanKeyMemory(func(km models.KeyMemory) {
+		keys = append(keys, km)
+		bucket := sort.Search(len(histogramBuckets), func(i int) bool {
+			return km.ValueSize < histogramBuckets[i]
+		})
+		histogram[bucket]++
+	})
+
+	stats := cs.MemoryStats()
+	fmt.Fprintf(w, "snapshot: %v\n", snapshotPath)
+	fmt.Fprintf(w, "commands: %v, keys: %v, collections: %v\n", records, stats.Keys, len(stats.CollectionBreakdown))
+	fmt.Fprintf(w, "used memory: %v bytes, dataset: %v bytes, overhead: %v bytes\n\n", stats.UsedMemory, stats.Dataset, stats.Overhead)
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Size > keys[j].Size })
+	fmt.Fprintf(w, "biggest keys:\n")
+	for i := 0; i < len(keys) && i < top; i++ {
+		fmt.Fprintf(w, "  %10d bytes  %v:%v\n", keys[i].Size, keys[i].Collection, keys[i].Key)
+	}
+
+	collNames := make([]string, 0, len(stats.CollectionBreakdown))
+	for collName := range stats.CollectionBreakdown {
+		collNames = append(collNames, collName)
+	}
+	sort.Slice(collNames, func(i, j int) bool {
+		return stats.CollectionBreakdown[collNames[i]].UsedBytes > stats.CollectionBreakdown[collNames[j]].UsedBytes
+	})
+	fmt.Fprintf(w, "\nbiggest collections:\n")
+	for i := 0; i < len(collNames) && i < top; i++ {
+		collStats := stats.CollectionBreakdown[collNames[i]]
+		fmt.Fprintf(w, "  %10d bytes  %8d keys  %v\n", collStats.UsedBytes, collStats.Keys, collNames[i])
+	}
+
+	fmt.Fprintf(w, "\nvalue size histogram:\n")
+	for i, count := range histogram {
+		label := fmt.Sprintf(">= %d", histogramBuckets[len(histogramBuckets)-1])
+		if i < len(histogramBuckets) {
+			label = fmt.Sprintf("< %d", histogramBuckets[i])
+		}
+		fmt.Fprintf(w, "  %12v bytes  %v\n", label, count)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"encoding/base64"
 	"fmt"
 	"log"
 	"strings"
@@ -15,6 +16,19 @@ type Command struct {
 	CollectionName string
 	Args           []string // Arguments of the command
 	Result         string   // Result of the command execution
+	// compression of the value of a SET, the value is then base64 encoded
+	Encoding string `json:",omitempty"`
+	// commands of a committed transaction, applied as one unit
+	Batch []Command `json:",omitempty"`
+	// transaction a framed record in the snapshot belongs to
+	TxID string `json:",omitempty"`
+	// lease a SET attaches its key to, given as a trailing LEASE <id>
+	Lease int64 `json:",omitempty"`
+	// client which issued a logged mutation, for auditing
+	Client string `json:",omitempty"`
+	// unix time in milliseconds the record was logged at, 0 for records
+	// logged before records were timestamped
+	Time int64 `json:",omitempty"`
 }
 
 // ParseCommand parses a raw command string into a Command struct
@@ -45,8 +59,111 @@ func ParseCommand(rawCommand string) *Command {
 	return cmd
 }
 
-// ExecuteCommand executes a command and returns the result
-func ExecuteCommand(cmd *Command, cs *models.CollectionStore, ts *models.TransactionalKeyValueStore, cc *models.ClientConfig, kv *models.KVServer, ps *models.PubSub) string {
+// ResolveCommand turns a client command into the form which gets logged and
+// replicated: relative expirations become absolute and values of compressed
+// collections are compressed once, here, instead of on every replay
+func ResolveCommand(cmd *Command, cs *models.CollectionStore) *Command {
+	cmd = ResolveExpiration(cmd)
+	cmd = resolveLease(cmd)
+	if cmd.Name != utils.SET || cmd.Encoding != "" || len(cmd.Args) < 2 {
+		return cmd
+	}
+	encoding, payload := cs.EncodeValue(cmd.CollectionName, strings.Join(cmd.Args[1:], " "))
+	if encoding == "" {
+		return cmd
+	}
+	return &Command{
+		Name:           cmd.Name,
+		CollectionName: cmd.CollectionName,
+		Args:           []string{cmd.Args[0], base64.StdEncoding.EncodeToString([]byte(payload))},
+		Encoding:       encoding,
+		Lease:          cmd.Lease,
+	}
+}
+
+// ExecuteCommand executes a command and returns the result, between MULTI
+// and EXEC the command is queued instead
+func ExecuteCommand(cmd *Command, cs *models.CollectionStore, cc *models.ClientConfig, kv *models.KVServer, ps *models.PubSub) string {
+	switch cmd.Name {
+	case utils.MULTI, utils.EXEC, utils.DISCARD:
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return "unauthorized"
+		}
+		return handleMultiCommand(cmd, cs, cc, kv, ps, "")
+	case utils.TXN:
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return "unauthorized"
+		}
+		return executeTxn(cmd, cs, cc, kv, ps, "")
+	case utils.LOCK:
+		// ACQUIRE may block, the lock manager holds the execution lock only
+		// while it changes a lock and logs the change
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return "unauthorized"
+		}
+		if cc.ClientState.State == utils.QUEUEING {
+			// a lock can't be queued, so the queue is rejected
+			return queueCommand(cmd, cc)
+		}
+		return handleLockCommand(cmd, cs, kv)
+	case utils.WATCH, utils.UNWATCH:
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return "unauthorized"
+		}
+		return handleWatchCommand(cmd, cs, cc)
+	}
+	if cc.ClientState.State == utils.QUEUEING {
+		return queueCommand(cmd, cc)
+	}
+
+	defer lockCommand(cmd, cs)()
+	return executeCommand(cmd, cs, cc, kv, ps)
+}
+
+// lockCommand takes the shared execution lock and the shared locks of the
+// collections the command touches, the returned function releases them
+func lockCommand(cmd *Command, cs *models.CollectionStore) func() {
+	cs.LockShared()
+	unlock := cs.LockCollections(commandCollections(cmd, cs), false)
+	return func() {
+		unlock()
+		cs.UnlockShared()
+	}
+}
+
+// commandCollections returns the collections the command reads or writes,
+// a command which may touch a key of any collection gets all of them
+func commandCollections(cmd *Command, cs *models.CollectionStore) []string {
+	switch {
+	case cmd.Name == "SHOWALL", cmd.Name == utils.COMMIT_PREPARED, cmd.Name == utils.LEASE_REVOKED:
+		return cs.CollectionNames()
+	case cmd.Name == utils.LEASE && strings.EqualFold(cmd.CollectionName, "REVOKE"):
+		return cs.CollectionNames()
+	case cmd.Name == utils.BATCH:
+		collections := make([]string, 0, len(cmd.Batch))
+		for _, op := range cmd.Batch {
+			collections = append(collections, op.CollectionName)
+		}
+		return collections
+	case cmd.Name == utils.EXPIRED, cmd.Name == utils.EVICTED:
+		return []string{cmd.CollectionName}
+	}
+	if _, ok := queueableCommands[cmd.Name]; ok {
+		return []string{cmd.CollectionName}
+	}
+	return nil
+}
+
+// executeCommand executes a single command, the caller holds the shared or
+// the exclusive execution lock
+func executeCommand(cmd *Command, cs *models.CollectionStore, cc *models.ClientConfig, kv *models.KVServer, ps *models.PubSub) string {
+	// inside a transaction writes are buffered and reads see them
+	if cc.ClientState.State == utils.TRANSACTIONAL {
+		if result, ok := executeInTransaction(cmd, cs, cc, kv); ok {
+			return result
+		}
+	}
+
 	switch cmd.Name {
 	case "AUTH":
 		if !kv.Config.ProtectedMode {
@@ -67,23 +184,46 @@ func ExecuteCommand(cmd *Command, cs *models.CollectionStore, ts *models.Transac
 		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
 			return "unauthorized"
 		}
-		ts.BeginTransaction()
+		isolation := models.ISOLATION_SNAPSHOT
+		if cmd.CollectionName != "" {
+			var err error
+			if !strings.EqualFold(cmd.CollectionName, "ISOLATION") || len(cmd.Args) < 1 {
+				return "Usage: BEGIN [ISOLATION <SNAPSHOT|READ COMMITTED>]"
+			}
+			if isolation, err = models.ParseIsolationLevel(cmd.Args); err != nil {
+				return fmt.Sprintf("ERROR: %v", err)
+			}
+		}
+		endSnapshot(cs, cc)
+		cc.Transaction.BeginTransaction()
+		if isolation == models.ISOLATION_SNAPSHOT {
+			cc.Transaction.UseSnapshot(cs.BeginSnapshot())
+		}
 		cc.ClientState.State = utils.TRANSACTIONAL
 		return "OK"
 	case "COMMIT":
 		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
 			return "unauthorized"
 		}
-		ts.ExecTransaction()
-		cc.ClientState.State = utils.ACTIVE
-		return "OK"
+		result, _ := commitTransaction(cs, cc, kv)
+		return result
 	case "ROLLBACK":
 		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
 			return "unauthorized"
 		}
-		ts.RollbackTransaction()
+		if cmd.CollectionName != "" {
+			return rollbackToSavepoint(cmd, cc)
+		}
+		endSnapshot(cs, cc)
+		cc.Transaction.RollbackTransaction()
 		cc.ClientState.State = utils.ACTIVE
+		releaseWatches(cs, cc)
 		return "OK"
+	case utils.SAVEPOINT, utils.RELEASE:
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return "unauthorized"
+		}
+		return handleSavepoint(cmd, cc)
 	case "TSET":
 		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
 			return "unauthorized"
@@ -97,7 +237,7 @@ func ExecuteCommand(cmd *Command, cs *models.CollectionStore, ts *models.Transac
 		key := cmd.Args[0]
 		collectionName := cmd.CollectionName
 		value := strings.Join(cmd.Args[1:], " ")
-		ts.Set(collectionName, key, value)
+		cc.Transaction.Set(collectionName, key, value)
 		return "OK"
 	case "TGET":
 		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
@@ -107,32 +247,111 @@ func ExecuteCommand(cmd *Command, cs *models.CollectionStore, ts *models.Transac
 			return "ERROR: Transaction not started"
 		}
 		if len(cmd.Args) < 1 {
-			return "Usage: TSET <collection_name> <key> <value>"
+			return "Usage: TGET <collection_name> <key>"
 		}
-		key := cmd.Args[0]
-		collectionName := cmd.CollectionName
-		val, err := ts.Get(collectionName, key)
+		return readInTransaction(cs, cc, cmd.CollectionName, cmd.Args[0])
+	case "BATCH":
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return "unauthorized"
+		}
+		mutations, err := batchToMutations(cmd.Batch)
 		if err != nil {
-			log.Printf("error getting key from transaction: %v", err)
-			return "ERROR"
+			log.Printf("invalid batch: %v", err)
+			return fmt.Sprintf("ERROR: %v", err)
+		}
+		if err := cs.ApplyBatch(mutations, models.BatchOptions{Reserve: kv.Config.IsMaster}); err != nil {
+			return fmt.Sprintf("ERROR: %v", err)
+		}
+		return "OK"
+	case utils.PREPARE, utils.COMMIT_PREPARED, utils.ABORT_PREPARED:
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return "unauthorized"
 		}
-		return val
+		result, _ := executePrepared(cmd, cs, kv)
+		return result
+	case utils.PREPARED:
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return "unauthorized"
+		}
+		return listPrepared(cs)
+	case utils.LOCK_GRANTED, utils.LOCK_RELEASED:
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return "unauthorized"
+		}
+		return applyLockRecord(cmd, cs)
+	case utils.LEASE:
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return "unauthorized"
+		}
+		result, _ := executeLease(cmd, cs, kv)
+		return result
+	case utils.LEASE_GRANTED, utils.LEASE_REVOKED:
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return "unauthorized"
+		}
+		return applyLeaseRecord(cmd, cs)
 	case "SET-TTL":
 		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
 			return "unauthorized"
 		}
-		if len(cmd.Args) < 1 {
+		if len(cmd.Args) < 2 {
 			return "Usage: SET-TTL <collection> <key> <ttl>"
 		}
 		key := cmd.Args[0]
 		collectionName := cmd.CollectionName
+		if cs.KeyLocked(collectionName, key) {
+			return fmt.Sprintf("ERROR: %v", models.ErrKeyLocked)
+		}
 		ttl := cmd.Args[1]
 		duration, err := utils.ParseDuration(ttl)
 		if err != nil {
 			log.Printf("invalid time format: %v", err)
 			return "Usage: SET-TTL <collection> <key> <ttl (xm xhxm xxs)>"
 		}
-		cs.UpdateKeyInCollectionWithTTL(collectionName, key, duration)
+		if !cs.UpdateKeyInCollectionWithTTL(collectionName, key, duration) {
+			return "ERROR: key not found"
+		}
+		return "OK"
+	case "EXPIREAT":
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return "unauthorized"
+		}
+		if len(cmd.Args) < 2 {
+			return "Usage: EXPIREAT <collection> <key> <unix-time-ms>"
+		}
+		key := cmd.Args[0]
+		collectionName := cmd.CollectionName
+		if cs.KeyLocked(collectionName, key) {
+			return fmt.Sprintf("ERROR: %v", models.ErrKeyLocked)
+		}
+		at, err := parseExpireAt(cmd.Args[1])
+		if err != nil {
+			log.Printf("invalid expiration: %v", err)
+			return "Usage: EXPIREAT <collection> <key> <unix-time-ms>"
+		}
+		if !cs.UpdateKeyInCollectionWithExpiration(collectionName, key, at) {
+			return "ERROR: key not found"
+		}
+		return "OK"
+	case "EVICTED":
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return "unauthorized"
+		}
+		if len(cmd.Args) < 1 {
+			return "Usage: EVICTED <collection> <key>"
+		}
+		// eviction decided by the master, replicas delete unconditionally
+		cs.EvictKeyInCollection(cmd.CollectionName, cmd.Args[0])
+		return "OK"
+	case "EXPIRED":
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return "unauthorized"
+		}
+		if len(cmd.Args) < 1 {
+			return "Usage: EXPIRED <collection> <key>"
+		}
+		// expiry decided by the master, replicas delete unconditionally
+		cs.ExpireKeyInCollection(cmd.CollectionName, cmd.Args[0])
 		return "OK"
 	case "SET":
 		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
@@ -143,9 +362,39 @@ func ExecuteCommand(cmd *Command, cs *models.CollectionStore, ts *models.Transac
 		}
 		key := cmd.Args[0]
 		collectionName := cmd.CollectionName
+		if cs.KeyLocked(collectionName, key) {
+			return fmt.Sprintf("ERROR: %v", models.ErrKeyLocked)
+		}
 		value := strings.Join(cmd.Args[1:], " ")
-		cs.SetKeyInCollection(collectionName, key, value)
+		if cmd.Encoding != "" {
+			payload, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				log.Printf("invalid encoded value: %v", err)
+				return "ERROR: invalid encoded value"
+			}
+			value = string(payload)
+		}
+		// only the master evicts, replicas apply the evictions it replicates
+		if kv.Config.IsMaster {
+			if err := cs.ReserveMemory(collectionName, key, value); err != nil {
+				return fmt.Sprintf("ERROR: %v", err)
+			}
+		}
+		if cmd.Lease != 0 {
+			if err := cs.SetKeyInCollectionWithLease(collectionName, key, cmd.Encoding, value, cmd.Lease); err != nil {
+				return fmt.Sprintf("ERROR: %v", err)
+			}
+		} else if cmd.Encoding != "" {
+			cs.SetEncodedKeyInCollection(collectionName, key, cmd.Encoding, value)
+		} else {
+			cs.SetKeyInCollection(collectionName, key, value)
+		}
 		return "OK"
+	case utils.INCR, utils.INCRBY:
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return "unauthorized"
+		}
+		return executeIncrement(cmd, cs)
 	case "GET":
 		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
 			return "unauthorized"
@@ -177,6 +426,11 @@ func ExecuteCommand(cmd *Command, cs *models.CollectionStore, ts *models.Transac
 			log.Printf("error converting to json: %v", err)
 		}
 		return jsonString
+	case "MEMORY":
+		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+			return "unauthorized"
+		}
+		return handleMemoryCommand(cmd, cs)
 	case "DELETE":
 		if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
 			return "unauthorized"
@@ -186,6 +440,9 @@ func ExecuteCommand(cmd *Command, cs *models.CollectionStore, ts *models.Transac
 		}
 		key := cmd.Args[0]
 		collectionName := cmd.CollectionName
+		if cs.KeyLocked(collectionName, key) {
+			return fmt.Sprintf("ERROR: %v", models.ErrKeyLocked)
+		}
 		cs.DeleteKeyInCollection(collectionName, key)
 		return "OK"
 	default:
@@ -193,8 +450,22 @@ func ExecuteCommand(cmd *Command, cs *models.CollectionStore, ts *models.Transac
 	}
 }
 
+// internalRecords are the records the server writes to the snapshot on
+// its own, replay and the replicas apply them but a client can't send them
+var internalRecords = map[string]bool{
+	utils.EXPIRED:       true,
+	utils.EVICTED:       true,
+	utils.BATCH:         true,
+	utils.LOCK_GRANTED:  true,
+	utils.LOCK_RELEASED: true,
+	utils.LEASE_GRANTED: true,
+	utils.LEASE_REVOKED: true,
+}
+
+// ShouldWriteLog reports whether the command changes the store, those are
+// logged once they succeed. Reads and pub/sub are never logged
 func ShouldWriteLog(cmd Command) bool {
-	if cmd.Name == utils.SET || cmd.Name == utils.DEL || cmd.Name == utils.SET_TTL || cmd.Name == utils.SUBSCRIBE || cmd.Name == utils.PUBLISH {
+	if cmd.Name == utils.SET || cmd.Name == utils.DEL || cmd.Name == utils.SET_TTL || cmd.Name == utils.EXPIRE_AT || cmd.Name == utils.INCR || cmd.Name == utils.INCRBY {
 		return true
 	}
 	return false
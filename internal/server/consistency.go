@@ -3,6 +3,7 @@ package server
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -12,7 +13,7 @@ import (
 	models "github.com/sk25469/kv/internal/model"
 )
 
-func WatchSnapshotAndUpdate(file string, cs *models.CollectionStore, ts *models.TransactionalKeyValueStore, kvServer *models.KVServer, ps *models.PubSub) {
+func WatchSnapshotAndUpdate(file string, cs *models.CollectionStore, kvServer *models.KVServer, ps *models.PubSub) {
 	// Initialize the file watcher
 	err := waitUntilFind(file)
 	if err != nil {
@@ -32,7 +33,7 @@ func WatchSnapshotAndUpdate(file string, cs *models.CollectionStore, ts *models.
 
 	errCh := make(chan error)
 
-	go handleFileEvent(watcher, file, errCh, cs, ts, kvServer, ps)
+	go handleFileEvent(watcher, file, errCh, cs, kvServer, ps)
 	<-errCh
 
 }
@@ -53,57 +54,173 @@ func waitUntilFind(filename string) error {
 	return nil
 }
 
-func handleFileEvent(watcher *fsnotify.Watcher, file string, errCh chan error, cs *models.CollectionStore, ts *models.TransactionalKeyValueStore, kvServer *models.KVServer, ps *models.PubSub) {
-	var lastPosition int64 = 0 // Keep track of the last read position
+func handleFileEvent(watcher *fsnotify.Watcher, file string, errCh chan error, cs *models.CollectionStore, kvServer *models.KVServer, ps *models.PubSub) {
+	tail, err := openLogTail(file)
+	if err != nil {
+		errCh <- err
+		return
+	}
+	defer tail.file.Close()
 	absFilePath, _ := filepath.Abs(file)
 	log.Printf("Absolute path being watched: %s", absFilePath)
+
+	apply := func(record Command) {
+		// the master executes the commands it logs itself
+		if kvServer.Config.IsMaster {
+			return
+		}
+		// a framed transaction is applied once all of it has been read
+		if cmd := tail.assembler.add(record); cmd != nil {
+			result := replicateCommand(cmd, cs, kvServer, ps)
+			log.Printf("result for replication: %v -------- %v", cmd, result)
+		}
+	}
+
+	// sealing a segment renames the log and starts a new file, which may not
+	// show up as an event on the watched file, so the log is also checked
+	// periodically
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
 		select {
-		case event := <-watcher.Events:
-			if event.Op&fsnotify.Write == fsnotify.Write {
-				file, err := os.Open(file)
-				if err != nil {
-					fmt.Println("Error opening filepath:", err)
-					continue
-				}
-
-				// Seek to the last known position before reading new entries
-				_, err = file.Seek(lastPosition, 0)
-				if err != nil {
-					fmt.Println("Error seeking file:", err)
-					file.Close()
-					continue
-				}
-
-				// Read new entries from the current position
-				lastEntry := ""
-				scanner := bufio.NewScanner(file)
-				for scanner.Scan() {
-					newEntry := scanner.Text()
-					// fmt.Println("New Entry:", newEntry)
-					lastEntry = newEntry
-					// Here, you would process/store the new entry as needed
-				}
-
-				// Update the last known position
-				lastPosition, err = file.Seek(0, 1) // 1 means current position
-				if err != nil {
-					fmt.Println("Error updating last position:", err)
-				}
-
-				if err := scanner.Err(); err != nil {
-					fmt.Println("Scanner Error:", err)
-				}
-
-				log.Printf("Last Entry: %s", lastEntry)
-				result := ReplicateChanges(lastEntry, cs, ts, kvServer, ps)
-				log.Printf("result for replication: %v -------- %v", lastEntry, result)
-
-				file.Close()
-			}
+		case <-watcher.Events:
+		case <-ticker.C:
 		case err := <-watcher.Errors:
 			log.Printf("Error: %v", err)
 			errCh <- err
+			return
+		}
+		tail.read(apply)
+		if swapped, err := tail.follow(apply); err != nil {
+			log.Printf("error following the new segment of %v: %v", file, err)
+		} else if swapped {
+			if err := watcher.Add(file); err != nil {
+				log.Printf("error watching the new segment of %v: %v", file, err)
+			}
+			tail.read(apply)
+		}
+	}
+}
+
+// logTail reads the records appended to the snapshot log. It keeps the
+// active segment open, so once it is sealed it can still read the end of it
+// before it continues in the new one. seq is the last record read, records
+// at or before it were already applied
+type logTail struct {
+	path      string
+	file      *os.File
+	position  int64
+	seq       uint64
+	assembler txAssembler
+}
+
+// openLogTail starts at the end of the log, everything written before was
+// applied by handleInitLoad
+func openLogTail(path string) (*logTail, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	t := &logTail{path: path, file: file, position: info.Size()}
+	if manifest, err := readManifest(path); err == nil {
+		t.seq = manifest.lastSeq()
+	}
+	_ = readLog(path, 0, func(cmd Command, seq uint64) {
+		if next := nextSequence(cmd, seq); next != 0 {
+			t.seq = next
+		}
+	})
+	return t, nil
+}
+
+// read applies every complete record after the position, a single write
+// event can carry several of them. A line without its newline is still
+// being written and is read again the next time
+func (t *logTail) read(apply func(Command)) {
+	t.position = t.readFrom(t.file, t.position, apply)
+}
+
+// readFrom applies the records of the file after the position and returns
+// the position after the last complete one
+func (t *logTail) readFrom(file *os.File, position int64, apply func(Command)) int64 {
+	if _, err := file.Seek(position, io.SeekStart); err != nil {
+		fmt.Println("Error seeking file:", err)
+		return position
+	}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := readLine(reader)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Println("Error reading file:", err)
+			}
+			return position
+		}
+		position += int64(len(line))
+
+		record, seq, err := parseRecord(line)
+		if err != nil {
+			log.Printf("skipping invalid record at offset %v of %v: %v", position-int64(len(line)), file.Name(), err)
+			continue
+		}
+		// the compacted records of a rewritten log hold the state the tail
+		// already applied record by record
+		if seq == 0 && line[0] != '{' {
+			continue
+		}
+		if seq != 0 {
+			if seq <= t.seq {
+				continue
+			}
+			t.seq = nextSequence(record, seq)
+		}
+		apply(record)
+	}
+}
+
+// follow switches to the new active segment once the one it reads was
+// sealed or rewritten. It reads the rest of the old file, then the segments
+// sealed since then, in case several were sealed in between, and continues
+// at the start of the new file
+func (t *logTail) follow(apply func(Command)) (bool, error) {
+	current, err := t.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	latest, err := os.Stat(t.path)
+	if err != nil || os.SameFile(current, latest) {
+		return false, nil
+	}
+
+	// nothing is appended to a segment once it was sealed
+	t.read(apply)
+	file, err := os.Open(t.path)
+	if err != nil {
+		return false, err
+	}
+	manifest, err := readManifest(t.path)
+	if err != nil {
+		file.Close()
+		return false, err
+	}
+	for _, segment := range manifest.Segments {
+		if segment.LastSeq <= t.seq {
+			continue
+		}
+		sealed, err := os.Open(segmentPath(t.path, segment.ID))
+		if err != nil {
+			log.Printf("error reading segment %v of %v: %v", segment.ID, t.path, err)
+			continue
 		}
+		t.readFrom(sealed, 0, apply)
+		sealed.Close()
 	}
+	t.file.Close()
+	t.file, t.position = file, 0
+	return true, nil
 }
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/utils"
+)
+
+// States of a distributed transaction in the decision log of the coordinator
+const (
+	TX_STARTED   = "started"
+	TX_COMMITTED = "committed"
+	TX_ABORTED   = "aborted"
+	TX_DONE      = "done"
+)
+
+// decisionRecord is a line of the decision log, the participants are the
+// addresses of the shard masters taking part in the transaction
+type decisionRecord struct {
+	TxID         string
+	State        string
+	Participants []string `json:",omitempty"`
+}
+
+// SendFunc sends a command to the node at the address and returns its reply
+type SendFunc func(command, address string) (string, error)
+
+// Coordinator runs two-phase commit across the shard masters. Every step is
+// written to the decision log first, so after a crash Recover can tell the
+// participants the outcome of the transactions they prepared
+type Coordinator struct {
+	logPath string
+	send    SendFunc
+	mu      sync.Mutex // serializes writes to the decision log
+}
+
+func NewCoordinator(logPath string, send SendFunc) *Coordinator {
+	// the decision log is small and read whole on recovery, it is never
+	// split into segments
+	SetLogSegments(logPath, models.LogSegmentConfig{})
+	return &Coordinator{logPath: logPath, send: send}
+}
+
+func (c *Coordinator) record(txID, state string, participants []string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return appendRecord(c.logPath, decisionRecord{TxID: txID, State: state, Participants: participants}, true)
+}
+
+// Execute runs the commands of a transaction, grouped by the address of the
+// shard master owning their keys, as a single atomic unit
+func (c *Coordinator) Execute(ops map[string][]string) string {
+	participants := make([]string, 0, len(ops))
+	for address := range ops {
+		participants = append(participants, address)
+	}
+	sort.Strings(participants)
+
+	txID := utils.GenerateBase64ClientID()
+	if err := c.record(txID, TX_STARTED, participants); err != nil {
+		log.Printf("error writing to the decision log: %v", err)
+		return fmt.Sprintf("ERROR: %v", err)
+	}
+
+	// phase one, every participant locks its keys and logs its vote
+	var failure string
+	for _, address := range participants {
+		reply, err := c.send(fmt.Sprintf("%s %s %s", utils.PREPARE, txID, strings.Join(ops[address], " ; ")), address)
+		if err != nil {
+			failure = err.Error()
+			break
+		}
+		if reply = strings.TrimSpace(reply); reply != "OK" {
+			failure = reply
+			break
+		}
+	}
+
+	// the decision is durable before any participant learns about it
+	decision := TX_COMMITTED
+	if failure != "" {
+		decision = TX_ABORTED
+	}
+	if err := c.record(txID, decision, nil); err != nil {
+		log.Printf("error writing to the decision log: %v", err)
+		if decision == TX_COMMITTED {
+			// without a logged decision recovery would abort, so abort now
+			decision, failure = TX_ABORTED, err.Error()
+		}
+	}
+
+	// phase two, a participant which doesn't acknowledge is resolved by Recover
+	c.resolve(txID, decision, participants)
+	if decision == TX_ABORTED {
+		return fmt.Sprintf("ABORTED: %v", failure)
+	}
+	return "OK"
+}
+
+// resolve sends the decision to the participants and marks the transaction
+// done once all of them acknowledged it
+func (c *Coordinator) resolve(txID, decision string, participants []string) bool {
+	command := utils.COMMIT_PREPARED
+	if decision != TX_COMMITTED {
+		command = utils.ABORT_PREPARED
+	}
+	acknowledged := true
+	for _, address := range participants {
+		reply, err := c.send(fmt.Sprintf("%s %s", command, txID), address)
+		reply = strings.TrimSpace(reply)
+		// a participant which never prepared the transaction has nothing to do
+		if err != nil || (reply != "OK" && !strings.Contains(reply, "unknown prepared transaction")) {
+			log.Printf("%v of %v not acknowledged by %v: %v %v", command, txID, address, reply, err)
+			acknowledged = false
+		}
+	}
+	if acknowledged {
+		if err := c.record(txID, TX_DONE, nil); err != nil {
+			log.Printf("error writing to the decision log: %v", err)
+		}
+	}
+	return acknowledged
+}
+
+// readDecisions returns the last state and the participants of every
+// transaction in the decision log, a log sealed into segments is read in
+// the order of its segments
+func (c *Coordinator) readDecisions() (map[string]*decisionRecord, error) {
+	manifest, err := readManifest(c.logPath)
+	if err != nil {
+		return nil, err
+	}
+	decisions := make(map[string]*decisionRecord)
+	for _, segment := range manifest.Segments {
+		if err := readDecisionFile(segmentPath(c.logPath, segment.ID), decisions); err != nil {
+			return nil, err
+		}
+	}
+	if err := readDecisionFile(c.logPath, decisions); err != nil {
+		return nil, err
+	}
+	return decisions, nil
+}
+
+func readDecisionFile(path string, decisions map[string]*decisionRecord) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := readLine(reader)
+		if len(line) == 0 {
+			if err == io.EOF {
+				err = nil
+			}
+			return err
+		}
+		var record decisionRecord
+		_, payload, err := decodeRecord(line)
+		if err == nil {
+			err = json.Unmarshal(payload, &record)
+		}
+		if err != nil {
+			// a torn last line is a record that was never acknowledged
+			log.Printf("skipping invalid decision record: %v", err)
+			continue
+		}
+		if current, ok := decisions[record.TxID]; ok {
+			current.State = record.State
+			continue
+		}
+		decisions[record.TxID] = &record
+	}
+}
+
+// Recover resolves the transactions which were in flight when the
+// coordinator stopped: the ones with a commit decision are committed, every
+// other one is aborted. The shard masters are also asked for the
+// transactions they still hold prepared, so none is left in doubt
+func (c *Coordinator) Recover(masters []string) {
+	decisions, err := c.readDecisions()
+	if err != nil {
+		log.Printf("error reading the decision log: %v", err)
+		return
+	}
+
+	for address, txIDs := range c.inDoubt(masters) {
+		for _, txID := range txIDs {
+			decision, ok := decisions[txID]
+			if !ok {
+				decision = &decisionRecord{TxID: txID, State: TX_STARTED}
+				decisions[txID] = decision
+			}
+			if !contains(decision.Participants, address) {
+				decision.Participants = append(decision.Participants, address)
+			}
+		}
+	}
+
+	for txID, decision := range decisions {
+		if decision.State == TX_DONE {
+			continue
+		}
+		if decision.State != TX_COMMITTED && decision.State != TX_ABORTED {
+			if err := c.record(txID, TX_ABORTED, nil); err != nil {
+				log.Printf("error writing to the decision log: %v", err)
+				continue
+			}
+			decision.State = TX_ABORTED
+		}
+		log.Printf("recovering transaction %v: %v", txID, decision.State)
+		c.resolve(txID, decision.State, decision.Participants)
+	}
+}
+
+// inDoubt asks the shard masters for their prepared transactions
+func (c *Coordinator) inDoubt(masters []string) map[string][]string {
+	prepared := make(map[string][]string)
+	for _, address := range masters {
+		reply, err := c.send(utils.PREPARED, address)
+		if err != nil {
+			log.Printf("error asking %v for prepared transactions: %v", address, err)
+			continue
+		}
+		var txIDs []string
+		if err := json.Unmarshal([]byte(strings.TrimSpace(reply)), &txIDs); err != nil {
+			log.Printf("invalid prepared transactions from %v: %v", address, reply)
+			continue
+		}
+		prepared[address] = txIDs
+	}
+	return prepared
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/utils"
+)
+
+// parseIncrement returns the delta of INCR <collection> <key> and
+// INCRBY <collection> <key> <delta>
+func parseIncrement(cmd *Command) (int64, error) {
+	if cmd.Name == utils.INCR {
+		if len(cmd.Args) < 1 {
+			return 0, fmt.Errorf("Usage: INCR <collection> <key>")
+		}
+		return 1, nil
+	}
+	if len(cmd.Args) < 2 {
+		return 0, fmt.Errorf("Usage: INCRBY <collection> <key> <delta>")
+	}
+	delta, err := strconv.ParseInt(cmd.Args[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Usage: INCRBY <collection> <key> <delta>")
+	}
+	return delta, nil
+}
+
+// executeIncrement handles INCR and INCRBY and replies with the new value
+func executeIncrement(cmd *Command, cs *models.CollectionStore) string {
+	delta, err := parseIncrement(cmd)
+	if err != nil {
+		return err.Error()
+	}
+	if cs.KeyLocked(cmd.CollectionName, cmd.Args[0]) {
+		return fmt.Sprintf("ERROR: %v", models.ErrKeyLocked)
+	}
+	value, err := cs.IncrementKeyInCollection(cmd.CollectionName, cmd.Args[0], delta)
+	if err != nil {
+		return fmt.Sprintf("ERROR: %v", err)
+	}
+	return strconv.FormatInt(value, 10)
+}
+
+// incrementInTransaction buffers the incremented value as a SET of the
+// transaction, reading the client's own writes first
+func incrementInTransaction(cmd *Command, cs *models.CollectionStore, cc *models.ClientConfig) string {
+	delta, err := parseIncrement(cmd)
+	if err != nil {
+		return err.Error()
+	}
+	current := readInTransaction(cs, cc, cmd.CollectionName, cmd.Args[0])
+	if current == utils.NIL {
+		current = ""
+	}
+	n, err := models.ParseCounter(current)
+	if err == nil {
+		n, err = models.AddToCounter(n, delta)
+	}
+	if err != nil {
+		return fmt.Sprintf("ERROR: %v", err)
+	}
+	value := strconv.FormatInt(n, 10)
+	cc.Transaction.Set(cmd.CollectionName, cmd.Args[0], value)
+	return value
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/utils"
+)
+
+// DumpPath returns the path of the binary dump kept next to the snapshot log
+func DumpPath(snapshotPath string) string {
+	return snapshotPath + utils.DUMP_SUFFIX
+}
+
+// dumpSaver runs SAVE, BGSAVE, REWRITELOG, BACKUP and RESTORE for a node, at
+// most one of them at a time since each of them replaces the dump and
+// removes the segments it covers, or copies them
+type dumpSaver struct {
+	mu       sync.Mutex
+	busy     bool
+	lastSave time.Time // zero until a dump was saved or loaded
+}
+
+func newDumpSaver(snapshotPath string) *dumpSaver {
+	saver := &dumpSaver{}
+	if info, err := os.Stat(DumpPath(snapshotPath)); err == nil {
+		saver.lastSave = info.ModTime()
+	}
+	return saver
+}
+
+// handleSaveCommands handles SAVE (and its alias SNAPSHOT), BGSAVE, LASTSAVE
+// and REWRITELOG. Dumps are taken on the master, whose state matches the
+// whole log, and only the master rewrites the log
+func handleSaveCommands(cmd *Command, cs *models.CollectionStore, kv *models.KVServer, saver *dumpSaver, snapshotPath string) string {
+	if cmd.Name == utils.LASTSAVE {
+		saver.mu.Lock()
+		defer saver.mu.Unlock()
+		if saver.lastSave.IsZero() {
+			return utils.NIL
+		}
+		return strconv.FormatInt(saver.lastSave.Unix(), 10)
+	}
+	if !kv.Config.IsMaster {
+		return "ERROR: dumps are saved and the log is rewritten on the master"
+	}
+	if !saver.begin() {
+		return "ERROR: a save, a log rewrite or a backup is already in progress"
+	}
+	if cmd.Name == utils.REWRITELOG {
+		go func() {
+			saver.finish(RewriteLog(cs, snapshotPath))
+		}()
+		return "Background log rewrite started"
+	}
+
+	img, err := captureDump(cs, snapshotPath)
+	if err != nil {
+		saver.finish(err)
+		return fmt.Sprintf("ERROR: %v", err)
+	}
+	if cmd.Name == utils.BGSAVE {
+		go func() {
+			saver.finish(saveDump(img, snapshotPath))
+		}()
+		return "Background saving started"
+	}
+	if err := saveDump(img, snapshotPath); err != nil {
+		saver.finish(err)
+		return fmt.Sprintf("ERROR: %v", err)
+	}
+	saver.finish(nil)
+	return "OK"
+}
+
+func (saver *dumpSaver) begin() bool {
+	saver.mu.Lock()
+	defer saver.mu.Unlock()
+	if saver.busy {
+		return false
+	}
+	saver.busy = true
+	return true
+}
+
+// release ends a backup or a restore, which leave the dump of the node as
+// it is
+func (saver *dumpSaver) release() {
+	saver.mu.Lock()
+	defer saver.mu.Unlock()
+	saver.busy = false
+}
+
+func (saver *dumpSaver) finish(err error) {
+	saver.mu.Lock()
+	defer saver.mu.Unlock()
+	saver.busy = false
+	if err != nil {
+		log.Printf("error saving dump: %v", err)
+		return
+	}
+	saver.lastSave = time.Now()
+}
+
+// captureDump copies the store together with the sequence number of the
+// last record of the log, after sealing the active segment. Every logged
+// command is written and applied under the execution lock, so holding it
+// exclusively gives a copy which matches the log exactly. The lock is only
+// held for the copy, not while the dump is written
+func captureDump(cs *models.CollectionStore, snapshotPath string) (*models.DumpImage, error) {
+	cs.LockExclusive()
+	defer cs.UnlockExclusive()
+
+	seq, err := sealLog(snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	return cs.CaptureDump(seq), nil
+}
+
+// SaveDump dumps the store next to the snapshot log in the foreground, as
+// SAVE does
+func SaveDump(cs *models.CollectionStore, snapshotPath string) error {
+	img, err := captureDump(cs, snapshotPath)
+	if err != nil {
+		return err
+	}
+	return saveDump(img, snapshotPath)
+}
+
+// saveDump writes the dump of the snapshot log and removes the segments it
+// covers
+func saveDump(img *models.DumpImage, snapshotPath string) error {
+	defer img.Release()
+	if err := WriteDump(img, DumpPath(snapshotPath)); err != nil {
+		return err
+	}
+	return dumpSaved(snapshotPath, img)
+}
+
+// WriteDump writes the dump to a temporary file which replaces the previous
+// dump once it is synced, so a crash never leaves a partial dump behind
+func WriteDump(img *models.DumpImage, path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := img.Encode(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	log.Printf("saved dump %v with %v keys at log record %v", path, img.Keys(), img.LogSeq)
+	return nil
+}
+
+// ReadDump reads the dump at the path, it returns an error satisfying
+// os.IsNotExist when there is none
+func ReadDump(path string) (*models.DumpImage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return models.DecodeDump(file)
+}
+
+// restoreDump loads the dump of the snapshot log into the store and returns
+// the sequence number of the last record it covers, only the records after
+// it still have to be replayed. A dump the manifest records has replaced
+// the segments it covers, so failing to read it is an error. A dump it
+// doesn't record is older than a rewrite of the log and is skipped
+func restoreDump(snapshotPath string, manifest *logManifest, cs *models.CollectionStore) (uint64, bool, error) {
+	if manifest.Dump == nil {
+		if _, err := os.Stat(DumpPath(snapshotPath)); err == nil {
+			log.Printf("skipping dump of %v, the log doesn't continue from it", snapshotPath)
+		}
+		return 0, false, nil
+	}
+	img, err := ReadDump(DumpPath(snapshotPath))
+	if err != nil {
+		return 0, false, fmt.Errorf("the log continues from the dump at record %v, which can't be read: %w", manifest.Dump.Seq, err)
+	}
+	cs.RestoreDump(img)
+	log.Printf("loaded dump of %v from %v with %v keys", snapshotPath, img.CreatedAt.Format(time.RFC3339), img.Keys())
+	return img.LogSeq, true, nil
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/utils"
+)
+
+// executeLease handles
+//
+//	LEASE GRANT <ttl>
+//	LEASE KEEPALIVE <id>
+//	LEASE REVOKE <id>
+//	LEASE TIMETOLIVE <id> [KEYS]
+//
+// GRANT replies with the id of the lease. The record which replicates the
+// change is returned for GRANT, KEEPALIVE and REVOKE
+func executeLease(cmd *Command, cs *models.CollectionStore, kv *models.KVServer) (string, *Command) {
+	subcommand := strings.ToUpper(cmd.CollectionName)
+	args := cmd.Args
+	if subcommand != "TIMETOLIVE" && !kv.Config.IsMaster {
+		return "ERROR: leases are granted on the master", nil
+	}
+
+	switch subcommand {
+	case "GRANT":
+		if len(args) != 1 {
+			return "Usage: LEASE GRANT <ttl>", nil
+		}
+		ttl, err := utils.ParseDuration(args[0])
+		if err != nil || ttl <= 0 {
+			return "Usage: LEASE GRANT <ttl (xm xhxm xxs)>", nil
+		}
+		lease := cs.GrantLease(ttl)
+		return strconv.FormatInt(lease.ID, 10), leaseGrantRecord(lease)
+	case "KEEPALIVE":
+		id, err := parseLeaseID(args)
+		if err != nil {
+			return "Usage: LEASE KEEPALIVE <id>", nil
+		}
+		lease, err := cs.KeepAliveLease(id)
+		if err != nil {
+			return fmt.Sprintf("ERROR: %v", err), nil
+		}
+		return "OK", leaseGrantRecord(lease)
+	case "REVOKE":
+		id, err := parseLeaseID(args)
+		if err != nil {
+			return "Usage: LEASE REVOKE <id>", nil
+		}
+		if _, err := cs.RevokeLease(id); err != nil {
+			return fmt.Sprintf("ERROR: %v", err), nil
+		}
+		return "OK", leaseRevokeRecord(id)
+	case "TIMETOLIVE":
+		withKeys := len(args) == 2 && strings.EqualFold(args[1], "KEYS")
+		if len(args) != 1 && !withKeys {
+			return "Usage: LEASE TIMETOLIVE <id> [KEYS]", nil
+		}
+		id, err := parseLeaseID(args[:1])
+		if err != nil {
+			return "Usage: LEASE TIMETOLIVE <id> [KEYS]", nil
+		}
+		info, err := cs.LeaseTimeToLive(id, withKeys)
+		if err != nil {
+			return utils.NIL, nil
+		}
+		jsonString, err := utils.MapToJSON(info)
+		if err != nil {
+			log.Printf("error converting to json: %v", err)
+		}
+		return jsonString, nil
+	default:
+		return "Usage: LEASE <GRANT|KEEPALIVE|REVOKE|TIMETOLIVE> ...", nil
+	}
+}
+
+// handleLease runs the lease command and writes the change to the snapshot
+// once it is applied, with the absolute expiration of the lease
+func handleLease(conn net.Conn, cmd *Command, cs *models.CollectionStore, cc *models.ClientConfig, kv *models.KVServer, snapshotPath string) {
+	result := "unauthorized"
+	if cc.ClientState.IsAuthenticated || !kv.Config.ProtectedMode {
+		var record *Command
+		unlock := lockCommand(cmd, cs)
+		result, record = executeLease(cmd, cs, kv)
+		if record != nil {
+			record.Client = clientIdentity(cc)
+			if err := WriteCommandsToFile(*record, snapshotPath); err != nil {
+				log.Printf("error writing lease to dump: %v", err)
+				result = fmt.Sprintf("ERROR: %v", err)
+			}
+		}
+		unlock()
+	}
+	if _, err := fmt.Fprintln(conn, result); err != nil {
+		log.Printf("error writing to the connection: %v : [%v]", conn, err)
+	}
+}
+
+func parseLeaseID(args []string) (int64, error) {
+	if len(args) != 1 {
+		return 0, fmt.Errorf("expected a lease id")
+	}
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid lease id: %v", args[0])
+	}
+	return id, nil
+}
+
+// resolveLease takes a trailing LEASE <id> off the value of a SET and keeps
+// it in the command, so the lease survives the compression of the value
+func resolveLease(cmd *Command) *Command {
+	n := len(cmd.Args)
+	if cmd.Name != utils.SET || cmd.Lease != 0 || n < 4 || !strings.EqualFold(cmd.Args[n-2], "LEASE") {
+		return cmd
+	}
+	id, err := parseLeaseID(cmd.Args[n-1:])
+	if err != nil {
+		return cmd
+	}
+	resolved := *cmd
+	resolved.Args = cmd.Args[:n-2]
+	resolved.Lease = id
+	return &resolved
+}
+
+// leaseGrantRecord is the command which replicates a grant or a keepalive
+//
+//	LEASE-GRANTED <id> <ttl-ms> <unix-time-ms>
+func leaseGrantRecord(lease models.Lease) *Command {
+	return &Command{
+		Name:           utils.LEASE_GRANTED,
+		CollectionName: strconv.FormatInt(lease.ID, 10),
+		Args:           []string{strconv.FormatInt(lease.TTL.Milliseconds(), 10), strconv.FormatInt(lease.ExpiresAt.UnixMilli(), 10)},
+	}
+}
+
+// leaseRevokeRecord is the command which replicates a revoke or an expiry
+func leaseRevokeRecord(id int64) *Command {
+	return &Command{Name: utils.LEASE_REVOKED, CollectionName: strconv.FormatInt(id, 10)}
+}
+
+// applyLeaseRecord applies a grant or a revoke logged by the master
+func applyLeaseRecord(cmd *Command, cs *models.CollectionStore) string {
+	id, err := parseLeaseID([]string{cmd.CollectionName})
+	if err != nil {
+		return fmt.Sprintf("ERROR: %v", err)
+	}
+	if cmd.Name == utils.LEASE_REVOKED {
+		// revoking a lease which is already gone is a no-op
+		_, _ = cs.RevokeLease(id)
+		return "OK"
+	}
+
+	if len(cmd.Args) < 2 {
+		return "Usage: LEASE-GRANTED <id> <ttl-ms> <unix-time-ms>"
+	}
+	ttl, err := strconv.ParseInt(cmd.Args[0], 10, 64)
+	if err != nil {
+		return "Usage: LEASE-GRANTED <id> <ttl-ms> <unix-time-ms>"
+	}
+	expiresAt, err := parseExpireAt(cmd.Args[1])
+	if err != nil {
+		return "Usage: LEASE-GRANTED <id> <ttl-ms> <unix-time-ms>"
+	}
+	cs.ApplyLeaseGrant(id, time.Duration(ttl)*time.Millisecond, expiresAt)
+	return "OK"
+}
+
+// StartLeaseExpiry revokes the leases which ran out, only the master does
+// so and it logs every revoke for the replicas
+func StartLeaseExpiry(cs *models.CollectionStore, duration time.Duration, kvServer *models.KVServer, snapshotPath string) {
+	ticker := time.NewTicker(duration)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !kvServer.Config.IsMaster {
+			continue
+		}
+		if err := expireLeases(cs, snapshotPath, time.Now()); err != nil {
+			log.Printf("error writing expired leases to dump: %v", err)
+		}
+	}
+}
+
+// expireLeases revokes the expired leases once their revoke records are
+// written, when the records can't be written the leases are kept and
+// revoked on a later tick
+func expireLeases(cs *models.CollectionStore, snapshotPath string, now time.Time) error {
+	if len(cs.ExpiredLeases(now)) == 0 {
+		return nil
+	}
+	cs.LockExclusive()
+	defer cs.UnlockExclusive()
+
+	ids := cs.ExpiredLeases(now)
+	records := make([]Command, 0, len(ids))
+	for _, id := range ids {
+		records = append(records, *leaseRevokeRecord(id))
+	}
+	if err := writeCommandsInOneAppend(records, snapshotPath); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if deleted, err := cs.RevokeLease(id); err == nil {
+			log.Printf("lease %v expired, deleted %v keys", id, deleted)
+		}
+	}
+	return nil
+}
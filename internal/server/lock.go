@@ -0,0 +1,133 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/utils"
+)
+
+// lockInfo is the reply to LOCK INFO
+type lockInfo struct {
+	models.DistributedLock
+	TTL     int64 `json:"ttl_ms"`
+	Waiters int   `json:"waiters"`
+}
+
+// handleLockCommand handles
+//
+//	LOCK ACQUIRE <name> <owner> <ttl> [WAIT <timeout>]
+//	LOCK RENEW <name> <owner> <ttl>
+//	LOCK RELEASE <name> <owner>
+//	LOCK INFO <name>
+//
+// ACQUIRE replies with the fencing token of the lease, or (nil) when the lock
+// wasn't granted in time
+func handleLockCommand(cmd *Command, cs *models.CollectionStore, kv *models.KVServer) string {
+	subcommand := strings.ToUpper(cmd.CollectionName)
+	args := cmd.Args
+	if subcommand != "INFO" && !kv.Config.IsMaster {
+		return "ERROR: locks are taken on the master"
+	}
+
+	switch subcommand {
+	case "ACQUIRE":
+		if len(args) != 3 && !(len(args) == 5 && strings.EqualFold(args[3], "WAIT")) {
+			return "Usage: LOCK ACQUIRE <name> <owner> <ttl> [WAIT <timeout>]"
+		}
+		ttl, err := utils.ParseDuration(args[2])
+		if err != nil || ttl <= 0 {
+			return "Usage: LOCK ACQUIRE <name> <owner> <ttl (xm xhxm xxs)> [WAIT <timeout>]"
+		}
+		var wait time.Duration
+		if len(args) == 5 {
+			if wait, err = utils.ParseDuration(args[4]); err != nil {
+				return "Usage: LOCK ACQUIRE <name> <owner> <ttl> [WAIT <timeout (xm xhxm xxs)>]"
+			}
+		}
+		lock, ok := cs.Locks().Acquire(args[0], args[1], ttl, wait)
+		if !ok {
+			return utils.NIL
+		}
+		return strconv.FormatUint(lock.Token, 10)
+	case "RENEW":
+		if len(args) != 3 {
+			return "Usage: LOCK RENEW <name> <owner> <ttl>"
+		}
+		ttl, err := utils.ParseDuration(args[2])
+		if err != nil || ttl <= 0 {
+			return "Usage: LOCK RENEW <name> <owner> <ttl (xm xhxm xxs)>"
+		}
+		if _, err := cs.Locks().Renew(args[0], args[1], ttl); err != nil {
+			return fmt.Sprintf("ERROR: %v", err)
+		}
+		return "OK"
+	case "RELEASE":
+		if len(args) != 2 {
+			return "Usage: LOCK RELEASE <name> <owner>"
+		}
+		if err := cs.Locks().Release(args[0], args[1]); err != nil {
+			return fmt.Sprintf("ERROR: %v", err)
+		}
+		return "OK"
+	case "INFO":
+		if len(args) != 1 {
+			return "Usage: LOCK INFO <name>"
+		}
+		lock, waiters, ok := cs.Locks().Info(args[0])
+		if !ok {
+			return utils.NIL
+		}
+		jsonString, err := utils.MapToJSON(lockInfo{DistributedLock: lock, TTL: time.Until(lock.ExpiresAt).Milliseconds(), Waiters: waiters})
+		if err != nil {
+			log.Printf("error converting to json: %v", err)
+		}
+		return jsonString
+	default:
+		return "Usage: LOCK <ACQUIRE|RENEW|RELEASE|INFO> <name> ..."
+	}
+}
+
+// lockRecord is the command which replicates a grant or a release, with the
+// absolute expiration so replaying it later gives the same lease
+func lockRecord(lock models.DistributedLock, held bool) Command {
+	token := strconv.FormatUint(lock.Token, 10)
+	if !held {
+		return Command{Name: utils.LOCK_RELEASED, CollectionName: lock.Name, Args: []string{token}}
+	}
+	expiresAt := strconv.FormatInt(lock.ExpiresAt.UnixMilli(), 10)
+	return Command{Name: utils.LOCK_GRANTED, CollectionName: lock.Name, Args: []string{lock.Owner, token, expiresAt}}
+}
+
+// applyLockRecord applies a grant or a release logged by the master
+func applyLockRecord(cmd *Command, cs *models.CollectionStore) string {
+	if cmd.Name == utils.LOCK_RELEASED {
+		if len(cmd.Args) < 1 {
+			return "Usage: LOCK-RELEASED <name> <token>"
+		}
+		token, err := strconv.ParseUint(cmd.Args[0], 10, 64)
+		if err != nil {
+			return "Usage: LOCK-RELEASED <name> <token>"
+		}
+		cs.Locks().ApplyRelease(cmd.CollectionName, token)
+		return "OK"
+	}
+
+	if len(cmd.Args) < 3 {
+		return "Usage: LOCK-GRANTED <name> <owner> <token> <unix-time-ms>"
+	}
+	token, err := strconv.ParseUint(cmd.Args[1], 10, 64)
+	if err != nil {
+		return "Usage: LOCK-GRANTED <name> <owner> <token> <unix-time-ms>"
+	}
+	expiresAt, err := parseExpireAt(cmd.Args[2])
+	if err != nil {
+		return "Usage: LOCK-GRANTED <name> <owner> <token> <unix-time-ms>"
+	}
+	cs.Locks().ApplyGrant(models.DistributedLock{Name: cmd.CollectionName, Owner: cmd.Args[0], Token: token, ExpiresAt: expiresAt})
+	return "OK"
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/sk25469/kv/utils"
+)
+
+// Every record of a log is a line
+//
+//	<seq> <length> <crc32c> <json>
+//
+// where seq counts the records of the log, length is the size of the json
+// in bytes and crc32c its checksum in hex. Lines starting with { are
+// records written before the framing and are read as plain json
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// encodeRecord frames the json payload of a record as a line of the log
+func encodeRecord(seq uint64, payload []byte) []byte {
+	line := fmt.Appendf(nil, "%d %d %08x ", seq, len(payload), crc32.Checksum(payload, crc32c))
+	line = append(line, payload...)
+	return append(line, '\n')
+}
+
+// decodeRecord checks the frame of a line and returns its sequence number
+// and payload. A legacy line and a compacted record of a rewritten log have
+// the sequence number 0
+func decodeRecord(line []byte) (uint64, []byte, error) {
+	if len(line) == 0 || line[len(line)-1] != '\n' {
+		return 0, nil, errors.New("record is cut short")
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[0] == '{' {
+		return 0, line, nil
+	}
+
+	fields := bytes.SplitN(line, []byte(" "), 4)
+	if len(fields) != 4 {
+		return 0, nil, errors.New("record has no frame")
+	}
+	seq, err := strconv.ParseUint(string(fields[0]), 10, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid sequence number %q", fields[0])
+	}
+	length, err := strconv.Atoi(string(fields[1]))
+	if err != nil || length != len(fields[3]) {
+		return 0, nil, fmt.Errorf("record %v has %v bytes, its frame says %s", seq, len(fields[3]), fields[1])
+	}
+	checksum, err := strconv.ParseUint(string(fields[2]), 16, 32)
+	if err != nil || uint32(checksum) != crc32.Checksum(fields[3], crc32c) {
+		return 0, nil, fmt.Errorf("record %v fails its checksum", seq)
+	}
+	return seq, fields[3], nil
+}
+
+// parseRecord decodes a line of the snapshot log into its command
+func parseRecord(line []byte) (Command, uint64, error) {
+	var cmd Command
+	seq, payload, err := decodeRecord(line)
+	if err != nil {
+		return cmd, 0, err
+	}
+	if err := json.Unmarshal(payload, &cmd); err != nil {
+		return cmd, 0, err
+	}
+	return cmd, seq, nil
+}
+
+// nextSequence returns the sequence number the record after this one must
+// follow, 0 when it doesn't tell. The records copied after the LOG-REWRITTEN
+// record of a rewritten log keep the numbers they had in the old log, which
+// the LOG-REWRITTEN record carries. A log rewritten before it was split into
+// segments numbers its compacted records from 1, a later rewrite leaves
+// them unnumbered
+func nextSequence(cmd Command, seq uint64) uint64 {
+	if cmd.Name == utils.LOG_REWRITTEN && len(cmd.Args) >= 2 {
+		if last, err := strconv.ParseUint(cmd.Args[1], 10, 64); err == nil {
+			return last
+		}
+	}
+	return seq
+}
+
+// LogCorruption is the first damaged record of a log. A torn record is
+// only followed by more damage, which is what a write cut short by a crash
+// leaves behind, and can be cut off without losing an acknowledged record
+type LogCorruption struct {
+	Path   string
+	Offset int64
+	Torn   bool
+	Err    error
+}
+
+func (c *LogCorruption) Error() string {
+	if c.Torn {
+		return fmt.Sprintf("%v has a torn record at offset %v: %v", c.Path, c.Offset, c.Err)
+	}
+	return fmt.Sprintf("%v has a corrupt record at offset %v followed by valid records: %v", c.Path, c.Offset, c.Err)
+}
+
+// readLog calls fn with every record of the log after the offset and its
+// sequence number. It stops at the first damaged or out of order record
+// and returns it as a *LogCorruption
+func readLog(filename string, offset int64, fn func(cmd Command, seq uint64)) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReaderSize(file, 64*1024)
+	var last uint64
+	for {
+		line, err := readLine(reader)
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		cmd, seq, err := parseRecord(line)
+		if err == nil && seq != 0 && last != 0 && seq != last+1 {
+			err = fmt.Errorf("expected record %v, got %v", last+1, seq)
+		}
+		if err != nil {
+			return &LogCorruption{Path: filename, Offset: offset, Torn: !validRecordFollows(reader), Err: err}
+		}
+		offset += int64(len(line))
+		if next := nextSequence(cmd, seq); next != 0 {
+			last = next
+		}
+		fn(cmd, seq)
+	}
+}
+
+// readLine reads a whole line, up to MAX_RECORD_SIZE bytes
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+		if len(line) > MAX_RECORD_SIZE {
+			return line, fmt.Errorf("record longer than %v bytes", MAX_RECORD_SIZE)
+		}
+	}
+}
+
+func validRecordFollows(reader *bufio.Reader) bool {
+	for {
+		line, err := readLine(reader)
+		if len(line) == 0 || (err != nil && err != io.EOF) {
+			return false
+		}
+		if _, _, err := parseRecord(line); err == nil {
+			return true
+		}
+	}
+}
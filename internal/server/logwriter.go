@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/utils"
+)
+
+// logWriter owns a log file. Every append goes through its channel to a
+// single goroutine which keeps the file open and writes the records in the
+// order they arrive. The appends which queue up while a write or a sync is
+// running go out together in the next write and share its fsync. The file
+// is the active segment of the log, see rollLocked
+type logWriter struct {
+	path     string
+	requests chan *logAppend
+
+	mu       sync.Mutex   // guards the fields below against a roll or a repair
+	file     *os.File     // nil until the first append or after a repair
+	manifest *logManifest // read on open
+	seq      uint64       // sequence number of the last record, read on open
+	size     int64        // size of the active segment
+	policy   string
+	dirty    bool // written since the last sync
+	segments models.LogSegmentConfig
+	// whether loading cuts off a torn tail or fails
+	loadTruncated bool
+	// copy of the appends since a running RewriteLog captured the state,
+	// the active segment isn't sealed while it is set
+	rewrite *bytes.Buffer
+}
+
+// logAppend is a single append waiting for the writer, sync asks for the
+// records to be on disk before done is signalled whatever the policy
+type logAppend struct {
+	records [][]byte // json payloads, framed by the writer
+	sync    bool
+	done    chan error
+}
+
+var (
+	logWritersMu sync.Mutex
+	logWriters   = make(map[string]*logWriter)
+)
+
+// getLogWriter returns the writer of the file and starts it on first use,
+// the nodes of a shard share the log and so its writer
+func getLogWriter(filename string) *logWriter {
+	if abs, err := filepath.Abs(filename); err == nil {
+		filename = abs
+	}
+	logWritersMu.Lock()
+	defer logWritersMu.Unlock()
+	w, ok := logWriters[filename]
+	if !ok {
+		w = &logWriter{
+			path:     filename,
+			requests: make(chan *logAppend, 256),
+			policy:   models.FSYNC_EVERYSEC,
+			segments: models.LogSegmentConfig{MaxSize: models.DEFAULT_SEGMENT_MAX_SIZE, MaxAge: models.DEFAULT_SEGMENT_MAX_AGE},
+			// a torn tail is cut off unless the config says otherwise
+			loadTruncated: true,
+		}
+		logWriters[filename] = w
+		go w.run()
+	}
+	return w
+}
+
+// SetLogFsync sets the fsync policy of the log, see models.ParseFsyncPolicy
+func SetLogFsync(filename, policy string) {
+	w := getLogWriter(filename)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.policy = policy
+}
+
+// SetLogLoadTruncated sets whether loading the log cuts off a torn tail or
+// fails with the offset of the damage
+func SetLogLoadTruncated(filename string, truncate bool) {
+	w := getLogWriter(filename)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.loadTruncated = truncate
+}
+
+func logLoadTruncated(filename string) bool {
+	w := getLogWriter(filename)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.loadTruncated
+}
+
+// appendToLog appends the json payloads to the log as framed records and
+// returns once they are written, and synced under the always policy or
+// when sync is set
+func appendToLog(filename string, records [][]byte, sync bool) error {
+	req := &logAppend{records: records, sync: sync, done: make(chan error, 1)}
+	getLogWriter(filename).requests <- req
+	return <-req.done
+}
+
+func (w *logWriter) run() {
+	ticker := time.NewTicker(utils.FSYNC_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case req := <-w.requests:
+			group := []*logAppend{req}
+			// everything queued behind the first append goes out with it
+			for queued := true; queued; {
+				select {
+				case req := <-w.requests:
+					group = append(group, req)
+				default:
+					queued = false
+				}
+			}
+			err := w.write(group)
+			for _, req := range group {
+				req.done <- err
+			}
+		case <-ticker.C:
+			w.syncIfDirty()
+			w.rollIfOld()
+		}
+	}
+}
+
+// write numbers the records of the group and appends them in a single
+// write, so a crash tears at most the last records of the log
+func (w *logWriter) write(group []*logAppend) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.openLocked(); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	sync := false
+	seq := w.seq
+	for _, req := range group {
+		for _, record := range req.records {
+			seq++
+			buf.Write(encodeRecord(seq, record))
+		}
+		sync = sync || req.sync
+	}
+	if _, err := w.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if w.rewrite != nil {
+		w.rewrite.Write(buf.Bytes())
+	}
+	w.seq = seq
+	w.size += int64(buf.Len())
+	w.dirty = true
+	if sync || w.policy == models.FSYNC_ALWAYS {
+		if err := w.syncLocked(); err != nil {
+			return err
+		}
+	}
+	// the records are written, a failed roll is retried on the next write
+	if w.segments.MaxSize > 0 && w.size >= w.segments.MaxSize && w.rewrite == nil {
+		if err := w.rollLocked(); err != nil {
+			log.Printf("error sealing the active segment of %v: %v", w.path, err)
+		}
+	}
+	return nil
+}
+
+// syncIfDirty is the once a second sync of the everysec policy
+func (w *logWriter) syncIfDirty() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.policy != models.FSYNC_EVERYSEC || !w.dirty || w.file == nil {
+		return
+	}
+	if err := w.syncLocked(); err != nil {
+		log.Printf("error syncing %v: %v", w.path, err)
+	}
+}
+
+func (w *logWriter) syncLocked() error {
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.dirty = false
+	return nil
+}
+
+// openLocked opens the active segment for the first append after a start or
+// a repair and continues the sequence numbers of the log
+func (w *logWriter) openLocked() error {
+	if w.file != nil {
+		return nil
+	}
+	manifest, err := readManifest(w.path)
+	if err != nil {
+		return err
+	}
+	seq := manifest.lastSeq()
+	first := seq + 1
+	err = readLog(w.path, 0, func(cmd Command, s uint64) {
+		if s != 0 && first > seq {
+			first = s
+		}
+		if next := nextSequence(cmd, s); next != 0 {
+			seq = next
+		}
+	})
+	var corruption *LogCorruption
+	if err != nil && !os.IsNotExist(err) && !errors.As(err, &corruption) {
+		return err
+	}
+	// with log-load-truncated no the torn tail is left for repair-log, and
+	// nothing is appended after it
+	if corruption != nil && corruption.Torn && !w.loadTruncated {
+		return corruption
+	}
+
+	file, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	// an append after a torn record would be read as part of it
+	if corruption != nil && corruption.Torn {
+		log.Printf("cutting off the torn tail of %v at offset %v", w.path, corruption.Offset)
+		if err := file.Truncate(corruption.Offset); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	manifest.Active.FirstSeq = first
+	if manifest.Active.CreatedAt.IsZero() {
+		manifest.Active.CreatedAt = time.Now()
+	}
+	if err := writeManifest(w.path, manifest); err != nil {
+		file.Close()
+		return err
+	}
+	w.file, w.manifest, w.seq, w.size = file, manifest, seq, info.Size()
+	return nil
+}
+
+// truncateLog cuts the log off at the offset
+func truncateLog(filename string, offset int64) error {
+	w := getLogWriter(filename)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.reopenLocked()
+	return os.Truncate(filename, offset)
+}
+
+// reopenLocked drops the handle of a log which was changed on disk, the
+// next append opens it again
+func (w *logWriter) reopenLocked() {
+	if w.file != nil {
+		w.file.Close()
+		w.file = nil
+	}
+	w.dirty = false
+}
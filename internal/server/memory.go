@@ -0,0 +1,39 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/utils"
+)
+
+// handleMemoryCommand handles the MEMORY subcommands:
+// MEMORY USAGE <collection> <key> = approximate bytes taken by the key
+// MEMORY STATS = overhead, dataset size and per-collection breakdown as json
+// MEMORY DOCTOR = single line report of the memory problems found
+func handleMemoryCommand(cmd *Command, cs *models.CollectionStore) string {
+	switch strings.ToUpper(cmd.CollectionName) {
+	case "USAGE":
+		if len(cmd.Args) < 2 {
+			return "Usage: MEMORY USAGE <collection> <key>"
+		}
+		size, ok := cs.MemoryUsageOfKey(cmd.Args[0], cmd.Args[1])
+		if !ok {
+			return "ERROR: key not found"
+		}
+		return strconv.FormatInt(size, 10)
+	case "STATS":
+		jsonString, err := utils.MapToJSON(cs.MemoryStats())
+		if err != nil {
+			log.Printf("error converting to json: %v", err)
+		}
+		return jsonString
+	case "DOCTOR":
+		return cs.MemoryDoctor()
+	default:
+		return fmt.Sprintf("Unknown MEMORY subcommand: %s", cmd.CollectionName)
+	}
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/utils"
+)
+
+// queueableCommands are the data commands MULTI can queue, with the number
+// of arguments they need after the collection name
+var queueableCommands = map[string]int{
+	utils.SET:       2,
+	utils.GET:       1,
+	utils.DEL:       1,
+	utils.SET_TTL:   2,
+	utils.EXPIRE_AT: 2,
+	utils.INCR:      1,
+	utils.INCRBY:    2,
+	"SHOW":          0,
+	"SHOWALL":       0,
+}
+
+// handleMultiCommand handles MULTI, EXEC and DISCARD, EXEC writes the
+// writes of the queue to the snapshot unless snapshotPath is empty
+func handleMultiCommand(cmd *Command, cs *models.CollectionStore, cc *models.ClientConfig, kv *models.KVServer, ps *models.PubSub, snapshotPath string) string {
+	switch cmd.Name {
+	case utils.MULTI:
+		if cc.ClientState.State == utils.QUEUEING {
+			return "ERROR: MULTI calls can not be nested"
+		}
+		if cc.ClientState.State == utils.TRANSACTIONAL {
+			return "ERROR: MULTI inside a transaction"
+		}
+		cc.ClientState.State = utils.QUEUEING
+		cc.ClientState.Queue = nil
+		cc.ClientState.QueueFailed = false
+		return "OK"
+	case utils.DISCARD:
+		if cc.ClientState.State != utils.QUEUEING {
+			return "ERROR: DISCARD without MULTI"
+		}
+		resetQueue(cc)
+		releaseWatches(cs, cc)
+		return "OK"
+	default:
+		if cc.ClientState.State != utils.QUEUEING {
+			return "ERROR: EXEC without MULTI"
+		}
+		return execQueue(cs, cc, kv, ps, snapshotPath)
+	}
+}
+
+func resetQueue(cc *models.ClientConfig) {
+	cc.ClientState.State = utils.ACTIVE
+	cc.ClientState.Queue = nil
+	cc.ClientState.QueueFailed = false
+}
+
+// queueCommand validates the syntax of the command and queues it, an
+// invalid command makes the following EXEC abort
+func queueCommand(cmd *Command, cc *models.ClientConfig) string {
+	if err := validateQueuedCommand(cmd); err != nil {
+		cc.ClientState.QueueFailed = true
+		return fmt.Sprintf("ERROR: %v", err)
+	}
+	cc.ClientState.Queue = append(cc.ClientState.Queue, models.QueuedCommand{
+		Name:           cmd.Name,
+		CollectionName: cmd.CollectionName,
+		Args:           cmd.Args,
+		Encoding:       cmd.Encoding,
+	})
+	return "QUEUED"
+}
+
+func validateQueuedCommand(cmd *Command) error {
+	arity, ok := queueableCommands[cmd.Name]
+	if !ok {
+		return fmt.Errorf("command %v can not be queued", cmd.Name)
+	}
+	if cmd.Name != "SHOWALL" && cmd.CollectionName == "" {
+		return fmt.Errorf("wrong number of arguments for %v", cmd.Name)
+	}
+	if len(cmd.Args) < arity {
+		return fmt.Errorf("wrong number of arguments for %v", cmd.Name)
+	}
+	if cmd.Lease != 0 {
+		return fmt.Errorf("SET with a lease can not be queued")
+	}
+	if cmd.Name == utils.SET_TTL {
+		if _, err := utils.ParseDuration(cmd.Args[1]); err != nil {
+			return fmt.Errorf("invalid ttl: %v", cmd.Args[1])
+		}
+	}
+	if cmd.Name == utils.EXPIRE_AT {
+		if _, err := parseExpireAt(cmd.Args[1]); err != nil {
+			return err
+		}
+	}
+	if cmd.Name == utils.INCRBY {
+		if _, err := parseIncrement(cmd); err != nil {
+			return fmt.Errorf("invalid delta: %v", cmd.Args[1])
+		}
+	}
+	return nil
+}
+
+// execQueue runs the queued commands while holding the execution locks of
+// their collections exclusively, so no other client observes or interleaves
+// with them. The writes are buffered as in a transaction and committed
+// together at the end, and they are logged before the locks are released.
+// The result is a json array with the reply of every command
+func execQueue(cs *models.CollectionStore, cc *models.ClientConfig, kv *models.KVServer, ps *models.PubSub, snapshotPath string) string {
+	queue, failed := cc.ClientState.Queue, cc.ClientState.QueueFailed
+	resetQueue(cc)
+	if failed {
+		releaseWatches(cs, cc)
+		return "EXECABORT Transaction discarded because of previous errors"
+	}
+
+	var collections []string
+	for _, queued := range queue {
+		collections = append(collections, commandCollections(&Command{Name: queued.Name, CollectionName: queued.CollectionName}, cs)...)
+	}
+	cs.LockShared()
+	defer cs.UnlockShared()
+	defer cs.LockCollections(collections, true)()
+
+	// a queue which is going to fail on its watched keys doesn't need to run
+	// at all, a watched key changing after the check still aborts the commit
+	if cs.WatchedKeysChanged(cc.ClientState.Watches) {
+		releaseWatches(cs, cc)
+		return utils.NIL
+	}
+
+	execClient := &models.ClientConfig{
+		ClientID:    cc.ClientID,
+		ClientState: &models.ClientState{State: utils.TRANSACTIONAL, IsAuthenticated: true, Watches: cc.ClientState.Watches},
+		Transaction: models.NewTransactionalKeyValueStore(),
+	}
+	cc.ClientState.Watches = nil
+	results := make([]string, 0, len(queue))
+	for _, queued := range queue {
+		cmd := ResolveCommand(&Command{
+			Name:           queued.Name,
+			CollectionName: queued.CollectionName,
+			Args:           queued.Args,
+			Encoding:       queued.Encoding,
+		}, cs)
+		results = append(results, executeCommand(cmd, cs, execClient, kv, ps))
+	}
+
+	result, batch := commitTransaction(cs, execClient, kv)
+	if err := logTransaction(batch, cc, snapshotPath); err != nil {
+		return fmt.Sprintf("ERROR: %v", err)
+	}
+	if result != "OK" {
+		return result
+	}
+	jsonString, err := utils.MapToJSON(results)
+	if err != nil {
+		log.Printf("error converting to json: %v", err)
+	}
+	return jsonString
+}
+
+// handleExec runs the queue of the client and writes its writes to the
+// snapshot as a single BATCH command
+func handleExec(conn net.Conn, cs *models.CollectionStore, cc *models.ClientConfig, kv *models.KVServer, ps *models.PubSub, snapshotPath string) {
+	result := "unauthorized"
+	if cc.ClientState.IsAuthenticated || !kv.Config.ProtectedMode {
+		result = handleMultiCommand(&Command{Name: utils.EXEC}, cs, cc, kv, ps, snapshotPath)
+	}
+	if _, err := fmt.Fprintln(conn, result); err != nil {
+		log.Printf("error writing to the connection: %v : [%v]", conn, err)
+	}
+}
+
+// handleWatchCommand handles WATCH <collection> <key> [key...], which records
+// the versions of the keys so EXEC or COMMIT fail if any of them changes, and
+// UNWATCH, which forgets all the watched keys
+func handleWatchCommand(cmd *Command, cs *models.CollectionStore, cc *models.ClientConfig) string {
+	if cmd.Name == utils.UNWATCH {
+		releaseWatches(cs, cc)
+		return "OK"
+	}
+	if cc.ClientState.State == utils.QUEUEING {
+		return "ERROR: WATCH inside MULTI is not allowed"
+	}
+	if cmd.CollectionName == "" || len(cmd.Args) < 1 {
+		return "Usage: WATCH <collection> <key> [key...]"
+	}
+	for _, key := range cmd.Args {
+		cc.ClientState.Watches = append(cc.ClientState.Watches, cs.Watch(cmd.CollectionName, key))
+	}
+	return "OK"
+}
+
+// releaseWatches forgets the watched keys of the client and returns them
+func releaseWatches(cs *models.CollectionStore, cc *models.ClientConfig) []models.WatchedKey {
+	watches := cc.ClientState.Watches
+	cc.ClientState.Watches = nil
+	cs.Unwatch(watches)
+	return watches
+}
@@ -1,62 +1,71 @@
 package server
 
 import (
-	"bufio"
 	"encoding/json"
 	"log"
 	"os"
+	"time"
 )
 
+// MAX_RECORD_SIZE is the longest line of the snapshot which can be read back
+const MAX_RECORD_SIZE = 64 << 20
+
 // WriteCommandsToFile writes a slice of Command structs to a file
 func WriteCommandsToFile(command Command, filename string) error {
-	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
+	command.Time = time.Now().UnixMilli()
+	return appendRecord(filename, command, false)
+}
 
-	writer := bufio.NewWriter(file)
-	defer writer.Flush()
+// SyncCommandToFile writes the command to the file and waits until it is
+// on disk whatever the fsync policy, for records which must survive a crash
+// once acknowledged
+func SyncCommandToFile(command Command, filename string) error {
+	command.Time = time.Now().UnixMilli()
+	return appendRecord(filename, command, true)
+}
 
-	cmdBytes, err := json.Marshal(command)
-	if err != nil {
-		return err
-	}
-	_, err = writer.Write(cmdBytes)
-	if err != nil {
-		return err
+// writeCommandsInOneAppend writes the commands in a single write, so
+// either all of them are logged or none, every command carries the same
+// timestamp
+func writeCommandsInOneAppend(commands []Command, filename string) error {
+	now := time.Now().UnixMilli()
+	payloads := make([][]byte, 0, len(commands))
+	for _, command := range commands {
+		command.Time = now
+		payload, err := json.Marshal(command)
+		if err != nil {
+			return err
+		}
+		payloads = append(payloads, payload)
 	}
-	_, err = writer.WriteString("\n")
+	return appendToLog(filename, payloads, false)
+}
+
+// appendRecord appends the record to the file as a framed line of json
+func appendRecord(filename string, record interface{}, sync bool) error {
+	cmdBytes, err := json.Marshal(record)
 	if err != nil {
 		return err
 	}
-
-	return nil
+	return appendToLog(filename, [][]byte{cmdBytes}, sync)
 }
 
 // ReadCommandsFromFile reads a slice of Command structs from a file
 func ReadCommandsFromFile(filename string) ([]Command, error) {
-	var commands []Command
-
-	file, err := os.Open(filename)
-	if err != nil {
-		log.Printf("no such file to open")
-		return []Command{}, nil
-	}
-	defer file.Close()
+	return ReadCommandsFromOffset(filename, 0)
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		var cmd Command
-		err := json.Unmarshal(scanner.Bytes(), &cmd)
-		if err != nil {
-			return nil, err
-		}
+// ReadCommandsFromOffset reads the records written after the offset, which
+// must be the start of a record. On a damaged record it returns the
+// records before it together with a *LogCorruption
+func ReadCommandsFromOffset(filename string, offset int64) ([]Command, error) {
+	commands := []Command{}
+	err := readLog(filename, offset, func(cmd Command, _ uint64) {
 		commands = append(commands, cmd)
+	})
+	if os.IsNotExist(err) {
+		log.Printf("no such file to open")
+		return commands, nil
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, err
-	}
-
-	return commands, nil
+	return commands, err
 }
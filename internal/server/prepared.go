@@ -0,0 +1,116 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/utils"
+)
+
+// preparedCommands are the writes a shard can prepare for a distributed
+// transaction
+var preparedCommands = map[string]bool{
+	utils.SET:       true,
+	utils.DEL:       true,
+	utils.SET_TTL:   true,
+	utils.EXPIRE_AT: true,
+}
+
+// prepareMutations returns the mutations of PREPARE <txid> <command> [; <command>...],
+// a PREPARE read back from the snapshot carries them as a batch
+func prepareMutations(cmd *Command) ([]models.Mutation, error) {
+	if len(cmd.Batch) > 0 {
+		return batchToMutations(cmd.Batch)
+	}
+	var batch []Command
+	for _, tokens := range splitCommands(cmd.Args) {
+		op, err := parseTxnCommand(tokens)
+		if err != nil {
+			return nil, err
+		}
+		if !preparedCommands[op.Name] {
+			return nil, fmt.Errorf("command not allowed in a distributed transaction: %v", op.Name)
+		}
+		batch = append(batch, *ResolveExpiration(op))
+	}
+	if len(batch) == 0 {
+		return nil, fmt.Errorf("nothing to prepare")
+	}
+	return batchToMutations(batch)
+}
+
+// executePrepared handles PREPARE, COMMIT-PREPARED and ABORT-PREPARED of a
+// distributed transaction and returns the command which logs the outcome,
+// nil when nothing changed
+func executePrepared(cmd *Command, cs *models.CollectionStore, kv *models.KVServer) (string, *Command) {
+	txID := cmd.CollectionName
+	if txID == "" {
+		return fmt.Sprintf("Usage: %s <txid>", cmd.Name), nil
+	}
+
+	switch cmd.Name {
+	case utils.PREPARE:
+		mutations, err := prepareMutations(cmd)
+		if err != nil {
+			return fmt.Sprintf("ERROR: %v", err), nil
+		}
+		result := "OK"
+		if err := cs.Prepare(txID, mutations, kv.Config.IsMaster); err != nil {
+			if !errors.Is(err, models.ErrEvictionNotLogged) {
+				return fmt.Sprintf("ERROR: %v", err), nil
+			}
+			// the transaction is prepared all the same, so it is still
+			// logged and the coordinator aborts it on the error
+			result = fmt.Sprintf("ERROR: %v", err)
+		}
+		batch := make([]Command, 0, len(mutations))
+		for _, m := range mutations {
+			batch = append(batch, mutationToCommand(m))
+		}
+		return result, &Command{Name: utils.PREPARE, CollectionName: txID, Batch: batch}
+	case utils.COMMIT_PREPARED:
+		if err := cs.CommitPrepared(txID); err != nil {
+			return fmt.Sprintf("ERROR: %v", err), nil
+		}
+	default:
+		if err := cs.AbortPrepared(txID); err != nil {
+			return fmt.Sprintf("ERROR: %v", err), nil
+		}
+	}
+	return "OK", &Command{Name: cmd.Name, CollectionName: txID}
+}
+
+// handlePrepared runs a step of a distributed transaction and writes it to
+// the snapshot before replying, so a vote or a decision is never lost once
+// the coordinator saw it
+func handlePrepared(conn net.Conn, cmd *Command, cs *models.CollectionStore, cc *models.ClientConfig, kv *models.KVServer, snapshotPath string) {
+	result := "unauthorized"
+	if cc.ClientState.IsAuthenticated || !kv.Config.ProtectedMode {
+		var record *Command
+		unlock := lockCommand(cmd, cs)
+		result, record = executePrepared(cmd, cs, kv)
+		if record != nil {
+			record.Client = clientIdentity(cc)
+			if err := SyncCommandToFile(*record, snapshotPath); err != nil {
+				log.Printf("error writing %v to dump: %v", cmd.Name, err)
+				result = fmt.Sprintf("ERROR: %v", err)
+			}
+		}
+		unlock()
+	}
+	if _, err := fmt.Fprintln(conn, result); err != nil {
+		log.Printf("error writing to the connection: %v : [%v]", conn, err)
+	}
+}
+
+// listPrepared returns the ids of the prepared transactions as a json array
+func listPrepared(cs *models.CollectionStore) string {
+	jsonString, err := utils.MapToJSON(cs.PreparedTransactions())
+	if err != nil {
+		log.Printf("error converting to json: %v", err)
+	}
+	return jsonString
+}
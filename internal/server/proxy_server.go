@@ -6,13 +6,21 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strings"
 
 	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/utils"
 )
 
 func RouteRequestsToShards(port string, ch *models.ConsistentHash, shardList *models.ShardsList) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+
+	// transactions left in flight by a previous run are resolved before
+	// any new request is routed
+	coordinator := NewCoordinator(utils.COORDINATOR_LOG, sendCommand)
+	coordinator.Recover(shardMasterAddresses(shardList))
+
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%v", port))
 	if err != nil {
 		log.Println("Error starting server:", err)
@@ -31,13 +39,11 @@ func RouteRequestsToShards(port string, ch *models.ConsistentHash, shardList *mo
 				continue
 			}
 		}
-		shardID := ch.GetNode(conn.RemoteAddr().String())
-		log.Printf("shardID = %v for routing with consistent hash", shardID)
-		go sendRequestToShard(shardID, &conn, shardList)
+		go sendRequestToShard(&conn, ch, shardList, coordinator)
 	}
 }
 
-func sendRequestToShard(shardID string, conn *net.Conn, shardList *models.ShardsList) {
+func sendRequestToShard(conn *net.Conn, ch *models.ConsistentHash, shardList *models.ShardsList, coordinator *Coordinator) {
 	// Code
 	reader := bufio.NewReader(*conn)
 	command, err := reader.ReadString('\n')
@@ -45,8 +51,22 @@ func sendRequestToShard(shardID string, conn *net.Conn, shardList *models.Shards
 		fmt.Println("Error reading from connection:", err)
 		return
 	}
+	cmd := ParseCommand(command)
+	if cmd != nil && cmd.Name == utils.DTXN {
+		fmt.Fprintln(*conn, executeDistributed(cmd, ch, shardList, coordinator))
+		return
+	}
+
+	// commands on a key go to the shard owning the key, so a distributed
+	// transaction finds the keys written by single commands
+	routingKey := (*conn).RemoteAddr().String()
+	if cmd != nil && cmd.CollectionName != "" && len(cmd.Args) > 0 {
+		routingKey = keyRoutingKey(cmd.CollectionName, cmd.Args[0])
+	}
+	shardID := ch.GetNode(routingKey)
+	log.Printf("shardID = %v for routing with consistent hash", shardID)
 	shard := shardList.GetShard(shardID)
-	shardIP := shard.Nodes[0].Config.IP + ":" + shard.Nodes[0].Config.Port
+	shardIP := shardMasterAddress(shard)
 
 	shardList.GetShard(shardID).PrintActiveConnections()
 	res, err := sendCommand(command, shardIP)
@@ -64,6 +84,7 @@ func sendCommand(command string, ip string) (string, error) {
 		log.Printf("error connecting to shard: %v", err)
 		return "", err
 	}
+	defer shardConn.Close()
 	_, err = shardConn.Write([]byte(command + "\n"))
 	if err != nil {
 		log.Printf("error writing to shard: %v", err)
@@ -78,3 +99,48 @@ func sendCommand(command string, ip string) (string, error) {
 
 	return response, nil
 }
+
+// keyRoutingKey is what the consistent hash places a key of a collection by
+func keyRoutingKey(collection, key string) string {
+	return collection + "/" + key
+}
+
+// shardMasterAddress returns the address of the master of the shard
+func shardMasterAddress(shard *models.Shard) string {
+	master := shard.DbState.GetMaster()
+	if master.Port == "" {
+		master = shard.Nodes[0].Config
+	}
+	return master.IP + ":" + master.Port
+}
+
+func shardMasterAddresses(shardList *models.ShardsList) []string {
+	addresses := make([]string, 0, len(shardList.Shards))
+	for _, shard := range shardList.Shards {
+		addresses = append(addresses, shardMasterAddress(shard))
+	}
+	return addresses
+}
+
+// executeDistributed handles DTXN <command> [; <command>...], the writes are
+// routed to the shards owning their keys and committed there atomically
+func executeDistributed(cmd *Command, ch *models.ConsistentHash, shardList *models.ShardsList, coordinator *Coordinator) string {
+	tokens := append([]string{cmd.CollectionName}, cmd.Args...)
+	ops := make(map[string][]string)
+	for _, part := range splitCommands(tokens) {
+		op, err := parseTxnCommand(part)
+		if err != nil || !preparedCommands[op.Name] {
+			return "Usage: DTXN <SET|DELETE|SET-TTL|EXPIREAT> <collection> <key> [args] [; <command>...]"
+		}
+		shard := shardList.GetShard(ch.GetNode(keyRoutingKey(op.CollectionName, op.Args[0])))
+		if shard == nil {
+			return "ERROR: no shard for key " + op.Args[0]
+		}
+		address := shardMasterAddress(shard)
+		ops[address] = append(ops[address], strings.Join(part, " "))
+	}
+	if len(ops) == 0 {
+		return "Usage: DTXN <SET|DELETE|SET-TTL|EXPIREAT> <collection> <key> [args] [; <command>...]"
+	}
+	return coordinator.Execute(ops)
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/utils"
+)
+
+// RecoveryTarget is the point in the history of a node a recovery stops
+// at, the last record logged no later than Time and no later than Seq
+type RecoveryTarget struct {
+	Time        time.Time // zero for no limit on the time
+	Seq         uint64    // 0 for no limit on the sequence number
+	Collections []string  // every collection when empty
+}
+
+// after reports whether the record comes after the target. Records logged
+// before records were timestamped count as older than any time
+func (t RecoveryTarget) after(cmd Command, seq uint64) bool {
+	return (t.Seq != 0 && seq > t.Seq) || (!t.Time.IsZero() && cmd.Time > t.Time.UnixMilli())
+}
+
+// recoveryDump is a dump a recovery can start from, or a rewritten log
+// file whose compacted records rebuild the state as of seq
+type recoveryDump struct {
+	path      string
+	seq       uint64
+	savedAt   time.Time
+	rewritten bool
+}
+
+// recoveryLog is a file of records, lastSeq is 0 for an active segment
+type recoveryLog struct {
+	path     string
+	firstSeq uint64
+	lastSeq  uint64
+}
+
+// RecoverToPoint rebuilds the state of a node as of the target into a
+// fresh data directory: it loads the newest dump of the sources taken no
+// later than the target and replays the records logged after it up to the
+// target. The sources are the snapshot log of the node and backup
+// directories of it, the result is a dump next to outPath which a node
+// with that snapshot path loads on startup
+func RecoverToPoint(sources []string, target RecoveryTarget, outPath string, w io.Writer) error {
+	if err := checkFreshDir(filepath.Dir(outPath)); err != nil {
+		return err
+	}
+	dumps, logs, err := recoverySources(sources)
+	if err != nil {
+		return err
+	}
+
+	cs := models.NewCollectionStore()
+	var start uint64
+	var base []Command
+	if dump := startingDump(dumps, target); dump != nil && dump.rewritten {
+		if base, err = compactedRecords(dump.path); err != nil {
+			return err
+		}
+		start = dump.seq
+		fmt.Fprintf(w, "loaded the rewritten log %v at record %v from %v with %v records\n", dump.path, dump.seq, dump.savedAt.Format(time.RFC3339), len(base))
+	} else if dump != nil {
+		img, err := ReadDump(dump.path)
+		if err != nil {
+			return err
+		}
+		cs.RestoreDump(img)
+		start = dump.seq
+		fmt.Fprintf(w, "loaded dump %v at record %v from %v with %v keys\n", dump.path, dump.seq, dump.savedAt.Format(time.RFC3339), img.Keys())
+	} else {
+		fmt.Fprintf(w, "no dump was taken before the target, replaying the log from its first record\n")
+	}
+	cmds, last, lastTime, err := recoveryRecords(logs, start, target)
+	if err != nil {
+		return err
+	}
+	// the keys are expired as of the target, not as of the recovery
+	expireAt := target.Time
+	if expireAt.IsZero() && lastTime != 0 {
+		expireAt = time.UnixMilli(lastTime)
+	}
+	replayCommands(append(base, cmds...), cs, expireAt)
+	at := ""
+	if lastTime != 0 {
+		at = " logged at " + time.UnixMilli(lastTime).Format(time.RFC3339)
+	}
+	fmt.Fprintf(w, "replayed %v records up to record %v%v\n", len(cmds), last, at)
+
+	if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+		return err
+	}
+	img, err := captureDump(cs, outPath)
+	if err != nil {
+		return err
+	}
+	if len(target.Collections) > 0 {
+		img.KeepCollections(target.Collections)
+	}
+	keys := img.Keys()
+	if err := saveDump(img, outPath); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "wrote %v keys to %v\n", keys, DumpPath(outPath))
+	return nil
+}
+
+// checkFreshDir makes sure a recovery doesn't mix its dump with the files
+// of another node
+func checkFreshDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%v is not empty, recover into a fresh data directory", dir)
+	}
+	return nil
+}
+
+// recoverySources lists the dumps and the log files of the sources in the
+// order of their records, a directory is read as a backup and anything
+// else as a snapshot log
+func recoverySources(sources []string) ([]recoveryDump, []recoveryLog, error) {
+	var dumps []recoveryDump
+	var logs []recoveryLog
+	for _, source := range sources {
+		info, err := os.Stat(source)
+		if err != nil {
+			return nil, nil, err
+		}
+		if info.IsDir() {
+			manifest, err := verifyBackup(source)
+			if err != nil {
+				return nil, nil, fmt.Errorf("backup %v: %w", source, err)
+			}
+			dumps = append(dumps, recoveryDump{path: filepath.Join(source, manifest.Dump.File), seq: manifest.Dump.LastSeq, savedAt: manifest.Dump.TakenAt})
+			for _, file := range manifest.Segments {
+				logs = append(logs, recoveryLog{path: filepath.Join(source, file.File), firstSeq: file.FirstSeq, lastSeq: file.LastSeq})
+			}
+			continue
+		}
+
+		manifest, err := readManifest(source)
+		if err != nil {
+			return nil, nil, err
+		}
+		if manifest.Dump != nil {
+			dumps = append(dumps, recoveryDump{path: DumpPath(source), seq: manifest.Dump.Seq, savedAt: manifest.Dump.SavedAt})
+		}
+		for _, segment := range manifest.Segments {
+			path := segmentPath(source, segment.ID)
+			if segment.Rewrite != nil {
+				dumps = append(dumps, recoveryDump{path: path, seq: segment.Rewrite.Seq, savedAt: segment.CreatedAt, rewritten: true})
+			}
+			logs = append(logs, recoveryLog{path: path, firstSeq: segment.FirstSeq, lastSeq: segment.LastSeq})
+		}
+		if manifest.Active.Rewrite != nil {
+			dumps = append(dumps, recoveryDump{path: source, seq: manifest.Active.Rewrite.Seq, savedAt: manifest.Active.CreatedAt, rewritten: true})
+		}
+		logs = append(logs, recoveryLog{path: source, firstSeq: manifest.lastSeq() + 1})
+	}
+	sort.SliceStable(logs, func(i, j int) bool { return logs[i].firstSeq < logs[j].firstSeq })
+	return dumps, logs, nil
+}
+
+// startingDump returns the newest dump taken no later than the target, nil
+// when the recovery has to start from an empty store
+func startingDump(dumps []recoveryDump, target RecoveryTarget) *recoveryDump {
+	var start *recoveryDump
+	for i := range dumps {
+		dump := &dumps[i]
+		if (target.Seq != 0 && dump.seq > target.Seq) || (!target.Time.IsZero() && dump.savedAt.After(target.Time)) {
+			continue
+		}
+		if start == nil || dump.seq > start.seq {
+			start = dump
+		}
+	}
+	return start
+}
+
+// compactedRecords returns the compacted records at the start of a
+// rewritten log file
+func compactedRecords(path string) ([]Command, error) {
+	cmds := []Command{}
+	done := false
+	err := readLog(path, 0, func(cmd Command, seq uint64) {
+		if done || seq != 0 || cmd.Name == utils.LOG_REWRITTEN {
+			done = true
+			return
+		}
+		cmds = append(cmds, cmd)
+	})
+	// the active segment of a node may end in a record torn by a crash
+	var corruption *LogCorruption
+	if errors.As(err, &corruption) && corruption.Torn && done {
+		err = nil
+	}
+	return cmds, err
+}
+
+// recoveryRecords reads the records after start up to the target from the
+// log files, a record held by more than one of them is read once. It
+// returns the records with the sequence number and the time of the last one
+func recoveryRecords(logs []recoveryLog, start uint64, target RecoveryTarget) ([]Command, uint64, int64, error) {
+	cmds := []Command{}
+	last, lastTime := start, int64(0)
+	reached := false
+	for _, file := range logs {
+		if reached {
+			break
+		}
+		if file.lastSeq != 0 && file.lastSeq <= last {
+			continue
+		}
+		if file.firstSeq > last+1 {
+			return nil, 0, 0, fmt.Errorf("records %v to %v are missing, none of the sources holds them", last+1, file.firstSeq-1)
+		}
+
+		var gap error
+		err := readLog(file.path, 0, func(cmd Command, seq uint64) {
+			if reached || gap != nil || seq <= last {
+				return
+			}
+			if seq != last+1 {
+				gap = fmt.Errorf("records %v to %v are missing before %v", last+1, seq-1, file.path)
+				return
+			}
+			if target.after(cmd, seq) {
+				reached = true
+				return
+			}
+			cmds = append(cmds, cmd)
+			last = seq
+			if cmd.Time != 0 {
+				lastTime = cmd.Time
+			}
+		})
+		// the active segment of a node may end in a record torn by a crash
+		var corruption *LogCorruption
+		if os.IsNotExist(err) || (errors.As(err, &corruption) && corruption.Torn) {
+			err = nil
+		}
+		if err == nil {
+			err = gap
+		}
+		if err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	if !reached && target.Seq > last {
+		return nil, 0, 0, fmt.Errorf("the sources hold the records up to %v, not up to %v", last, target.Seq)
+	}
+	return cmds, last, lastTime, nil
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// RepairLog checks every record of a log, its sealed segments and the
+// active one, and reports the first damaged record of each. With fix the
+// active segment is cut off at the damaged record, the bytes cut off are
+// kept in <log>.corrupt so nothing is lost for good. A damaged sealed
+// segment is only reported: the later segments continue it, so cutting it
+// off would lose their records as well
+func RepairLog(path string, fix bool, w io.Writer) error {
+	damaged, err := checkSegments(path, w)
+	if err != nil {
+		return err
+	}
+	if damaged {
+		fmt.Fprintf(w, "sealed segments are damaged, restore the records from a backup or recover the node up to the damage with kv-server recover\n")
+		if fix {
+			return errors.New("repair-log only cuts off the active segment, the sealed segments are left as they are")
+		}
+	}
+
+	records := 0
+	err = readLog(path, 0, func(Command, uint64) { records++ })
+	var corruption *LogCorruption
+	if !errors.As(err, &corruption) {
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%v: %v records, no damage found\n", path, records)
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	dropped := info.Size() - corruption.Offset
+	fmt.Fprintf(w, "%v\n", corruption)
+	fmt.Fprintf(w, "%v valid records before it, %v bytes from it to the end of the log\n", records, dropped)
+	if !fix {
+		fmt.Fprintf(w, "run with -fix to cut the log off at offset %v\n", corruption.Offset)
+		return nil
+	}
+
+	if err := saveCorruptTail(path, corruption.Offset); err != nil {
+		return err
+	}
+	if err := truncateLog(path, corruption.Offset); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "cut the log off at offset %v, the %v bytes after it are in %v\n", corruption.Offset, dropped, path+".corrupt")
+	return nil
+}
+
+// checkSegments checks the records of the sealed segments of the log and
+// that each of them continues the one before it, it returns whether any
+// damage was found
+func checkSegments(path string, w io.Writer) (bool, error) {
+	manifest, err := readManifest(path)
+	if err != nil {
+		return false, err
+	}
+	damaged := false
+	var last uint64
+	for _, segment := range manifest.Segments {
+		file := segmentPath(path, segment.ID)
+		if last != 0 && segment.FirstSeq > last+1 {
+			fmt.Fprintf(w, "records %v to %v are missing before %v\n", last+1, segment.FirstSeq-1, file)
+			damaged = true
+		}
+		last = segment.LastSeq
+
+		records := 0
+		err := readLog(file, 0, func(Command, uint64) { records++ })
+		var corruption *LogCorruption
+		if errors.As(err, &corruption) {
+			fmt.Fprintf(w, "%v\n", corruption)
+			fmt.Fprintf(w, "%v valid records before it in sealed segment %v\n", records, segment.ID)
+			damaged = true
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		fmt.Fprintf(w, "%v: %v records, no damage found\n", file, records)
+	}
+	return damaged, nil
+}
+
+func saveCorruptTail(path string, offset int64) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	dst, err := os.Create(path + ".corrupt")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/utils"
+)
+
+// RewriteLog replaces the log with the minimal commands which rebuild the
+// current state. The state is captured under the exclusive execution lock
+// with the active segment sealed, from then on every append to the new
+// active segment is also buffered. The new file is written while writes
+// keep flowing, then the buffered appends are copied to it and it is
+// renamed over the active segment between two appends of the log writer.
+// The dump and the sealed segments are removed once the manifest lists the
+// new file as the start of the log, except the segments the next
+// incremental backup needs, so a crash at any point leaves either the old
+// log or the new one complete.
+//
+// The compacted records carry no sequence number and end with a
+// LOG-REWRITTEN record holding the length of the segment sealed at the
+// capture and its last sequence number, the records after it keep the
+// numbers they had in the old file
+func RewriteLog(cs *models.CollectionStore, snapshotPath string) error {
+	w := getLogWriter(snapshotPath)
+
+	cs.LockExclusive()
+	w.mu.Lock()
+	if err := w.openLocked(); err != nil {
+		w.mu.Unlock()
+		cs.UnlockExclusive()
+		return err
+	}
+	if w.rewrite != nil {
+		w.mu.Unlock()
+		cs.UnlockExclusive()
+		return errors.New("the log is already being rewritten")
+	}
+	// the records up to the capture stay in sealed segments, which the
+	// next incremental backup may still need
+	offset, seq := w.size, w.seq
+	if w.size > 0 {
+		if err := w.rollLocked(); err != nil {
+			w.mu.Unlock()
+			cs.UnlockExclusive()
+			return err
+		}
+	}
+	w.rewrite = &bytes.Buffer{}
+	w.mu.Unlock()
+	img := cs.CaptureDump(seq)
+	cs.UnlockExclusive()
+	defer img.Release()
+
+	if err := writeRewrittenLog(img, offset, w, snapshotPath); err != nil {
+		w.mu.Lock()
+		w.rewrite = nil
+		w.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func writeRewrittenLog(img *models.DumpImage, offset int64, w *logWriter, snapshotPath string) error {
+	dir := filepath.Dir(snapshotPath)
+	tmp, err := os.CreateTemp(dir, filepath.Base(snapshotPath)+".rewrite-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	records, err := rewriteCommands(img, time.Now())
+	if err != nil {
+		return err
+	}
+	records = append(records, Command{Name: utils.LOG_REWRITTEN, Args: []string{strconv.FormatInt(offset, 10), strconv.FormatUint(img.LogSeq, 10)}})
+	writer := bufio.NewWriter(tmp)
+	var compacted int64
+	for _, record := range records {
+		payload, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		n, err := writer.Write(encodeRecord(0, payload))
+		if err != nil {
+			return err
+		}
+		compacted += int64(n)
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	// no append can happen from here until the new file is in place
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.openLocked(); err != nil {
+		return err
+	}
+	tail := w.rewrite.Len()
+	if _, err := tmp.Write(w.rewrite.Bytes()); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), snapshotPath); err != nil {
+		return err
+	}
+	w.rewrite = nil
+	w.reopenLocked()
+	if err := syncDir(dir); err != nil {
+		log.Printf("error syncing %v: %v", dir, err)
+	}
+
+	m := w.manifest
+	dump := m.Dump
+	m.Dump = nil
+	m.Active = logSegment{ID: m.Active.ID, File: filepath.Base(snapshotPath), FirstSeq: img.LogSeq + 1, CreatedAt: img.CreatedAt, Rewrite: &logRewrite{Seq: img.LogSeq, Size: compacted}}
+	if err := w.removeCoveredLocked(); err != nil {
+		return err
+	}
+	if dump != nil {
+		if err := os.Remove(DumpPath(snapshotPath)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("error removing the dump of %v: %v", snapshotPath, err)
+		}
+	}
+	log.Printf("rewrote %v to %v records up to record %v, %v bytes appended during the rewrite", snapshotPath, len(records), img.LogSeq, tail)
+	return nil
+}
+
+// rewriteCommands returns the records which rebuild the image: the leases,
+// the locks, a SET and an EXPIREAT for every live key and the prepared
+// transactions. The lease ids and the fencing tokens continue where they
+// left off even when their last lease or lock is gone
+func rewriteCommands(img *models.DumpImage, now time.Time) ([]Command, error) {
+	var records []Command
+
+	leases, lastLeaseID := img.Leases()
+	lastLeaseLive := false
+	for _, lease := range leases {
+		records = append(records, *leaseGrantRecord(lease))
+		lastLeaseLive = lastLeaseLive || lease.ID == lastLeaseID
+	}
+	if lastLeaseID > 0 && !lastLeaseLive {
+		records = append(records, *leaseGrantRecord(models.Lease{ID: lastLeaseID, ExpiresAt: time.UnixMilli(0)}), *leaseRevokeRecord(lastLeaseID))
+	}
+
+	locks, lastToken := img.Locks()
+	lastTokenHeld := false
+	for _, lock := range locks {
+		records = append(records, lockRecord(lock, true))
+		lastTokenHeld = lastTokenHeld || lock.Token == lastToken
+	}
+	if lastToken > 0 && !lastTokenHeld {
+		records = append(records, lockRecord(models.DistributedLock{Token: lastToken}, false))
+	}
+
+	err := img.Scan(func(collection, key string, value *models.Value, payload string, lease int64) {
+		if value.IsExpired(now) {
+			return
+		}
+		if value.Encoding() != "" {
+			payload = base64.StdEncoding.EncodeToString([]byte(payload))
+		}
+		records = append(records, Command{Name: utils.SET, CollectionName: collection, Args: []string{key, payload}, Encoding: value.Encoding(), Lease: lease})
+		if value.HasExpiration() {
+			records = append(records, Command{Name: utils.EXPIRE_AT, CollectionName: collection, Args: []string{key, strconv.FormatInt(value.GetExpiration().UnixMilli(), 10)}})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tx := range img.Prepared() {
+		batch := make([]Command, 0, len(tx.Mutations))
+		for _, m := range tx.Mutations {
+			batch = append(batch, mutationToCommand(m))
+		}
+		records = append(records, Command{Name: utils.PREPARE, CollectionName: tx.TxID, Batch: batch})
+	}
+	return records, nil
+}
+
+// readRewrite reads the compacted records at the start of a rewritten log
+// file and returns where they leave off, nil for a file which wasn't
+// rewritten
+func readRewrite(path string) (*logRewrite, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var size int64
+	for {
+		line, err := readLine(reader)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		// a legacy line has no frame, a numbered record follows the
+		// compacted ones
+		if len(line) == 0 || line[0] == '{' {
+			return nil, nil
+		}
+		cmd, seq, err := parseRecord(line)
+		if err != nil || seq != 0 {
+			return nil, nil
+		}
+		size += int64(len(line))
+		if cmd.Name == utils.LOG_REWRITTEN {
+			return &logRewrite{Seq: nextSequence(cmd, seq), Size: size}, nil
+		}
+	}
+}
+
+// rewriteDue reports whether the log replayed on top of a dump or the
+// compacted records of a rewrite of the size outgrew the thresholds
+func rewriteDue(config models.LogRewriteConfig, size, baseSize int64) bool {
+	if config.Percentage <= 0 || size < config.MinSize {
+		return false
+	}
+	if baseSize == 0 {
+		return true
+	}
+	return size*100/baseSize >= int64(config.Percentage)
+}
+
+// StartLogRewrite rewrites the snapshot log whenever it outgrows the
+// thresholds of the config, only the master rewrites the log
+func StartLogRewrite(cs *models.CollectionStore, duration time.Duration, kvServer *models.KVServer, saver *dumpSaver, snapshotPath string) {
+	ticker := time.NewTicker(duration)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !kvServer.Config.IsMaster {
+			continue
+		}
+		size, baseSize, err := logSize(snapshotPath)
+		if err != nil {
+			log.Printf("error reading the segments of %v: %v", snapshotPath, err)
+			continue
+		}
+		if !rewriteDue(kvServer.Config.LogRewrite, size, baseSize) || !saver.begin() {
+			continue
+		}
+		log.Printf("log %v grew to %v bytes since the last dump or rewrite, rewriting it", snapshotPath, size)
+		saver.finish(RewriteLog(cs, snapshotPath))
+	}
+}
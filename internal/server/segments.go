@@ -0,0 +1,422 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/utils"
+)
+
+// The snapshot log is split into segments. The active segment is the log
+// file itself, once it is full or old enough it is renamed to
+// <snapshot>.<id> and sealed, and a new active segment starts. The manifest
+// next to the log lists the dump the log continues from and the sealed
+// segments with the records they hold, a segment is removed once a dump or
+// a rewrite covers all of its records. Once a backup was taken the segments
+// after the last record it holds are kept until the next incremental backup
+// copied them
+type logManifest struct {
+	Dump     *manifestDump `json:"dump,omitempty"`
+	Segments []logSegment  `json:"segments"`
+	Active   logSegment    `json:"active"`
+	Backup   uint64        `json:"backup_seq,omitempty"`
+}
+
+type manifestDump struct {
+	File    string    `json:"file"`
+	Seq     uint64    `json:"seq"`
+	SavedAt time.Time `json:"saved_at"`
+}
+
+// logSegment is a file of the log, File is relative to the directory of the
+// log and LastSeq is 0 for the active segment. A segment RewriteLog wrote
+// starts with the compacted state of the log as of Rewrite.Seq, FirstSeq is
+// the record after it
+type logSegment struct {
+	ID        int         `json:"id"`
+	File      string      `json:"file"`
+	FirstSeq  uint64      `json:"first_seq"`
+	LastSeq   uint64      `json:"last_seq"`
+	Size      int64       `json:"size"`
+	CreatedAt time.Time   `json:"created_at"`
+	SealedAt  time.Time   `json:"sealed_at,omitempty"`
+	Rewrite   *logRewrite `json:"rewrite,omitempty"`
+}
+
+// logRewrite is where the compacted records of a rewritten segment leave
+// off and the bytes they take
+type logRewrite struct {
+	Seq  uint64 `json:"seq"`
+	Size int64  `json:"size"`
+}
+
+// ManifestPath returns the path of the manifest of the snapshot log
+func ManifestPath(snapshotPath string) string {
+	return snapshotPath + utils.MANIFEST_SUFFIX
+}
+
+// segmentPath returns the path of the sealed segment of the snapshot log
+func segmentPath(snapshotPath string, id int) string {
+	return fmt.Sprintf("%s.%06d", snapshotPath, id)
+}
+
+// lastSeq is the sequence number of the last record before the active
+// segment
+func (m *logManifest) lastSeq() uint64 {
+	var seq uint64
+	if m.Dump != nil {
+		seq = m.Dump.Seq
+	}
+	if n := len(m.Segments); n > 0 && m.Segments[n-1].LastSeq > seq {
+		seq = m.Segments[n-1].LastSeq
+	}
+	if m.Active.Rewrite != nil && m.Active.Rewrite.Seq > seq {
+		seq = m.Active.Rewrite.Seq
+	}
+	return seq
+}
+
+// rewritten returns the index of the segment the log was last rewritten
+// into, len(m.Segments) for the active one and -1 when there is none. The
+// compacted state of that segment replaces everything before it, unless a
+// dump was saved after the rewrite
+func (m *logManifest) rewritten() int {
+	if m.Active.Rewrite != nil {
+		return len(m.Segments)
+	}
+	for i := len(m.Segments) - 1; i >= 0; i-- {
+		if m.Segments[i].Rewrite != nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// readManifest reads the manifest of the snapshot log and reconciles it with
+// the files on disk: a crash between sealing a segment or saving a dump and
+// writing the manifest leaves files it doesn't list yet, which are added,
+// and segments which are gone are dropped
+func readManifest(snapshotPath string) (*logManifest, error) {
+	m := &logManifest{}
+	data, err := os.ReadFile(ManifestPath(snapshotPath))
+	if err == nil {
+		if err := json.Unmarshal(data, m); err != nil {
+			return nil, fmt.Errorf("invalid manifest %v: %w", ManifestPath(snapshotPath), err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	ids, err := segmentIDs(snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[int]logSegment, len(m.Segments))
+	for _, segment := range m.Segments {
+		listed[segment.ID] = segment
+	}
+	m.Segments = m.Segments[:0]
+	for _, id := range ids {
+		segment, ok := listed[id]
+		if !ok {
+			if segment, err = scanSegment(snapshotPath, id); err != nil {
+				return nil, err
+			}
+		}
+		m.Segments = append(m.Segments, segment)
+	}
+
+	if m.Dump == nil {
+		if img, err := ReadDump(DumpPath(snapshotPath)); err == nil {
+			m.Dump = &manifestDump{File: filepath.Base(DumpPath(snapshotPath)), Seq: img.LogSeq, SavedAt: img.CreatedAt}
+		}
+	}
+	if n := len(m.Segments); n > 0 && m.Active.ID <= m.Segments[n-1].ID {
+		m.Active = logSegment{ID: m.Segments[n-1].ID + 1}
+	}
+	if m.Active.ID == 0 {
+		m.Active.ID = 1
+	}
+	m.Active.File = filepath.Base(snapshotPath)
+	m.Active.LastSeq = 0
+
+	// a crash right after RewriteLog renamed its file into place leaves a
+	// manifest which doesn't list the rewrite yet, and the dump from before
+	// it, which the rewrite replaces
+	if m.Active.Rewrite == nil {
+		if m.Active.Rewrite, err = readRewrite(snapshotPath); err != nil {
+			return nil, err
+		}
+	}
+	if i := m.rewritten(); i >= 0 && m.Dump != nil {
+		rewrite := m.Active.Rewrite
+		if i < len(m.Segments) {
+			rewrite = m.Segments[i].Rewrite
+		}
+		if m.Dump.Seq <= rewrite.Seq {
+			m.Dump = nil
+		}
+	}
+	return m, nil
+}
+
+// segmentIDs returns the ids of the sealed segments on disk in order
+func segmentIDs(snapshotPath string) ([]int, error) {
+	matches, err := filepath.Glob(snapshotPath + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, match := range matches {
+		suffix := strings.TrimPrefix(match, snapshotPath+".")
+		if len(suffix) < 6 || strings.Trim(suffix, "0123456789") != "" {
+			continue
+		}
+		if id, err := strconv.Atoi(suffix); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// scanSegment reads the sequence numbers of a segment the manifest misses
+func scanSegment(snapshotPath string, id int) (logSegment, error) {
+	path := segmentPath(snapshotPath, id)
+	info, err := os.Stat(path)
+	if err != nil {
+		return logSegment{}, err
+	}
+	segment := logSegment{ID: id, File: filepath.Base(path), Size: info.Size(), CreatedAt: info.ModTime(), SealedAt: info.ModTime()}
+	if segment.Rewrite, err = readRewrite(path); err != nil {
+		return segment, err
+	}
+	if segment.Rewrite != nil {
+		segment.FirstSeq, segment.LastSeq = segment.Rewrite.Seq+1, segment.Rewrite.Seq
+	}
+	err = readLog(path, 0, func(cmd Command, seq uint64) {
+		if seq == 0 {
+			return
+		}
+		if segment.FirstSeq == 0 {
+			segment.FirstSeq = seq
+		}
+		segment.LastSeq = nextSequence(cmd, seq)
+	})
+	return segment, err
+}
+
+// writeManifest replaces the manifest with a synced temporary file
+func writeManifest(snapshotPath string, m *logManifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := ManifestPath(snapshotPath)
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// SetLogSegments sets when the active segment of the log is sealed
+func SetLogSegments(filename string, config models.LogSegmentConfig) {
+	w := getLogWriter(filename)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.segments = config
+}
+
+// rollLocked seals the active segment and starts a new one. The log file is
+// renamed first, so after a crash the segment is either still the active
+// one or a sealed one which readManifest picks up
+func (w *logWriter) rollLocked() error {
+	if err := w.syncLocked(); err != nil {
+		return err
+	}
+	segment := w.manifest.Active
+	path := segmentPath(w.path, segment.ID)
+	segment.File = filepath.Base(path)
+	segment.LastSeq = w.seq
+	segment.Size = w.size
+	segment.SealedAt = time.Now()
+	if err := os.Rename(w.path, path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		w.reopenLocked()
+		return err
+	}
+	w.file.Close()
+	w.file, w.size = file, 0
+	w.manifest.Segments = append(w.manifest.Segments, segment)
+	w.manifest.Active = logSegment{ID: segment.ID + 1, File: filepath.Base(w.path), FirstSeq: w.seq + 1, CreatedAt: segment.SealedAt}
+	log.Printf("sealed segment %v of %v with records %v to %v", segment.ID, w.path, segment.FirstSeq, segment.LastSeq)
+	return writeManifest(w.path, w.manifest)
+}
+
+// rollIfOld seals the active segment once it is older than the max age
+func (w *logWriter) rollIfOld() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil || w.size == 0 || w.rewrite != nil || w.segments.MaxAge <= 0 || time.Since(w.manifest.Active.CreatedAt) < w.segments.MaxAge {
+		return
+	}
+	if err := w.rollLocked(); err != nil {
+		log.Printf("error sealing the active segment of %v: %v", w.path, err)
+	}
+}
+
+// sealLog seals the active segment, unless it is empty, and returns the
+// sequence number of the last record of the log. Called with the exclusive
+// execution lock held it gives the point a dump is captured at, from which
+// on every record is in a segment the dump doesn't cover
+func sealLog(snapshotPath string) (uint64, error) {
+	w := getLogWriter(snapshotPath)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.openLocked(); err != nil {
+		return 0, err
+	}
+	if w.rewrite != nil {
+		return 0, errors.New("the log is being rewritten")
+	}
+	if w.size > 0 {
+		if err := w.rollLocked(); err != nil {
+			return 0, err
+		}
+	}
+	return w.seq, nil
+}
+
+// dumpSaved records the dump in the manifest and removes the sealed
+// segments whose records it covers
+func dumpSaved(snapshotPath string, img *models.DumpImage) error {
+	w := getLogWriter(snapshotPath)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.openLocked(); err != nil {
+		return err
+	}
+	w.manifest.Dump = &manifestDump{File: filepath.Base(DumpPath(snapshotPath)), Seq: img.LogSeq, SavedAt: img.CreatedAt}
+	return w.removeCoveredLocked()
+}
+
+// backupTaken records the last record of a backup of the log and removes
+// the segments which were only kept for it
+func backupTaken(snapshotPath string, seq uint64) error {
+	w := getLogWriter(snapshotPath)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.openLocked(); err != nil {
+		return err
+	}
+	if seq > w.manifest.Backup {
+		w.manifest.Backup = seq
+	}
+	return w.removeCoveredLocked()
+}
+
+// removeCoveredLocked drops the sealed segments whose records the dump or
+// the last rewrite cover from the manifest and removes them, except those
+// holding records after the last backup
+func (w *logWriter) removeCoveredLocked() error {
+	m := w.manifest
+	rewritten := m.rewritten()
+	var covered, kept []logSegment
+	for i, segment := range m.Segments {
+		base := i < rewritten || (m.Dump != nil && segment.LastSeq <= m.Dump.Seq)
+		if base && (m.Backup == 0 || segment.LastSeq <= m.Backup) {
+			covered = append(covered, segment)
+		} else {
+			kept = append(kept, segment)
+		}
+	}
+	m.Segments = kept
+	if err := writeManifest(w.path, m); err != nil {
+		return err
+	}
+	for _, segment := range covered {
+		if err := os.Remove(segmentPath(w.path, segment.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("error removing segment %v of %v: %v", segment.ID, w.path, err)
+		}
+	}
+	if len(covered) > 0 {
+		log.Printf("removed %v segments of %v up to record %v", len(covered), w.path, covered[len(covered)-1].LastSeq)
+	}
+	return nil
+}
+
+// logSize returns the bytes of the log which a load replays on top of its
+// base, the dump or the compacted records of the last rewrite, and the
+// bytes of the base
+func logSize(snapshotPath string) (int64, int64, error) {
+	m, err := readManifest(snapshotPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	active := m.Active
+	if info, err := os.Stat(snapshotPath); err == nil {
+		active.Size = info.Size()
+	}
+	segments := append(m.Segments, active)
+
+	var size, base int64
+	start := m.rewritten()
+	if m.Dump != nil {
+		if info, err := os.Stat(DumpPath(snapshotPath)); err == nil {
+			base = info.Size()
+		}
+		start = 0
+	}
+	for i, segment := range segments {
+		if i < start || (m.Dump != nil && i < len(m.Segments) && segment.LastSeq <= m.Dump.Seq) {
+			continue
+		}
+		size += segment.Size
+		if segment.Rewrite != nil {
+			size -= segment.Rewrite.Size
+			if m.Dump == nil && i == start {
+				base = segment.Rewrite.Size
+			}
+		}
+	}
+	return size, base, nil
+}
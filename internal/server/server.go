@@ -4,11 +4,15 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	models "github.com/sk25469/kv/internal/model"
 	"github.com/sk25469/kv/utils"
@@ -34,16 +38,35 @@ func StartServer(config *models.Config, isMaster bool, readySignal chan<- bool,
 	log.Printf("creating all the stores for the server: %v", config.Port)
 	cs := models.NewCollectionStore()
 	ps := models.NewPubSub()
-	ts := models.NewTransactionalKeyValueStore()
+	cs.SetNotifier(models.NewKeyspaceNotifier(ps, config.NotifyKeyspaceEvents))
+	cs.SetMemoryLimit(config.MemoryLimit)
+	cs.SetCompression(config.Compression)
+	storage := config.Storage
+	if storage.Dir == "" {
+		storage.Dir = filepath.Join(utils.STORAGE_DIRECTORY, config.Port)
+	}
+	if err := cs.SetStorage(storage); err != nil {
+		log.Printf("error opening the storage engines: %v", err)
+		return
+	}
+	cs.SetTiering(config.Tiering)
+	cs.SetEvictionHandler(func(collection, key string) error {
+		cmd := Command{Name: utils.EVICTED, CollectionName: collection, Args: []string{key}}
+		if err := WriteCommandsToFile(cmd, shardConfigDb.GetSnapshotPath()); err != nil {
+			log.Printf("error writing eviction of %v:%v to dump: %v", collection, key, err)
+			return err
+		}
+		return nil
+	})
 	kvServer := models.NewKVServer(config)
 
 	shard.AddNode(kvServer)
 
-	Start(config, readySignal, cs, ps, ts, kvServer, shardConfigDb, shard)
+	Start(config, readySignal, cs, ps, kvServer, shardConfigDb, shard)
 }
 
 // Start initializes the server
-func Start(config *models.Config, readySignal chan<- bool, cs *models.CollectionStore, ps *models.PubSub, ts *models.TransactionalKeyValueStore, kvServer *models.KVServer, shardConfigDb *models.ShardDbConfig, shard *models.Shard) {
+func Start(config *models.Config, readySignal chan<- bool, cs *models.CollectionStore, ps *models.PubSub, kvServer *models.KVServer, shardConfigDb *models.ShardDbConfig, shard *models.Shard) {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	contexts[config.Port] = ctx
@@ -58,17 +81,35 @@ func Start(config *models.Config, readySignal chan<- bool, cs *models.Collection
 	defer listener.Close()
 	log.Printf("Server is listening on port %v...\n", config.Port)
 
+	snapshotPath := shardConfigDb.GetSnapshotPath()
+	SetLogFsync(snapshotPath, config.AppendFsync)
+	SetLogLoadTruncated(snapshotPath, config.LogLoadTruncated)
+	SetLogSegments(snapshotPath, config.LogSegments)
 	err = handleInitLoad(cs, shardConfigDb, shard)
 	if err != nil {
 		log.Printf("error loading dump: %v", err)
 		return
 	}
+	// only the master logs lock changes, replicas apply what it logged. The
+	// handler is set once the log is replayed, so a lease which runs out
+	// during the replay isn't logged into the log being read
+	cs.Locks().SetHandler(func(lock models.DistributedLock, held bool) {
+		if !kvServer.Config.IsMaster {
+			return
+		}
+		if err := WriteCommandsToFile(lockRecord(lock, held), snapshotPath); err != nil {
+			log.Printf("error writing lock %v to dump: %v", lock.Name, err)
+		}
+	})
 
-	snapshotPath := shardConfigDb.GetSnapshotPath()
-	go WatchSnapshotAndUpdate(snapshotPath, cs, ts, kvServer, ps)
+	saver := newDumpSaver(snapshotPath)
+	go WatchSnapshotAndUpdate(snapshotPath, cs, kvServer, ps)
 
 	log.Printf("starting TTL cleanups")
-	StartKVCleanup(cs, utils.CLEANUP_DURATION)
+	go StartKVCleanup(cs, utils.CLEANUP_DURATION, kvServer, snapshotPath)
+	go StartLeaseExpiry(cs, utils.LEASE_CHECK_DURATION, kvServer, snapshotPath)
+	go StartLogRewrite(cs, utils.REWRITE_CHECK_DURATION, kvServer, saver, snapshotPath)
+	go StartTiering(cs, utils.TIERING_CHECK_DURATION)
 
 	// Accept client connections
 
@@ -82,6 +123,9 @@ func Start(config *models.Config, readySignal chan<- bool, cs *models.Collection
 			select {
 			case <-ctx.Done():
 				log.Printf("Server on port %v shutting down", config.Port)
+				if err := cs.Close(); err != nil {
+					log.Printf("error closing the storage engines: %v", err)
+				}
 				return // Exit goroutine when context is cancelled
 			default:
 				log.Printf("Error accepting connection: %v", err)
@@ -91,7 +135,7 @@ func Start(config *models.Config, readySignal chan<- bool, cs *models.Collection
 		// log.Printf("adding new connection to shard: %v", shard.ShardID)
 		shard.DbState.AddConnection(conn.RemoteAddr().String(), &conn)
 		// log.Printf("connected with client: %v", conn.RemoteAddr().String())
-		go handleConnection(conn, cs, ts, kvServer, ps, shardConfigDb, shard)
+		go handleConnection(conn, cs, kvServer, ps, shardConfigDb, shard, saver)
 	}
 }
 
@@ -105,7 +149,7 @@ func Start(config *models.Config, readySignal chan<- bool, cs *models.Collection
 // 6. Admin commands: SHUTDOWN, MAKE_MASTER, MAKE_SLAVE
 // 7. Config commands: CONFIG = get or set configuration
 // 8. Health commands: PING
-func handleConnection(conn net.Conn, cs *models.CollectionStore, ts *models.TransactionalKeyValueStore, kvServer *models.KVServer, ps *models.PubSub, shardConfigDb *models.ShardDbConfig, shard *models.Shard) {
+func handleConnection(conn net.Conn, cs *models.CollectionStore, kvServer *models.KVServer, ps *models.PubSub, shardConfigDb *models.ShardDbConfig, shard *models.Shard, saver *dumpSaver) {
 
 	reader := bufio.NewReader(conn)
 	remoteAddress := conn.RemoteAddr().String()
@@ -119,6 +163,8 @@ func handleConnection(conn net.Conn, cs *models.CollectionStore, ts *models.Tran
 
 	// handle client disconnection
 	defer func(clientId string) {
+		releaseWatches(cs, clientConfig)
+		endSnapshot(cs, clientConfig)
 		shard.DbState.RemoveConnection(conn.RemoteAddr().String())
 		conn.Close()
 		kvServer.HandleClientDisconnect(clientId, &conn)
@@ -135,13 +181,8 @@ func handleConnection(conn net.Conn, cs *models.CollectionStore, ts *models.Tran
 			return
 		}
 		cmd := ParseCommand(command)
-
-		if cmd != nil && ShouldWriteLog(*cmd) {
-			snapshotPath := shardConfigDb.GetSnapshotPath()
-			err = WriteCommandsToFile(*cmd, snapshotPath)
-			if err != nil {
-				log.Printf("error writing operation to dump")
-			}
+		if cmd != nil {
+			cmd = ResolveCommand(cmd, cs)
 		}
 
 		if cmd == nil {
@@ -149,18 +190,58 @@ func handleConnection(conn net.Conn, cs *models.CollectionStore, ts *models.Tran
 			return
 		}
 
+		if internalRecords[cmd.Name] {
+			if _, err := fmt.Fprintf(conn, "ERROR: %v is written by the server only\n", cmd.Name); err != nil {
+				log.Printf("error writing to the connection: %v : [%v]", conn, err)
+			}
+			continue
+		}
+
+		// between MULTI and EXEC everything else is queued by ExecuteCommand
+		if clientConfig.ClientState.State == utils.QUEUEING && cmd.Name != utils.EXEC {
+			if _, err := fmt.Fprintln(conn, ExecuteCommand(cmd, cs, clientConfig, kvServer, ps)); err != nil {
+				log.Printf("error writing to the connection: %v : [%v]", conn, err)
+			}
+			continue
+		}
+
 		switch cmd.Name {
 		case utils.SUBSCRIBE, utils.PUBLISH:
 			handlePubSubMode(cmd, conn, ps, clientConfig)
 		case utils.SHUTDOWN, utils.MAKE_MASTER, utils.MAKE_SLAVE:
 			handleAdminCommands(conn, kvServer, cmd)
+		case utils.COMMIT:
+			handleCommit(conn, cs, clientConfig, kvServer, shardConfigDb.GetSnapshotPath())
+		case utils.EXEC:
+			handleExec(conn, cs, clientConfig, kvServer, ps, shardConfigDb.GetSnapshotPath())
+		case utils.PREPARE, utils.COMMIT_PREPARED, utils.ABORT_PREPARED:
+			handlePrepared(conn, cmd, cs, clientConfig, kvServer, shardConfigDb.GetSnapshotPath())
+		case utils.LEASE:
+			handleLease(conn, cmd, cs, clientConfig, kvServer, shardConfigDb.GetSnapshotPath())
+		case utils.TXN:
+			handleTxn(conn, cmd, cs, clientConfig, kvServer, ps, shardConfigDb.GetSnapshotPath())
 		case utils.CONFIG:
 			handleConfigCommands(conn)
 		case utils.PING:
 			handleHealthCommands(conn)
+		case utils.BACKUP, utils.RESTORE:
+			handleBackup(conn, reader, cmd, cs, clientConfig, kvServer, saver, shardConfigDb.GetSnapshotPath())
+		case utils.SAVE, utils.SNAPSHOT, utils.BGSAVE, utils.LASTSAVE, utils.REWRITELOG:
+			result := "unauthorized"
+			if clientConfig.ClientState.IsAuthenticated || !kvServer.Config.ProtectedMode {
+				result = handleSaveCommands(cmd, cs, kvServer, saver, shardConfigDb.GetSnapshotPath())
+			}
+			if _, err := fmt.Fprintln(conn, result); err != nil {
+				log.Printf("error writing to the connection: %v : [%v]", conn, err)
+			}
 		default:
-
-			result := ExecuteCommand(cmd, cs, ts, clientConfig, kvServer, ps)
+			var result string
+			// writes inside a transaction are logged by COMMIT or EXEC as a single batch
+			if ShouldWriteLog(*cmd) && !inTransaction(clientConfig) {
+				result = ExecuteLogged(cmd, cs, clientConfig, kvServer, ps, shardConfigDb.GetSnapshotPath())
+			} else {
+				result = ExecuteCommand(cmd, cs, clientConfig, kvServer, ps)
+			}
 			// log.Printf("result for cmd: %v -------- %v", cmd, result)
 			_, err := fmt.Fprintln(conn, result)
 			if err != nil {
@@ -172,20 +253,138 @@ func handleConnection(conn net.Conn, cs *models.CollectionStore, ts *models.Tran
 	}
 }
 
+// ExecuteLogged executes a mutation and, once it succeeded, writes what it
+// changed to the snapshot under the same execution lock, so a dump never
+// sees a logged command which isn't applied yet. A failed or rejected
+// command leaves no record, a record which can't be written is replied
+// with an error
+func ExecuteLogged(cmd *Command, cs *models.CollectionStore, cc *models.ClientConfig, kv *models.KVServer, ps *models.PubSub, snapshotPath string) string {
+	defer lockCommand(cmd, cs)()
+	result := executeCommand(cmd, cs, cc, kv, ps)
+	if record := appliedMutation(cmd, result); record != nil {
+		record.Client = clientIdentity(cc)
+		if err := WriteCommandsToFile(*record, snapshotPath); err != nil {
+			log.Printf("error writing operation to dump: %v", err)
+			result = fmt.Sprintf("ERROR: %v", err)
+		}
+	}
+	return result
+}
+
+// appliedMutation returns the record of a command which succeeded, nil if
+// it failed. Mutations reply OK, except INCR and INCRBY which reply with
+// the new value and are logged as the SET of it
+func appliedMutation(cmd *Command, result string) *Command {
+	switch cmd.Name {
+	case utils.INCR, utils.INCRBY:
+		if _, err := strconv.ParseInt(result, 10, 64); err != nil {
+			return nil
+		}
+		return &Command{Name: utils.SET, CollectionName: cmd.CollectionName, Args: []string{cmd.Args[0], result}}
+	}
+	if result != "OK" {
+		return nil
+	}
+	record := *cmd
+	return &record
+}
+
+// clientIdentity names the client in the records it gets logged
+func clientIdentity(cc *models.ClientConfig) string {
+	if cc.IPAddress == "" {
+		return cc.ClientID
+	}
+	return cc.ClientID + "@" + cc.IPAddress
+}
+
 func handleInitLoad(cs *models.CollectionStore, shardConfig *models.ShardDbConfig, shard *models.Shard) error {
 	snapshotPath := shardConfig.GetSnapshotPath()
-	cmds, err := ReadCommandsFromFile(snapshotPath)
-	if err != nil {
+	if _, err := LoadSnapshot(snapshotPath, cs); err != nil {
 		log.Printf("error reading cmds from file: [%v]", err)
 		return err
 	}
-	for _, cmd := range cmds {
-		if ShouldWriteLog(cmd) {
-			_ = ExecuteCommand(&cmd, cs, nil, &models.ClientConfig{ClientState: &models.ClientState{State: utils.ACTIVE, IsAuthenticated: true}}, &models.KVServer{Config: &models.Config{ProtectedMode: false}}, nil)
+	return nil
+}
+
+// LoadSnapshot loads the latest dump and replays the records of the
+// snapshot log written after it, from the sealed segments the dump doesn't
+// cover and the active one, it returns the number of records read. A torn
+// tail left by a crash is cut off the active segment when
+// log-load-truncated is set, any other damage fails the load with the
+// offset of the record
+func LoadSnapshot(snapshotPath string, cs *models.CollectionStore) (int, error) {
+	return loadSnapshot(snapshotPath, cs, true)
+}
+
+// loadSnapshot only reads the log when repair is false, so a torn tail is
+// skipped but stays in the file
+func loadSnapshot(snapshotPath string, cs *models.CollectionStore, repair bool) (int, error) {
+	manifest, err := readManifest(snapshotPath)
+	if err != nil {
+		return 0, err
+	}
+	dumpSeq, restored, err := restoreDump(snapshotPath, manifest, cs)
+	if err != nil {
+		return 0, err
+	}
+	cmds := []Command{}
+	// with a dump the records it covers are skipped, including those
+	// written before the log was numbered and the compacted records of a
+	// rewrite. Without one the log starts at its last rewrite
+	collect := func(cmd Command, seq uint64) {
+		if !restored || seq > dumpSeq {
+			cmds = append(cmds, cmd)
+		}
+	}
+	rewritten := manifest.rewritten()
+	for i, segment := range manifest.Segments {
+		if (restored && segment.LastSeq <= dumpSeq) || (!restored && i < rewritten) {
+			continue
+		}
+		if err := readLog(segmentPath(snapshotPath, segment.ID), 0, collect); err != nil {
+			return 0, err
+		}
+	}
+	err = readLog(snapshotPath, 0, collect)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	var corruption *LogCorruption
+	if errors.As(err, &corruption) && corruption.Torn && logLoadTruncated(snapshotPath) {
+		log.Printf("%v, loading the %v records before it", err, len(cmds))
+		err = nil
+		if repair {
+			err = truncateLog(snapshotPath, corruption.Offset)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	replayCommands(cmds, cs, time.Now())
+	return len(cmds), nil
+}
+
+// replayCommands applies the logged commands to the store and then drops
+// everything that expired by now, since expirations are absolute, nothing
+// when now is zero. Framed transactions are applied as a whole once their
+// commit record is read, an uncommitted transaction at the end of the file
+// is skipped
+func replayCommands(cmds []Command, cs *models.CollectionStore, now time.Time) {
+	var assembler txAssembler
+	for _, record := range cmds {
+		cmd := assembler.add(record)
+		if cmd != nil && shouldReplay(*cmd) {
+			_ = ExecuteCommand(cmd, cs, &models.ClientConfig{ClientState: &models.ClientState{State: utils.ACTIVE, IsAuthenticated: true}}, &models.KVServer{Config: &models.Config{ProtectedMode: false}}, nil)
 			// log.Printf("successfully executed curr cmd: %v ------------ %v", cmd, result)
 		}
 	}
-	return nil
+	assembler.discard()
+	if now.IsZero() {
+		return
+	}
+	for collName, keys := range cs.DeleteExpiredKeys(now) {
+		log.Printf("skipped %v expired keys in collection %v on load", len(keys), collName)
+	}
 }
 
 func handlePubSubMode(cmd *Command, conn net.Conn, pubSub *models.PubSub, cc *models.ClientConfig) {
@@ -218,16 +417,21 @@ func publishToTopic(topic, message string, conn net.Conn, pubSub *models.PubSub)
 	conn.Write([]byte("Published message to " + topic + "\n"))
 }
 
-func ReplicateChanges(jsonCmd string, cs *models.CollectionStore, ts *models.TransactionalKeyValueStore, kvServer *models.KVServer, ps *models.PubSub) string {
+func ReplicateChanges(jsonCmd string, cs *models.CollectionStore, kvServer *models.KVServer, ps *models.PubSub) string {
 	var cmd Command
 	err := json.Unmarshal([]byte(jsonCmd), &cmd)
 	if err != nil {
 		return ""
 	}
 
+	return replicateCommand(&cmd, cs, kvServer, ps)
+}
+
+// replicateCommand applies a command read from the snapshot
+func replicateCommand(cmd *Command, cs *models.CollectionStore, kvServer *models.KVServer, ps *models.PubSub) string {
 	log.Printf("parsed command for replication: %v", cmd)
 	// Execute the command on the slave server
-	result := ExecuteCommand(&cmd, cs, ts, &models.ClientConfig{ClientState: &models.ClientState{State: utils.ACTIVE, IsAuthenticated: true}}, kvServer, ps)
+	result := ExecuteCommand(cmd, cs, &models.ClientConfig{ClientState: &models.ClientState{State: utils.ACTIVE, IsAuthenticated: true}}, kvServer, ps)
 	return result
 }
 
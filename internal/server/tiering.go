@@ -0,0 +1,19 @@
+package server
+
+import (
+	"time"
+
+	models "github.com/sk25469/kv/internal/model"
+)
+
+// StartTiering periodically spills the idle values to the value files and
+// compacts them. Every node tiers on its own, which values are in memory
+// doesn't change what the keys hold so nothing is written to the snapshot
+func StartTiering(cs *models.CollectionStore, duration time.Duration) {
+	ticker := time.NewTicker(duration)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		cs.TierValues(time.Now())
+	}
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/utils"
+)
+
+// executeInTransaction buffers the writes of a client inside a transaction
+// and serves its reads from the buffer first, ok is false for commands
+// which execute as usual
+func executeInTransaction(cmd *Command, cs *models.CollectionStore, cc *models.ClientConfig, kv *models.KVServer) (string, bool) {
+	switch cmd.Name {
+	case utils.SET, utils.DEL, utils.EXPIRE_AT, utils.GET, utils.INCR, utils.INCRBY:
+	default:
+		return "", false
+	}
+	if !cc.ClientState.IsAuthenticated && kv.Config.ProtectedMode {
+		return "unauthorized", true
+	}
+
+	switch cmd.Name {
+	case utils.SET:
+		if len(cmd.Args) < 2 {
+			return "Usage: SET <collection> <key> <value>", true
+		}
+		if cmd.Lease != 0 {
+			return "ERROR: SET with a lease inside a transaction", true
+		}
+		value, err := decodeCommandValue(cmd)
+		if err != nil {
+			log.Printf("invalid encoded value: %v", err)
+			return "ERROR: invalid encoded value", true
+		}
+		cc.Transaction.Set(cmd.CollectionName, cmd.Args[0], value)
+	case utils.DEL:
+		if len(cmd.Args) < 1 {
+			return "Usage: DELETE <collection> <key>", true
+		}
+		cc.Transaction.Delete(cmd.CollectionName, cmd.Args[0])
+	case utils.EXPIRE_AT:
+		if len(cmd.Args) < 2 {
+			return "Usage: EXPIREAT <collection> <key> <unix-time-ms>", true
+		}
+		at, err := parseExpireAt(cmd.Args[1])
+		if err != nil {
+			return "Usage: EXPIREAT <collection> <key> <unix-time-ms>", true
+		}
+		cc.Transaction.ExpireAt(cmd.CollectionName, cmd.Args[0], at)
+	case utils.GET:
+		if len(cmd.Args) < 1 {
+			return "Usage: GET <collection> <key>", true
+		}
+		return readInTransaction(cs, cc, cmd.CollectionName, cmd.Args[0]), true
+	case utils.INCR, utils.INCRBY:
+		return incrementInTransaction(cmd, cs, cc), true
+	}
+	return "OK", true
+}
+
+// inTransaction reports whether the writes of the client are buffered, by
+// BEGIN or by MULTI
+func inTransaction(cc *models.ClientConfig) bool {
+	return cc.ClientState.State == utils.TRANSACTIONAL || cc.ClientState.State == utils.QUEUEING
+}
+
+// readInTransaction reads the client's own write if there is one, the
+// committed value otherwise, as of the snapshot of the transaction
+func readInTransaction(cs *models.CollectionStore, cc *models.ClientConfig, collectionName, key string) string {
+	if value, ok := cc.Transaction.Get(collectionName, key); ok {
+		return value
+	}
+	if snapshot := cc.Transaction.Snapshot(); snapshot != 0 {
+		return cs.GetKeyInCollectionAt(collectionName, key, snapshot)
+	}
+	return cs.GetKeyInCollection(collectionName, key)
+}
+
+// endSnapshot ends the snapshot of the client's transaction, if it has one
+func endSnapshot(cs *models.CollectionStore, cc *models.ClientConfig) {
+	cs.EndSnapshot(cc.Transaction.Snapshot())
+}
+
+// handleSavepoint handles SAVEPOINT <name> and RELEASE [SAVEPOINT] <name>
+func handleSavepoint(cmd *Command, cc *models.ClientConfig) string {
+	if cc.ClientState.State != utils.TRANSACTIONAL {
+		return "ERROR: Transaction not started"
+	}
+	name := cmd.CollectionName
+	if cmd.Name == utils.RELEASE && strings.EqualFold(name, utils.SAVEPOINT) && len(cmd.Args) > 0 {
+		name = cmd.Args[0]
+	}
+	if name == "" {
+		return fmt.Sprintf("Usage: %s <name>", cmd.Name)
+	}
+	if cmd.Name == utils.SAVEPOINT {
+		cc.Transaction.Savepoint(name)
+		return "OK"
+	}
+	if err := cc.Transaction.ReleaseSavepoint(name); err != nil {
+		return fmt.Sprintf("ERROR: %v", err)
+	}
+	return "OK"
+}
+
+// rollbackToSavepoint handles ROLLBACK TO [SAVEPOINT] <name>, which undoes
+// the writes after the savepoint and keeps the transaction open
+func rollbackToSavepoint(cmd *Command, cc *models.ClientConfig) string {
+	args := cmd.Args
+	if len(args) > 1 && strings.EqualFold(args[0], utils.SAVEPOINT) {
+		args = args[1:]
+	}
+	if !strings.EqualFold(cmd.CollectionName, "TO") || len(args) != 1 {
+		return "Usage: ROLLBACK TO <name>"
+	}
+	if cc.ClientState.State != utils.TRANSACTIONAL {
+		return "ERROR: Transaction not started"
+	}
+	if err := cc.Transaction.RollbackToSavepoint(args[0]); err != nil {
+		return fmt.Sprintf("ERROR: %v", err)
+	}
+	return "OK"
+}
+
+// decodeCommandValue returns the value of a SET as the client wrote it,
+// decompressing it if ResolveCommand compressed it
+func decodeCommandValue(cmd *Command) (string, error) {
+	value := strings.Join(cmd.Args[1:], " ")
+	if cmd.Encoding == "" {
+		return value, nil
+	}
+	payload, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return "", err
+	}
+	return models.DecodeValue(cmd.Encoding, string(payload))
+}
+
+// commitTransaction applies the buffered writes of the client atomically and
+// returns the BATCH command which logs and replicates them as one unit, the
+// command is nil when nothing was applied
+func commitTransaction(cs *models.CollectionStore, cc *models.ClientConfig, kv *models.KVServer) (string, *Command) {
+	if cc.ClientState.State != utils.TRANSACTIONAL {
+		return "ERROR: Transaction not started", nil
+	}
+	snapshot := cc.Transaction.Snapshot()
+	defer cs.EndSnapshot(snapshot)
+	mutations := cc.Transaction.ExecTransaction()
+	cc.ClientState.State = utils.ACTIVE
+	watches := releaseWatches(cs, cc)
+	if len(mutations) == 0 {
+		if cs.WatchedKeysChanged(watches) {
+			return utils.NIL, nil
+		}
+		return "OK", nil
+	}
+
+	batch := make([]Command, 0, len(mutations))
+	for i := range mutations {
+		m := &mutations[i]
+		if m.Op == models.MUTATION_SET {
+			// compress once so the store and the log hold the same payload
+			m.Encoding, m.Value = cs.EncodeValue(m.Collection, m.Value)
+		}
+		batch = append(batch, mutationToCommand(*m))
+	}
+
+	opts := models.BatchOptions{Reserve: kv.Config.IsMaster, Watches: watches, Snapshot: snapshot}
+	if err := cs.ApplyBatch(mutations, opts); err != nil {
+		if err == models.ErrWatchedKeyModified {
+			return utils.NIL, nil
+		}
+		if err == models.ErrConflict {
+			return fmt.Sprintf("CONFLICT: %v", err), nil
+		}
+		if errors.Is(err, models.ErrEvictionNotLogged) {
+			// the batch is applied all the same, so it is still logged
+			return fmt.Sprintf("ERROR: %v", err), &Command{Name: utils.BATCH, Batch: batch}
+		}
+		return fmt.Sprintf("ERROR: %v", err), nil
+	}
+	return "OK", &Command{Name: utils.BATCH, Batch: batch}
+}
+
+// handleCommit commits the transaction of the client and writes it to the
+// snapshot as a single BATCH command, after it was applied
+func handleCommit(conn net.Conn, cs *models.CollectionStore, cc *models.ClientConfig, kv *models.KVServer, snapshotPath string) {
+	result := "unauthorized"
+	if cc.ClientState.IsAuthenticated || !kv.Config.ProtectedMode {
+		var batch *Command
+		cs.LockShared()
+		unlock := cs.LockCollections(cc.Transaction.Collections(), false)
+		result, batch = commitTransaction(cs, cc, kv)
+		if err := logTransaction(batch, cc, snapshotPath); err != nil {
+			result = fmt.Sprintf("ERROR: %v", err)
+		}
+		unlock()
+		cs.UnlockShared()
+	}
+	if _, err := fmt.Fprintln(conn, result); err != nil {
+		log.Printf("error writing to the connection: %v : [%v]", conn, err)
+	}
+}
+
+// mutationToCommand converts a mutation to the command which logs it
+func mutationToCommand(m models.Mutation) Command {
+	switch m.Op {
+	case models.MUTATION_SET:
+		value := m.Value
+		if m.Encoding != "" {
+			value = base64.StdEncoding.EncodeToString([]byte(m.Value))
+		}
+		return Command{Name: utils.SET, CollectionName: m.Collection, Args: []string{m.Key, value}, Encoding: m.Encoding}
+	case models.MUTATION_EXPIRE_AT:
+		return Command{Name: utils.EXPIRE_AT, CollectionName: m.Collection, Args: []string{m.Key, strconv.FormatInt(m.ExpireAt.UnixMilli(), 10)}}
+	default:
+		return Command{Name: utils.DEL, CollectionName: m.Collection, Args: []string{m.Key}}
+	}
+}
+
+// batchToMutations converts the commands of a BATCH back to mutations
+func batchToMutations(batch []Command) ([]models.Mutation, error) {
+	mutations := make([]models.Mutation, 0, len(batch))
+	for _, cmd := range batch {
+		m := models.Mutation{Collection: cmd.CollectionName}
+		switch cmd.Name {
+		case utils.SET:
+			if len(cmd.Args) < 2 {
+				return nil, fmt.Errorf("invalid SET in batch: %v", cmd.Args)
+			}
+			m.Op, m.Key, m.Value, m.Encoding = models.MUTATION_SET, cmd.Args[0], strings.Join(cmd.Args[1:], " "), cmd.Encoding
+			if cmd.Encoding != "" {
+				payload, err := base64.StdEncoding.DecodeString(m.Value)
+				if err != nil {
+					return nil, err
+				}
+				m.Value = string(payload)
+			}
+		case utils.DEL:
+			if len(cmd.Args) < 1 {
+				return nil, fmt.Errorf("invalid DELETE in batch: %v", cmd.Args)
+			}
+			m.Op, m.Key = models.MUTATION_DELETE, cmd.Args[0]
+		case utils.EXPIRE_AT:
+			if len(cmd.Args) < 2 {
+				return nil, fmt.Errorf("invalid EXPIREAT in batch: %v", cmd.Args)
+			}
+			at, err := parseExpireAt(cmd.Args[1])
+			if err != nil {
+				return nil, err
+			}
+			m.Op, m.Key, m.ExpireAt = models.MUTATION_EXPIRE_AT, cmd.Args[0], at
+		default:
+			return nil, fmt.Errorf("unsupported command in batch: %v", cmd.Name)
+		}
+		mutations = append(mutations, m)
+	}
+	return mutations, nil
+}
@@ -1,13 +1,87 @@
 package server
 
 import (
+	"fmt"
+	"log"
+	"strconv"
 	"time"
 
 	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/utils"
 )
 
-func StartKVCleanup(cs *models.CollectionStore, duration time.Duration) {
-	for _, collection := range cs.GetCollection() {
-		go collection.StartExpiryCleanup(duration)
+// StartKVCleanup periodically removes expired keys. Only the master expires
+// keys on its own clock, every removal is written to the snapshot as an
+// EXPIRED command so the replicas delete the same keys at the same point in
+// the log instead of relying on their own clocks
+func StartKVCleanup(cs *models.CollectionStore, duration time.Duration, kvServer *models.KVServer, snapshotPath string) {
+	ticker := time.NewTicker(duration)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !kvServer.Config.IsMaster {
+			continue
+		}
+		if err := expireKeys(cs, snapshotPath, time.Now()); err != nil {
+			log.Printf("error writing expired keys to dump: %v", err)
+		}
+	}
+}
+
+// expireKeys deletes the expired keys once their EXPIRED records are
+// written, when the records can't be written the keys are kept and expired
+// on a later tick. No command runs in between, so the log and the store
+// agree on what expired
+func expireKeys(cs *models.CollectionStore, snapshotPath string, now time.Time) error {
+	if len(cs.GetExpiredKeys(now)) == 0 {
+		return nil
+	}
+	cs.LockExclusive()
+	defer cs.UnlockExclusive()
+
+	expired := cs.GetExpiredKeys(now)
+	var records []Command
+	for collName, keys := range expired {
+		for _, key := range keys {
+			records = append(records, Command{Name: utils.EXPIRED, CollectionName: collName, Args: []string{key}})
+		}
+	}
+	if err := writeCommandsInOneAppend(records, snapshotPath); err != nil {
+		return err
+	}
+	for collName, keys := range expired {
+		for _, key := range keys {
+			cs.DeleteExpiredKeyInCollection(collName, key, now)
+		}
+	}
+	return nil
+}
+
+// ResolveExpiration rewrites a relative SET-TTL into an EXPIREAT with an
+// absolute unix timestamp in milliseconds, so replaying the command later
+// doesn't restart the TTL from the time of the replay
+func ResolveExpiration(cmd *Command) *Command {
+	if cmd.Name != utils.SET_TTL || len(cmd.Args) < 2 {
+		return cmd
+	}
+	duration, err := utils.ParseDuration(cmd.Args[1])
+	if err != nil {
+		// leave it as is, execution reports the usage error
+		return cmd
+	}
+	at := time.Now().Add(duration)
+	return &Command{
+		Name:           utils.EXPIRE_AT,
+		CollectionName: cmd.CollectionName,
+		Args:           []string{cmd.Args[0], strconv.FormatInt(at.UnixMilli(), 10)},
+	}
+}
+
+// parseExpireAt parses an absolute unix timestamp in milliseconds
+func parseExpireAt(input string) (time.Time, error) {
+	millis, err := strconv.ParseInt(input, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp: %v", input)
 	}
+	return time.UnixMilli(millis), nil
 }
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"log"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/utils"
+)
+
+// WriteTransactionToFile writes the commands of a committed transaction as
+// a framed record, a TXBEGIN line, one line per command and a TXCOMMIT
+// line, all tagged with the same transaction id. The record goes out in a
+// single write, so a crash leaves at most a torn tail which replay skips.
+// Every line carries the same timestamp
+func WriteTransactionToFile(batch Command, filename string) error {
+	txID := utils.GenerateBase64ClientID()
+
+	records := make([]Command, 0, len(batch.Batch)+2)
+	records = append(records, Command{Name: utils.TX_BEGIN, TxID: txID, Client: batch.Client})
+	for _, cmd := range batch.Batch {
+		cmd.TxID, cmd.Client = txID, batch.Client
+		records = append(records, cmd)
+	}
+	records = append(records, Command{Name: utils.TX_COMMIT, TxID: txID, Client: batch.Client})
+	return writeCommandsInOneAppend(records, filename)
+}
+
+// logTransaction writes the batch of a committed transaction of the client
+// to the snapshot, nothing is written for a nil batch or an empty path
+func logTransaction(batch *Command, cc *models.ClientConfig, snapshotPath string) error {
+	if batch == nil || snapshotPath == "" {
+		return nil
+	}
+	batch.Client = clientIdentity(cc)
+	if err := WriteTransactionToFile(*batch, snapshotPath); err != nil {
+		log.Printf("error writing transaction to dump: %v", err)
+		return err
+	}
+	return nil
+}
+
+// txAssembler collects the records of a framed transaction while the
+// snapshot is replayed, the transaction is handed out as a single BATCH
+// only once its TXCOMMIT is read
+type txAssembler struct {
+	txID string
+	ops  []Command
+	open bool
+}
+
+// add takes the next record of the snapshot and returns the command to
+// apply, nil while a transaction is still being collected
+func (a *txAssembler) add(cmd Command) *Command {
+	switch {
+	case cmd.Name == utils.TX_BEGIN:
+		a.discard()
+		a.txID, a.ops, a.open = cmd.TxID, nil, true
+		return nil
+	case cmd.Name == utils.TX_COMMIT:
+		if !a.open || cmd.TxID != a.txID {
+			log.Printf("skipping commit of unknown transaction %v", cmd.TxID)
+			return nil
+		}
+		batch := &Command{Name: utils.BATCH, Batch: a.ops}
+		a.txID, a.ops, a.open = "", nil, false
+		return batch
+	case cmd.TxID != "":
+		if !a.open || cmd.TxID != a.txID {
+			log.Printf("skipping record of unknown transaction %v", cmd.TxID)
+			return nil
+		}
+		cmd.TxID = ""
+		a.ops = append(a.ops, cmd)
+		return nil
+	default:
+		return &cmd
+	}
+}
+
+// discard drops a transaction which never got its TXCOMMIT
+func (a *txAssembler) discard() {
+	if a.open {
+		log.Printf("skipping uncommitted transaction %v with %v commands", a.txID, len(a.ops))
+	}
+	a.txID, a.ops, a.open = "", nil, false
+}
+
+// shouldReplay reports whether a record of the snapshot changes the store
+// when it is replayed
+func shouldReplay(cmd Command) bool {
+	switch cmd.Name {
+	case utils.PREPARE, utils.COMMIT_PREPARED, utils.ABORT_PREPARED:
+		return true
+	}
+	return internalRecords[cmd.Name] || ShouldWriteLog(cmd)
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/utils"
+)
+
+const txnUsage = "Usage: TXN IF <VALUE|VERSION|TTL|EXISTS> <collection> <key> <op> <operand> [AND ...] THEN <command> [; <command>...] [ELSE <command> [; <command>...]]"
+
+// txnCommands are the commands a branch of a TXN can run
+var txnCommands = map[string]bool{
+	utils.SET:       true,
+	utils.GET:       true,
+	utils.DEL:       true,
+	utils.SET_TTL:   true,
+	utils.EXPIRE_AT: true,
+	utils.INCR:      true,
+	utils.INCRBY:    true,
+}
+
+// txnComparison checks the value, version, TTL in milliseconds or existence
+// of a key, a missing key has version 0 and TTL -2, a key without an
+// expiration has TTL -1
+type txnComparison struct {
+	target     string
+	collection string
+	key        string
+	op         string
+	operand    string
+}
+
+// txnResult is the reply to TXN
+type txnResult struct {
+	Succeeded bool     `json:"succeeded"`
+	Branch    string   `json:"branch"`
+	Results   []string `json:"results"`
+}
+
+// parseTxn splits TXN IF <comparisons> THEN <commands> ELSE <commands> into
+// its comparisons and the commands of both branches
+func parseTxn(cmd *Command) ([]txnComparison, []*Command, []*Command, error) {
+	tokens := append([]string{cmd.CollectionName}, cmd.Args...)
+	if !strings.EqualFold(tokens[0], "IF") {
+		return nil, nil, nil, fmt.Errorf("TXN must start with IF")
+	}
+
+	var sections [3][]string
+	section := 0
+	for _, token := range tokens[1:] {
+		switch {
+		case section == 0 && strings.EqualFold(token, "THEN"):
+			section = 1
+		case section == 1 && strings.EqualFold(token, "ELSE"):
+			section = 2
+		default:
+			sections[section] = append(sections[section], token)
+		}
+	}
+	if section == 0 {
+		return nil, nil, nil, fmt.Errorf("TXN without THEN")
+	}
+
+	var comparisons []txnComparison
+	for _, part := range splitTokens(sections[0], func(token string) bool { return strings.EqualFold(token, "AND") }) {
+		comparison, err := parseComparison(part)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		comparisons = append(comparisons, comparison)
+	}
+	if len(comparisons) == 0 {
+		return nil, nil, nil, fmt.Errorf("TXN without comparisons")
+	}
+
+	var branches [2][]*Command
+	for i, tokens := range sections[1:] {
+		for _, part := range splitCommands(tokens) {
+			op, err := parseTxnCommand(part)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			branches[i] = append(branches[i], op)
+		}
+	}
+	return comparisons, branches[0], branches[1], nil
+}
+
+func splitTokens(tokens []string, isSeparator func(string) bool) [][]string {
+	var parts [][]string
+	var current []string
+	for _, token := range tokens {
+		if isSeparator(token) {
+			parts = append(parts, current)
+			current = nil
+			continue
+		}
+		current = append(current, token)
+	}
+	if len(current) > 0 || len(parts) > 0 {
+		parts = append(parts, current)
+	}
+	return parts
+}
+
+// splitCommands splits the commands of a branch at ';', which may be a token
+// on its own or end the last argument of a command
+func splitCommands(tokens []string) [][]string {
+	var split []string
+	for _, token := range tokens {
+		if token != ";" && strings.HasSuffix(token, ";") {
+			split = append(split, strings.TrimSuffix(token, ";"), ";")
+			continue
+		}
+		split = append(split, token)
+	}
+	var parts [][]string
+	for _, part := range splitTokens(split, func(token string) bool { return token == ";" }) {
+		if len(part) > 0 {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+func parseComparison(tokens []string) (txnComparison, error) {
+	if len(tokens) != 5 {
+		return txnComparison{}, fmt.Errorf("invalid comparison: %v", strings.Join(tokens, " "))
+	}
+	c := txnComparison{
+		target:     strings.ToUpper(tokens[0]),
+		collection: tokens[1],
+		key:        tokens[2],
+		op:         tokens[3],
+		operand:    tokens[4],
+	}
+	switch c.op {
+	case "=", "!=", "<", ">", "<=", ">=":
+	default:
+		return txnComparison{}, fmt.Errorf("invalid comparison operator: %v", c.op)
+	}
+	switch c.target {
+	case "VALUE":
+	case "VERSION", "TTL":
+		if _, err := strconv.ParseInt(c.operand, 10, 64); err != nil {
+			return txnComparison{}, fmt.Errorf("invalid %v: %v", c.target, c.operand)
+		}
+	case "EXISTS":
+		if _, err := strconv.ParseBool(c.operand); err != nil || (c.op != "=" && c.op != "!=") {
+			return txnComparison{}, fmt.Errorf("EXISTS compares with = or != to true or false")
+		}
+	default:
+		return txnComparison{}, fmt.Errorf("invalid comparison target: %v", c.target)
+	}
+	return c, nil
+}
+
+func parseTxnCommand(tokens []string) (*Command, error) {
+	cmd := ParseCommand(strings.Join(tokens, " "))
+	if cmd == nil || !txnCommands[cmd.Name] {
+		return nil, fmt.Errorf("command not allowed in TXN: %v", strings.Join(tokens, " "))
+	}
+	if cmd.CollectionName == "" || len(cmd.Args) < queueableCommands[cmd.Name] {
+		return nil, fmt.Errorf("wrong number of arguments for %v", cmd.Name)
+	}
+	return cmd, nil
+}
+
+// holds evaluates the comparison against the current state of the key
+func (c txnComparison) holds(cs *models.CollectionStore, now time.Time) bool {
+	state := cs.GetKeyState(c.collection, c.key)
+	switch c.target {
+	case "VALUE":
+		return compareOrdered(strings.Compare(state.Value, c.operand), c.op)
+	case "EXISTS":
+		expected, _ := strconv.ParseBool(c.operand)
+		return (state.Exists == expected) == (c.op == "=")
+	case "VERSION":
+		operand, _ := strconv.ParseUint(c.operand, 10, 64)
+		switch {
+		case state.Version < operand:
+			return compareOrdered(-1, c.op)
+		case state.Version > operand:
+			return compareOrdered(1, c.op)
+		}
+		return compareOrdered(0, c.op)
+	default:
+		ttl := int64(-2)
+		if state.Exists && state.ExpireAt.IsZero() {
+			ttl = -1
+		} else if state.Exists {
+			ttl = state.ExpireAt.Sub(now).Milliseconds()
+		}
+		operand, _ := strconv.ParseInt(c.operand, 10, 64)
+		switch {
+		case ttl < operand:
+			return compareOrdered(-1, c.op)
+		case ttl > operand:
+			return compareOrdered(1, c.op)
+		}
+		return compareOrdered(0, c.op)
+	}
+}
+
+// compareOrdered applies the operator to the result of a three-way compare
+func compareOrdered(cmp int, op string) bool {
+	switch op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case ">":
+		return cmp > 0
+	case "<=":
+		return cmp <= 0
+	default:
+		return cmp >= 0
+	}
+}
+
+// executeTxn evaluates the comparisons and runs the THEN or the ELSE branch
+// while holding the execution locks of the collections they touch
+// exclusively, so the comparisons and the writes are atomic. The writes are
+// committed together and written to the snapshot before the locks are
+// released, unless snapshotPath is empty
+func executeTxn(cmd *Command, cs *models.CollectionStore, cc *models.ClientConfig, kv *models.KVServer, ps *models.PubSub, snapshotPath string) string {
+	if inTransaction(cc) {
+		return "ERROR: TXN inside a transaction"
+	}
+	comparisons, then, otherwise, err := parseTxn(cmd)
+	if err != nil {
+		log.Printf("invalid TXN: %v", err)
+		return fmt.Sprintf("ERROR: %v. %v", err, txnUsage)
+	}
+
+	var collections []string
+	for _, comparison := range comparisons {
+		collections = append(collections, comparison.collection)
+	}
+	for _, op := range then {
+		collections = append(collections, op.CollectionName)
+	}
+	for _, op := range otherwise {
+		collections = append(collections, op.CollectionName)
+	}
+	cs.LockShared()
+	defer cs.UnlockShared()
+	defer cs.LockCollections(collections, true)()
+
+	now := time.Now()
+	reply := txnResult{Succeeded: true, Branch: "THEN"}
+	for _, comparison := range comparisons {
+		if !comparison.holds(cs, now) {
+			reply.Succeeded, reply.Branch = false, "ELSE"
+			break
+		}
+	}
+	ops := then
+	if !reply.Succeeded {
+		ops = otherwise
+	}
+
+	txnClient := &models.ClientConfig{
+		ClientID:    cc.ClientID,
+		ClientState: &models.ClientState{State: utils.TRANSACTIONAL, IsAuthenticated: true},
+		Transaction: models.NewTransactionalKeyValueStore(),
+	}
+	reply.Results = make([]string, 0, len(ops))
+	for _, op := range ops {
+		reply.Results = append(reply.Results, executeCommand(ResolveCommand(op, cs), cs, txnClient, kv, ps))
+	}
+
+	result, batch := commitTransaction(cs, txnClient, kv)
+	if err := logTransaction(batch, cc, snapshotPath); err != nil {
+		return fmt.Sprintf("ERROR: %v", err)
+	}
+	if result != "OK" {
+		return result
+	}
+	jsonString, err := utils.MapToJSON(reply)
+	if err != nil {
+		log.Printf("error converting to json: %v", err)
+	}
+	return jsonString
+}
+
+// handleTxn runs the conditional transaction and writes its writes to the
+// snapshot as a single BATCH command
+func handleTxn(conn net.Conn, cmd *Command, cs *models.CollectionStore, cc *models.ClientConfig, kv *models.KVServer, ps *models.PubSub, snapshotPath string) {
+	result := "unauthorized"
+	if cc.ClientState.IsAuthenticated || !kv.Config.ProtectedMode {
+		result = executeTxn(cmd, cs, cc, kv, ps, snapshotPath)
+	}
+	if _, err := fmt.Fprintln(conn, result); err != nil {
+		log.Printf("error writing to the connection: %v : [%v]", conn, err)
+	}
+}
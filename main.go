@@ -12,6 +12,10 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && runTool(os.Args[1:]) {
+		return
+	}
+
 	utils.AsciiArt()
 	shardList := models.NewShardsList()
 
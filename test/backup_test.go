@@ -0,0 +1,166 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/internal/server"
+	"github.com/sk25469/kv/utils"
+)
+
+func TestBackupIncrementalAndRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.txt")
+	dir := filepath.Join(t.TempDir(), "backup")
+	cs := models.NewCollectionStore()
+	logged := func(raw string) {
+		server.ExecuteLogged(server.ParseCommand(raw), cs, newTestClient(), newTestServer(), nil, path)
+	}
+
+	logged("SET col1 a one")
+	logged("SET col1 b two")
+	if result, err := server.BackupToDir(cs, path, dir); err != nil || !strings.HasPrefix(result, "Full backup") {
+		t.Fatalf("expected a full backup, got %v: %v", result, err)
+	}
+	logged("SET col1 c three")
+	logged("DELETE col1 a")
+	if result, err := server.BackupToDir(cs, path, dir); err != nil || !strings.HasPrefix(result, "Incremental backup of records 3 to 4") {
+		t.Fatalf("expected an incremental backup, got %v: %v", result, err)
+	}
+
+	restorePath := filepath.Join(t.TempDir(), "snapshot.txt")
+	restored := models.NewCollectionStore()
+	if err := server.RestoreFromDir(restored, restorePath, dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.RestoreFromDir(restored, restorePath, dir); err == nil {
+		t.Fatalf("expected a restore into a node with keys to fail")
+	}
+	// the restored keys are in the log of the node
+	loaded := models.NewCollectionStore()
+	if _, err := server.LoadSnapshot(restorePath, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.GetAllKeyValuesInCollection("col1"); len(got) != 2 || got["b"] != "two" || got["c"] != "three" {
+		t.Fatalf("expected b and c to be restored, got %v", got)
+	}
+
+	// a rewrite keeps the segments the next incremental backup needs
+	stale := filepath.Join(t.TempDir(), "stale")
+	copyDir(t, dir, stale)
+	logged("SET col1 d four")
+	if err := server.RewriteLog(cs, path); err != nil {
+		t.Fatal(err)
+	}
+	logged("SET col1 e five")
+	if result, err := server.BackupToDir(cs, path, dir); err != nil || !strings.HasPrefix(result, "Incremental backup of records 5 to 6") {
+		t.Fatalf("expected an incremental backup after the rewrite, got %v: %v", result, err)
+	}
+	// which removes the segments kept for it
+	if kept, _ := filepath.Glob(path + ".0*"); len(kept) != 1 {
+		t.Fatalf("expected only the rewritten segment to be left, got %v", kept)
+	}
+	restored = models.NewCollectionStore()
+	if err := server.RestoreFromDir(restored, filepath.Join(t.TempDir(), "snapshot.txt"), dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.GetAllKeyValuesInCollection("col1"); len(got) != 4 || got["d"] != "four" || got["e"] != "five" {
+		t.Fatalf("expected b to e to be restored, got %v", got)
+	}
+
+	// a dump removes the segments once the last backup has them, an older
+	// backup can't continue from there
+	if err := server.SaveDump(cs, path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.BackupToDir(cs, path, stale); err == nil || !strings.Contains(err.Error(), "full backup") {
+		t.Fatalf("expected the missing log to be reported, got %v", err)
+	}
+
+	// a damaged file fails the restore before anything is loaded
+	segments, _ := filepath.Glob(filepath.Join(dir, "log-*"))
+	if len(segments) != 3 {
+		t.Fatalf("expected three segments in the backup, got %v", segments)
+	}
+	if err := os.WriteFile(segments[0], []byte("damaged"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	empty := models.NewCollectionStore()
+	if err := server.RestoreFromDir(empty, filepath.Join(t.TempDir(), "snapshot.txt"), dir); err == nil || empty.KeyCount() != 0 {
+		t.Fatalf("expected the damaged backup to be rejected, got %v with %v keys", err, empty.KeyCount())
+	}
+}
+
+func TestRestoreReachesReplicas(t *testing.T) {
+	sourcePath := filepath.Join(t.TempDir(), "snapshot.txt")
+	dir := filepath.Join(t.TempDir(), "backup")
+	source := models.NewCollectionStore()
+	for _, raw := range []string{"SET col1 a one", "SET col1 b two"} {
+		server.ExecuteLogged(server.ParseCommand(raw), source, newTestClient(), newTestServer(), nil, sourcePath)
+	}
+	exec(t, source, newTestClient(), "LOCK ACQUIRE job a 1m")
+	if _, err := server.BackupToDir(source, sourcePath, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "snapshot.txt")
+	master, replica := models.NewCollectionStore(), models.NewCollectionStore()
+	logged := func(raw string) {
+		server.ExecuteLogged(server.ParseCommand(raw), master, newTestClient(), newTestServer(), nil, path)
+	}
+	logged("SET col0 probe 0")
+	go server.WatchSnapshotAndUpdate(path, replica, &models.KVServer{Config: &models.Config{}}, nil)
+	// the replica reads the log from where it opens it on
+	for i := 1; replica.GetKeyInCollection("col0", "probe") == ""; i++ {
+		if i > 100 {
+			t.Fatalf("expected the replica to follow the log")
+		}
+		logged("SET col0 probe " + strconv.Itoa(i))
+		time.Sleep(50 * time.Millisecond)
+	}
+	logged("DELETE col0 probe")
+
+	if err := server.RestoreFromDir(master, path, dir); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		got := replica.GetAllKeyValuesInCollection("col1")
+		if len(got) == 2 && got["a"] == "one" && got["b"] == "two" {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("expected the replica to apply the restore, got %v", got)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if held := exec(t, replica, newTestClient(), "LOCK ACQUIRE job b 1m"); held != utils.NIL {
+		t.Fatalf("expected the restored lock to be held on the replica, got %v", held)
+	}
+	if got := replica.GetKeyInCollection("col0", "probe"); got != "" {
+		t.Fatalf("expected the probe to be deleted on the replica, got %v", got)
+	}
+}
+
+func copyDir(t *testing.T, src, dst string) {
+	t.Helper()
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(src, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dst, entry.Name()), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
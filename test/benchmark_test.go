@@ -23,7 +23,7 @@ func BenchmarkParseCommand(b *testing.B) {
 func BenchmarkExecuteCommand(b *testing.B) {
 	// Initialize your key-value database
 	cs := models.NewCollectionStore()
-	ts := models.NewTransactionalKeyValueStore()
+	cc, kv := newTestClient(), newTestServer()
 
 	// Raw command string to parse
 	rawCommand := "SET collection1 key1 value1"
@@ -32,7 +32,7 @@ func BenchmarkExecuteCommand(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		// Perform command execution
-		server.ExecuteCommand(cmd, cs, ts, nil, nil, nil)
+		server.ExecuteCommand(cmd, cs, cc, kv, nil)
 	}
 }
 
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/internal/server"
+)
+
+func TestCompressedValuesRoundTrip(t *testing.T) {
+	value := strings.Repeat("compressible ", 100)
+	for _, algorithm := range []string{models.GZIP, models.FLATE} {
+		setting := models.CompressionSetting{Algorithm: algorithm, Threshold: 64}
+		encoding, payload := models.EncodeValue(&setting, value)
+		if encoding != algorithm || len(payload) >= len(value) {
+			t.Fatalf("expected %v to compress the value, got %q with %v bytes", algorithm, encoding, len(payload))
+		}
+		if got, err := models.DecodeValue(encoding, payload); err != nil || got != value {
+			t.Fatalf("expected %v to decode the value, got %v", algorithm, err)
+		}
+
+		// the value is compressed in the store and in its log, and read back
+		// as it was written
+		path := filepath.Join(t.TempDir(), "snapshot.txt")
+		cs := models.NewCollectionStore()
+		cs.SetCompression(map[string]models.CompressionSetting{"col1": setting})
+		cmd := server.ResolveCommand(server.ParseCommand("SET col1 a "+strings.ReplaceAll(value, " ", "-")), cs)
+		if err := server.WriteCommandsToFile(*cmd, path); err != nil {
+			t.Fatal(err)
+		}
+		server.ExecuteCommand(cmd, cs, newTestClient(), newTestServer(), nil)
+		if got := exec(t, cs, newTestClient(), "GET col1 a"); got != strings.ReplaceAll(value, " ", "-") {
+			t.Fatalf("expected the value back from %v, got %q", algorithm, got)
+		}
+		if stats := cs.MemoryStats(); stats.CompressedKeys != 1 {
+			t.Fatalf("expected the value to be stored compressed with %v, got %v compressed keys", algorithm, stats.CompressedKeys)
+		}
+
+		if data, err := os.ReadFile(path); err != nil || strings.Contains(string(data), "compressible-") {
+			t.Fatalf("expected the log to hold the compressed value, got %v", err)
+		}
+
+		// the value is decoded from the log without the setting
+		cmds, err := server.ReadCommandsFromFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded := models.NewCollectionStore()
+		for i := range cmds {
+			server.ExecuteCommand(&cmds[i], loaded, newTestClient(), newTestServer(), nil)
+		}
+		if got := loaded.GetKeyInCollection("col1", "a"); got != strings.ReplaceAll(value, " ", "-") {
+			t.Fatalf("expected the value back from the log with %v, got %q", algorithm, got)
+		}
+	}
+
+	if _, err := models.DecodeValue(models.GZIP, ""); err == nil {
+		t.Fatalf("expected a corrupt payload to fail")
+	}
+}
+
+func TestValuesBelowTheThresholdStayRaw(t *testing.T) {
+	setting := models.CompressionSetting{Algorithm: models.GZIP, Threshold: 256}
+	small := strings.Repeat("a", 255)
+	if encoding, payload := models.EncodeValue(&setting, small); encoding != "" || payload != small {
+		t.Fatalf("expected a value below the threshold to stay raw, got %q", encoding)
+	}
+	// a value which doesn't get smaller is kept raw as well
+	incompressible := "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ-_"
+	if encoding, _ := models.EncodeValue(&setting, incompressible); encoding != "" {
+		t.Fatalf("expected a value which doesn't compress to stay raw, got %q", encoding)
+	}
+	if encoding, _ := models.EncodeValue(nil, strings.Repeat("a", 1000)); encoding != "" {
+		t.Fatalf("expected no compression without a setting, got %q", encoding)
+	}
+
+	cs := models.NewCollectionStore()
+	cs.SetCompression(map[string]models.CompressionSetting{models.DEFAULT_COLLECTION_SETTING: setting})
+	cc := newTestClient()
+	exec(t, cs, cc, "SET col1 small "+small)
+	exec(t, cs, cc, "SET col2 big "+strings.Repeat("a", 256))
+	stats := cs.MemoryStats()
+	if stats.CollectionBreakdown["col1"].CompressedKeys != 0 || stats.CollectionBreakdown["col2"].CompressedKeys != 1 {
+		t.Fatalf("expected only the value at the threshold to be compressed, got %+v and %+v", stats.CollectionBreakdown["col1"], stats.CollectionBreakdown["col2"])
+	}
+	if got := exec(t, cs, cc, "GET col1 small"); got != small {
+		t.Fatalf("expected the raw value back, got %q", got)
+	}
+}
+
+func TestCompressionRatioStats(t *testing.T) {
+	cs := models.NewCollectionStore()
+	cs.SetCompression(map[string]models.CompressionSetting{"col1": {Algorithm: models.GZIP, Threshold: 64}})
+	cc := newTestClient()
+	exec(t, cs, cc, "SET col1 a "+strings.Repeat("a", 1000))
+	exec(t, cs, cc, "SET col1 b "+strings.Repeat("b", 2000))
+	exec(t, cs, cc, "SET col1 raw small")
+	exec(t, cs, cc, "SET col2 c "+strings.Repeat("c", 1000))
+
+	stats := cs.MemoryStats()
+	if stats.CompressedKeys != 2 || stats.RawBytes != 3000 {
+		t.Fatalf("expected 2 compressed values of 3000 bytes, got %v of %v", stats.CompressedKeys, stats.RawBytes)
+	}
+	if stats.StoredBytes <= 0 || stats.StoredBytes >= stats.RawBytes {
+		t.Fatalf("expected the values to be stored in fewer bytes, got %v", stats.StoredBytes)
+	}
+	if ratio := float64(stats.RawBytes) / float64(stats.StoredBytes); stats.CompressionRatio != ratio || ratio <= 1 {
+		t.Fatalf("expected a ratio of %v, got %v", ratio, stats.CompressionRatio)
+	}
+	if col2 := stats.CollectionBreakdown["col2"]; col2.CompressedKeys != 0 || col2.CompressionRatio != 0 {
+		t.Fatalf("expected no compression stats for col2, got %+v", col2)
+	}
+
+	// overwriting and deleting a value takes it out of the stats
+	exec(t, cs, cc, "SET col1 a small")
+	exec(t, cs, cc, "DELETE col1 b")
+	if stats := cs.MemoryStats(); stats.CompressedKeys != 0 || stats.RawBytes != 0 || stats.StoredBytes != 0 || stats.CompressionRatio != 0 {
+		t.Fatalf("expected the stats to be empty, got %+v", stats.CompressionStats)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/internal/server"
+)
+
+// shardStub runs the commands sent by the coordinator against in-memory
+// shards, a shard marked down fails every command
+type shardStub struct {
+	stores map[string]*models.CollectionStore
+	down   map[string]bool
+}
+
+func (s *shardStub) send(command, address string) (string, error) {
+	if s.down[address] {
+		return "", fmt.Errorf("connection refused")
+	}
+	return server.ExecuteCommand(server.ParseCommand(command), s.stores[address], newTestClient(), newTestServer(), nil), nil
+}
+
+func TestTwoPhaseCommit(t *testing.T) {
+	shards := &shardStub{
+		stores: map[string]*models.CollectionStore{"a": models.NewCollectionStore(), "b": models.NewCollectionStore()},
+		down:   map[string]bool{},
+	}
+	logPath := filepath.Join(t.TempDir(), "coordinator.log")
+	coordinator := server.NewCoordinator(logPath, shards.send)
+
+	ops := map[string][]string{"a": {"SET accounts alice 50"}, "b": {"SET accounts bob 150"}}
+	if got := coordinator.Execute(ops); got != "OK" {
+		t.Fatalf("unexpected result: %v", got)
+	}
+	if got := shards.stores["b"].GetKeyInCollection("accounts", "bob"); got != "150" {
+		t.Fatalf("expected the write on the second shard, got %v", got)
+	}
+
+	// a key locked by a prepared transaction makes the other one abort
+	exec(t, shards.stores["b"], newTestClient(), "PREPARE other SET accounts bob 0")
+	ops = map[string][]string{"a": {"SET accounts alice 0"}, "b": {"SET accounts bob 200"}}
+	if got := coordinator.Execute(ops); got[:7] != "ABORTED" {
+		t.Fatalf("expected the transaction to abort, got %v", got)
+	}
+	if got := shards.stores["a"].GetKeyInCollection("accounts", "alice"); got != "50" {
+		t.Fatalf("expected the prepared write to be rolled back, got %v", got)
+	}
+
+	// the in-doubt transaction is aborted on recovery, it has no decision
+	server.NewCoordinator(logPath, shards.send).Recover([]string{"a", "b"})
+	if prepared := shards.stores["b"].PreparedTransactions(); len(prepared) != 0 {
+		t.Fatalf("expected no transaction in doubt, got %v", prepared)
+	}
+	if got := shards.stores["b"].GetKeyInCollection("accounts", "bob"); got != "150" {
+		t.Fatalf("expected the in-doubt write to be aborted, got %v", got)
+	}
+}
+
+func TestTwoPhaseCommitRecoversDecision(t *testing.T) {
+	shards := &shardStub{
+		stores: map[string]*models.CollectionStore{"a": models.NewCollectionStore(), "b": models.NewCollectionStore()},
+		down:   map[string]bool{},
+	}
+	logPath := filepath.Join(t.TempDir(), "coordinator.log")
+
+	// b goes down after voting, so it never hears the commit decision
+	send := func(command, address string) (string, error) {
+		reply, err := shards.send(command, address)
+		if address == "b" && command[:7] == "PREPARE" {
+			shards.down["b"] = true
+		}
+		return reply, err
+	}
+	ops := map[string][]string{"a": {"SET accounts alice 50"}, "b": {"SET accounts bob 150"}}
+	if got := server.NewCoordinator(logPath, send).Execute(ops); got != "OK" {
+		t.Fatalf("unexpected result: %v", got)
+	}
+	if got := shards.stores["b"].GetKeyInCollection("accounts", "bob"); got != "" {
+		t.Fatalf("expected the write to wait for the decision, got %v", got)
+	}
+
+	shards.down["b"] = false
+	server.NewCoordinator(logPath, shards.send).Recover([]string{"a", "b"})
+	if got := shards.stores["b"].GetKeyInCollection("accounts", "bob"); got != "150" {
+		t.Fatalf("expected the recovered commit, got %v", got)
+	}
+}
+
+func TestTwoPhaseCommitRecoversDecisionFromSealedSegments(t *testing.T) {
+	shards := &shardStub{
+		stores: map[string]*models.CollectionStore{"a": models.NewCollectionStore(), "b": models.NewCollectionStore()},
+		down:   map[string]bool{},
+	}
+	logPath := filepath.Join(t.TempDir(), "coordinator.log")
+	send := func(command, address string) (string, error) {
+		reply, err := shards.send(command, address)
+		if address == "b" && command[:7] == "PREPARE" {
+			shards.down["b"] = true
+		}
+		return reply, err
+	}
+
+	// the coordinator never seals its decision log
+	coordinator := server.NewCoordinator(logPath, send)
+	if got := coordinator.Execute(map[string][]string{"a": {"SET accounts alice 50"}, "b": {"SET accounts bob 150"}}); got != "OK" {
+		t.Fatalf("unexpected result: %v", got)
+	}
+	if segments, _ := filepath.Glob(logPath + ".0*"); len(segments) != 0 {
+		t.Fatalf("expected the decision log to stay in one file, got %v", segments)
+	}
+
+	// a decision log sealed into segments, as one written with segments
+	// turned on, still gives the decision after a restart
+	server.SetLogSegments(logPath, models.LogSegmentConfig{MaxSize: 1})
+	shards.down["b"] = false
+	if got := coordinator.Execute(map[string][]string{"a": {"SET accounts carol 10"}, "b": {"SET accounts dave 20"}}); got != "OK" {
+		t.Fatalf("unexpected result: %v", got)
+	}
+	if segments, _ := filepath.Glob(logPath + ".0*"); len(segments) == 0 {
+		t.Fatalf("expected the decision log to be sealed")
+	}
+
+	shards.down["b"] = false
+	server.NewCoordinator(logPath, shards.send).Recover([]string{"a", "b"})
+	for key, want := range map[string]string{"bob": "150", "dave": "20"} {
+		if got := shards.stores["b"].GetKeyInCollection("accounts", key); got != want {
+			t.Fatalf("expected the recovered commit of %v, got %v", key, got)
+		}
+	}
+}
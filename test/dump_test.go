@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/internal/server"
+)
+
+func TestDumpLoadsWithLogTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.txt")
+	cs := models.NewCollectionStore()
+	cs.SetCompression(map[string]models.CompressionSetting{"docs": {Algorithm: models.GZIP, Threshold: 16}})
+
+	cs.SetKeyInCollection("col1", "plain", "one")
+	cs.SetKeyInCollection("docs", "big", strings.Repeat("compressible ", 20))
+	cs.SetKeyInCollection("col1", "expiring", "soon")
+	at := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	cs.UpdateKeyInCollectionWithExpiration("col1", "expiring", at)
+	lease := cs.GrantLease(time.Minute)
+	if err := cs.SetKeyInCollectionWithLease("col1", "leased", "", "node", lease.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.WriteCommandsToFile(server.Command{Name: "SET", CollectionName: "col1", Args: []string{"plain", "one"}}, path); err != nil {
+		t.Fatal(err)
+	}
+
+	// the dump covers the one record logged so far
+	cs.LockExclusive()
+	img := cs.CaptureDump(1)
+	cs.UnlockExclusive()
+	// writes after the capture are neither in the dump nor in the image
+	cs.SetKeyInCollection("col1", "plain", "changed")
+	if err := server.WriteDump(img, server.DumpPath(path)); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.WriteCommandsToFile(server.Command{Name: "SET", CollectionName: "col1", Args: []string{"tail", "two"}}, path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := models.NewCollectionStore()
+	records, err := server.LoadSnapshot(path, loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records != 1 {
+		t.Fatalf("expected only the record after the dump to be replayed, got %v", records)
+	}
+	for key, want := range map[string]string{"plain": "one", "tail": "two", "expiring": "soon", "leased": "node"} {
+		if got := loaded.GetKeyInCollection("col1", key); got != want {
+			t.Fatalf("expected %v for %v, got %v", want, key, got)
+		}
+	}
+	if got := loaded.GetKeyInCollection("docs", "big"); got != strings.Repeat("compressible ", 20) {
+		t.Fatalf("expected the compressed value to be restored, got %v", got)
+	}
+	if state := loaded.GetKeyState("col1", "expiring"); !state.ExpireAt.Equal(at) {
+		t.Fatalf("expected the expiration %v, got %v", at, state.ExpireAt)
+	}
+	if _, err := loaded.RevokeLease(lease.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.GetKeyInCollection("col1", "leased"); got != "" {
+		t.Fatalf("expected the leased key to be revoked with its lease, got %v", got)
+	}
+}
+
+func TestDamagedDumpFailsLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.txt")
+	cs := models.NewCollectionStore()
+	logged := func(raw string) {
+		server.ExecuteLogged(server.ParseCommand(raw), cs, newTestClient(), newTestServer(), nil, path)
+	}
+	for i := 0; i < 5; i++ {
+		logged("SET col1 key" + strconv.Itoa(i) + " value")
+	}
+	if err := server.SaveDump(cs, path); err != nil {
+		t.Fatal(err)
+	}
+	logged("SET col1 after dump")
+
+	// the log the dump covers is gone, so a damaged dump fails the load
+	// instead of loading only the record after it
+	data, _ := os.ReadFile(server.DumpPath(path))
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(server.DumpPath(path), data, 0644)
+	if _, err := server.ReadDump(server.DumpPath(path)); err == nil {
+		t.Fatalf("expected the checksum to catch the damage")
+	}
+	if records, err := server.LoadSnapshot(path, models.NewCollectionStore()); err == nil {
+		t.Fatalf("expected the damaged dump to fail the load, got %v records", records)
+	}
+	os.Remove(server.DumpPath(path))
+	if _, err := server.LoadSnapshot(path, models.NewCollectionStore()); err == nil {
+		t.Fatalf("expected the missing dump to fail the load")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	models "github.com/sk25469/kv/internal/model"
+)
+
+func TestNoEvictionRejectsWrites(t *testing.T) {
+	cs := models.NewCollectionStore()
+	cs.SetMemoryLimit(models.MemoryLimit{MaxMemory: 1024, Policy: models.NO_EVICTION})
+
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)
+		if err = cs.ReserveMemory("col1", key, value); err == nil {
+			cs.SetKeyInCollection("col1", key, value)
+		}
+	}
+	if err != models.ErrOOM {
+		t.Fatalf("expected %v, got %v", models.ErrOOM, err)
+	}
+}
+
+func TestAllKeysLRUStaysUnderLimit(t *testing.T) {
+	cs := models.NewCollectionStore()
+	cs.SetMemoryLimit(models.MemoryLimit{MaxMemory: 4096, Policy: models.ALLKEYS_LRU, Samples: 5})
+
+	evicted := 0
+	// the handler runs without the collections lock held, so it can read
+	// the store
+	cs.SetEvictionHandler(func(collection, key string) error {
+		if cs.GetKeyInCollection(collection, key) != "" {
+			t.Errorf("expected %v:%v to be evicted", collection, key)
+		}
+		evicted++
+		return nil
+	})
+	for i := 0; i < 1000; i++ {
+		key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)
+		if err := cs.ReserveMemory(fmt.Sprintf("col%d", i%3), key, value); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		cs.SetKeyInCollection(fmt.Sprintf("col%d", i%3), key, value)
+	}
+	if used := cs.UsedMemory(); used > 4096 {
+		t.Fatalf("used memory %v is over the limit", used)
+	}
+	if evicted == 0 {
+		t.Fatalf("expected keys to be evicted")
+	}
+}
+
+func TestUnloggedEvictionFailsTheWrite(t *testing.T) {
+	cs := models.NewCollectionStore()
+	cs.SetMemoryLimit(models.MemoryLimit{MaxMemory: 1024, Policy: models.ALLKEYS_RANDOM, Samples: 5})
+	cs.SetEvictionHandler(func(collection, key string) error {
+		return errors.New("disk full")
+	})
+
+	cc := newTestClient()
+	var got string
+	for i := 0; i < 100 && !strings.HasPrefix(got, "ERROR:"); i++ {
+		got = exec(t, cs, cc, fmt.Sprintf("SET col1 key%d value%d", i, i))
+	}
+	if !strings.Contains(got, models.ErrEvictionNotLogged.Error()) {
+		t.Fatalf("expected the write which evicted a key to fail, got %q", got)
+	}
+}
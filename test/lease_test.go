@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/internal/server"
+)
+
+func execResolved(t *testing.T, cs *models.CollectionStore, cc *models.ClientConfig, raw string) string {
+	t.Helper()
+	cmd := server.ResolveCommand(server.ParseCommand(raw), cs)
+	return server.ExecuteCommand(cmd, cs, cc, newTestServer(), nil)
+}
+
+func TestLeaseRevokeDeletesItsKeys(t *testing.T) {
+	cs := models.NewCollectionStore()
+	cc := newTestClient()
+
+	id := execResolved(t, cs, cc, "LEASE GRANT 10s")
+	execResolved(t, cs, cc, "SET svc node1 10.0.0.1 LEASE "+id)
+	execResolved(t, cs, cc, "SET svc node2 10.0.0.2 LEASE "+id)
+	execResolved(t, cs, cc, "SET svc node3 10.0.0.3 LEASE "+id)
+	// a plain SET takes the key off the lease
+	execResolved(t, cs, cc, "SET svc node3 static")
+
+	if got := execResolved(t, cs, cc, "GET svc node1"); got != "10.0.0.1" {
+		t.Fatalf("expected the value without the lease option, got %v", got)
+	}
+	if got := execResolved(t, cs, cc, "LEASE TIMETOLIVE "+id+" KEYS"); !strings.Contains(got, `"keys":["svc:node1","svc:node2"]`) {
+		t.Fatalf("unexpected lease info: %v", got)
+	}
+
+	if got := execResolved(t, cs, cc, "LEASE REVOKE "+id); got != "OK" {
+		t.Fatalf("unexpected revoke result: %v", got)
+	}
+	for _, key := range []string{"node1", "node2"} {
+		if got := execResolved(t, cs, cc, "GET svc "+key); got == "10.0.0.1" || got == "10.0.0.2" {
+			t.Fatalf("expected %v to be deleted with the lease, got %v", key, got)
+		}
+	}
+	if got := execResolved(t, cs, cc, "GET svc node3"); got != "static" {
+		t.Fatalf("expected the detached key to stay, got %v", got)
+	}
+	if got := execResolved(t, cs, cc, "SET svc node1 x LEASE "+id); got != "ERROR: lease not found" {
+		t.Fatalf("expected the revoked lease to be rejected, got %v", got)
+	}
+}
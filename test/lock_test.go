@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/internal/server"
+)
+
+func TestLockFencingAndHandOff(t *testing.T) {
+	cs := models.NewCollectionStore()
+	cc := newTestClient()
+
+	first := exec(t, cs, cc, "LOCK ACQUIRE job a 10s")
+	if got := exec(t, cs, cc, "LOCK ACQUIRE job b 10s"); got != "(nil)" {
+		t.Fatalf("expected a held lock not to be granted, got %v", got)
+	}
+
+	// b waits and gets the lock with a bigger token once a releases it
+	granted := make(chan string)
+	go func() { granted <- exec(t, cs, newTestClient(), "LOCK ACQUIRE job b 10s WAIT 5s") }()
+	time.Sleep(50 * time.Millisecond)
+	if got := exec(t, cs, cc, "LOCK RELEASE job a"); got != "OK" {
+		t.Fatalf("unexpected release result: %v", got)
+	}
+	second := <-granted
+	if a, b := parseToken(t, first), parseToken(t, second); b <= a {
+		t.Fatalf("expected a bigger fencing token than %v, got %v", first, second)
+	}
+	if got := exec(t, cs, cc, "LOCK RELEASE job a"); got != "ERROR: lock is not held by the owner" {
+		t.Fatalf("expected the old holder to be rejected, got %v", got)
+	}
+}
+
+func TestLockInsideMultiIsRejected(t *testing.T) {
+	cs := models.NewCollectionStore()
+	cc := newTestClient()
+
+	exec(t, cs, cc, "MULTI")
+	if got := exec(t, cs, cc, "LOCK ACQUIRE job a 10s"); got != "ERROR: command LOCK can not be queued" {
+		t.Fatalf("expected LOCK to be rejected inside MULTI, got %v", got)
+	}
+	if _, _, held := cs.Locks().Info("job"); held {
+		t.Fatalf("expected the lock not to be taken while queueing")
+	}
+	if got := exec(t, cs, cc, "EXEC"); got != "EXECABORT Transaction discarded because of previous errors" {
+		t.Fatalf("expected EXEC to abort, got %v", got)
+	}
+}
+
+func TestLockLeaseExpiryAndReplication(t *testing.T) {
+	master, replica := models.NewCollectionStore(), models.NewCollectionStore()
+	var records []models.DistributedLock
+	master.Locks().SetHandler(func(lock models.DistributedLock, held bool) {
+		if held {
+			records = append(records, lock)
+		}
+	})
+
+	lock, ok := master.Locks().Acquire("job", "a", 50*time.Millisecond, 0)
+	if !ok {
+		t.Fatalf("expected the free lock to be granted")
+	}
+	replica.Locks().ApplyGrant(records[0])
+	if holder, _, ok := replica.Locks().Info("job"); !ok || holder.Token != lock.Token {
+		t.Fatalf("expected the replica to know the holder, got %v", holder)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, _, ok := master.Locks().Info("job"); ok {
+		t.Fatalf("expected the lease to expire")
+	}
+
+	// a promoted replica continues the token sequence
+	next, _ := replica.Locks().Acquire("job", "b", time.Second, 0)
+	if next.Token <= lock.Token {
+		t.Fatalf("expected a token after %v, got %v", lock.Token, next.Token)
+	}
+}
+
+func parseToken(t *testing.T, reply string) uint64 {
+	t.Helper()
+	token, err := strconv.ParseUint(reply, 10, 64)
+	if err != nil {
+		t.Fatalf("expected a fencing token, got %v", reply)
+	}
+	return token
+}
+
+func TestLockChangesWaitForCapture(t *testing.T) {
+	cs := models.NewCollectionStore()
+	logged := make(chan string, 1)
+	cs.Locks().SetHandler(func(lock models.DistributedLock, held bool) { logged <- lock.Owner })
+
+	// a grant isn't made and logged while a dump is captured
+	cs.LockExclusive()
+	go cs.Locks().Acquire("job", "a", 10*time.Second, 0)
+	select {
+	case owner := <-logged:
+		t.Fatalf("expected the grant to %v to wait for the capture", owner)
+	case <-time.After(50 * time.Millisecond):
+	}
+	held, _ := cs.Locks().Held()
+	cs.UnlockExclusive()
+	if len(held) != 0 {
+		t.Fatalf("expected no lock in the capture, got %v", held)
+	}
+	if owner := <-logged; owner != "a" {
+		t.Fatalf("expected the grant to a once the capture is done, got %v", owner)
+	}
+}
+
+func TestReplayedLocksWhichExpiredAreNotReported(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.txt")
+	expired := time.Now().Add(-time.Minute).UnixMilli()
+	held := time.Now().Add(time.Minute).UnixMilli()
+	for _, raw := range []string{
+		fmt.Sprintf("LOCK-GRANTED old a 1 %v", expired),
+		fmt.Sprintf("LOCK-GRANTED job a 2 %v", expired),
+		fmt.Sprintf("LOCK-GRANTED job b 3 %v", held),
+	} {
+		if err := server.WriteCommandsToFile(*server.ParseCommand(raw), path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cs := models.NewCollectionStore()
+	reported := make(chan models.DistributedLock, 10)
+	cs.Locks().SetHandler(func(lock models.DistributedLock, held bool) { reported <- lock })
+	if _, err := server.LoadSnapshot(path, cs); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case lock := <-reported:
+		t.Fatalf("expected no lock change to be reported on replay, got %v", lock)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, _, ok := cs.Locks().Info("old"); ok {
+		t.Fatalf("expected the expired lock to be free")
+	}
+	if holder, _, ok := cs.Locks().Info("job"); !ok || holder.Owner != "b" || holder.Token != 3 {
+		t.Fatalf("expected b to hold the lock, got %v", holder)
+	}
+	if next, _ := cs.Locks().Acquire("old", "c", time.Second, 0); next.Token != 4 {
+		t.Fatalf("expected the token sequence to continue after 3, got %v", next.Token)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/internal/server"
+)
+
+func TestOnlyAppliedMutationsAreLogged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.txt")
+	cs := models.NewCollectionStore()
+	cc := newTestClient()
+	cc.ClientID, cc.IPAddress = "client1", "127.0.0.1:5000"
+	logged := func(kv *models.KVServer, client *models.ClientConfig, raw string) string {
+		t.Helper()
+		return server.ExecuteLogged(server.ResolveCommand(server.ParseCommand(raw), cs), cs, client, kv, nil, path)
+	}
+
+	if got := logged(newTestServer(), cc, "INCR col1 counter"); got != "1" {
+		t.Fatalf("expected 1, got %v", got)
+	}
+	if got := logged(newTestServer(), cc, "INCRBY col1 counter 2"); got != "3" {
+		t.Fatalf("expected 3, got %v", got)
+	}
+	logged(newTestServer(), cc, "INCRBY col1 counter lots")
+	logged(newTestServer(), cc, "SET-TTL col1 missing 5m")
+	logged(newTestServer(), cc, "SET col1 word hello")
+	logged(newTestServer(), cc, "INCR col1 word")
+	protected := &models.KVServer{Config: &models.Config{ProtectedMode: true, IsMaster: true}}
+	stranger := newTestClient()
+	stranger.ClientState.IsAuthenticated = false
+	if got := logged(protected, stranger, "SET col1 counter 100"); got != "unauthorized" {
+		t.Fatalf("expected the write to be rejected, got %v", got)
+	}
+
+	records, err := server.ReadCommandsFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"SET", "counter", "1"}, {"SET", "counter", "3"}, {"SET", "word", "hello"}}
+	if len(records) != len(want) {
+		t.Fatalf("expected %v records, got %v", len(want), records)
+	}
+	for i, record := range records {
+		if record.Name != want[i][0] || record.Args[0] != want[i][1] || record.Args[1] != want[i][2] {
+			t.Fatalf("expected %v, got %v", want[i], record)
+		}
+		if record.Client != "client1@127.0.0.1:5000" {
+			t.Fatalf("expected the client to be recorded, got %q", record.Client)
+		}
+	}
+
+	loaded := models.NewCollectionStore()
+	if _, err := server.LoadSnapshot(path, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.GetKeyInCollection("col1", "counter"); got != "3" {
+		t.Fatalf("expected the counter to be replayed, got %v", got)
+	}
+}
+
+func TestUnloggedMutationsReplyWithAnError(t *testing.T) {
+	// the log can't be created below a regular file
+	dir := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(dir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "snapshot.txt")
+	cs := models.NewCollectionStore()
+	cmd := server.ResolveCommand(server.ParseCommand("SET col1 key1 value1"), cs)
+	if got := server.ExecuteLogged(cmd, cs, newTestClient(), newTestServer(), nil, path); !strings.HasPrefix(got, "ERROR:") {
+		t.Fatalf("expected the write to be replied with an error, got %q", got)
+	}
+}
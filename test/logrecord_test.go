@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/internal/server"
+)
+
+func TestTornTailIsCutOffOnLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.txt")
+	// records written before the framing are still read
+	os.WriteFile(path, []byte(`{"Name":"SET","CollectionName":"col1","Args":["legacy","yes"]}`+"\n"), 0644)
+	for _, key := range []string{"key1", "key2"} {
+		if err := server.WriteCommandsToFile(server.Command{Name: "SET", CollectionName: "col1", Args: []string{key, "value"}}, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info, _ := os.Stat(path)
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	file.WriteString(`3 70 0badc0de {"Name":"SET","Collection`)
+	file.Close()
+
+	server.SetLogLoadTruncated(path, false)
+	var corruption *server.LogCorruption
+	if _, err := server.LoadSnapshot(path, models.NewCollectionStore()); !errors.As(err, &corruption) || corruption.Offset != info.Size() || !corruption.Torn {
+		t.Fatalf("expected a torn record at offset %v, got %v", info.Size(), err)
+	}
+
+	server.SetLogLoadTruncated(path, true)
+	cs := models.NewCollectionStore()
+	if records, err := server.LoadSnapshot(path, cs); err != nil || records != 3 {
+		t.Fatalf("expected the 3 records before the torn one, got %v: %v", records, err)
+	}
+	if after, _ := os.Stat(path); after.Size() != info.Size() {
+		t.Fatalf("expected the torn tail to be cut off, the log has %v bytes", after.Size())
+	}
+	if err := server.WriteCommandsToFile(server.Command{Name: "SET", CollectionName: "col1", Args: []string{"key3", "value"}}, path); err != nil {
+		t.Fatal(err)
+	}
+	if records, err := server.LoadSnapshot(path, models.NewCollectionStore()); err != nil || records != 4 {
+		t.Fatalf("expected the next append to continue the log, got %v records: %v", records, err)
+	}
+}
+
+func TestTornTailIsKeptWithoutLoadTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.txt")
+	torn := []byte(`1 70 0badc0de {"Name":"SET","Collection`)
+	os.WriteFile(path, torn, 0644)
+	server.SetLogLoadTruncated(path, false)
+
+	// the first append doesn't cut off the tail the config keeps
+	var corruption *server.LogCorruption
+	err := server.WriteCommandsToFile(server.Command{Name: "SET", CollectionName: "col1", Args: []string{"key1", "value"}}, path)
+	if !errors.As(err, &corruption) || !corruption.Torn {
+		t.Fatalf("expected the append to fail on the torn record, got %v", err)
+	}
+	if data, _ := os.ReadFile(path); !bytes.Equal(data, torn) {
+		t.Fatalf("expected the log to be left alone, got %q", data)
+	}
+}
+
+func TestCorruptRecordFailsLoadUntilRepaired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.txt")
+	for _, key := range []string{"key1", "key2", "key3"} {
+		if err := server.WriteCommandsToFile(server.Command{Name: "SET", CollectionName: "col1", Args: []string{key, "value"}}, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, _ := os.ReadFile(path)
+	second := bytes.IndexByte(data, '\n') + 1
+	damaged := bytes.Replace(data, []byte("key2"), []byte("kez2"), 1)
+	os.WriteFile(path, damaged, 0644)
+
+	var corruption *server.LogCorruption
+	if _, err := server.LoadSnapshot(path, models.NewCollectionStore()); !errors.As(err, &corruption) || corruption.Offset != int64(second) || corruption.Torn {
+		t.Fatalf("expected a corrupt record at offset %v, got %v", second, err)
+	}
+
+	var out bytes.Buffer
+	if err := server.RepairLog(path, true, &out); err != nil {
+		t.Fatal(err)
+	}
+	if kept, _ := os.ReadFile(path + ".corrupt"); len(kept) != len(data)-second {
+		t.Fatalf("expected the cut off bytes to be kept, got %v bytes", len(kept))
+	}
+	cs := models.NewCollectionStore()
+	if records, err := server.LoadSnapshot(path, cs); err != nil || records != 1 {
+		t.Fatalf("expected the record before the damage to load, got %v: %v", records, err)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/internal/server"
+)
+
+func TestConcurrentAppendsKeepWholeRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.txt")
+	server.SetLogFsync(path, models.FSYNC_ALWAYS)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cmd := server.Command{Name: "SET", CollectionName: "col1", Args: []string{"key" + strconv.Itoa(i), "value"}}
+			if err := server.WriteCommandsToFile(cmd, path); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	commands, err := server.ReadCommandsFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, cmd := range commands {
+		seen[cmd.Args[0]] = true
+	}
+	if len(commands) != 50 || len(seen) != 50 {
+		t.Fatalf("expected 50 distinct records, got %v records for %v keys", len(commands), len(seen))
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"testing"
+
+	models "github.com/sk25469/kv/internal/model"
+)
+
+func TestLSMEngineFlushesCompactsAndReopens(t *testing.T) {
+	dir := t.TempDir()
+	options := models.LSMOptions{MemtableSize: 1024, CompactionTrigger: 2}
+	engine, err := models.OpenLSMEngine(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		if err := engine.Put("key"+strconv.Itoa(i), models.NewKeyValue("v"+strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot := engine.Snapshot()
+	for i := 0; i < 300; i += 3 {
+		if err := engine.Delete("key" + strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	engine.Put("key1", models.NewKeyValue("changed"))
+
+	if engine.Len() != 200 {
+		t.Fatalf("expected 200 keys, got %v", engine.Len())
+	}
+	if value, ok := snapshot.Get("key0"); !ok || value.Value != "v0" {
+		t.Fatalf("expected the snapshot to keep the deleted key, got %v", value)
+	}
+	if snapshot.Len() != 300 {
+		t.Fatalf("expected the snapshot to keep 300 keys, got %v", snapshot.Len())
+	}
+	snapshot.Release()
+	if err := engine.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the memtable comes back from the WAL, the rest from the tables
+	engine, err = models.OpenLSMEngine(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+	if engine.Len() != 200 {
+		t.Fatalf("expected 200 keys after reopening, got %v", engine.Len())
+	}
+	if value, ok := engine.Get("key1"); !ok || value.Value != "changed" {
+		t.Fatalf("expected the overwritten value, got %v", value)
+	}
+	if _, ok := engine.Get("key3"); ok {
+		t.Fatalf("expected key3 to stay deleted")
+	}
+	var keys []string
+	engine.Iterate(func(key string, _ *models.Value) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if len(keys) != 200 || !sort.StringsAreSorted(keys) {
+		t.Fatalf("expected the 200 keys in order, got %v", len(keys))
+	}
+}
+
+func TestCollectionOnLSMEngineSurvivesRestart(t *testing.T) {
+	storage := models.StorageConfig{Dir: t.TempDir(), Engines: map[string]string{"disk": models.LSM_ENGINE}}
+	cs := models.NewCollectionStore()
+	if err := cs.SetStorage(storage); err != nil {
+		t.Fatal(err)
+	}
+	cs.SetKeyInCollection("disk", "a", "one")
+	cs.SetKeyInCollection("disk", "b", "two")
+	cs.DeleteKeyInCollection("disk", "b")
+	cs.SetKeyInCollection("mem", "c", "three")
+	version := cs.GetKeyState("disk", "a").Version
+	if err := cs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := models.NewCollectionStore()
+	if err := reopened.SetStorage(storage); err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if got := reopened.GetAllKeyValuesInCollection("disk"); len(got) != 1 || got["a"] != "one" {
+		t.Fatalf("expected only a to be kept on disk, got %v", got)
+	}
+	if reopened.CollectionExists("mem") {
+		t.Fatalf("expected the memory collection to be gone")
+	}
+	// versions continue past the ones kept on disk
+	reopened.SetKeyInCollection("disk", "a", "changed")
+	if state := reopened.GetKeyState("disk", "a"); state.Version <= version {
+		t.Fatalf("expected a version after %v, got %v", version, state.Version)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/internal/server"
+)
+
+func TestMemoryUsageOfKey(t *testing.T) {
+	cs := models.NewCollectionStore()
+	cc := newTestClient()
+	exec(t, cs, cc, "SET col1 small a")
+	exec(t, cs, cc, "SET col1 large "+strings.Repeat("a", 1000))
+
+	if got := exec(t, cs, cc, "MEMORY USAGE col1 missing"); got != "ERROR: key not found" {
+		t.Fatalf("expected a missing key to be reported, got %q", got)
+	}
+	if got := exec(t, cs, cc, "MEMORY USAGE col2 small"); got != "ERROR: key not found" {
+		t.Fatalf("expected a key of another collection to be reported missing, got %q", got)
+	}
+	if got := exec(t, cs, cc, "MEMORY USAGE col1"); !strings.HasPrefix(got, "Usage:") {
+		t.Fatalf("expected the usage without a key, got %q", got)
+	}
+
+	small, err := strconv.ParseInt(exec(t, cs, cc, "MEMORY USAGE col1 small"), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, err := strconv.ParseInt(exec(t, cs, cc, "MEMORY USAGE col1 large"), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if small <= 0 || large < small+999 {
+		t.Fatalf("expected the usage to grow with the value, got %v and %v", small, large)
+	}
+	if got := exec(t, cs, cc, "MEMORY FOO"); got != "Unknown MEMORY subcommand: FOO" {
+		t.Fatalf("expected an unknown subcommand to be rejected, got %q", got)
+	}
+}
+
+func TestMemoryStats(t *testing.T) {
+	cs := models.NewCollectionStore()
+	cc := newTestClient()
+	exec(t, cs, cc, "SET col1 a one")
+	exec(t, cs, cc, "SET col1 b two")
+	exec(t, cs, cc, "SET col2 c three")
+
+	var stats models.MemoryStats
+	if err := json.Unmarshal([]byte(exec(t, cs, cc, "MEMORY STATS")), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Keys != 3 || len(stats.CollectionBreakdown) != 2 {
+		t.Fatalf("expected 3 keys in 2 collections, got %v keys in %v", stats.Keys, stats.CollectionBreakdown)
+	}
+	if col1 := stats.CollectionBreakdown["col1"]; col1 == nil || col1.Keys != 2 || col1.Dataset != int64(len("a")+len("one")+len("b")+len("two")) {
+		t.Fatalf("expected col1 to hold 2 keys, got %+v", col1)
+	}
+	if stats.UsedMemory != stats.Dataset+stats.Overhead || stats.Dataset != 14 {
+		t.Fatalf("expected the used memory to be the dataset and the overhead, got %+v", stats)
+	}
+}
+
+func TestMemoryDoctor(t *testing.T) {
+	cs := models.NewCollectionStore()
+	cc := newTestClient()
+	if got := exec(t, cs, cc, "MEMORY DOCTOR"); got != "the store is empty, nothing to report" {
+		t.Fatalf("expected an empty store to have nothing to report, got %q", got)
+	}
+
+	exec(t, cs, cc, "SET col1 big "+strings.Repeat("a", models.BIG_KEY_THRESHOLD))
+	exec(t, cs, cc, "SET col2 small a")
+	got := exec(t, cs, cc, "MEMORY DOCTOR")
+	if !strings.Contains(got, "1 big keys over") || !strings.Contains(got, "col1:big") {
+		t.Fatalf("expected the big key to be reported, got %q", got)
+	}
+	if !strings.Contains(got, "collection col1 holds more than half of the used memory") {
+		t.Fatalf("expected the dominant collection to be reported, got %q", got)
+	}
+	if strings.Contains(got, "col2") {
+		t.Fatalf("expected only col1 to be reported, got %q", got)
+	}
+}
+
+func TestAnalyzeSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.txt")
+	logged := func(raw string) {
+		if err := server.WriteCommandsToFile(*server.ParseCommand(raw), path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logged("SET col1 a " + strings.Repeat("a", 100))
+	logged("SET col1 b " + strings.Repeat("b", 2000))
+	logged("SET col2 c c")
+	logged("SET col2 d d")
+	logged("DELETE col2 d")
+
+	var out strings.Builder
+	if err := server.AnalyzeSnapshot(path, 2, &out); err != nil {
+		t.Fatal(err)
+	}
+	report := out.String()
+	if !strings.Contains(report, "commands: 5, keys: 3, collections: 2\n") {
+		t.Fatalf("expected the counts of the log, got\n%v", report)
+	}
+
+	// the biggest keys come first and no more than the top are listed
+	keys := report[strings.Index(report, "biggest keys:"):strings.Index(report, "biggest collections:")]
+	if !strings.Contains(keys, "col1:b") || !strings.Contains(keys, "col1:a") || strings.Index(keys, "col1:b") > strings.Index(keys, "col1:a") {
+		t.Fatalf("expected col1:b before col1:a, got\n%v", keys)
+	}
+	if strings.Contains(keys, "col2:c") {
+		t.Fatalf("expected only the top 2 keys, got\n%v", keys)
+	}
+	collections := report[strings.Index(report, "biggest collections:"):strings.Index(report, "value size histogram:")]
+	if strings.Index(collections, "col1") > strings.Index(collections, "col2") {
+		t.Fatalf("expected col1 before col2, got\n%v", collections)
+	}
+
+	histogram := map[string]string{}
+	for _, line := range strings.Split(report[strings.Index(report, "value size histogram:"):], "\n")[1:] {
+		if fields := strings.Fields(line); len(fields) == 4 {
+			histogram[fields[0]+" "+fields[1]] = fields[3]
+		}
+	}
+	if histogram["< 64"] != "1" || histogram["< 256"] != "1" || histogram["< 4096"] != "1" || histogram["< 1024"] != "0" {
+		t.Fatalf("expected one value in each of the buckets of 1, 100 and 2000 bytes, got %v", histogram)
+	}
+}
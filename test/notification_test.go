@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	models "github.com/sk25469/kv/internal/model"
+)
+
+// subscribe subscribes a new client to the topic and returns the messages
+// it gets
+func subscribe(t *testing.T, ps *models.PubSub, topic string) <-chan string {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	ps.Subscribe(topic, server, &models.ClientConfig{ClientID: fmt.Sprintf("%v-%v", t.Name(), topic)})
+
+	messages := make(chan string, 100)
+	go func() {
+		scanner := bufio.NewScanner(client)
+		for scanner.Scan() {
+			messages <- scanner.Text()
+		}
+	}()
+	return messages
+}
+
+// nextMessage returns the next message published to the topic, or the
+// "end" marker published after it when there is none. Messages are
+// delivered in order, so anything published before the marker comes first
+func nextMessage(t *testing.T, ps *models.PubSub, topic string, messages <-chan string) string {
+	t.Helper()
+	ps.Publish(topic, "end")
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a message on %v", topic)
+		return ""
+	}
+}
+
+func TestKeyspaceEventsOnlyForEnabledClasses(t *testing.T) {
+	events := []struct {
+		class   string
+		event   string
+		key     string
+		trigger func(t *testing.T, cs *models.CollectionStore)
+	}{
+		{"$", "set", "a", func(t *testing.T, cs *models.CollectionStore) {
+			cs.SetKeyInCollection("col1", "a", "one")
+		}},
+		{"g", "del", "b", func(t *testing.T, cs *models.CollectionStore) {
+			cs.DeleteKeyInCollection("col1", "b")
+		}},
+		{"x", "expired", "c", func(t *testing.T, cs *models.CollectionStore) {
+			cs.DeleteExpiredKeys(time.Now().Add(time.Second))
+		}},
+		{"e", "evicted", "", func(t *testing.T, cs *models.CollectionStore) {
+			cs.SetMemoryLimit(models.MemoryLimit{MaxMemory: 1024, Policy: models.ALLKEYS_LRU, Samples: 5})
+			for i := 0; i < 100; i++ {
+				key, value := fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)
+				if err := cs.ReserveMemory("col2", key, value); err != nil {
+					t.Fatal(err)
+				}
+				cs.SetKeyInCollection("col2", key, value)
+			}
+		}},
+	}
+
+	for _, e := range events {
+		for _, enabled := range []bool{true, false} {
+			flags := "KE" + e.class
+			if !enabled {
+				flags = "KE" + strings.Replace("g$xe", e.class, "", 1)
+			}
+			mask, err := models.ParseKeyspaceEvents(flags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ps := models.NewPubSub()
+			cs := models.NewCollectionStore()
+			for _, key := range []string{"b", "c"} {
+				cs.SetKeyInCollection("col1", key, "value")
+			}
+			cs.UpdateKeyInCollectionWithExpiration("col1", "c", time.Now().Add(time.Millisecond))
+			cs.SetNotifier(models.NewKeyspaceNotifier(ps, mask))
+
+			keyeventTopic := models.KEYEVENT_CHANNEL_PREFIX + e.event
+			keyspaceTopic := models.KEYSPACE_CHANNEL_PREFIX + "col1:" + e.key
+			keyevent := subscribe(t, ps, keyeventTopic)
+			var keyspace <-chan string
+			if e.key != "" {
+				keyspace = subscribe(t, ps, keyspaceTopic)
+			}
+			e.trigger(t, cs)
+
+			got := nextMessage(t, ps, keyeventTopic, keyevent)
+			if enabled && (got == "end" || (e.key != "" && got != "col1:"+e.key)) {
+				t.Fatalf("expected a %v event with %v, got %q", e.event, flags, got)
+			}
+			if !enabled && got != "end" {
+				t.Fatalf("expected no %v event with %v, got %q", e.event, flags, got)
+			}
+			if keyspace == nil {
+				continue
+			}
+			got = nextMessage(t, ps, keyspaceTopic, keyspace)
+			if enabled && got != e.event {
+				t.Fatalf("expected %v on the keyspace channel with %v, got %q", e.event, flags, got)
+			}
+			if !enabled && got != "end" {
+				t.Fatalf("expected nothing on the keyspace channel with %v, got %q", flags, got)
+			}
+		}
+	}
+}
+
+func TestKeyspaceAndKeyeventChannelsAreEnabledApart(t *testing.T) {
+	for _, flags := range []string{"K$", "E$"} {
+		mask, _ := models.ParseKeyspaceEvents(flags)
+		ps := models.NewPubSub()
+		cs := models.NewCollectionStore()
+		cs.SetNotifier(models.NewKeyspaceNotifier(ps, mask))
+
+		keyspaceTopic, keyeventTopic := models.KEYSPACE_CHANNEL_PREFIX+"col1:a", models.KEYEVENT_CHANNEL_PREFIX+"set"
+		keyspace := subscribe(t, ps, keyspaceTopic)
+		keyevent := subscribe(t, ps, keyeventTopic)
+		cs.SetKeyInCollection("col1", "a", "one")
+
+		onKeyspace, onKeyevent := flags == "K$", flags == "E$"
+		if got := nextMessage(t, ps, keyspaceTopic, keyspace); (got == "set") != onKeyspace {
+			t.Fatalf("with %v got %q on the keyspace channel", flags, got)
+		}
+		if got := nextMessage(t, ps, keyeventTopic, keyevent); (got == "col1:a") != onKeyevent {
+			t.Fatalf("with %v got %q on the keyevent channel", flags, got)
+		}
+	}
+
+	if _, err := models.ParseKeyspaceEvents("Kz"); err == nil {
+		t.Fatalf("expected an unknown class to be rejected")
+	}
+	// without either channel nothing is published
+	mask, _ := models.ParseKeyspaceEvents("A")
+	if models.NewKeyspaceNotifier(models.NewPubSub(), mask).Enabled(models.NotifyString) {
+		t.Fatalf("expected a notifier without K or E to publish nothing")
+	}
+}
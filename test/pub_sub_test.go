@@ -1,5 +1,14 @@
 package main
 
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+
+	models "github.com/sk25469/kv/internal/model"
+)
+
 // func BenchmarkPubSub(b *testing.B) {
 // 	ps := models.NewPubSub()
 // 	// ch := ps.Subscribe("topic")
@@ -36,3 +45,61 @@ package main
 // 		}
 // 	})
 // }
+
+func TestClientSubscribesToSeveralTopics(t *testing.T) {
+	ps := models.NewPubSub()
+	server, client := net.Pipe()
+	defer client.Close()
+	cc := &models.ClientConfig{ClientID: "client1"}
+	ps.Subscribe("news", server, cc)
+	ps.Subscribe("sports", server, cc)
+	// subscribing twice to a topic doesn't deliver its messages twice
+	ps.Subscribe("news", server, cc)
+
+	ps.Publish("news", "one")
+	ps.Publish("sports", "two")
+	ps.Publish("weather", "three")
+	got := map[string]bool{}
+	scanner := bufio.NewScanner(client)
+	for i := 0; i < 2 && scanner.Scan(); i++ {
+		got[scanner.Text()] = true
+	}
+	if !got["one"] || !got["two"] {
+		t.Fatalf("expected the messages of both topics, got %v", got)
+	}
+
+	ps.Publish("news", "end")
+	if scanner.Scan(); scanner.Text() != "end" {
+		t.Fatalf("expected every message once, got %q", scanner.Text())
+	}
+}
+
+func TestSlowSubscriberDropsMessages(t *testing.T) {
+	ps := models.NewPubSub()
+	server, client := net.Pipe()
+	defer client.Close()
+	ps.Subscribe("news", server, &models.ClientConfig{ClientID: "slow"})
+
+	// nothing reads from the subscriber, so its queue fills up, except for
+	// the message it may be writing already
+	for i := 0; i < models.SUBSCRIBER_QUEUE_SIZE+10; i++ {
+		ps.Publish("news", fmt.Sprint(i))
+	}
+	if dropped := ps.Dropped(); dropped < 9 || dropped > 10 {
+		t.Fatalf("expected the messages over the queue to be dropped, got %v", dropped)
+	}
+
+	// the messages which fit are delivered in order, once it caught up it
+	// gets new messages again
+	scanner := bufio.NewScanner(client)
+	delivered := models.SUBSCRIBER_QUEUE_SIZE + 10 - int(ps.Dropped())
+	for i := 0; i < delivered && scanner.Scan(); i++ {
+		if scanner.Text() != fmt.Sprint(i) {
+			t.Fatalf("expected message %v, got %q", i, scanner.Text())
+		}
+	}
+	ps.Publish("news", "end")
+	if scanner.Scan(); scanner.Text() != "end" {
+		t.Fatalf("expected the subscriber to get new messages, got %q", scanner.Text())
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/internal/server"
+)
+
+func TestRecoverToPointBeforeMassDelete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.txt")
+	dir := filepath.Join(t.TempDir(), "backup")
+	cs := models.NewCollectionStore()
+	logged := func(raw string) {
+		server.ExecuteLogged(server.ParseCommand(raw), cs, newTestClient(), newTestServer(), nil, path)
+	}
+
+	logged("SET col1 a one")
+	logged("SET col2 x other")
+	if _, err := server.BackupToDir(cs, path, dir); err != nil {
+		t.Fatal(err)
+	}
+	logged("SET col1 b two")
+	time.Sleep(5 * time.Millisecond)
+	beforeDelete := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	logged("DELETE col1 a")
+	logged("DELETE col1 b")
+	if _, err := server.BackupToDir(cs, path, dir); err != nil {
+		t.Fatal(err)
+	}
+	// the dump of the node is newer than the target, the records before
+	// it are only left in the backup
+	if err := server.RewriteLog(cs, path); err != nil {
+		t.Fatal(err)
+	}
+	logged("SET col1 c three")
+
+	recovered := func(target server.RecoveryTarget) map[string]string {
+		out := filepath.Join(t.TempDir(), "data", "snapshot.txt")
+		if err := server.RecoverToPoint([]string{path, dir}, target, out, io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		loaded := models.NewCollectionStore()
+		if _, err := server.LoadSnapshot(out, loaded); err != nil {
+			t.Fatal(err)
+		}
+		if got := loaded.GetAllKeyValuesInCollection("col2"); len(target.Collections) > 0 && len(got) > 0 {
+			t.Fatalf("expected only the selected collections, got col2 %v", got)
+		}
+		return loaded.GetAllKeyValuesInCollection("col1")
+	}
+
+	if got := recovered(server.RecoveryTarget{Time: beforeDelete, Collections: []string{"col1"}}); len(got) != 2 || got["a"] != "one" || got["b"] != "two" {
+		t.Fatalf("expected a and b before the delete, got %v", got)
+	}
+	if got := recovered(server.RecoveryTarget{Seq: 4}); len(got) != 1 || got["b"] != "two" {
+		t.Fatalf("expected b up to record 4, got %v", got)
+	}
+	if got := recovered(server.RecoveryTarget{Time: time.Now()}); len(got) != 1 || got["c"] != "three" {
+		t.Fatalf("expected the latest state, got %v", got)
+	}
+
+	// the result goes into a fresh directory only
+	if err := server.RecoverToPoint([]string{path}, server.RecoveryTarget{Seq: 1}, path, io.Discard); err == nil {
+		t.Fatalf("expected a recovery into the directory of the node to fail")
+	}
+	if err := server.RecoverToPoint([]string{path}, server.RecoveryTarget{Seq: 10}, filepath.Join(t.TempDir(), "snapshot.txt"), io.Discard); err == nil {
+		t.Fatalf("expected a record the log doesn't hold to fail the recovery")
+	}
+}
+
+func TestRecoverExpiresKeysAsOfTheTarget(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.txt")
+	cs := models.NewCollectionStore()
+	logged := func(raw string) {
+		server.ExecuteLogged(server.ParseCommand(raw), cs, newTestClient(), newTestServer(), nil, path)
+	}
+	expireAt := func(d time.Duration) string {
+		return strconv.FormatInt(time.Now().Add(d).UnixMilli(), 10)
+	}
+
+	logged("SET col1 expired before")
+	logged("EXPIREAT col1 expired " + expireAt(10*time.Millisecond))
+	logged("SET col1 live then")
+	logged("EXPIREAT col1 live " + expireAt(200*time.Millisecond))
+	time.Sleep(50 * time.Millisecond)
+	target := time.Now()
+	// by the time of the recovery both keys expired
+	time.Sleep(200 * time.Millisecond)
+
+	out := filepath.Join(t.TempDir(), "data", "snapshot.txt")
+	if err := server.RecoverToPoint([]string{path}, server.RecoveryTarget{Time: target}, out, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	img, err := server.ReadDump(server.DumpPath(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	img.Scan(func(collection, key string, value *models.Value, payload string, lease int64) {
+		keys = append(keys, key)
+	})
+	if len(keys) != 1 || keys[0] != "live" {
+		t.Fatalf("expected only the key live at the target, got %v", keys)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/internal/server"
+)
+
+func TestRewriteLogKeepsOnlyTheState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.txt")
+	cs := models.NewCollectionStore()
+	logged := func(cmd server.Command) {
+		t.Helper()
+		if err := server.WriteCommandsToFile(cmd, path); err != nil {
+			t.Fatal(err)
+		}
+		server.ExecuteCommand(&cmd, cs, newTestClient(), newTestServer(), nil)
+	}
+
+	for i := 0; i < 100; i++ {
+		logged(server.Command{Name: "SET", CollectionName: "col1", Args: []string{"counter", strconv.Itoa(i)}})
+	}
+	logged(server.Command{Name: "SET", CollectionName: "col1", Args: []string{"gone", "soon"}})
+	logged(server.Command{Name: "DELETE", CollectionName: "col1", Args: []string{"gone"}})
+	at := time.Now().Add(time.Hour).UnixMilli()
+	logged(server.Command{Name: "SET", CollectionName: "col1", Args: []string{"expiring", "value"}})
+	logged(server.Command{Name: "EXPIREAT", CollectionName: "col1", Args: []string{"expiring", strconv.FormatInt(at, 10)}})
+	exec(t, cs, newTestClient(), "LOCK ACQUIRE job a 10s")
+
+	before, _ := os.Stat(path)
+	if err := server.RewriteLog(cs, path); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.Stat(path)
+	if after.Size() >= before.Size() {
+		t.Fatalf("expected the rewrite to shrink the log, %v bytes before and %v after", before.Size(), after.Size())
+	}
+
+	loaded := models.NewCollectionStore()
+	if _, err := server.LoadSnapshot(path, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.GetKeyInCollection("col1", "counter"); got != "99" {
+		t.Fatalf("expected the last value, got %v", got)
+	}
+	if got := loaded.GetKeyInCollection("col1", "gone"); got != "" {
+		t.Fatalf("expected the deleted key to stay deleted, got %v", got)
+	}
+	if state := loaded.GetKeyState("col1", "expiring"); state.ExpireAt.UnixMilli() != at {
+		t.Fatalf("expected the expiration to be kept, got %v", state.ExpireAt)
+	}
+	// the fencing tokens continue after the rewrite
+	if token := exec(t, loaded, newTestClient(), "LOCK ACQUIRE other b 10s"); parseToken(t, token) != 2 {
+		t.Fatalf("expected the token sequence to continue, got %v", token)
+	}
+
+	// the records after the rewrite continue its numbering
+	logged(server.Command{Name: "SET", CollectionName: "col1", Args: []string{"after", "rewrite"}})
+	loaded = models.NewCollectionStore()
+	if _, err := server.LoadSnapshot(path, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.GetKeyInCollection("col1", "after"); got != "rewrite" {
+		t.Fatalf("expected the record after the rewrite, got %v", got)
+	}
+}
+
+func TestRewriteLogKeepsAppendsDuringTheRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.txt")
+	server.SetLogSegments(path, models.LogSegmentConfig{MaxSize: 512})
+	cs := models.NewCollectionStore()
+	logged := func(key string) {
+		server.ExecuteLogged(server.ParseCommand("SET col1 "+key+" value"), cs, newTestClient(), newTestServer(), nil, path)
+	}
+
+	for i := 0; i < 20; i++ {
+		logged("before" + strconv.Itoa(i))
+	}
+	if err := server.SaveDump(cs, path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		logged("sealed" + strconv.Itoa(i))
+	}
+	if segments, _ := filepath.Glob(path + ".0*"); len(segments) == 0 {
+		t.Fatalf("expected sealed segments before the rewrite")
+	}
+	if err := server.RewriteLog(cs, path); err != nil {
+		t.Fatal(err)
+	}
+	// the rewritten log holds the whole state on its own
+	if segments, _ := filepath.Glob(path + ".0*"); len(segments) != 0 {
+		t.Fatalf("expected the rewrite to remove the sealed segments, got %v", segments)
+	}
+	if _, err := os.Stat(server.DumpPath(path)); !os.IsNotExist(err) {
+		t.Fatalf("expected the rewrite to remove the dump, got %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			logged("during" + strconv.Itoa(i))
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		if err := server.RewriteLog(cs, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+
+	loaded := models.NewCollectionStore()
+	if _, err := server.LoadSnapshot(path, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(loaded.GetAllKeyValuesInCollection("col1")); got != 240 {
+		t.Fatalf("expected every key written before and during the rewrites, got %v", got)
+	}
+}
+
+func TestRewrittenLogWithoutItsManifestLoads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.txt")
+	cs := models.NewCollectionStore()
+	logged := func(raw string) {
+		server.ExecuteLogged(server.ParseCommand(raw), cs, newTestClient(), newTestServer(), nil, path)
+	}
+
+	logged("SET col1 a one")
+	logged("SET col1 b two")
+	if err := server.SaveDump(cs, path); err != nil {
+		t.Fatal(err)
+	}
+	logged("DELETE col1 a")
+	manifest, _ := os.ReadFile(server.ManifestPath(path))
+	dump, _ := os.ReadFile(server.DumpPath(path))
+	if err := server.RewriteLog(cs, path); err != nil {
+		t.Fatal(err)
+	}
+	logged("SET col1 c three")
+
+	// a crash right after the rename leaves the manifest and the dump from
+	// before the rewrite
+	os.WriteFile(server.ManifestPath(path), manifest, 0644)
+	os.WriteFile(server.DumpPath(path), dump, 0644)
+	loaded := models.NewCollectionStore()
+	if _, err := server.LoadSnapshot(path, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if got := loaded.GetAllKeyValuesInCollection("col1"); len(got) != 2 || got["b"] != "two" || got["c"] != "three" {
+		t.Fatalf("expected b and c from the rewritten log, got %v", got)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/internal/server"
+)
+
+func TestSegmentsRollAndAreRemovedByADump(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.txt")
+	server.SetLogSegments(path, models.LogSegmentConfig{MaxSize: 256})
+	cs := models.NewCollectionStore()
+
+	for i := 0; i < 20; i++ {
+		cmd := server.Command{Name: "SET", CollectionName: "col1", Args: []string{"key" + strconv.Itoa(i), "value"}}
+		server.ExecuteLogged(&cmd, cs, newTestClient(), newTestServer(), nil, path)
+	}
+	segments, _ := filepath.Glob(path + ".0*")
+	if len(segments) < 2 {
+		t.Fatalf("expected the log to be split into segments, got %v", segments)
+	}
+	if _, err := os.Stat(server.ManifestPath(path)); err != nil {
+		t.Fatalf("expected a manifest: %v", err)
+	}
+
+	loaded := models.NewCollectionStore()
+	if records, err := server.LoadSnapshot(path, loaded); err != nil || records != 20 {
+		t.Fatalf("expected the 20 records of every segment, got %v: %v", records, err)
+	}
+
+	if err := server.SaveDump(cs, path); err != nil {
+		t.Fatal(err)
+	}
+	if segments, _ := filepath.Glob(path + ".0*"); len(segments) != 0 {
+		t.Fatalf("expected the dump to remove the segments it covers, got %v", segments)
+	}
+	cmd := server.Command{Name: "SET", CollectionName: "col1", Args: []string{"after", "dump"}}
+	server.ExecuteLogged(&cmd, cs, newTestClient(), newTestServer(), nil, path)
+
+	loaded = models.NewCollectionStore()
+	if records, err := server.LoadSnapshot(path, loaded); err != nil || records != 1 {
+		t.Fatalf("expected only the record after the dump, got %v: %v", records, err)
+	}
+	for _, key := range []string{"key0", "key19", "after"} {
+		if loaded.GetKeyInCollection("col1", key) == "" {
+			t.Fatalf("expected %v to be loaded", key)
+		}
+	}
+}
+
+func TestRepairLogChecksSealedSegments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.txt")
+	server.SetLogSegments(path, models.LogSegmentConfig{MaxSize: 256})
+	for i := 0; i < 10; i++ {
+		cmd := server.Command{Name: "SET", CollectionName: "col1", Args: []string{"key" + strconv.Itoa(i), "value"}}
+		if err := server.WriteCommandsToFile(cmd, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	segments, _ := filepath.Glob(path + ".0*")
+	if len(segments) < 2 {
+		t.Fatalf("expected the log to be split into segments, got %v", segments)
+	}
+	data, _ := os.ReadFile(segments[0])
+	os.WriteFile(segments[0], bytes.Replace(data, []byte("key0"), []byte("kez0"), 1), 0644)
+
+	var out bytes.Buffer
+	if err := server.RepairLog(path, false, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), segments[0]+" has a corrupt record at offset 0") {
+		t.Fatalf("expected the damaged segment to be reported, got %v", out.String())
+	}
+	// cutting off a sealed segment would lose the segments after it
+	if err := server.RepairLog(path, true, &out); err == nil {
+		t.Fatalf("expected -fix to leave the damaged sealed segment alone")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	models "github.com/sk25469/kv/internal/model"
+)
+
+func newTieredStore(t *testing.T, setting models.TieringSetting) *models.CollectionStore {
+	cs := models.NewCollectionStore()
+	if err := cs.SetStorage(models.StorageConfig{Dir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	cs.SetTiering(map[string]models.TieringSetting{"*": setting})
+	t.Cleanup(func() { cs.Close() })
+	return cs
+}
+
+func TestTieringSpillsIdleValuesAndFaultsThemIn(t *testing.T) {
+	cs := newTieredStore(t, models.TieringSetting{ColdAfter: time.Minute})
+	value := strings.Repeat("v", 200)
+	for i := 0; i < 3; i++ {
+		cs.SetKeyInCollection("cache", "key"+strconv.Itoa(i), value+strconv.Itoa(i))
+	}
+	hot := cs.UsedMemory()
+
+	cs.TierValues(time.Now().Add(2 * time.Minute))
+	stats := cs.MemoryStats().TieringStats
+	if stats.ColdKeys != 3 || stats.HotKeys != 0 || stats.Spills != 3 {
+		t.Fatalf("expected the 3 idle values to be spilled, got %+v", stats)
+	}
+	if used := cs.UsedMemory(); used >= hot {
+		t.Fatalf("expected spilling to free memory, used %v before and %v after", hot, used)
+	}
+
+	// a spilled value is read from the value file and kept in memory again
+	if got := cs.GetKeyInCollection("cache", "key1"); got != value+"1" {
+		t.Fatalf("expected the spilled value, got %v", got)
+	}
+	stats = cs.MemoryStats().TieringStats
+	if stats.ColdKeys != 2 || stats.HotKeys != 1 || stats.Faults != 1 {
+		t.Fatalf("expected key1 to be faulted in, got %+v", stats)
+	}
+	if got := cs.GetAllKeyValuesInCollection("cache"); len(got) != 3 || got["key2"] != value+"2" {
+		t.Fatalf("expected every value to be readable, got %v", got)
+	}
+
+	// the dump holds the spilled values themselves
+	cs.LockExclusive()
+	img := cs.CaptureDump(0)
+	cs.UnlockExclusive()
+	var buf bytes.Buffer
+	err := img.Encode(&buf)
+	img.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := models.DecodeDump(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := models.NewCollectionStore()
+	restored.RestoreDump(decoded)
+	if got := restored.GetKeyInCollection("cache", "key0"); got != value+"0" {
+		t.Fatalf("expected the spilled value in the dump, got %v", got)
+	}
+}
+
+func TestTieringKeepsOversizedValuesOnDiskAndCompacts(t *testing.T) {
+	cs := newTieredStore(t, models.TieringSetting{MinSize: 64 << 10})
+	big := strings.Repeat("b", 64<<10)
+	for i := 0; i < 20; i++ {
+		cs.SetKeyInCollection("blobs", "key"+strconv.Itoa(i), big)
+	}
+	cs.SetKeyInCollection("blobs", "keep", big+"keep")
+	cs.SetKeyInCollection("blobs", "small", "small")
+
+	// oversized values stay on disk when they are read
+	if got := cs.GetKeyInCollection("blobs", "key3"); got != big {
+		t.Fatalf("expected the oversized value, got %v bytes", len(got))
+	}
+	stats := cs.MemoryStats().TieringStats
+	if stats.ColdKeys != 21 || stats.HotKeys != 1 || stats.Faults != 0 {
+		t.Fatalf("expected the oversized values to stay spilled, got %+v", stats)
+	}
+
+	for i := 0; i < 20; i++ {
+		cs.DeleteKeyInCollection("blobs", "key"+strconv.Itoa(i))
+	}
+	cs.TierValues(time.Now())
+	stats = cs.MemoryStats().TieringStats
+	if stats.Compactions != 1 || stats.ValueFileBytes != stats.ColdBytes {
+		t.Fatalf("expected the dead values to be compacted away, got %+v", stats)
+	}
+	if got := cs.GetKeyInCollection("blobs", "keep"); got != big+"keep" {
+		t.Fatalf("expected the value moved by the compaction, got %v bytes", len(got))
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/internal/server"
+)
+
+func exec(t *testing.T, cs *models.CollectionStore, cc *models.ClientConfig, raw string) string {
+	t.Helper()
+	return server.ExecuteCommand(server.ParseCommand(raw), cs, cc, newTestServer(), nil)
+}
+
+func TestTransactionIsolatedPerClient(t *testing.T) {
+	cs := models.NewCollectionStore()
+	alice, bob := newTestClient(), newTestClient()
+
+	exec(t, cs, alice, "SET col1 key1 before")
+	exec(t, cs, alice, "BEGIN")
+	exec(t, cs, bob, "BEGIN")
+	exec(t, cs, alice, "SET col1 key1 alice")
+	exec(t, cs, alice, "DELETE col1 key2")
+
+	if got := exec(t, cs, alice, "GET col1 key1"); got != "alice" {
+		t.Fatalf("expected to read own write, got %v", got)
+	}
+	if got := exec(t, cs, bob, "GET col1 key1"); got != "before" {
+		t.Fatalf("expected uncommitted write to be invisible, got %v", got)
+	}
+
+	// BEGIN of another client doesn't touch alice's buffer
+	exec(t, cs, bob, "ROLLBACK")
+	if got := exec(t, cs, alice, "COMMIT"); got != "OK" {
+		t.Fatalf("unexpected commit result: %v", got)
+	}
+	if got := cs.GetKeyInCollection("col1", "key1"); got != "alice" {
+		t.Fatalf("expected committed write in the store, got %v", got)
+	}
+}
+
+func TestRollbackDiscardsWrites(t *testing.T) {
+	cs := models.NewCollectionStore()
+	cc := newTestClient()
+
+	exec(t, cs, cc, "BEGIN")
+	exec(t, cs, cc, "TSET col1 key1 value1")
+	exec(t, cs, cc, "ROLLBACK")
+
+	if got := cs.GetKeyInCollection("col1", "key1"); got != "" {
+		t.Fatalf("expected rolled back write to be discarded, got %v", got)
+	}
+}
+
+func TestBatchReplayIsApplied(t *testing.T) {
+	cs := models.NewCollectionStore()
+	batch := &server.Command{Name: "BATCH", Batch: []server.Command{
+		{Name: "SET", CollectionName: "col1", Args: []string{"key1", "value1"}},
+		{Name: "SET", CollectionName: "col1", Args: []string{"key2", "value2"}},
+		{Name: "DELETE", CollectionName: "col1", Args: []string{"key1"}},
+	}}
+	if got := server.ExecuteCommand(batch, cs, newTestClient(), newTestServer(), nil); got != "OK" {
+		t.Fatalf("unexpected batch result: %v", got)
+	}
+	if cs.GetKeyInCollection("col1", "key1") != "" || cs.GetKeyInCollection("col1", "key2") != "value2" {
+		t.Fatalf("unexpected state after batch: %v", cs.GetAllKeyValues())
+	}
+}
+
+func TestMultiExecRunsQueue(t *testing.T) {
+	cs := models.NewCollectionStore()
+	cc := newTestClient()
+
+	exec(t, cs, cc, "MULTI")
+	if got := exec(t, cs, cc, "SET col1 key1 value1"); got != "QUEUED" {
+		t.Fatalf("expected command to be queued, got %v", got)
+	}
+	exec(t, cs, cc, "GET col1 key1")
+	if got := cs.GetKeyInCollection("col1", "key1"); got != "" {
+		t.Fatalf("expected queued write to wait for EXEC, got %v", got)
+	}
+	if got := exec(t, cs, cc, "EXEC"); got != `["OK","value1"]` {
+		t.Fatalf("unexpected EXEC result: %v", got)
+	}
+	if got := cs.GetKeyInCollection("col1", "key1"); got != "value1" {
+		t.Fatalf("expected EXEC to apply the write, got %v", got)
+	}
+}
+
+func TestMultiQueueErrorAbortsExec(t *testing.T) {
+	cs := models.NewCollectionStore()
+	cc := newTestClient()
+
+	exec(t, cs, cc, "MULTI")
+	exec(t, cs, cc, "SET col1 key1 value1")
+	exec(t, cs, cc, "SET col1")
+	if got := exec(t, cs, cc, "EXEC"); got != "EXECABORT Transaction discarded because of previous errors" {
+		t.Fatalf("expected EXEC to abort, got %v", got)
+	}
+	if got := cs.GetKeyInCollection("col1", "key1"); got != "" {
+		t.Fatalf("expected aborted write to be discarded, got %v", got)
+	}
+}
+
+func TestExecLocksOnlyItsCollections(t *testing.T) {
+	cs := models.NewCollectionStore()
+	run := func(raw string) <-chan string {
+		done := make(chan string, 1)
+		go func() {
+			done <- server.ExecuteCommand(server.ParseCommand(raw), cs, newTestClient(), newTestServer(), nil)
+		}()
+		return done
+	}
+
+	// while a queue holds col1 a command on col2 runs and one on col1 waits
+	cs.LockShared()
+	unlock := cs.LockCollections([]string{"col1"}, true)
+	select {
+	case <-run("SET col2 key1 value"):
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a write to another collection to run")
+	}
+	waiting := run("SET col1 key1 value")
+	select {
+	case got := <-waiting:
+		t.Fatalf("expected the write to col1 to wait for the queue, got %v", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	cs.UnlockShared()
+	if got := <-waiting; got != "OK" {
+		t.Fatalf("expected the write to run after the queue, got %v", got)
+	}
+
+	// queues taking the same collections in a different order don't deadlock
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cc := newTestClient()
+			first, second := "col1", "col2"
+			if i%2 == 1 {
+				first, second = second, first
+			}
+			exec(t, cs, cc, "MULTI")
+			exec(t, cs, cc, "INCR "+first+" counter")
+			exec(t, cs, cc, "INCR "+second+" counter")
+			exec(t, cs, cc, "EXEC")
+		}(i)
+	}
+	wg.Wait()
+	if cs.GetKeyInCollection("col1", "counter") != "50" || cs.GetKeyInCollection("col2", "counter") != "50" {
+		t.Fatalf("expected every queue to run, got %v and %v", cs.GetKeyInCollection("col1", "counter"), cs.GetKeyInCollection("col2", "counter"))
+	}
+}
+
+func TestWatchAbortsExecOnModifiedKey(t *testing.T) {
+	cs := models.NewCollectionStore()
+	alice, bob := newTestClient(), newTestClient()
+
+	exec(t, cs, alice, "SET col1 key1 before")
+	exec(t, cs, alice, "WATCH col1 key1 key2")
+	exec(t, cs, bob, "DELETE col1 key1")
+	exec(t, cs, alice, "MULTI")
+	exec(t, cs, alice, "SET col1 key2 alice")
+	if got := exec(t, cs, alice, "EXEC"); got != "(nil)" {
+		t.Fatalf("expected EXEC to fail on a deleted watched key, got %v", got)
+	}
+	if got := cs.GetKeyInCollection("col1", "key2"); got != "" {
+		t.Fatalf("expected no write from aborted EXEC, got %v", got)
+	}
+
+	// the watches are gone after EXEC, so the next one goes through
+	exec(t, cs, alice, "MULTI")
+	exec(t, cs, alice, "SET col1 key2 alice")
+	if got := exec(t, cs, alice, "EXEC"); got == "(nil)" {
+		t.Fatalf("expected EXEC without watches to succeed")
+	}
+}
+
+func TestSnapshotIsolation(t *testing.T) {
+	cs := models.NewCollectionStore()
+	alice, bob := newTestClient(), newTestClient()
+
+	exec(t, cs, alice, "SET col1 key1 before")
+	exec(t, cs, alice, "BEGIN")
+	exec(t, cs, bob, "SET col1 key1 bob")
+	exec(t, cs, bob, "SET col1 key2 bob")
+
+	if got := exec(t, cs, alice, "GET col1 key1"); got != "before" {
+		t.Fatalf("expected the value as of BEGIN, got %v", got)
+	}
+	if got := exec(t, cs, alice, "GET col1 key2"); got != "" {
+		t.Fatalf("expected a key created after BEGIN to be missing, got %v", got)
+	}
+
+	exec(t, cs, alice, "SET col1 key1 alice")
+	if got := exec(t, cs, alice, "COMMIT"); got[:8] != "CONFLICT" {
+		t.Fatalf("expected a write-write conflict, got %v", got)
+	}
+	if got := cs.GetKeyInCollection("col1", "key1"); got != "bob" {
+		t.Fatalf("expected the conflicting commit to be rejected, got %v", got)
+	}
+
+	// read committed sees the latest values and doesn't detect conflicts
+	exec(t, cs, alice, "BEGIN ISOLATION READ COMMITTED")
+	exec(t, cs, bob, "SET col1 key1 later")
+	if got := exec(t, cs, alice, "GET col1 key1"); got != "later" {
+		t.Fatalf("expected the latest committed value, got %v", got)
+	}
+	exec(t, cs, alice, "SET col1 key1 alice")
+	if got := exec(t, cs, alice, "COMMIT"); got != "OK" {
+		t.Fatalf("unexpected commit result: %v", got)
+	}
+}
+
+func TestUnwatchKeepsTheTombstoneOfASnapshot(t *testing.T) {
+	cs := models.NewCollectionStore()
+	alice, bob, carol := newTestClient(), newTestClient(), newTestClient()
+
+	exec(t, cs, alice, "SET col1 key1 before")
+	exec(t, cs, alice, "BEGIN")
+	exec(t, cs, alice, "SET col1 key1 alice")
+	exec(t, cs, carol, "WATCH col1 key1")
+	exec(t, cs, bob, "DELETE col1 key1")
+	exec(t, cs, carol, "UNWATCH")
+
+	// the delete still conflicts once nobody watches the key
+	if got := exec(t, cs, alice, "COMMIT"); !strings.HasPrefix(got, "CONFLICT") {
+		t.Fatalf("expected a write-write conflict with the delete, got %v", got)
+	}
+	if got := cs.GetKeyInCollection("col1", "key1"); got != "" {
+		t.Fatalf("expected the conflicting commit to be rejected, got %v", got)
+	}
+}
+
+func TestRollbackToSavepoint(t *testing.T) {
+	cs := models.NewCollectionStore()
+	cc := newTestClient()
+
+	exec(t, cs, cc, "SET col1 existing before")
+	exec(t, cs, cc, "BEGIN")
+	exec(t, cs, cc, "SET col1 kept one")
+	exec(t, cs, cc, "SAVEPOINT sp1")
+	exec(t, cs, cc, "SET col1 created two")
+	exec(t, cs, cc, "DELETE col1 existing")
+	exec(t, cs, cc, "SET col1 kept changed")
+	exec(t, cs, cc, fmt.Sprintf("EXPIREAT col1 kept %d", time.Now().Add(time.Hour).UnixMilli()))
+
+	if got := exec(t, cs, cc, "ROLLBACK TO sp1"); got != "OK" {
+		t.Fatalf("unexpected rollback result: %v", got)
+	}
+	if got := exec(t, cs, cc, "GET col1 created"); got != "" {
+		t.Fatalf("expected the key created after the savepoint to be gone, got %v", got)
+	}
+	if got := exec(t, cs, cc, "GET col1 existing"); got != "before" {
+		t.Fatalf("expected the deleted key to be restored, got %v", got)
+	}
+
+	exec(t, cs, cc, "RELEASE sp1")
+	if got := exec(t, cs, cc, "ROLLBACK TO sp1"); got != "ERROR: no such savepoint" {
+		t.Fatalf("expected the released savepoint to be gone, got %v", got)
+	}
+	exec(t, cs, cc, "COMMIT")
+
+	if got := cs.GetKeyInCollection("col1", "kept"); got != "one" {
+		t.Fatalf("expected the write before the savepoint, got %v", got)
+	}
+	if expired := cs.GetCollection()["col1"].ExpiredKeys(time.Now().Add(2 * time.Hour)); len(expired) != 0 {
+		t.Fatalf("expected the expiration after the savepoint to be undone, got %v", expired)
+	}
+}
+
+func TestConditionalTxn(t *testing.T) {
+	cs := models.NewCollectionStore()
+	cc := newTestClient()
+
+	elect := "TXN IF EXISTS election leader = false THEN SET election leader node1 ; GET election leader ELSE GET election leader"
+	if got := exec(t, cs, cc, elect); got != `{"succeeded":true,"branch":"THEN","results":["OK","node1"]}` {
+		t.Fatalf("unexpected result of the first election: %v", got)
+	}
+	if got := exec(t, cs, cc, elect); got != `{"succeeded":false,"branch":"ELSE","results":["node1"]}` {
+		t.Fatalf("unexpected result of the second election: %v", got)
+	}
+
+	update := "TXN IF VALUE election leader = node1 AND TTL election leader = -1 THEN DELETE election leader"
+	if got := exec(t, cs, cc, update); got != `{"succeeded":true,"branch":"THEN","results":["OK"]}` {
+		t.Fatalf("unexpected result of the update: %v", got)
+	}
+	if got := cs.GetKeyInCollection("election", "leader"); got != "" {
+		t.Fatalf("expected the key to be deleted, got %v", got)
+	}
+}
+
+func TestTxnLocksOnlyItsCollections(t *testing.T) {
+	cs := models.NewCollectionStore()
+	run := func(raw string) <-chan string {
+		done := make(chan string, 1)
+		go func() {
+			done <- server.ExecuteCommand(server.ParseCommand(raw), cs, newTestClient(), newTestServer(), nil)
+		}()
+		return done
+	}
+
+	cs.LockShared()
+	unlock := cs.LockCollections([]string{"col1"}, true)
+	select {
+	case <-run("TXN IF EXISTS col2 key1 = false THEN SET col2 key1 value"):
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a TXN on another collection to run")
+	}
+	waiting := run("TXN IF EXISTS col2 key1 = true THEN SET col1 key1 value")
+	select {
+	case got := <-waiting:
+		t.Fatalf("expected the TXN writing col1 to wait, got %v", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	cs.UnlockShared()
+	if got := <-waiting; !strings.Contains(got, `"succeeded":true`) {
+		t.Fatalf("expected the TXN to run once col1 is free, got %v", got)
+	}
+
+	// compare and set stays atomic, every increment goes through once
+	exec(t, cs, newTestClient(), "SET col1 counter 0")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cc := newTestClient()
+			for {
+				current := exec(t, cs, cc, "GET col1 counter")
+				next, _ := strconv.Atoi(current)
+				got := exec(t, cs, cc, fmt.Sprintf("TXN IF VALUE col1 counter = %v THEN SET col1 counter %v", current, next+1))
+				if strings.Contains(got, `"succeeded":true`) {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got := cs.GetKeyInCollection("col1", "counter"); got != "20" {
+		t.Fatalf("expected 20 increments, got %v", got)
+	}
+}
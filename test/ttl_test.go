@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/internal/server"
+	"github.com/sk25469/kv/utils"
+)
+
+func newTestClient() *models.ClientConfig {
+	return &models.ClientConfig{
+		ClientState: &models.ClientState{State: utils.ACTIVE, IsAuthenticated: true},
+		Transaction: models.NewTransactionalKeyValueStore(),
+	}
+}
+
+func newTestServer() *models.KVServer {
+	return &models.KVServer{Config: &models.Config{ProtectedMode: false, IsMaster: true}}
+}
+
+func TestResolveExpirationIsAbsolute(t *testing.T) {
+	cmd := server.ResolveExpiration(server.ParseCommand("SET-TTL col1 key1 5m"))
+	if cmd.Name != utils.EXPIRE_AT {
+		t.Fatalf("expected %v, got %v", utils.EXPIRE_AT, cmd.Name)
+	}
+
+	millis, err := strconv.ParseInt(cmd.Args[1], 10, 64)
+	if err != nil {
+		t.Fatalf("expected unix millis, got %v", cmd.Args[1])
+	}
+	remaining := time.Until(time.UnixMilli(millis))
+	if remaining < 4*time.Minute || remaining > 5*time.Minute {
+		t.Fatalf("unexpected remaining ttl: %v", remaining)
+	}
+}
+
+func TestReplayedExpirationDoesNotRestart(t *testing.T) {
+	cs := models.NewCollectionStore()
+	cc, kv := newTestClient(), newTestServer()
+
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).UnixMilli(), 10)
+	server.ExecuteCommand(server.ParseCommand("SET col1 key1 value1"), cs, cc, kv, nil)
+	server.ExecuteCommand(server.ParseCommand("EXPIREAT col1 key1 "+past), cs, cc, kv, nil)
+
+	if got := cs.GetKeyInCollection("col1", "key1"); got != "" {
+		t.Fatalf("expected expired key to be hidden, got %v", got)
+	}
+	removed := cs.DeleteExpiredKeys(time.Now())
+	if len(removed["col1"]) != 1 {
+		t.Fatalf("expected key to be removed, got %v", removed)
+	}
+}
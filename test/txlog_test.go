@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	models "github.com/sk25469/kv/internal/model"
+	"github.com/sk25469/kv/internal/server"
+)
+
+func TestReplaySkipsUncommittedTransaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.txt")
+	committed := server.Command{Name: "BATCH", Batch: []server.Command{
+		{Name: "SET", CollectionName: "col1", Args: []string{"key1", "one"}},
+		{Name: "SET", CollectionName: "col1", Args: []string{"key2", "two"}},
+	}}
+	if err := server.WriteTransactionToFile(committed, path); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash in the middle of the next transaction leaves a torn tail
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"Name":"TXBEGIN","TxID":"torn"}` + "\n")
+	file.WriteString(`{"Name":"SET","CollectionName":"col1","Args":["key3","three"],"TxID":"torn"}` + "\n")
+	file.WriteString(`{"Name":"SET","CollectionName":"col1","Ar`)
+	file.Close()
+
+	cs := models.NewCollectionStore()
+	if _, err := server.LoadSnapshot(path, cs); err != nil {
+		t.Fatal(err)
+	}
+	if got := cs.GetKeyInCollection("col1", "key2"); got != "two" {
+		t.Fatalf("expected the committed transaction to be replayed, got %v", got)
+	}
+	if got := cs.GetKeyInCollection("col1", "key3"); got != "" {
+		t.Fatalf("expected the uncommitted transaction to be skipped, got %v", got)
+	}
+}
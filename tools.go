@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sk25469/kv/internal/server"
+	"github.com/sk25469/kv/utils"
+)
+
+// runTool runs one of the offline subcommands or one of the tools which
+// connect to a node, returns false if args don't name a known subcommand
+func runTool(args []string) bool {
+	switch args[0] {
+	case "analyze":
+		runAnalyze(args[1:])
+	case "repair-log":
+		runRepairLog(args[1:])
+	case "backup":
+		runBackup(args[1:])
+	case "restore":
+		runRestore(args[1:])
+	case "recover":
+		runRecover(args[1:])
+	default:
+		return false
+	}
+	return true
+}
+
+// kv-server analyze [-top n] <snapshot-file>
+func runAnalyze(args []string) {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	top := fs.Int("top", 10, "number of biggest keys and collections to report")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: kv-server analyze [-top n] <snapshot-file>")
+		os.Exit(2)
+	}
+	if err := server.AnalyzeSnapshot(fs.Arg(0), *top, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "error analyzing snapshot: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// kv-server repair-log [-fix] <snapshot-file>
+func runRepairLog(args []string) {
+	fs := flag.NewFlagSet("repair-log", flag.ExitOnError)
+	fix := fs.Bool("fix", false, "cut the log off at the first damaged record")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: kv-server repair-log [-fix] <snapshot-file>")
+		os.Exit(2)
+	}
+	if err := server.RepairLog(fs.Arg(0), *fix, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "error repairing log: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// kv-server backup [-addr host:port] [-user name -password secret] <dir>
+func runBackup(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:7000", "address of the master to back up")
+	user := fs.String("user", "", "username of a node in protected mode")
+	password := fs.String("password", "", "password of the user")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: kv-server backup [-addr host:port] [-user name -password secret] <dir>")
+		os.Exit(2)
+	}
+	if err := server.BackupRemote(*addr, *user, *password, fs.Arg(0), os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "error backing up %v: %v\n", *addr, err)
+		os.Exit(1)
+	}
+}
+
+// kv-server restore [-addr host:port] [-user name -password secret] <dir>
+func runRestore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:7000", "address of the empty master to restore into")
+	user := fs.String("user", "", "username of a node in protected mode")
+	password := fs.String("password", "", "password of the user")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: kv-server restore [-addr host:port] [-user name -password secret] <dir>")
+		os.Exit(2)
+	}
+	if err := server.RestoreRemote(*addr, *user, *password, fs.Arg(0), os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "error restoring into %v: %v\n", *addr, err)
+		os.Exit(1)
+	}
+}
+
+// kv-server recover [-time t] [-seq n] [-collections c1,c2] <out-dir> <snapshot-file|backup-dir>...
+func runRecover(args []string) {
+	fs := flag.NewFlagSet("recover", flag.ExitOnError)
+	at := fs.String("time", "", "recover to this time, RFC 3339 or a duration before now such as 5m")
+	seq := fs.Uint64("seq", 0, "recover up to this log record")
+	collections := fs.String("collections", "", "comma separated collections to recover, all of them by default")
+	fs.Parse(args)
+	if fs.NArg() < 2 || (*at == "" && *seq == 0) {
+		fmt.Fprintln(os.Stderr, "Usage: kv-server recover [-time t] [-seq n] [-collections c1,c2] <out-dir> <snapshot-file|backup-dir>...")
+		os.Exit(2)
+	}
+
+	target := server.RecoveryTarget{Seq: *seq}
+	if *at != "" {
+		t, err := parseRecoveryTime(*at)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid time %q: %v\n", *at, err)
+			os.Exit(2)
+		}
+		target.Time = t
+	}
+	if *collections != "" {
+		target.Collections = strings.Split(*collections, ",")
+	}
+
+	// the recovered log keeps the name of the snapshot log it comes from
+	name := filepath.Base(utils.SNAPSHOT_FILE)
+	for _, source := range fs.Args()[1:] {
+		if info, err := os.Stat(source); err == nil && !info.IsDir() {
+			name = filepath.Base(source)
+			break
+		}
+	}
+	if err := server.RecoverToPoint(fs.Args()[1:], target, filepath.Join(fs.Arg(0), name), os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "error recovering: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// parseRecoveryTime reads a time given as RFC 3339 or as a duration before
+// now
+func parseRecoveryTime(value string) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -13,34 +13,81 @@ var (
 	SLAVE_3_CONFIG     = CONF_DIRECTORY + "slave3.conf"
 	SNAPSHOT_FILE      = SNAPSHOT_DIRECTORY + "snapshot.txt"
 	SHARD_CONFIG_FILE  = CONF_DIRECTORY + "shard-conf.json"
+	COORDINATOR_LOG    = SNAPSHOT_DIRECTORY + "coordinator.log"
+	// collections kept on disk by a storage engine, a directory per port
+	STORAGE_DIRECTORY = SNAPSHOT_DIRECTORY + "data/"
+	// the binary dump of a snapshot log is kept next to it with this suffix
+	DUMP_SUFFIX = ".dump"
+	// the manifest of the segments of a snapshot log is kept next to it
+	MANIFEST_SUFFIX = ".manifest"
 )
 
 const (
 	SERVER_PORT = "4321"
 	// Define the interval for the health check
-	HEALTH_CHECK_INTERVAL = 10 * time.Second
-	CLEANUP_DURATION      = time.Duration(1 * time.Minute)
-	TRANSACTIONAL         = 0
-	ACTIVE                = 1
-	SNAPSHOT_DIRECTORY    = "/home/sahilsarwar/Desktop/open-source/kv/snapshot/"
-	CONF_DIRECTORY        = "/home/sahilsarwar/Desktop/open-source/kv/conf/"
-	PUB_SUB               = 2
-	SUBSCRIBE             = "SUBSCRIBE"
-	PUBLISH               = "PUBLISH"
-	GET                   = "GET"
-	SET                   = "SET"
-	DEL                   = "DELETE"
-	SET_TTL               = "SET-TTL"
-	EXISTS                = "EXISTS"
-	EXPIRE                = "EXPIRE"
-	REPLICATE             = "REPLICATE"
-	SNAPSHOT              = "SNAPSHOT"
-	BEGIN                 = "BEGIN"
-	COMMIT                = "COMMIT"
-	ROLLBACK              = "ROLLBACK"
-	SHUTDOWN              = "SHUTDOWN"
-	MAKE_MASTER           = "MAKE_MASTER"
-	MAKE_SLAVE            = "MAKE_SLAVE"
-	CONFIG                = "CONFIG"
-	PING                  = "PING"
+	HEALTH_CHECK_INTERVAL  = 10 * time.Second
+	CLEANUP_DURATION       = time.Duration(1 * time.Minute)
+	LEASE_CHECK_DURATION   = time.Duration(1 * time.Second)
+	REWRITE_CHECK_DURATION = time.Duration(10 * time.Second)
+	TIERING_CHECK_DURATION = time.Duration(1 * time.Second)
+	FSYNC_INTERVAL         = time.Duration(1 * time.Second)
+	TRANSACTIONAL          = 0
+	ACTIVE                 = 1
+	SNAPSHOT_DIRECTORY     = "/home/sahilsarwar/Desktop/open-source/kv/snapshot/"
+	CONF_DIRECTORY         = "/home/sahilsarwar/Desktop/open-source/kv/conf/"
+	PUB_SUB                = 2
+	QUEUEING               = 3
+	SUBSCRIBE              = "SUBSCRIBE"
+	PUBLISH                = "PUBLISH"
+	GET                    = "GET"
+	SET                    = "SET"
+	INCR                   = "INCR"
+	INCRBY                 = "INCRBY"
+	DEL                    = "DELETE"
+	SET_TTL                = "SET-TTL"
+	EXISTS                 = "EXISTS"
+	EXPIRE                 = "EXPIRE"
+	EXPIRE_AT              = "EXPIREAT"
+	EXPIRED                = "EXPIRED"
+	EVICTED                = "EVICTED"
+	REPLICATE              = "REPLICATE"
+	SNAPSHOT               = "SNAPSHOT"
+	SAVE                   = "SAVE"
+	BGSAVE                 = "BGSAVE"
+	LASTSAVE               = "LASTSAVE"
+	REWRITELOG             = "REWRITELOG"
+	BACKUP                 = "BACKUP"
+	RESTORE                = "RESTORE"
+	LOG_REWRITTEN          = "LOG-REWRITTEN"
+	BEGIN                  = "BEGIN"
+	COMMIT                 = "COMMIT"
+	ROLLBACK               = "ROLLBACK"
+	SAVEPOINT              = "SAVEPOINT"
+	RELEASE                = "RELEASE"
+	BATCH                  = "BATCH"
+	TX_BEGIN               = "TXBEGIN"
+	TX_COMMIT              = "TXCOMMIT"
+	MULTI                  = "MULTI"
+	EXEC                   = "EXEC"
+	DISCARD                = "DISCARD"
+	WATCH                  = "WATCH"
+	TXN                    = "TXN"
+	LOCK                   = "LOCK"
+	LOCK_GRANTED           = "LOCK-GRANTED"
+	LOCK_RELEASED          = "LOCK-RELEASED"
+	LEASE                  = "LEASE"
+	LEASE_GRANTED          = "LEASE-GRANTED"
+	LEASE_REVOKED          = "LEASE-REVOKED"
+	DTXN                   = "DTXN"
+	PREPARE                = "PREPARE"
+	COMMIT_PREPARED        = "COMMIT-PREPARED"
+	ABORT_PREPARED         = "ABORT-PREPARED"
+	PREPARED               = "PREPARED"
+	UNWATCH                = "UNWATCH"
+	NIL                    = "(nil)"
+	SHUTDOWN               = "SHUTDOWN"
+	MAKE_MASTER            = "MAKE_MASTER"
+	MAKE_SLAVE             = "MAKE_SLAVE"
+	CONFIG                 = "CONFIG"
+	PING                   = "PING"
 )
@@ -53,28 +53,37 @@ func MapToJSON(data interface{}) (string, error) {
 	return string(jsonBytes), nil
 }
 
+// ParseDuration parses durations like 30s, 5m or 1h30m, every number needs
+// a unit of h, m or s
 func ParseDuration(input string) (time.Duration, error) {
-	parts := strings.Split(input, "")
 	duration := time.Duration(0)
+	digits := ""
 
-	for i := 0; i < len(parts); i += 2 {
-		value, err := strconv.Atoi(parts[i])
+	for _, r := range input {
+		if r >= '0' && r <= '9' {
+			digits += string(r)
+			continue
+		}
+		value, err := strconv.Atoi(digits)
 		if err != nil {
-			return 0, err
+			return 0, fmt.Errorf("invalid duration: %s", input)
 		}
+		digits = ""
 
-		unit := parts[i+1]
-		switch unit {
-		case "h":
+		switch r {
+		case 'h':
 			duration += time.Duration(value) * time.Hour
-		case "m":
+		case 'm':
 			duration += time.Duration(value) * time.Minute
-		case "s":
+		case 's':
 			duration += time.Duration(value) * time.Second
 		default:
-			return 0, fmt.Errorf("invalid unit: %s", unit)
+			return 0, fmt.Errorf("invalid unit: %c", r)
 		}
 	}
+	if digits != "" || input == "" {
+		return 0, fmt.Errorf("invalid duration: %s", input)
+	}
 
 	return duration, nil
 }